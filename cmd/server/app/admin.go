@@ -0,0 +1,217 @@
+package app
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// entries an admin listing returns when no limit is given
+const DefaultPageSize = 100
+
+// the most entries an admin listing returns
+const MaxPageSize = 1000
+
+// A page of topics. Next is set to the name to ask for topics after when there are more
+type topicPage struct {
+	Topics []*TopicInfo `json:"topics"`
+	Next   string       `json:"next,omitempty"`
+}
+
+// A page of subscribers. Next is set to the name to ask for subscribers after when there are more
+type subscriberPage struct {
+	Subscribers []*SubscriberInfo `json:"subscribers"`
+	Next        string            `json:"next,omitempty"`
+}
+
+// which entries of a listing to return, those whose names start with prefix and come after
+// after, or for a window of messages those from offset
+type page struct {
+	prefix string
+	after  string
+	offset int
+	limit  int
+}
+
+// GET /_admin/topics?prefix=<prefix>&after=<name>&limit=<count>
+// Lists the topics ordered by name
+func (api *Api) ListTopics(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	requested, err := parsePage(r)
+
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	log.Println("ListTopics : prefix", requested.prefix, "after", requested.after)
+
+	topics, more := api.service.ListTopics(requested.prefix, requested.after, requested.limit)
+	listed := topicPage{Topics: topics}
+
+	if more {
+		listed.Next = topics[len(topics)-1].Name
+	}
+	writeJson(w, listed)
+}
+
+// GET /_admin/topics/<topic>
+// Describes a topic. Returns 404 if it does not exist
+func (api *Api) DescribeTopic(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+
+	if isEmptyString(topicFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("DescribeTopic : topic", topicFromRequest)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	info, _, err := api.service.DescribeTopicContext(ctx, topicFromRequest)
+
+	if err != nil {
+		writeAdminError("DescribeTopic", err, w)
+		return
+	}
+	writeJson(w, info)
+}
+
+// GET /_admin/topics/<topic>/subscribers?prefix=<prefix>&after=<name>&limit=<count>
+// Lists the subscribers and consumer group members of a topic ordered by name.
+// Returns 404 if the topic does not exist
+func (api *Api) ListSubscribers(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+
+	if isEmptyString(topicFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	requested, err := parsePage(r)
+
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	log.Println("ListSubscribers : topic", topicFromRequest, "prefix", requested.prefix, "after", requested.after)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	_, subscribers, err := api.service.DescribeTopicContext(ctx, topicFromRequest)
+
+	if err != nil {
+		writeAdminError("ListSubscribers", err, w)
+		return
+	}
+
+	listed := subscriberPage{Subscribers: make([]*SubscriberInfo, 0, requested.limit)}
+
+	for _, subscriber := range subscribers {
+
+		if !strings.HasPrefix(subscriber.Name, requested.prefix) || subscriber.Name <= requested.after {
+			continue
+		}
+
+		if len(listed.Subscribers) == requested.limit {
+			listed.Next = listed.Subscribers[len(listed.Subscribers)-1].Name
+			break
+		}
+		listed.Subscribers = append(listed.Subscribers, subscriber)
+	}
+	writeJson(w, listed)
+}
+
+// DELETE /_admin/topics/<topic>
+// Deletes a topic along with its subscribers and their messages. Returns 404 if it does not exist
+func (api *Api) DeleteTopic(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+
+	if isEmptyString(topicFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("DeleteTopic : topic", topicFromRequest)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	if err := api.service.DeleteTopicContext(ctx, topicFromRequest); err != nil {
+		writeAdminError("DeleteTopic", err, w)
+		return
+	}
+
+	api.forgetStreams(topicFromRequest, "")
+	w.WriteHeader(200)
+}
+
+// refuses admin requests without the admin token when one is set, with a 401
+func (api *Api) asAdmin(handler web.HandlerFunc) web.HandlerFunc {
+	return func(c web.C, w http.ResponseWriter, r *http.Request) {
+
+		if api.adminToken != "" {
+
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+			if subtle.ConstantTimeCompare([]byte(token), []byte(api.adminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(401)
+				return
+			}
+		}
+		handler(c, w, r)
+	}
+}
+
+func parsePage(r *http.Request) (page, error) {
+
+	query := r.URL.Query()
+	requested := page{prefix: query.Get("prefix"), after: query.Get("after"), limit: DefaultPageSize}
+
+	if limit := query.Get("limit"); limit != "" {
+
+		parsed, err := strconv.Atoi(limit)
+
+		if err != nil || parsed < 1 || parsed > MaxPageSize {
+			return requested, fmt.Errorf("limit should be between 1 and %d", MaxPageSize)
+		}
+		requested.limit = parsed
+	}
+
+	if offset := query.Get("offset"); offset != "" {
+
+		parsed, err := strconv.Atoi(offset)
+
+		if err != nil || parsed < 0 {
+			return requested, fmt.Errorf("offset should be zero or a positive number")
+		}
+		requested.offset = parsed
+	}
+	return requested, nil
+}
+
+func writeAdminError(handler string, err error, w http.ResponseWriter) {
+
+	if err == UnknownTopic {
+		w.WriteHeader(404)
+	} else if !writeUnavailableError(err, w) {
+		log.Print(handler, " : unexpected error : ", err.Error())
+		w.WriteHeader(500)
+	}
+}
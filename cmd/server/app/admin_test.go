@@ -0,0 +1,185 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mdevilliers/take-home/pkg/topic"
+)
+
+// Request: GET /_admin/topics?prefix=<prefix>&after=<name>&limit=<count>
+// Response codes:
+// ● 200: A page of topics as JSON.
+// ● 400: The limit is invalid.
+func TestTopicsAreListedInPages(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	for _, name := range []string{"orders.eu", "audit", "orders.us", "orders.uk"} {
+		http.Post(instance.URL+"/"+name+"/user-one", "text", nil)
+	}
+
+	http.Post(instance.URL+"/orders.eu", "text", strings.NewReader("message1"))
+
+	listed := topicPage{}
+	status := getJson(t, instance.URL+"/_admin/topics?prefix=orders.&limit=2", &listed)
+
+	if status != 200 || len(listed.Topics) != 2 || listed.Topics[0].Name != "orders.eu" || listed.Topics[1].Name != "orders.uk" || listed.Next != "orders.uk" {
+		t.Fatal("The first page should have the first two matching topics but returned ", status, listed)
+	}
+
+	if listed.Topics[0].Subscribers != 1 || listed.Topics[0].Backlog != 1 || listed.Topics[0].Created.IsZero() {
+		t.Error("Topics should be described : ", listed.Topics[0])
+	}
+
+	listed = topicPage{}
+	getJson(t, instance.URL+"/_admin/topics?prefix=orders.&limit=2&after=orders.uk", &listed)
+
+	if len(listed.Topics) != 1 || listed.Topics[0].Name != "orders.us" || listed.Next != "" {
+		t.Error("The last page should have the remaining topic but returned ", listed)
+	}
+
+	res, _ := http.Get(instance.URL + "/_admin/topics?limit=0")
+	_, status = parseResponse(res)
+
+	if status != 400 {
+		t.Error("An invalid limit should return 400 but returned ", status)
+	}
+
+	res, _ = http.Post(instance.URL+"/_admin/topics", "text", nil)
+	_, status = parseResponse(res)
+
+	if status != 400 {
+		t.Error("Subscribing to a topic starting with _ should return 400 but returned ", status)
+	}
+
+	res, _ = http.Post(instance.URL+"/_admin", "text", strings.NewReader("message1"))
+	_, status = parseResponse(res)
+
+	if status != 400 {
+		t.Error("Publishing to a topic starting with _ should return 400 but returned ", status)
+	}
+}
+
+// Request: GET /_admin/topics/<topic> and GET /_admin/topics/<topic>/subscribers
+// Response codes:
+// ● 200: The topic or a page of its subscribers as JSON.
+// ● 404: The topic does not exist.
+func TestTopicsAndTheirSubscribersCanBeDescribed(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	res, _ := http.Get(instance.URL + "/_admin/topics/topic-one")
+	_, status := parseResponse(res)
+
+	if status != 404 {
+		t.Error("Describing an unknown topic should return 404 but returned ", status)
+	}
+
+	http.Post(instance.URL+"/topic-one/user-one", "text", nil)
+	http.Post(instance.URL+"/topic-one/_groups/workers/worker-one", "text", nil)
+	http.Post(instance.URL+"/topic-one", "text", strings.NewReader("message1"))
+
+	info := TopicInfo{}
+	status = getJson(t, instance.URL+"/_admin/topics/topic-one", &info)
+
+	if status != 200 || info.Name != "topic-one" || info.Subscribers != 2 || info.Backlog != 2 || info.OldestMessageAge <= 0 {
+		t.Error("The topic should be described but returned ", status, info)
+	}
+
+	listed := subscriberPage{}
+	getJson(t, instance.URL+"/_admin/topics/topic-one/subscribers?limit=1", &listed)
+
+	if len(listed.Subscribers) != 1 || listed.Subscribers[0].Name != "user-one" || listed.Next != "user-one" || listed.Subscribers[0].Subscribed.IsZero() {
+		t.Fatal("The first subscriber should be listed but returned ", listed)
+	}
+
+	listed = subscriberPage{}
+	getJson(t, instance.URL+"/_admin/topics/topic-one/subscribers?after=user-one", &listed)
+
+	if len(listed.Subscribers) != 1 || listed.Subscribers[0].Name != topic.GroupChannelName("workers", "worker-one") || listed.Subscribers[0].Group != "workers" {
+		t.Error("The group member should be listed with its group but returned ", listed)
+	}
+}
+
+// Request: DELETE /_admin/topics/<topic>
+// Response codes:
+// ● 200: The topic was deleted.
+// ● 404: The topic does not exist.
+func TestDeletedTopicsAreGone(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	http.Post(instance.URL+"/topic-one/user-one", "text", nil)
+	http.Post(instance.URL+"/topic-one", "text", strings.NewReader("message1"))
+
+	if status := deleteRequest(instance.URL + "/_admin/topics/topic-one"); status != 200 {
+		t.Error("Deleting a topic should return 200 but returned ", status)
+	}
+
+	res, _ := http.Get(instance.URL + "/topic-one/user-one")
+	_, status := parseResponse(res)
+
+	if status != 404 {
+		t.Error("A deleted topic should not be found but returned ", status)
+	}
+
+	if status := deleteRequest(instance.URL + "/_admin/topics/topic-one"); status != 404 {
+		t.Error("Deleting an unknown topic should return 404 but returned ", status)
+	}
+}
+
+func TestAdminRoutesRequireTheAdminTokenWhenSet(t *testing.T) {
+
+	instance := httptest.NewServer(routed(NewApiWithOptions(NewService(), ApiOptions{AdminToken: "secret"})))
+	defer instance.Close()
+
+	res, _ := http.Get(instance.URL + "/_admin/topics")
+	_, status := parseResponse(res)
+
+	if status != 401 {
+		t.Error("A request without the token should return 401 but returned ", status)
+	}
+
+	req, _ := http.NewRequest("GET", instance.URL+"/_admin/topics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, _ = http.DefaultClient.Do(req)
+	_, status = parseResponse(res)
+
+	if status != 200 {
+		t.Error("A request with the token should return 200 but returned ", status)
+	}
+}
+
+func getJson(t *testing.T, url string, value interface{}) int {
+
+	res, err := http.Get(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == 200 {
+		if err := json.NewDecoder(res.Body).Decode(value); err != nil {
+			t.Fatal("The response should be JSON : ", err)
+		}
+	}
+	return res.StatusCode
+}
+
+func deleteRequest(url string) int {
+
+	req, _ := http.NewRequest("DELETE", url, nil)
+	res, _ := http.DefaultClient.Do(req)
+	_, status := parseResponse(res)
+
+	return status
+}
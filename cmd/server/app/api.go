@@ -1,37 +1,166 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/mdevilliers/take-home/pkg/topic"
 	"github.com/zenazn/goji/web"
 )
 
+// the longest a GET will wait for a message
+const MaxWait = 2 * time.Minute
+
+// request headers with this prefix are kept as message headers, and returned with it
+const MessageHeaderPrefix = "X-Msg-"
+
+// the longest a request waits for the Service by default before a 503 is returned
+const DefaultRequestTimeout = 10 * time.Second
+
+// Settings for how an Api serves requests
+type ApiOptions struct {
+	// how long a request waits for the Service, not counting a GET waiting for a message
+	// to be published. DefaultRequestTimeout if 0
+	RequestTimeout time.Duration
+
+	// how many subscribers of each topic are given their own backlog series in /metrics,
+	// the rest are summed. DefaultSubscriberLabels if 0, none if negative
+	SubscriberLabels int
+
+	// required as a bearer token by the /_admin routes when set
+	AdminToken string
+}
+
 type Api struct {
-	service *Service
+	service        *Service
+	requestTimeout time.Duration
+
+	metrics          *requestMetrics
+	subscriberLabels int
+	adminToken       string
+
+	streamsLock sync.Mutex
+	streams     map[streamKey]*streamHistory
+
+	// closed when the server is shutting down, ending long polls, streams and WebSockets
+	closing   chan struct{}
+	closeLock sync.Mutex
+	sockets   sync.WaitGroup
 }
 
 func NewApi() *Api {
+	return NewApiWithService(NewService())
+}
+
+// Returns an Api serving requests with the given service
+func NewApiWithService(service *Service) *Api {
+	return NewApiWithOptions(service, ApiOptions{})
+}
+
+// Returns an Api serving requests with the given service as options says
+func NewApiWithOptions(service *Service, options ApiOptions) *Api {
+
+	if options.RequestTimeout <= 0 {
+		options.RequestTimeout = DefaultRequestTimeout
+	}
+
+	if options.SubscriberLabels == 0 {
+		options.SubscriberLabels = DefaultSubscriberLabels
+	}
+
 	return &Api{
-		service: NewService(),
+		service:          service,
+		requestTimeout:   options.RequestTimeout,
+		metrics:          newRequestMetrics(),
+		subscriberLabels: options.SubscriberLabels,
+		adminToken:       options.AdminToken,
+		streams:          make(map[streamKey]*streamHistory),
+		closing:          make(chan struct{}),
+	}
+}
+
+// Ends the requests which wait for messages so the server can shut down. Long polls return
+// 204, streams finish and WebSockets are closed, which Close waits for. WebSockets opened
+// once closed are refused with a 503
+func (api *Api) Close() {
+
+	api.closeLock.Lock()
+
+	select {
+	case <-api.closing:
+	default:
+		close(api.closing)
 	}
+
+	api.closeLock.Unlock()
+	api.sockets.Wait()
 }
 
 // Sets up the routes
 func (api *Api) Route(m *web.Mux) {
 
-	m.Get("/:topic/:username", api.NextMessage)
-	m.Post("/:topic/:username", api.SubscribeToTopic)
-	m.Delete("/:topic/:username", api.UnsubscribeFromTopic)
+	route := func(method func(web.PatternType, web.HandlerType), pattern string, name string, handler web.HandlerFunc) {
+		method(pattern, api.instrument(name, handler))
+	}
+
+	m.Get("/metrics", api.Metrics)
+
+	// under a prefix no topic can start with, so it is not taken for a topic
+	route(m.Post, "/_transactions", "PublishTransaction", api.PublishTransaction)
 
-	m.Post("/:topic", api.PublishMessage)
+	// under a prefix no topic can start with, so they are not taken for a topic and username
+	route(m.Get, "/_admin/topics", "ListTopics", api.asAdmin(api.ListTopics))
+	route(m.Get, "/_admin/topics/:topic", "DescribeTopic", api.asAdmin(api.DescribeTopic))
+	route(m.Delete, "/_admin/topics/:topic", "DeleteTopic", api.asAdmin(api.DeleteTopic))
+	route(m.Get, "/_admin/topics/:topic/subscribers", "ListSubscribers", api.asAdmin(api.ListSubscribers))
+
+	// under a prefix no username can start with, so they are not taken for a username
+	route(m.Get, "/:topic/_scheduled", "ListScheduled", api.ListScheduled)
+	route(m.Delete, "/:topic/_scheduled/:id", "CancelScheduled", api.CancelScheduled)
+	route(m.Post, "/:topic/_batch", "PublishBatch", api.PublishBatch)
+
+	// under a prefix no username can start with, so they are not taken for a username
+	route(m.Post, "/:topic/_groups/:group/:member", "JoinGroup", api.JoinGroup)
+	route(m.Delete, "/:topic/_groups/:group/:member", "LeaveGroup", api.LeaveGroup)
+	route(m.Get, "/:topic/_groups/:group/:member", "NextMessage", asGroupMember(api.NextMessage))
+	route(m.Post, "/:topic/_groups/:group/:member/ack/:receipt", "AckMessage", asGroupMember(api.AckMessage))
+	route(m.Post, "/:topic/_groups/:group/:member/nack/:receipt", "NackMessage", asGroupMember(api.NackMessage))
+
+	route(m.Get, "/:topic/:username", "NextMessage", api.NextMessage)
+	route(m.Post, "/:topic/:username", "SubscribeToTopic", api.SubscribeToTopic)
+	route(m.Delete, "/:topic/:username", "UnsubscribeFromTopic", api.UnsubscribeFromTopic)
+
+	route(m.Post, "/:topic", "PublishMessage", api.PublishMessage)
+
+	route(m.Post, "/:topic/:username/ack/:receipt", "AckMessage", api.AckMessage)
+	route(m.Post, "/:topic/:username/nack/:receipt", "NackMessage", api.NackMessage)
+
+	route(m.Get, "/:topic/:username/stream", "StreamMessages", api.StreamMessages)
+	route(m.Get, "/ws", "WebSocket", api.WebSocket)
+
+	route(m.Get, "/:topic/:username/expired", "ExpiredMessages", api.ExpiredMessages)
+	route(m.Get, "/:topic/:username/peek", "PeekMessage", api.PeekMessage)
+	route(m.Get, "/:topic/:username/browse", "BrowseMessages", api.BrowseMessages)
+	route(m.Get, "/:topic/:username/batch", "FetchBatch", api.FetchBatch)
+
+	route(m.Get, "/:topic/:username/dlq", "ListDeadLetters", api.ListDeadLetters)
+	route(m.Post, "/:topic/:username/dlq/replay", "ReplayDeadLetters", api.ReplayDeadLetters)
+	route(m.Delete, "/:topic/:username/dlq", "PurgeDeadLetters", api.PurgeDeadLetters)
 
 }
 
-//  POST /<topic>/<username>
+//  POST /<topic>/<username>?from=<earliest|latest|sequence|time|duration>&filter=<expression>
 func (api *Api) SubscribeToTopic(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	topicFromRequest := c.URLParams["topic"]
@@ -44,12 +173,28 @@ func (api *Api) SubscribeToTopic(c web.C, w http.ResponseWriter, r *http.Request
 
 	log.Println("SubscribeToTopic : topic", topicFromRequest, "username", usernameFromRequest)
 
-	err := api.service.Subscribe(topicFromRequest, usernameFromRequest)
+	options, err := subscribeOptionsOf(r)
+
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	err = api.service.SubscribeWithContext(ctx, topicFromRequest, usernameFromRequest, options)
 
 	if err == nil {
 		w.WriteHeader(200)
 
-	} else {
+	} else if err == InvalidTopicName || err == ReservedTopicName || err == ReservedUsername {
+
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+
+	} else if !writeUnavailableError(err, w) {
 
 		w.WriteHeader(500)
 		log.Print("SubscribeToTopic : unexpected error : ", err.Error())
@@ -72,7 +217,10 @@ func (api *Api) UnsubscribeFromTopic(c web.C, w http.ResponseWriter, r *http.Req
 
 	log.Println("UnsubscribeFromTopic : topic", topicFromRequest, "username", usernameFromRequest)
 
-	err := api.service.UnSubscribe(topicFromRequest, usernameFromRequest)
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	err := api.service.UnSubscribeContext(ctx, topicFromRequest, usernameFromRequest)
 
 	if err != nil {
 
@@ -80,7 +228,7 @@ func (api *Api) UnsubscribeFromTopic(c web.C, w http.ResponseWriter, r *http.Req
 
 			w.WriteHeader(404)
 
-		} else {
+		} else if !writeUnavailableError(err, w) {
 
 			// unexpected error
 			log.Print("UnsubscribeFromTopic : unexpected error : ", err.Error())
@@ -89,11 +237,17 @@ func (api *Api) UnsubscribeFromTopic(c web.C, w http.ResponseWriter, r *http.Req
 		}
 
 	} else {
+		api.forgetStreams(topicFromRequest, usernameFromRequest)
 		w.WriteHeader(200)
 	}
 }
 
-// POST /<topic>
+// POST /<topic>[?ttl=<duration>][?delay=<duration>|?deliver-at=<RFC3339 time>]
+// X-Msg-<name> request headers are kept with the message and the publisher is taken from
+// the X-Publisher header, or the client address if it is not set. The message expires
+// after ttl, which may also be given in the X-TTL header, or the topic default.
+// With delay or deliver-at the message is held and only published once it is due.
+// The id given to the message is returned in the X-Message-Id header
 func (api *Api) PublishMessage(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	topicFromRequest := c.URLParams["topic"]
@@ -111,23 +265,73 @@ func (api *Api) PublishMessage(c web.C, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	ttl, err := parseDuration(r, "ttl", 0)
+
+	if err == nil && ttl == 0 {
+		ttl, err = parseDurationValue("ttl", r.Header.Get("X-TTL"), 0)
+	}
+
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	deliverAt, err := parseDeliverAt(r)
+
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
 	log.Println("PublishMessage : topic", topicFromRequest, "message", messageFromRequest)
-	err = api.service.PublishMessage(topicFromRequest, messageFromRequest)
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	id, err := api.service.PublishContext(ctx, topicFromRequest, messageFromRequest, PublishOptions{
+		Publisher: publisherOf(r),
+		Headers:   messageHeadersOf(r),
+		TTL:       ttl,
+		DeliverAt: deliverAt,
+	})
 
 	if err != nil {
 
+		if err == TopicFull {
+			w.WriteHeader(507)
+			return
+		}
+
+		if err == PublishTimedOut {
+			w.WriteHeader(429)
+			return
+		}
+
+		if err == InvalidTopicName || err == ReservedTopicName || err == WildcardPublish {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if writeUnavailableError(err, w) {
+			return
+		}
+
 		// unexpected error
 		log.Print("PublishMessage : unexpected error : ", err.Error())
 		w.WriteHeader(500)
 		return
 
 	} else {
+		w.Header().Set("X-Message-Id", id)
 		w.WriteHeader(200)
 	}
 
 }
 
-// GET /<topic>/<username>
+// GET /<topic>/<username>[?wait=<duration>]
+// With wait the request is held open until a message arrives or the duration passes.
+// The message id, sequence, timestamp and publisher are returned in X-Message-* headers
+// and the headers it was published with as X-Msg-<name>
 func (api *Api) NextMessage(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	topicFromRequest := c.URLParams["topic"]
@@ -140,30 +344,720 @@ func (api *Api) NextMessage(c web.C, w http.ResponseWriter, r *http.Request) {
 
 	log.Println("NextMessage : topic", topicFromRequest, "username", usernameFromRequest)
 
-	message, err := api.service.GetMessage(topicFromRequest, usernameFromRequest)
+	wait, err := parseDuration(r, "wait", 0)
+
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	if wait > MaxWait {
+		wait = MaxWait
+	}
+
+	if r.URL.Query().Get("ack") == "true" {
+		api.leaseMessage(topicFromRequest, usernameFromRequest, wait, w, r)
+		return
+	}
+
+	var delivery *Delivery
+
+	err = api.waitForMessage(topicFromRequest, usernameFromRequest, wait, r, func(ctx context.Context) error {
+		delivery, err = api.service.ReceiveContext(ctx, topicFromRequest, usernameFromRequest)
+		return err
+	})
+
+	if err != nil {
+		writeNextMessageError(err, w)
+		return
+	}
+
+	writeMessageHeaders(w, delivery)
+
+	// REVIEW : html encode response? my feeling is no as this is a "service" rather than a front end web application
+	io.WriteString(w, string(delivery.Message))
+	w.WriteHeader(200)
+}
+
+// GET /<topic>/<username>?ack=true[&visibility=<duration>][&wait=<duration>]
+// Leases the next message. The receipt handle needed to ack or nack it is returned in
+// the X-Receipt-Handle header and the number of previous deliveries in X-Redelivery-Count
+func (api *Api) leaseMessage(topicFromRequest string, usernameFromRequest string, wait time.Duration, w http.ResponseWriter, r *http.Request) {
+
+	visibility, err := parseDuration(r, "visibility", DefaultVisibilityTimeout)
+
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	var delivery *Delivery
+
+	err = api.waitForMessage(topicFromRequest, usernameFromRequest, wait, r, func(ctx context.Context) error {
+		delivery, err = api.service.LeaseMessageContext(ctx, topicFromRequest, usernameFromRequest, visibility)
+		return err
+	})
+
+	if err != nil {
+		writeNextMessageError(err, w)
+		return
+	}
+
+	writeMessageHeaders(w, delivery)
+	w.Header().Set("X-Receipt-Handle", delivery.Receipt)
+	w.Header().Set("X-Redelivery-Count", strconv.Itoa(delivery.Redeliveries))
+	w.WriteHeader(200)
+	w.Write(delivery.Message)
+}
+
+// calls fetch until it finds a message, wait passes or the client goes away.
+// Between attempts the request is parked until a message is published for the user,
+// so the Service is not polled. Each attempt has the request timeout to get an answer
+func (api *Api) waitForMessage(topicFromRequest string, usernameFromRequest string, wait time.Duration, r *http.Request, fetch func(context.Context) error) error {
+
+	if wait <= 0 {
+
+		ctx, cancel := api.serviceContext(r)
+		defer cancel()
+
+		return fetch(ctx)
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		ctx, cancel := api.serviceContext(r)
+		available, err := api.service.AvailableContext(ctx, topicFromRequest, usernameFromRequest)
+
+		if err == nil {
+			err = fetch(ctx)
+		}
+		cancel()
+
+		if err != NoMessagesAvailable {
+			return err
+		}
+
+		select {
+		case <-available:
+		case <-timer.C:
+			return NoMessagesAvailable
+		case <-api.closing:
+			return NoMessagesAvailable
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+// POST /<topic>/_groups/<group>/<member>[?assignment=round-robin|least-loaded]
+// Adds member to a consumer group, creating it if needed. Each message published to the topic
+// is delivered to one member of the group, chosen by the assignment which defaults to round-robin
+func (api *Api) JoinGroup(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	groupFromRequest := c.URLParams["group"]
+	memberFromRequest := c.URLParams["member"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(groupFromRequest) || isEmptyString(memberFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	assignment := topic.RoundRobin
+
+	if value := r.URL.Query().Get("assignment"); value != "" {
+
+		parsed, err := topic.ParseAssignment(value)
+
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+		assignment = parsed
+	}
+
+	log.Println("JoinGroup : topic", topicFromRequest, "group", groupFromRequest, "member", memberFromRequest, "assignment", assignment)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	err := api.service.JoinGroupContext(ctx, topicFromRequest, groupFromRequest, memberFromRequest, assignment)
+
+	if err == InvalidTopicName || err == ReservedTopicName {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if writeUnavailableError(err, w) {
+		return
+	}
+
+	if err != nil {
+		log.Print("JoinGroup : unexpected error : ", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// DELETE /<topic>/_groups/<group>/<member>
+// Removes member from a consumer group. Messages waiting for it are shared between the remaining members
+func (api *Api) LeaveGroup(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	groupFromRequest := c.URLParams["group"]
+	memberFromRequest := c.URLParams["member"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(groupFromRequest) || isEmptyString(memberFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("LeaveGroup : topic", topicFromRequest, "group", groupFromRequest, "member", memberFromRequest)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	err := api.service.LeaveGroupContext(ctx, topicFromRequest, groupFromRequest, memberFromRequest)
+
+	if err == UnknownTopic || err == UnknownUser {
+		w.WriteHeader(404)
+		return
+	}
+
+	if writeUnavailableError(err, w) {
+		return
+	}
 
 	if err != nil {
+		log.Print("LeaveGroup : unexpected error : ", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// serves a request from a consumer group member with a handler written for subscribers,
+// which reads the member's messages as the username topic.GroupChannelName(group, member)
+func asGroupMember(handler web.HandlerFunc) web.HandlerFunc {
+	return func(c web.C, w http.ResponseWriter, r *http.Request) {
+
+		if isEmptyString(c.URLParams["group"]) || isEmptyString(c.URLParams["member"]) {
+			w.WriteHeader(500)
+			return
+		}
+
+		c.URLParams["username"] = topic.GroupChannelName(c.URLParams["group"], c.URLParams["member"])
+		handler(c, w, r)
+	}
+}
+
+// GET /<topic>/_scheduled
+// Lists the messages waiting to be published to the topic as JSON, earliest first
+func (api *Api) ListScheduled(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+
+	if isEmptyString(topicFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("ListScheduled : topic", topicFromRequest)
+
+	writeJson(w, api.service.ListScheduled(topicFromRequest))
+}
+
+// DELETE /<topic>/_scheduled/<id>
+// Cancels a scheduled message. Returns 404 if it does not exist or has already been published
+func (api *Api) CancelScheduled(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	idFromRequest := c.URLParams["id"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(idFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("CancelScheduled : topic", topicFromRequest, "id", idFromRequest)
+
+	err := api.service.CancelScheduled(topicFromRequest, idFromRequest)
+
+	if err == UnknownScheduled {
+		w.WriteHeader(404)
+		return
+	}
+
+	if err != nil {
+		log.Print("CancelScheduled : unexpected error : ", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// GET /<topic>/<username>/expired
+// Returns how many messages expired before being read as {"topic": <count>, "subscriber": <count>},
+// the topic count including every subscriber
+func (api *Api) ExpiredMessages(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	usernameFromRequest := c.URLParams["username"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(usernameFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("ExpiredMessages : topic", topicFromRequest, "username", usernameFromRequest)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	expiries, err := api.service.ExpiredContext(ctx, topicFromRequest, usernameFromRequest)
 
-		if err == UnknownUser || err == UnknownTopic {
+	if err != nil {
+		writeNextMessageError(err, w)
+		return
+	}
+
+	writeJson(w, expiries)
+}
+
+// A message with its metadata as returned by BrowseMessages and FetchBatch
+type jsonMessage struct {
+	Id        string            `json:"id,omitempty"`
+	Topic     string            `json:"topic,omitempty"`
+	Sequence  uint64            `json:"sequence,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	Publisher string            `json:"publisher,omitempty"`
+	Headers   map[string]string `json:"headers"`
+	Body      string            `json:"body"`
+	// only set for leased messages
+	Receipt      string `json:"receipt,omitempty"`
+	Redeliveries int    `json:"redeliveries,omitempty"`
+}
+
+func newJsonMessages(deliveries []*Delivery) []*jsonMessage {
+
+	messages := make([]*jsonMessage, 0, len(deliveries))
+
+	for _, delivery := range deliveries {
+		messages = append(messages, &jsonMessage{
+			Id:           delivery.Id,
+			Topic:        delivery.Topic,
+			Sequence:     delivery.Sequence,
+			Timestamp:    delivery.Timestamp,
+			Publisher:    delivery.Publisher,
+			Headers:      delivery.Headers,
+			Body:         string(delivery.Message),
+			Receipt:      delivery.Receipt,
+			Redeliveries: delivery.Redeliveries,
+		})
+	}
+	return messages
+}
+
+// GET /<topic>/<username>/peek
+// Returns the next message as GET /<topic>/<username> does without removing it
+func (api *Api) PeekMessage(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	usernameFromRequest := c.URLParams["username"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(usernameFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("PeekMessage : topic", topicFromRequest, "username", usernameFromRequest)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	delivery, err := api.service.PeekContext(ctx, topicFromRequest, usernameFromRequest)
+
+	if err != nil {
+		writeNextMessageError(err, w)
+		return
+	}
+
+	writeMessageHeaders(w, delivery)
+	w.WriteHeader(200)
+	w.Write(delivery.Message)
+}
+
+// GET /<topic>/<username>/browse?offset=<count>&limit=<count>
+// Returns a JSON array of the messages waiting for the user, oldest first, without removing them.
+// offset skips that many from the next message, limit is DefaultPageSize if not given
+func (api *Api) BrowseMessages(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	usernameFromRequest := c.URLParams["username"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(usernameFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	requested, err := parsePage(r)
+
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	log.Println("BrowseMessages : topic", topicFromRequest, "username", usernameFromRequest, "offset", requested.offset)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	deliveries, err := api.service.BrowseContext(ctx, topicFromRequest, usernameFromRequest, requested.offset, requested.limit)
+
+	if err != nil {
+		writeNextMessageError(err, w)
+		return
+	}
+
+	writeJson(w, newJsonMessages(deliveries))
+}
+
+// sets the response headers describing a delivered message
+func writeMessageHeaders(w http.ResponseWriter, delivery *Delivery) {
+
+	// messages stored before metadata was recorded have none
+	if delivery.Id != "" {
+		w.Header().Set("X-Message-Id", delivery.Id)
+		w.Header().Set("X-Message-Sequence", strconv.FormatUint(delivery.Sequence, 10))
+		w.Header().Set("X-Message-Timestamp", delivery.Timestamp.UTC().Format(time.RFC3339Nano))
+	}
+
+	if delivery.Publisher != "" {
+		w.Header().Set("X-Message-Publisher", delivery.Publisher)
+	}
+
+	if delivery.Topic != "" {
+		w.Header().Set("X-Message-Topic", delivery.Topic)
+	}
+
+	for name, value := range delivery.Headers {
+		w.Header().Set(MessageHeaderPrefix+name, value)
+	}
+}
+
+// the position a subscription starts from and its filter, from the from and filter query parameters
+func subscribeOptionsOf(r *http.Request) (SubscribeOptions, error) {
+
+	options := SubscribeOptions{}
+
+	if from := r.URL.Query().Get("from"); from != "" {
+
+		position, err := topic.ParsePosition(from)
+
+		if err != nil {
+			return options, err
+		}
+		options.From = &position
+	}
+
+	if expression := r.URL.Query().Get("filter"); expression != "" {
+
+		filter, err := topic.ParseFilter(expression)
+
+		if err != nil {
+			return options, err
+		}
+		options.Filter = filter
+	}
+	return options, nil
+}
+
+// when a published message is due from the delay or deliver-at query parameters,
+// the zero time if it is due now. Giving both is an error
+func parseDeliverAt(r *http.Request) (time.Time, error) {
+
+	delay, err := parseDuration(r, "delay", 0)
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	value := r.URL.Query().Get("deliver-at")
+
+	if value == "" {
+
+		if delay == 0 {
+			return time.Time{}, nil
+		}
+		return time.Now().Add(delay), nil
+	}
+
+	if delay != 0 {
+		return time.Time{}, errors.New("only one of delay and deliver-at may be given")
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// the X-Msg-<name> headers of a request keyed by lower case name
+func messageHeadersOf(r *http.Request) map[string]string {
+
+	headers := make(map[string]string)
+
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, MessageHeaderPrefix) && len(name) > len(MessageHeaderPrefix) {
+			headers[strings.ToLower(name[len(MessageHeaderPrefix):])] = values[0]
+		}
+	}
+	return headers
+}
+
+// the X-Publisher header of a request, or the client address if it is not set
+func publisherOf(r *http.Request) string {
+
+	if publisher := r.Header.Get("X-Publisher"); publisher != "" {
+		return publisher
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func writeNextMessageError(err error, w http.ResponseWriter) {
+
+	if err == UnknownUser || err == UnknownTopic {
+		w.WriteHeader(404)
+		return
+	}
+
+	if err == NoMessagesAvailable {
+		w.WriteHeader(204)
+		return
+	}
+
+	if writeUnavailableError(err, w) {
+		return
+	}
+
+	// unexpected error
+	log.Print("NextMessage : unexpected error : ", err.Error())
+	w.WriteHeader(500)
+}
+
+// reads a positive duration from the query string, returning defaultValue if it is not given
+func parseDuration(r *http.Request, name string, defaultValue time.Duration) (time.Duration, error) {
+	return parseDurationValue(name, r.URL.Query().Get(name), defaultValue)
+}
+
+// reads a positive duration, returning defaultValue if value is empty
+func parseDurationValue(name string, value string, defaultValue time.Duration) (time.Duration, error) {
+
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if parsed <= 0 {
+		return 0, fmt.Errorf("%s must be positive", name)
+	}
+	return parsed, nil
+}
+
+// POST /<topic>/<username>/ack/<receipt>
+func (api *Api) AckMessage(c web.C, w http.ResponseWriter, r *http.Request) {
+	api.settle("AckMessage", api.service.AckContext, c, w, r)
+}
+
+// POST /<topic>/<username>/nack/<receipt>
+func (api *Api) NackMessage(c web.C, w http.ResponseWriter, r *http.Request) {
+	api.settle("NackMessage", api.service.NackContext, c, w, r)
+}
+
+// acks or nacks a leased message
+func (api *Api) settle(name string, settle func(context.Context, string, string, string) error, c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	usernameFromRequest := c.URLParams["username"]
+	receiptFromRequest := c.URLParams["receipt"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(usernameFromRequest) || isEmptyString(receiptFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println(name, ": topic", topicFromRequest, "username", usernameFromRequest, "receipt", receiptFromRequest)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	err := settle(ctx, topicFromRequest, usernameFromRequest, receiptFromRequest)
+
+	if err != nil {
+
+		if err == UnknownTopic || err == UnknownUser || err == UnknownReceipt {
 			w.WriteHeader(404)
 			return
 		}
 
-		if err == NoMessagesAvailable {
-			w.WriteHeader(204)
+		if writeUnavailableError(err, w) {
 			return
 		}
 
 		// unexpected error
+		log.Print(name, " : unexpected error : ", err.Error())
 		w.WriteHeader(500)
 		return
 	}
 
-	// REVIEW : html encode response? my feeling is no as this is a "service" rather than a front end web application
-	io.WriteString(w, string(message))
 	w.WriteHeader(200)
 }
 
+// GET /<topic>/<username>/dlq
+// Lists the messages moved to the dead letter topic from the subscription as a JSON array
+func (api *Api) ListDeadLetters(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	usernameFromRequest := c.URLParams["username"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(usernameFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("ListDeadLetters : topic", topicFromRequest, "username", usernameFromRequest)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	deadLetters, err := api.service.DeadLettersContext(ctx, topicFromRequest, usernameFromRequest)
+
+	if err != nil {
+		writeDeadLetterError("ListDeadLetters", err, w)
+		return
+	}
+
+	writeJson(w, deadLetters)
+}
+
+// POST /<topic>/<username>/dlq/replay
+// Moves the dead letters back to the subscription, responding with {"replayed": <count>}
+func (api *Api) ReplayDeadLetters(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	usernameFromRequest := c.URLParams["username"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(usernameFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("ReplayDeadLetters : topic", topicFromRequest, "username", usernameFromRequest)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	count, err := api.service.ReplayDeadLettersContext(ctx, topicFromRequest, usernameFromRequest)
+
+	if err != nil {
+		writeDeadLetterError("ReplayDeadLetters", err, w)
+		return
+	}
+
+	writeJson(w, map[string]int{"replayed": count})
+}
+
+// DELETE /<topic>/<username>/dlq
+// Deletes the dead letters of the subscription, responding with {"purged": <count>}
+func (api *Api) PurgeDeadLetters(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	usernameFromRequest := c.URLParams["username"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(usernameFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("PurgeDeadLetters : topic", topicFromRequest, "username", usernameFromRequest)
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	count, err := api.service.PurgeDeadLettersContext(ctx, topicFromRequest, usernameFromRequest)
+
+	if err != nil {
+		writeDeadLetterError("PurgeDeadLetters", err, w)
+		return
+	}
+
+	writeJson(w, map[string]int{"purged": count})
+}
+
+func writeDeadLetterError(name string, err error, w http.ResponseWriter) {
+
+	if err == UnknownTopic || err == UnknownUser {
+		w.WriteHeader(404)
+		return
+	}
+
+	if writeUnavailableError(err, w) {
+		return
+	}
+
+	// unexpected error
+	log.Print(name, " : unexpected error : ", err.Error())
+	w.WriteHeader(500)
+}
+
+// the context a request's calls to the Service are made with, done when the client goes
+// away or the request timeout passes
+func (api *Api) serviceContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), api.requestTimeout)
+}
+
+// writes a 503 if the Service did not answer within the request timeout or is shutting
+// down. Nothing is written if the client has gone away. Returns false for other errors
+func writeUnavailableError(err error, w http.ResponseWriter) bool {
+
+	if err == context.DeadlineExceeded || err == ServiceClosed {
+		w.WriteHeader(503)
+		return true
+	}
+
+	// the client has gone away
+	return err == context.Canceled
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	writeJsonWithStatus(w, 200, value)
+}
+
+func writeJsonWithStatus(w http.ResponseWriter, status int, value interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Print("unable to write json response : ", err.Error())
+	}
+}
+
 func isEmptyString(str string) bool {
 	return len(strings.TrimSpace(str)) == 0
 }
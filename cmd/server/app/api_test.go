@@ -5,8 +5,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mdevilliers/take-home/pkg/topic"
 	"github.com/zenazn/goji/web"
 )
 
@@ -203,12 +207,592 @@ func TestRetrieveFromExistingTopicButNonExistantUserReturns404(t *testing.T) {
 
 }
 
+func TestPublishToFullTopicReturns507(t *testing.T) {
+
+	registry := topic.NewTopicRegistryWithChannelFactory(
+		topic.RingBufferChannelFactory(topic.RingBufferOptions{Capacity: 1, Overflow: topic.RejectPublish}, nil))
+
+	instance := getServerInstanceWithService(NewServiceWithRegistry(registry))
+	defer instance.Close()
+
+	//POST /<topic>/<username>
+	http.Post(instance.URL+"/topic-one/user-one", "text", nil)
+
+	//POST /<topic>
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-one")))
+	res, _ := http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-two")))
+
+	_, status := parseResponse(res)
+
+	if status != 507 {
+		t.Error("Posting to a full topic should return 507 but returned ", status)
+	}
+}
+
+// Request: GET /<topic>/<username>?ack=true
+// Request: POST /<topic>/<username>/ack/<receipt>
+// Response codes:
+// ● 200: Acknowledged.
+// ● 404: The receipt is unknown or has expired.
+func TestLeasedMessageIsRedeliveredUntilAcked(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one"
+
+	http.Post(url, "text", nil)
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-one")))
+
+	res, _ := http.Get(url + "?ack=true&visibility=1ms")
+	content, status := parseResponse(res)
+
+	if status != http.StatusOK || content != "message-one" || res.Header.Get("X-Redelivery-Count") != "0" {
+		t.Fatal("Leasing a message should return it with a redelivery count of 0 but returned ", status)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	res, _ = http.Get(url + "?ack=true")
+	content, _ = parseResponse(res)
+
+	if content != "message-one" || res.Header.Get("X-Redelivery-Count") != "1" {
+		t.Error("An unacknowledged message should be redelivered.")
+	}
+
+	res, _ = http.Post(url+"/ack/"+res.Header.Get("X-Receipt-Handle"), "text", nil)
+	_, status = parseResponse(res)
+
+	if status != http.StatusOK {
+		t.Error("Acknowledging a leased message should return 200 but returned ", status)
+	}
+
+	res, _ = http.Post(url+"/ack/unknown", "text", nil)
+	_, status = parseResponse(res)
+
+	if status != 404 {
+		t.Error("Acknowledging an unknown receipt should return 404 but returned ", status)
+	}
+}
+
+// Request: GET /<topic>/<username>/dlq
+// Response codes:
+// ● 200: JSON array of dead letters.
+// ● 404: The subscription does not exist.
+func TestMessageMetadataIsReturnedAsHeaders(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one"
+	http.Post(url, "text", nil)
+
+	req, _ := http.NewRequest("POST", instance.URL+"/topic-one", bytes.NewBuffer([]byte("message-one")))
+	req.Header.Set("X-Msg-Trace-Id", "trace-one")
+	req.Header.Set("X-Publisher", "publisher-one")
+
+	res, _ := http.DefaultClient.Do(req)
+	_, status := parseResponse(res)
+	id := res.Header.Get("X-Message-Id")
+
+	if status != http.StatusOK || id == "" {
+		t.Fatal("Publishing should return the id of the message but returned ", status)
+	}
+
+	res, _ = http.Get(url)
+	content, _ := parseResponse(res)
+
+	if content != "message-one" || res.Header.Get("X-Message-Id") != id || res.Header.Get("X-Message-Sequence") != "1" {
+		t.Error("A message should be returned with its id and sequence : ", res.Header)
+	}
+
+	if res.Header.Get("X-Msg-Trace-Id") != "trace-one" || res.Header.Get("X-Message-Publisher") != "publisher-one" {
+		t.Error("A message should be returned with its publisher and headers : ", res.Header)
+	}
+
+	if _, err := time.Parse(time.RFC3339Nano, res.Header.Get("X-Message-Timestamp")); err != nil {
+		t.Error("A message should be returned with its timestamp : ", err)
+	}
+}
+
+func TestExpiredMessagesAreSkippedAndCounted(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one"
+	http.Post(url, "text", nil)
+
+	http.Post(instance.URL+"/topic-one?ttl=1ms", "text", bytes.NewBuffer([]byte("message-one")))
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-two")))
+
+	res, _ := http.Post(instance.URL+"/topic-one?ttl=never", "text", bytes.NewBuffer([]byte("message-three")))
+	_, status := parseResponse(res)
+
+	if status != 400 {
+		t.Error("Publishing with an invalid ttl should return 400 but returned ", status)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	res, _ = http.Get(url)
+	content, _ := parseResponse(res)
+
+	if content != "message-two" {
+		t.Error("An expired message should not be returned but got ", content)
+	}
+
+	res, _ = http.Get(url + "/expired")
+	content, status = parseResponse(res)
+
+	if status != http.StatusOK || content != "{\"topic\":1,\"subscriber\":1}\n" {
+		t.Error("Expired messages should be counted but returned ", status, content)
+	}
+}
+
+func TestSubscribingFromEarliestReplaysRetainedMessages(t *testing.T) {
+
+	registry := topic.NewTopicRegistryWithOptions(nil, func(string) topic.TopicOptions {
+		return topic.TopicOptions{Retention: time.Hour}
+	})
+
+	instance := getServerInstanceWithService(NewServiceWithRegistry(registry))
+	defer instance.Close()
+
+	http.Post(instance.URL+"/topic-one/user-one", "text", nil)
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-one")))
+
+	res, _ := http.Get(instance.URL + "/topic-one/user-one")
+	parseResponse(res)
+
+	res, _ = http.Post(instance.URL+"/topic-one/user-two?from=yesterday", "text", nil)
+	_, status := parseResponse(res)
+
+	if status != 400 {
+		t.Error("Subscribing from an invalid position should return 400 but returned ", status)
+	}
+
+	for _, username := range []string{"user-one", "user-two"} {
+
+		http.Post(instance.URL+"/topic-one/"+username+"?from=earliest", "text", nil)
+
+		res, _ = http.Get(instance.URL + "/topic-one/" + username)
+		content, _ := parseResponse(res)
+
+		if content != "message-one" {
+			t.Error("Subscribing from earliest should replay retained messages to ", username, " but got ", content)
+		}
+	}
+}
+
+func TestSubscribersOnlyReceiveMessagesMatchingTheirFilter(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	endpoint := instance.URL + "/topic-one/user-one"
+
+	res, _ := http.Post(endpoint+"?filter="+url.QueryEscape("body.total >"), "text", nil)
+	content, status := parseResponse(res)
+
+	if status != 400 || !strings.Contains(content, "position") {
+		t.Error("Subscribing with an invalid filter should return 400 and the reason but returned ", status, content)
+	}
+
+	http.Post(endpoint+"?filter="+url.QueryEscape("body.total > 10 && header.region == 'eu'"), "text", nil)
+
+	for _, region := range []string{"us", "eu"} {
+
+		req, _ := http.NewRequest("POST", instance.URL+"/topic-one", bytes.NewBuffer([]byte(`{"total": 20}`)))
+		req.Header.Set(MessageHeaderPrefix+"Region", region)
+		http.DefaultClient.Do(req)
+	}
+
+	res, _ = http.Get(endpoint)
+	parseResponse(res)
+
+	if res.Header.Get(MessageHeaderPrefix+"Region") != "eu" {
+		t.Error("Only the message matching the filter should be received.")
+	}
+
+	res, _ = http.Get(endpoint)
+	_, status = parseResponse(res)
+
+	if status != 204 {
+		t.Error("Messages not matching the filter should not be received but returned ", status)
+	}
+}
+
+func TestWildcardSubscribersReceiveMessagesFromMatchingTopics(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	http.Post(instance.URL+"/orders.+.created/user-one", "text", nil)
+	http.Post(instance.URL+"/orders.eu.created", "text", bytes.NewBuffer([]byte("message-one")))
+	http.Post(instance.URL+"/orders.eu.cancelled", "text", bytes.NewBuffer([]byte("message-two")))
+
+	res, _ := http.Get(instance.URL + "/orders.+.created/user-one")
+	content, _ := parseResponse(res)
+
+	if content != "message-one" || res.Header.Get("X-Message-Topic") != "orders.eu.created" {
+		t.Error("A wildcard subscriber should receive messages from matching topics but got ", content)
+	}
+
+	res, _ = http.Post(instance.URL+"/orders.%23", "text", bytes.NewBuffer([]byte("message-three")))
+	_, status := parseResponse(res)
+
+	if status != 400 {
+		t.Error("Publishing to a wildcard topic should return 400 but returned ", status)
+	}
+
+	res, _ = http.Post(instance.URL+"/orders.%23.created/user-one", "text", nil)
+	_, status = parseResponse(res)
+
+	if status != 400 {
+		t.Error("Subscribing to an invalid topic name should return 400 but returned ", status)
+	}
+}
+
+func TestScheduledMessagesCanBeListedAndCancelled(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one"
+	http.Post(url, "text", nil)
+
+	res, _ := http.Post(instance.URL+"/topic-one?delay=1h", "text", bytes.NewBuffer([]byte("message-one")))
+	_, status := parseResponse(res)
+	id := res.Header.Get("X-Message-Id")
+
+	if status != http.StatusOK || id == "" {
+		t.Fatal("Scheduling a message should return its id but returned ", status)
+	}
+
+	res, _ = http.Post(instance.URL+"/topic-one?delay=1h&deliver-at=2030-01-01T00:00:00Z", "text", bytes.NewBuffer([]byte("message-two")))
+	_, status = parseResponse(res)
+
+	if status != 400 {
+		t.Error("Giving both delay and deliver-at should return 400 but returned ", status)
+	}
+
+	res, _ = http.Get(url)
+	_, status = parseResponse(res)
+
+	if status != 204 {
+		t.Error("A scheduled message should not be delivered before it is due but returned ", status)
+	}
+
+	res, _ = http.Get(instance.URL + "/topic-one/_scheduled")
+	content, _ := parseResponse(res)
+
+	if !strings.Contains(content, id) || !strings.Contains(content, "message-one") {
+		t.Error("Scheduled messages should be listed : ", content)
+	}
+
+	req, _ := http.NewRequest("DELETE", instance.URL+"/topic-one/_scheduled/"+id, nil)
+	res, _ = http.DefaultClient.Do(req)
+	_, status = parseResponse(res)
+
+	if status != http.StatusOK {
+		t.Error("Cancelling a scheduled message should return 200 but returned ", status)
+	}
+
+	res, _ = http.DefaultClient.Do(req)
+	_, status = parseResponse(res)
+
+	if status != 404 {
+		t.Error("Cancelling an unknown scheduled message should return 404 but returned ", status)
+	}
+
+	res, _ = http.Post(instance.URL+"/topic-one/scheduled", "text", nil)
+	_, status = parseResponse(res)
+
+	if status != http.StatusOK {
+		t.Error("Subscribing as scheduled should return 200 but returned ", status)
+	}
+
+	res, _ = http.Post(instance.URL+"/topic-one/_scheduled", "text", nil)
+	_, status = parseResponse(res)
+
+	if status != 400 {
+		t.Error("Subscribing with a username starting with _ should return 400 but returned ", status)
+	}
+}
+
+func TestGroupMembersShareMessages(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	group := instance.URL + "/topic-one/_groups/workers"
+
+	res, _ := http.Post(group+"/worker-one?assignment=fastest", "text", nil)
+	_, status := parseResponse(res)
+
+	if status != 400 {
+		t.Error("Joining with an unknown assignment should return 400 but returned ", status)
+	}
+
+	http.Post(group+"/worker-one", "text", nil)
+	http.Post(group+"/worker-two", "text", nil)
+
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-one")))
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-two")))
+
+	res, _ = http.Get(group + "/worker-one")
+	first, _ := parseResponse(res)
+	res, _ = http.Get(group + "/worker-two")
+	second, _ := parseResponse(res)
+
+	if first != "message-one" || second != "message-two" {
+		t.Error("Each member should receive its share of the messages : ", first, second)
+	}
+
+	res, _ = http.Get(group + "/worker-one")
+	_, status = parseResponse(res)
+
+	if status != 204 {
+		t.Error("A message should only be delivered to one member but returned ", status)
+	}
+
+	req, _ := http.NewRequest("DELETE", group+"/worker-one", nil)
+	res, _ = http.DefaultClient.Do(req)
+	_, status = parseResponse(res)
+
+	if status != http.StatusOK {
+		t.Error("Leaving a group should return 200 but returned ", status)
+	}
+
+	res, _ = http.DefaultClient.Do(req)
+	_, status = parseResponse(res)
+
+	if status != 404 {
+		t.Error("Leaving a group twice should return 404 but returned ", status)
+	}
+
+	res, _ = http.Post(instance.URL+"/topic-one/groups", "text", nil)
+	_, status = parseResponse(res)
+
+	if status != http.StatusOK {
+		t.Error("Subscribing as groups should return 200 but returned ", status)
+	}
+}
+
+func TestListDeadLettersReturnsJson(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one/dlq"
+
+	res, _ := http.Get(url)
+	_, status := parseResponse(res)
+
+	if status != 404 {
+		t.Error("Listing dead letters without subscribing should return 404 but returned ", status)
+	}
+
+	http.Post(instance.URL+"/topic-one/user-one", "text", nil)
+
+	res, _ = http.Get(url)
+	content, status := parseResponse(res)
+
+	if status != http.StatusOK || content != "[]\n" {
+		t.Error("Listing dead letters should return an empty array but returned ", status, content)
+	}
+}
+
+// Request: GET /<topic>/<username>?wait=<duration>
+// Response codes:
+// ● 200: A message arrived while waiting.
+// ● 204: No message arrived before the duration passed.
+// ● 400: The duration is invalid.
+func TestLongPollReturnsMessagePublishedWhileWaiting(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one"
+	http.Post(url, "text", nil)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-one")))
+	}()
+
+	res, _ := http.Get(url + "?wait=5s")
+	content, status := parseResponse(res)
+
+	if status != http.StatusOK || content != "message-one" {
+		t.Error("Waiting should return the published message but returned ", status, content)
+	}
+}
+
+func TestLongPollTimesOutWith204(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one"
+	http.Post(url, "text", nil)
+
+	res, _ := http.Get(url + "?wait=10ms")
+	_, status := parseResponse(res)
+
+	if status != 204 {
+		t.Error("Waiting without a message being published should return 204 but returned ", status)
+	}
+
+	res, _ = http.Get(url + "?wait=soon")
+	_, status = parseResponse(res)
+
+	if status != 400 {
+		t.Error("An invalid wait should return 400 but returned ", status)
+	}
+}
+
+func TestRequestsTheServiceDoesNotAnswerInTimeReturn503(t *testing.T) {
+
+	service, stalled := newStalledService(topic.NewTopicRegistry())
+	instance := httptest.NewServer(routed(NewApiWithOptions(service, ApiOptions{RequestTimeout: 10 * time.Millisecond})))
+	defer instance.Close()
+
+	res, _ := http.Post(instance.URL+"/topic-one/user-one", "text", nil)
+	_, status := parseResponse(res)
+
+	if status != 503 {
+		t.Error("A request the Service does not answer in time should return 503 but returned ", status)
+	}
+
+	go stalled.loop()
+
+	// the wait for a message is not limited by the request timeout
+	endpoint := instance.URL + "/topic-one/user-one"
+	http.Post(endpoint, "text", nil)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		http.Post(instance.URL+"/topic-one", "text", strings.NewReader("message-one"))
+	}()
+
+	res, _ = http.Get(endpoint + "?wait=1s")
+	content, status := parseResponse(res)
+
+	if status != http.StatusOK || content != "message-one" {
+		t.Error("Waiting longer than the request timeout should return the published message but returned ", status, content)
+	}
+}
+
+func TestClosingTheApiEndsLongPollsAndAClosedServiceReturns503(t *testing.T) {
+
+	service := NewService()
+	api := NewApiWithService(service)
+	instance := httptest.NewServer(routed(api))
+	defer instance.Close()
+
+	endpoint := instance.URL + "/topic-one/user-one"
+	http.Post(endpoint, "text", nil)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		api.Close()
+	}()
+
+	started := time.Now()
+	res, _ := http.Get(endpoint + "?wait=1m")
+	_, status := parseResponse(res)
+
+	if status != 204 || time.Since(started) > 10*time.Second {
+		t.Error("Closing the Api should end a long poll with 204 but returned ", status)
+	}
+
+	service.Close()
+
+	res, _ = http.Post(instance.URL+"/topic-one", "text", strings.NewReader("message-one"))
+	_, status = parseResponse(res)
+
+	if status != 503 {
+		t.Error("Publishing once the Service is closed should return 503 but returned ", status)
+	}
+}
+
+// Request: GET /<topic>/<username>/peek and GET /<topic>/<username>/browse?offset=<count>&limit=<count>
+// Response codes:
+// ● 200: The next message, or a JSON array of waiting messages.
+// ● 204: No message is waiting to be peeked.
+// ● 404: The topic or subscription does not exist.
+func TestPeekingAndBrowsingDoNotRemoveMessages(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	res, _ := http.Get(instance.URL + "/topic-one/user-one/peek")
+	_, status := parseResponse(res)
+
+	if status != 404 {
+		t.Error("Peeking without subscribing should return 404 but returned ", status)
+	}
+
+	http.Post(instance.URL+"/topic-one/user-one", "text", nil)
+
+	res, _ = http.Get(instance.URL + "/topic-one/user-one/peek")
+	_, status = parseResponse(res)
+
+	if status != 204 {
+		t.Error("Peeking with no messages should return 204 but returned ", status)
+	}
+
+	for _, body := range []string{"message1", "message2", "message3"} {
+		http.Post(instance.URL+"/topic-one", "text", strings.NewReader(body))
+	}
+
+	res, _ = http.Get(instance.URL + "/topic-one/user-one/peek")
+	content, status := parseResponse(res)
+
+	if status != 200 || content != "message1" || res.Header.Get("X-Message-Sequence") != "1" {
+		t.Error("Peeking should return the next message but returned ", status, content)
+	}
+
+	browsed := []jsonMessage{}
+
+	if status := getJson(t, instance.URL+"/topic-one/user-one/browse?offset=1&limit=5", &browsed); status != 200 {
+		t.Fatal("Browsing should return 200 but returned ", status)
+	}
+
+	if len(browsed) != 2 || browsed[0].Body != "message2" || browsed[0].Sequence != 2 || browsed[0].Id == "" || browsed[1].Body != "message3" {
+		t.Error("Browsing should return the window of messages with their metadata : ", browsed)
+	}
+
+	res, _ = http.Get(instance.URL + "/topic-one/user-one/browse?offset=-1")
+	_, status = parseResponse(res)
+
+	if status != 400 {
+		t.Error("A negative offset should return 400 but returned ", status)
+	}
+
+	res, _ = http.Get(instance.URL + "/topic-one/user-one")
+	content, _ = parseResponse(res)
+
+	if content != "message1" {
+		t.Error("Peeking and browsing should not remove messages but received ", content)
+	}
+}
+
 func getServerInstance() *httptest.Server {
-	api := NewApi()
+	return getServerInstanceWithService(NewService())
+}
+
+func getServerInstanceWithService(service *Service) *httptest.Server {
+	return httptest.NewServer(routed(NewApiWithService(service)))
+}
+
+func routed(api *Api) *web.Mux {
 	mux := web.New()
 	api.Route(mux)
 
-	return httptest.NewServer(mux)
+	return mux
 }
 
 func parseResponse(res *http.Response) (string, int) {
@@ -0,0 +1,347 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/zenazn/goji/web"
+)
+
+// the most messages a batch can publish
+const MaxBatchSize = 1000
+
+// status of an item whose batch was not published because of another item
+const StatusNotPublished = http.StatusFailedDependency
+
+// A message in a batch to publish. It may also be given as a JSON string, which is its body
+type batchItem struct {
+	Body      string            `json:"body"`
+	Headers   map[string]string `json:"headers"`
+	Publisher string            `json:"publisher"`
+	TTL       string            `json:"ttl"`
+}
+
+// What happened to one message of a batch, with a status as a response to publishing it alone would have
+type batchItemResult struct {
+	Status int    `json:"status"`
+	Id     string `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// POST /<topic>/_batch[?ttl=<duration>]
+// Publishes a batch of messages in order with nothing else published to the topic in between.
+// The body is a JSON array with Content-Type application/json, a JSON message per line with
+// application/x-ndjson, and otherwise a message body per line. JSON messages are a string body or
+// {"body": ..., "headers": {...}, "publisher": ..., "ttl": ...}, defaulting to the request's
+// X-Msg-<name> headers, publisher and ttl.
+// Returns a JSON array with the outcome of each message: 200 if every message was published,
+// 207 if some were published but not pushed to every subscriber, 400 if a message is invalid,
+// 507 if a subscriber does not have space for the batch and 429 if one which blocks did not make
+// space for it before its timeout, in which case nothing is published
+func (api *Api) PublishBatch(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+
+	if isEmptyString(topicFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Print("PublishBatch : error parsing body : ", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	defaults, err := batchDefaultsOf(r)
+
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	messages, problems, err := parseBatch(r.Header.Get("Content-Type"), body, defaults)
+
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if len(messages) > MaxBatchSize {
+		w.WriteHeader(413)
+		fmt.Fprintf(w, "a batch can have at most %d messages", MaxBatchSize)
+		return
+	}
+
+	log.Println("PublishBatch : topic", topicFromRequest, "messages", len(messages))
+
+	if len(problems) > 0 {
+		writeBatchFailure(w, 400, len(messages), problems)
+		return
+	}
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	results, err := api.service.PublishBatchContext(ctx, topicFromRequest, messages)
+
+	if err != nil {
+
+		if err == TopicFull || err == PublishTimedOut {
+			writeBatchFailure(w, publishErrorStatus(err), len(messages), nil)
+			return
+		}
+
+		if err == InvalidTopicName || err == ReservedTopicName || err == WildcardPublish {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if writeUnavailableError(err, w) {
+			return
+		}
+
+		log.Print("PublishBatch : unexpected error : ", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	status := 200
+	outcomes := make([]*batchItemResult, 0, len(results))
+
+	for _, result := range results {
+
+		outcome := &batchItemResult{Status: 200, Id: result.Id}
+
+		if result.Err != nil {
+			outcome.Status = publishErrorStatus(result.Err)
+			outcome.Error = result.Err.Error()
+			status = http.StatusMultiStatus
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	writeJsonWithStatus(w, status, outcomes)
+}
+
+// GET /<topic>/<username>/batch?limit=<count>[&wait=<duration>][&ack=true[&visibility=<duration>]]
+// Returns a JSON array of up to limit messages, DefaultPageSize if not given, removing them or
+// leasing them as GET /<topic>/<username> does. A wait returns as soon as any message arrives
+func (api *Api) FetchBatch(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	usernameFromRequest := c.URLParams["username"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(usernameFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	requested, err := parsePage(r)
+
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	wait, err := parseDuration(r, "wait", 0)
+
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	if wait > MaxWait {
+		wait = MaxWait
+	}
+
+	visibility, err := parseDuration(r, "visibility", DefaultVisibilityTimeout)
+
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	leasing := r.URL.Query().Get("ack") == "true"
+
+	log.Println("FetchBatch : topic", topicFromRequest, "username", usernameFromRequest, "limit", requested.limit)
+
+	var deliveries []*Delivery
+
+	err = api.waitForMessage(topicFromRequest, usernameFromRequest, wait, r, func(ctx context.Context) error {
+
+		if leasing {
+			deliveries, err = api.service.LeaseBatchContext(ctx, topicFromRequest, usernameFromRequest, requested.limit, visibility)
+		} else {
+			deliveries, err = api.service.ReceiveBatchContext(ctx, topicFromRequest, usernameFromRequest, requested.limit)
+		}
+		return err
+	})
+
+	if err != nil {
+		writeNextMessageError(err, w)
+		return
+	}
+	writeJson(w, newJsonMessages(deliveries))
+}
+
+// the options of the messages in a batch which do not set their own, taken from the request
+func batchDefaultsOf(r *http.Request) (PublishOptions, error) {
+
+	ttl, err := parseDuration(r, "ttl", 0)
+
+	if err == nil && ttl == 0 {
+		ttl, err = parseDurationValue("ttl", r.Header.Get("X-TTL"), 0)
+	}
+
+	return PublishOptions{
+		Publisher: publisherOf(r),
+		Headers:   messageHeadersOf(r),
+		TTL:       ttl,
+	}, err
+}
+
+// reads the messages of a batch, returning the problem with each invalid one by its index.
+// Returns an error if the body can not be read as a batch at all
+func parseBatch(contentType string, body []byte, defaults PublishOptions) ([]*BatchMessage, map[int]string, error) {
+
+	var items []json.RawMessage
+	var lines [][]byte
+
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "application/json":
+
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, nil, fmt.Errorf("the body should be a JSON array of messages : %s", err.Error())
+		}
+
+	case "application/x-ndjson":
+
+		for _, line := range batchLines(body) {
+			items = append(items, json.RawMessage(line))
+		}
+
+	default:
+		lines = batchLines(body)
+	}
+
+	if len(items) == 0 && len(lines) == 0 {
+		return nil, nil, fmt.Errorf("the batch has no messages")
+	}
+
+	messages := make([]*BatchMessage, 0, len(items)+len(lines))
+	problems := make(map[int]string)
+
+	for _, line := range lines {
+		messages = append(messages, &BatchMessage{Message: line, Options: defaults})
+	}
+
+	for index, item := range items {
+
+		message, err := parseBatchItem(item, defaults)
+
+		if err != nil {
+			problems[index] = err.Error()
+		}
+		messages = append(messages, message)
+	}
+	return messages, problems, nil
+}
+
+func parseBatchItem(raw json.RawMessage, defaults PublishOptions) (*BatchMessage, error) {
+
+	item := &batchItem{}
+	var body string
+
+	if err := json.Unmarshal(raw, &body); err == nil {
+		item.Body = body
+	} else if err := json.Unmarshal(raw, item); err != nil {
+		return nil, fmt.Errorf("a message should be a string or an object : %s", err.Error())
+	}
+
+	if item.Body == "" {
+		return nil, fmt.Errorf("a message should have a body")
+	}
+
+	options := PublishOptions{Publisher: defaults.Publisher, Headers: make(map[string]string), TTL: defaults.TTL}
+
+	for name, value := range defaults.Headers {
+		options.Headers[name] = value
+	}
+
+	for name, value := range item.Headers {
+		options.Headers[strings.ToLower(name)] = value
+	}
+
+	if item.Publisher != "" {
+		options.Publisher = item.Publisher
+	}
+
+	ttl, err := parseDurationValue("ttl", item.TTL, defaults.TTL)
+
+	if err != nil {
+		return nil, err
+	}
+	options.TTL = ttl
+
+	return &BatchMessage{Message: []byte(item.Body), Options: options}, nil
+}
+
+// the non empty lines of a body
+func batchLines(body []byte) [][]byte {
+
+	lines := make([][]byte, 0)
+
+	for _, line := range bytes.Split(body, []byte("\n")) {
+
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// writes the outcome of a batch which was not published. Items with a problem have it as
+// their error, the rest are given status. Every item has status if problems is nil
+func writeBatchFailure(w http.ResponseWriter, status int, count int, problems map[int]string) {
+
+	outcomes := make([]*batchItemResult, 0, count)
+
+	for index := 0; index < count; index++ {
+
+		if problems == nil {
+			outcomes = append(outcomes, &batchItemResult{Status: status, Error: "a subscriber does not have space for the batch"})
+		} else if problem, invalid := problems[index]; invalid {
+			outcomes = append(outcomes, &batchItemResult{Status: status, Error: problem})
+		} else {
+			outcomes = append(outcomes, &batchItemResult{Status: StatusNotPublished, Error: "not published as another message in the batch is invalid"})
+		}
+	}
+	writeJsonWithStatus(w, status, outcomes)
+}
+
+// the status a publish returning err would have
+func publishErrorStatus(err error) int {
+
+	switch err {
+	case TopicFull:
+		return 507
+	case PublishTimedOut:
+		return 429
+	}
+	return 500
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mdevilliers/take-home/pkg/topic"
+)
+
+// Request: POST /<topic>/_batch
+// Response codes:
+// ● 200: Every message was published, their ids are returned in order.
+// ● 400: A message is invalid and nothing was published.
+func TestBatchesArePublishedInOrder(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	http.Post(instance.URL+"/topic-one/user-one", "text", nil)
+
+	outcomes, status := postBatch(t, instance.URL+"/topic-one/_batch", "application/json", `["message1", {"body": "message2", "headers": {"Kind": "b"}, "ttl": "1h"}]`)
+
+	if status != 200 || len(outcomes) != 2 || outcomes[0].Status != 200 || outcomes[0].Id == "" || outcomes[1].Id == "" {
+		t.Fatal("Publishing a batch should return 200 with an id for each message but returned ", status, outcomes)
+	}
+
+	outcomes, status = postBatch(t, instance.URL+"/topic-one/_batch", "text/plain", "message3\r\n\nmessage4\n")
+
+	if status != 200 || len(outcomes) != 2 {
+		t.Fatal("Publishing lines should return 200 with an id for each line but returned ", status, outcomes)
+	}
+
+	outcomes, status = postBatch(t, instance.URL+"/topic-one/_batch", "application/x-ndjson", "\"message5\"\n{\"ttl\": \"1h\"}\n")
+
+	if status != 400 || len(outcomes) != 2 || outcomes[0].Status != StatusNotPublished || outcomes[1].Status != 400 || outcomes[1].Error == "" {
+		t.Error("A batch with an invalid message should return 400 with the problem but returned ", status, outcomes)
+	}
+
+	received := []jsonMessage{}
+	getJson(t, instance.URL+"/topic-one/user-one/batch?limit=10", &received)
+
+	if len(received) != 4 || received[0].Body != "message1" || received[1].Body != "message2" || received[1].Headers["kind"] != "b" || received[3].Body != "message4" {
+		t.Error("The valid batches should be received in order : ", received)
+	}
+
+	for index, message := range received {
+		if message.Sequence != uint64(index+1) {
+			t.Error("Messages in a batch should be numbered in order : ", message.Sequence)
+		}
+	}
+
+	http.Post(instance.URL+"/topic-one/batch", "text", nil)
+	http.Post(instance.URL+"/topic-one", "text", strings.NewReader("message6"))
+
+	res, _ := http.Get(instance.URL + "/topic-one/batch")
+	content, _ := parseResponse(res)
+
+	if content != "message6" {
+		t.Error("batch should be usable as a username : ", content)
+	}
+}
+
+// Request: POST /<topic>/_batch
+// Response codes:
+// ● 507: A subscriber does not have space for the batch and nothing was published.
+func TestBatchWhichDoesNotFitIsNotPublished(t *testing.T) {
+
+	registry := topic.NewTopicRegistryWithChannelFactory(topic.RingBufferChannelFactory(topic.RingBufferOptions{Capacity: 2, Overflow: topic.RejectPublish}, nil))
+	instance := getServerInstanceWithService(NewServiceWithRegistry(registry))
+	defer instance.Close()
+
+	http.Post(instance.URL+"/topic-one/user-one", "text", nil)
+
+	outcomes, status := postBatch(t, instance.URL+"/topic-one/_batch", "text/plain", "message1\nmessage2\nmessage3")
+
+	if status != 507 || len(outcomes) != 3 || outcomes[2].Status != 507 {
+		t.Error("A batch which does not fit should return 507 but returned ", status, outcomes)
+	}
+
+	res, _ := http.Get(instance.URL + "/topic-one/user-one")
+	_, status = parseResponse(res)
+
+	if status != 204 {
+		t.Error("No message of a rejected batch should be published but returned ", status)
+	}
+}
+
+// Request: GET /<topic>/<username>/batch?limit=<count>[&ack=true]
+// Response codes:
+// ● 200: A JSON array of up to limit messages.
+// ● 204: No messages are waiting.
+// ● 404: The topic or subscription does not exist.
+func TestBatchesOfMessagesCanBeFetched(t *testing.T) {
+
+	service := NewService()
+	instance := httptest.NewServer(routed(NewApiWithService(service)))
+	defer instance.Close()
+
+	res, _ := http.Get(instance.URL + "/topic-one/user-one/batch")
+	_, status := parseResponse(res)
+
+	if status != 404 {
+		t.Error("Fetching without subscribing should return 404 but returned ", status)
+	}
+
+	service.Subscribe("topic-one", "user-one")
+
+	for _, body := range []string{"message1", "message2", "message3"} {
+		service.PublishMessage("topic-one", []byte(body))
+	}
+
+	leased := []jsonMessage{}
+	getJson(t, instance.URL+"/topic-one/user-one/batch?limit=2&ack=true", &leased)
+
+	if len(leased) != 2 || leased[0].Body != "message1" || leased[0].Receipt == "" || leased[1].Body != "message2" {
+		t.Fatal("Leasing a batch should return the messages with their receipts : ", leased)
+	}
+
+	if err := service.Ack("topic-one", "user-one", leased[1].Receipt); err != nil {
+		t.Error("A message leased in a batch should be acknowledged with its receipt : ", err)
+	}
+
+	received := []jsonMessage{}
+	getJson(t, instance.URL+"/topic-one/user-one/batch?limit=5", &received)
+
+	if len(received) != 1 || received[0].Body != "message3" || received[0].Receipt != "" {
+		t.Error("Fetching should return the remaining message : ", received)
+	}
+
+	res, _ = http.Get(instance.URL + "/topic-one/user-one/batch")
+	_, status = parseResponse(res)
+
+	if status != 204 {
+		t.Error("Fetching with no messages should return 204 but returned ", status)
+	}
+}
+
+func postBatch(t *testing.T, url string, contentType string, body string) ([]*batchItemResult, int) {
+
+	res, err := http.Post(url, contentType, strings.NewReader(body))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	outcomes := []*batchItemResult{}
+
+	if res.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(res.Body).Decode(&outcomes); err != nil {
+			t.Fatal("The response should be JSON : ", err)
+		}
+	}
+	return outcomes, res.StatusCode
+}
@@ -0,0 +1,325 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdevilliers/take-home/pkg/topic"
+	"github.com/zenazn/goji/web"
+)
+
+// subscribers of a topic given their own backlog series by default
+const DefaultSubscriberLabels = 100
+
+// subscribers beyond the limit share a backlog series with this label
+const OtherSubscribers = "other"
+
+// upper bounds in seconds of the request duration histogram buckets. Long polls and
+// streams are held open for up to minutes so the buckets reach MaxWait
+var RequestDurationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// durations of the requests served by each handler, by status code
+type requestMetrics struct {
+	sync.Mutex
+	durations map[requestKey]*histogram
+}
+
+type requestKey struct {
+	handler string
+	code    int
+}
+
+type histogram struct {
+	// count of observations at or below each bucket's bound
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{durations: make(map[requestKey]*histogram)}
+}
+
+func (m *requestMetrics) observe(handler string, code int, duration time.Duration) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	key := requestKey{handler: handler, code: code}
+	observed, exists := m.durations[key]
+
+	if !exists {
+		observed = &histogram{buckets: make([]uint64, len(RequestDurationBuckets))}
+		m.durations[key] = observed
+	}
+
+	seconds := duration.Seconds()
+
+	for index, bound := range RequestDurationBuckets {
+		if seconds <= bound {
+			observed.buckets[index]++
+		}
+	}
+
+	observed.count++
+	observed.sum += seconds
+}
+
+// records how long each request to handler takes and the status it returns
+func (api *Api) instrument(name string, handler web.HandlerFunc) web.HandlerFunc {
+	return func(c web.C, w http.ResponseWriter, r *http.Request) {
+
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+
+		handler(c, recorder, r)
+		api.metrics.observe(name, recorder.status(), time.Since(started))
+	}
+}
+
+// remembers the status written to a response. Streams need it to flush and WebSockets to hijack
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(content []byte) (int, error) {
+
+	if s.code == 0 {
+		s.code = 200
+	}
+	return s.ResponseWriter.Write(content)
+}
+
+func (s *statusRecorder) Flush() {
+
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, fmt.Errorf("response can not be hijacked")
+	}
+
+	s.code = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// a handler which writes nothing returns 200
+func (s *statusRecorder) status() int {
+
+	if s.code == 0 {
+		return 200
+	}
+	return s.code
+}
+
+// GET /metrics
+// Metrics in the Prometheus text format
+func (api *Api) Metrics(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(200)
+
+	if err := api.writeMetrics(w); err != nil {
+		log.Print("Metrics : unable to write : ", err.Error())
+	}
+}
+
+func (api *Api) writeMetrics(w io.Writer) error {
+
+	out := &metricsWriter{writer: bufio.NewWriter(w)}
+	stats := api.service.TopicStats()
+
+	out.family("take_home_topics", "gauge", "Topics in the registry")
+	out.sample("take_home_topics", nil, float64(len(stats)))
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(topic.Stats) uint64
+	}{
+		{"take_home_messages_published_total", "Messages published to a topic", func(s topic.Stats) uint64 { return s.Published }},
+		{"take_home_messages_delivered_total", "Messages handed to subscribers, counting redeliveries", func(s topic.Stats) uint64 { return s.Delivered }},
+		{"take_home_messages_dropped_total", "Messages discarded by the overflow policy of a topic's subscribers", func(s topic.Stats) uint64 { return s.Dropped }},
+		{"take_home_messages_expired_total", "Messages which expired before being read, once for each subscriber which missed them", func(s topic.Stats) uint64 { return s.Expired }},
+	}
+
+	for _, counter := range counters {
+
+		out.family(counter.name, "counter", counter.help)
+
+		for _, topicStats := range stats {
+			out.sample(counter.name, []string{"topic", topicStats.Topic}, float64(counter.value(topicStats)))
+		}
+	}
+
+	out.family("take_home_topic_backlog", "gauge", "Messages waiting for the subscribers of a topic")
+
+	for _, topicStats := range stats {
+
+		total := 0
+
+		for _, count := range topicStats.Backlog {
+			total += count
+		}
+		out.sample("take_home_topic_backlog", []string{"topic", topicStats.Topic}, float64(total))
+	}
+
+	out.family("take_home_subscriber_backlog", "gauge", "Messages waiting for a subscriber. Subscribers beyond the label limit are summed as \""+OtherSubscribers+"\"")
+
+	for _, topicStats := range stats {
+		for _, backlog := range limitSubscribers(topicStats.Backlog, api.subscriberLabels) {
+			out.sample("take_home_subscriber_backlog", []string{"topic", topicStats.Topic, "subscriber", backlog.subscriber}, float64(backlog.count))
+		}
+	}
+
+	out.family("take_home_shard_queue_depth", "gauge", "Requests waiting for a worker")
+
+	for _, depth := range api.service.QueueDepths() {
+		shard := strconv.Itoa(depth.Shard)
+		out.sample("take_home_shard_queue_depth", []string{"shard", shard, "queue", "requests"}, float64(depth.Requests))
+		out.sample("take_home_shard_queue_depth", []string{"shard", shard, "queue", "waiting"}, float64(depth.Waiting))
+	}
+
+	api.metrics.write(out)
+	return out.flush()
+}
+
+func (m *requestMetrics) write(out *metricsWriter) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	keys := make([]requestKey, 0, len(m.durations))
+
+	for key := range m.durations {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	name := "take_home_http_request_duration_seconds"
+	out.family(name, "histogram", "Time taken to serve a request by handler and status code")
+
+	for _, key := range keys {
+
+		observed := m.durations[key]
+		labels := []string{"handler", key.handler, "code", strconv.Itoa(key.code)}
+
+		for index, bound := range RequestDurationBuckets {
+			out.sample(name+"_bucket", append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(observed.buckets[index]))
+		}
+
+		out.sample(name+"_bucket", append(labels, "le", "+Inf"), float64(observed.count))
+		out.sample(name+"_sum", labels, observed.sum)
+		out.sample(name+"_count", labels, float64(observed.count))
+	}
+}
+
+type subscriberBacklog struct {
+	subscriber string
+	count      int
+}
+
+// the backlog of each subscriber, the limit with the largest given their own entry and the
+// rest summed as OtherSubscribers. A negative limit sums every subscriber
+func limitSubscribers(backlog map[string]int, limit int) []subscriberBacklog {
+
+	backlogs := make([]subscriberBacklog, 0, len(backlog))
+
+	for subscriber, count := range backlog {
+		backlogs = append(backlogs, subscriberBacklog{subscriber: subscriber, count: count})
+	}
+
+	sort.Slice(backlogs, func(i, j int) bool {
+		if backlogs[i].count != backlogs[j].count {
+			return backlogs[i].count > backlogs[j].count
+		}
+		return backlogs[i].subscriber < backlogs[j].subscriber
+	})
+
+	if limit < 0 {
+		limit = 0
+	}
+
+	if len(backlogs) <= limit {
+		return backlogs
+	}
+
+	other := subscriberBacklog{subscriber: OtherSubscribers}
+
+	for _, rest := range backlogs[limit:] {
+		other.count += rest.count
+	}
+	return append(backlogs[:limit], other)
+}
+
+// writes the Prometheus text format, keeping the first error
+type metricsWriter struct {
+	writer *bufio.Writer
+	err    error
+}
+
+func (m *metricsWriter) family(name string, kind string, help string) {
+	m.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labels are name, value pairs
+func (m *metricsWriter) sample(name string, labels []string, value float64) {
+
+	pairs := make([]string, 0, len(labels)/2)
+
+	for index := 0; index+1 < len(labels); index += 2 {
+		pairs = append(pairs, labels[index]+"=\""+labelEscaper.Replace(labels[index+1])+"\"")
+	}
+
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	m.printf("%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (m *metricsWriter) printf(format string, args ...interface{}) {
+
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.writer, format, args...)
+	}
+}
+
+func (m *metricsWriter) flush() error {
+
+	if m.err != nil {
+		return m.err
+	}
+	return m.writer.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
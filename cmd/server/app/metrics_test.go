@@ -0,0 +1,84 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Request: GET /metrics
+// Response codes:
+// ● 200: Metrics in the Prometheus text format.
+func TestMetricsAreExposedInThePrometheusFormat(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	http.Post(instance.URL+"/topic-one/user-one", "text", nil)
+	http.Post(instance.URL+"/topic-one/user-two", "text", nil)
+	http.Post(instance.URL+"/topic-one", "text", strings.NewReader("message1"))
+	http.Post(instance.URL+"/topic-one", "text", strings.NewReader("message2"))
+
+	res, _ := http.Get(instance.URL + "/topic-one/user-one")
+	parseResponse(res)
+
+	res, _ = http.Get(instance.URL + "/metrics")
+	content, status := parseResponse(res)
+
+	if status != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		t.Fatal("Metrics should return 200 with plain text but returned ", status, res.Header.Get("Content-Type"))
+	}
+
+	expected := []string{
+		"# TYPE take_home_messages_published_total counter",
+		"take_home_topics 1",
+		`take_home_messages_published_total{topic="topic-one"} 2`,
+		`take_home_messages_delivered_total{topic="topic-one"} 1`,
+		`take_home_messages_dropped_total{topic="topic-one"} 0`,
+		`take_home_topic_backlog{topic="topic-one"} 3`,
+		`take_home_subscriber_backlog{topic="topic-one",subscriber="user-one"} 1`,
+		`take_home_subscriber_backlog{topic="topic-one",subscriber="user-two"} 2`,
+		`take_home_shard_queue_depth{shard="0",queue="requests"} 0`,
+		"# TYPE take_home_http_request_duration_seconds histogram",
+		`take_home_http_request_duration_seconds_count{handler="PublishMessage",code="200"} 2`,
+		`take_home_http_request_duration_seconds_bucket{handler="NextMessage",code="200",le="+Inf"} 1`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(content, line+"\n") {
+			t.Error("Metrics should contain ", line, " but were ", content)
+		}
+	}
+}
+
+func TestSubscriberBacklogSeriesAreLimited(t *testing.T) {
+
+	service := NewService()
+	instance := httptest.NewServer(routed(NewApiWithOptions(service, ApiOptions{SubscriberLabels: 1})))
+	defer instance.Close()
+
+	for _, user := range []string{"a", "b", "c"} {
+		service.Subscribe("topic-one", user)
+	}
+
+	service.PublishMessage("topic-one", []byte("message1"))
+	service.GetMessage("topic-one", "a")
+	service.GetMessage("topic-one", "b")
+	service.PublishMessage("topic-one", []byte("message2"))
+
+	res, _ := http.Get(instance.URL + "/metrics")
+	content, _ := parseResponse(res)
+
+	if !strings.Contains(content, `take_home_subscriber_backlog{topic="topic-one",subscriber="c"} 2`+"\n") ||
+		!strings.Contains(content, `take_home_subscriber_backlog{topic="topic-one",subscriber="other"} 2`+"\n") ||
+		strings.Contains(content, `subscriber="a"`) {
+		t.Error("Only the subscriber with the largest backlog should have its own series : ", content)
+	}
+
+	summed := limitSubscribers(map[string]int{"a": 1}, -1)
+
+	if len(summed) != 1 || summed[0].subscriber != OtherSubscribers || summed[0].count != 1 {
+		t.Error("A negative limit should sum every subscriber : ", summed)
+	}
+}
@@ -1,8 +1,13 @@
 package app
 
 import (
+	"context"
 	"errors"
-	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mdevilliers/take-home/pkg/topic"
 )
@@ -11,189 +16,1086 @@ var (
 	UnknownTopic        = errors.New("Unknown topic")
 	UnknownUser         = errors.New("Unknown user")
 	NoMessagesAvailable = errors.New("No messages available for user")
+	TopicFull           = errors.New("Topic has a subscriber which cannot accept more messages")
+	PublishTimedOut     = errors.New("Timed out waiting for a subscriber to accept the message")
+	UnknownReceipt      = errors.New("Unknown or expired receipt")
+	UnknownScheduled    = errors.New("Unknown or already delivered scheduled message")
+	InvalidTopicName    = errors.New("Invalid topic name, levels are separated by ., + and # must be a whole level and # the last")
+	WildcardPublish     = errors.New("Messages can not be published to a wildcard topic")
+	ReservedUsername    = errors.New("Usernames starting with _ are reserved for the api")
+	ReservedTopicName   = errors.New("Topic names starting with _ are reserved for the api")
+	ServiceClosed       = errors.New("Service is closed")
 )
 
-// Service serializes access to topic registry, and topics
+// how long a leased message is hidden from a user before it is delivered again
+const DefaultVisibilityTimeout = 30 * time.Second
+
+// how often expired leases are looked for so dead letters can be moved
+const DefaultSweepInterval = time.Second
+
+// Settings for how a Service spreads requests over its workers
+type ServiceOptions struct {
+	// workers the topics are partitioned between by a hash of their name. DefaultShards if 0
+	Shards int
+	// requests each worker queues before callers wait for space. DefaultQueueSize if 0
+	QueueSize int
+}
+
+var (
+	DefaultShards    = runtime.NumCPU()
+	DefaultQueueSize = 256
+)
+
+// Service serializes access to the topics in a registry. Topics are partitioned between
+// shards by a hash of their name and each shard handles the requests for its topics in
+// the order they arrive, so requests to different topics are served in parallel.
+// A publish waiting on a full subscriber is set aside without stopping its shard. The
+// requests which read, take or acknowledge messages may be handled before it so the
+// subscriber can make space, while the other requests to its topic, such as publishes
+// and unsubscribes, wait behind it in the order they arrived.
+//
+// The ...Context variants of the methods give up waiting for a shard when their context
+// is done, returning the context's error
 type Service struct {
-	registry              topic.Registry
-	subscribeChannel      chan *request
-	unSubscribeChannel    chan *request
-	publishMessageChannel chan *request
-	getMessageChannel     chan *request
+	registry  topic.Registry
+	scheduler *topic.Scheduler
+	shards    []*shard
+
+	// held to register a caller so Close can wait for it
+	lock    sync.RWMutex
+	closed  bool
+	callers sync.WaitGroup
+	// closed to stop the sweeper
+	stopSweeping chan struct{}
+	// the shards' loops and the sweeper
+	workers sync.WaitGroup
 }
 
 // Returns a new Service instance
 func NewService() *Service {
+	return NewServiceWithRegistry(topic.NewTopicRegistry())
+}
+
+// Returns a new Service instance serving the topics in registry, holding scheduled messages in memory
+func NewServiceWithRegistry(registry topic.Registry) *Service {
+	return NewServiceWithScheduler(registry, topic.NewScheduler(registry))
+}
+
+// Returns a new Service instance serving the topics in registry with messages scheduled by scheduler
+func NewServiceWithScheduler(registry topic.Registry, scheduler *topic.Scheduler) *Service {
+	return NewServiceWithOptions(registry, scheduler, ServiceOptions{})
+}
+
+// Returns a new Service instance serving the topics in registry with messages scheduled by
+// scheduler, with requests spread over workers as options says
+func NewServiceWithOptions(registry topic.Registry, scheduler *topic.Scheduler, options ServiceOptions) *Service {
+
+	if options.Shards <= 0 {
+		options.Shards = DefaultShards
+	}
+
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+
 	service := &Service{
-		registry:              topic.NewTopicRegistry(),
-		subscribeChannel:      make(chan *request),
-		unSubscribeChannel:    make(chan *request),
-		publishMessageChannel: make(chan *request),
-		getMessageChannel:     make(chan *request),
+		registry:     registry,
+		scheduler:    scheduler,
+		shards:       make([]*shard, options.Shards),
+		stopSweeping: make(chan struct{}),
 	}
-	go service.loop()
+
+	for index := range service.shards {
+
+		sh := newShard(registry, index, options)
+		service.shards[index] = sh
+		service.workers.Add(1)
+
+		go func() {
+			defer service.workers.Done()
+			sh.loop()
+		}()
+	}
+
+	service.workers.Add(1)
+
+	go func() {
+		defer service.workers.Done()
+		service.sweep()
+	}()
 	return service
 }
 
+// Stops taking requests, waits for those already made to be answered then stops the shards
+// and the scheduler. Requests made once closed return ServiceClosed
+func (s *Service) Close() {
+
+	s.lock.Lock()
+
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+
+	s.closed = true
+	s.lock.Unlock()
+
+	s.callers.Wait()
+	close(s.stopSweeping)
+
+	for _, sh := range s.shards {
+		sh.stop()
+	}
+
+	s.workers.Wait()
+	s.scheduler.Stop()
+}
+
+// hands each shard the topics it owns every DefaultSweepInterval, so expired leases are found
+// and dead letters moved by the shard serving the topic, until the Service is closed
+func (s *Service) sweep() {
+
+	ticker := time.NewTicker(DefaultSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopSweeping:
+			return
+		case <-ticker.C:
+			s.sweepShards()
+		}
+	}
+}
+
+// lists the topics once and hands each shard those it owns. A shard still sweeping the
+// topics it was last handed skips this sweep rather than holding up the others
+func (s *Service) sweepShards() {
+
+	owned := make([][]*topic.Topic, len(s.shards))
+
+	for _, existingTopic := range s.registry.Topics() {
+		index := shardIndex(existingTopic.Name(), len(s.shards))
+		owned[index] = append(owned[index], existingTopic)
+	}
+
+	for index, sh := range s.shards {
+		select {
+		case sh.sweeps <- owned[index]:
+		default:
+		}
+	}
+}
+
+// registers a caller with the Service, false if it is closed. Each caller must call leave
+func (s *Service) enter() bool {
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.callers.Add(1)
+	return true
+}
+
+func (s *Service) leave() {
+	s.callers.Done()
+}
+
 type request struct {
+	operation       operation
 	topic           string
 	user            string
+	group           string
+	assignment      topic.Assignment
 	message         []byte
+	publish         PublishOptions
+	receipt         string
+	visibility      time.Duration
+	subscribe       SubscribeOptions
+	offset          int
+	limit           int
+	batch           []*BatchMessage
+	transaction     []*TransactionMessage
+	waitingSince    time.Time
+	context         context.Context
+	state           int32
 	responseChannel chan *response
 }
 
 type response struct {
-	err     error
-	message []byte
+	err         error
+	messageId   string
+	messageIds  []string
+	delivery    *Delivery
+	deadLetters []*DeadLetter
+	expiries    *Expiries
+	deliveries  []*Delivery
+	results     []*BatchResult
+	topicInfo   *TopicInfo
+	subscribers []*SubscriberInfo
+	count       int
+	available   <-chan struct{}
+}
+
+// Optional settings for a subscription
+type SubscribeOptions struct {
+	// the subscription is moved to the topic's retained messages from there if set
+	From *topic.Position
+	// the messages the subscription receives, every message if nil
+	Filter *topic.Filter
+}
+
+// Optional settings for a published message
+type PublishOptions struct {
+	Publisher string
+	Headers   map[string]string
+	// how long the message lives, the topic default if 0
+	TTL time.Duration
+	// the message is held until then if it is in the future
+	DeliverAt time.Time
+}
+
+// Messages which expired before being read
+type Expiries struct {
+	// counted once for each subscriber to the topic which missed them
+	Topic      uint64 `json:"topic"`
+	Subscriber uint64 `json:"subscriber"`
+}
+
+// A message published as part of a batch. Options.DeliverAt is ignored
+type BatchMessage struct {
+	Message []byte
+	Options PublishOptions
+}
+
+// The outcome of publishing one message of a batch
+type BatchResult struct {
+	// the id given to the message
+	Id string
+	// set if the message could not be pushed to every subscriber, such as PublishTimedOut
+	Err error
+}
+
+// A message published to a topic as part of a transaction. Options.DeliverAt is ignored
+type TransactionMessage struct {
+	Topic   string
+	Message []byte
+	Options PublishOptions
+}
+
+// A message waiting to be published
+type ScheduledMessage struct {
+	Id        string            `json:"id"`
+	Body      string            `json:"body"`
+	DeliverAt time.Time         `json:"deliver_at"`
+	Headers   map[string]string `json:"headers"`
+}
+
+// A message delivered to a user along with what was recorded when it was published.
+// A leased message is delivered again unless acknowledged using the Receipt
+type Delivery struct {
+	Message []byte
+	// the topic the message was published to, which a wildcard subscription matched
+	Topic     string
+	Id        string
+	Sequence  uint64
+	Timestamp time.Time
+	Publisher string
+	Headers   map[string]string
+	// only set for leased messages
+	Receipt string
+	// number of times the message was delivered to the user before this one
+	Redeliveries int
+}
+
+func newDelivery(message *topic.Message) *Delivery {
+	return &Delivery{
+		Message:   message.Bytes(),
+		Topic:     message.Topic(),
+		Id:        message.Id(),
+		Sequence:  message.Sequence(),
+		Timestamp: message.Timestamp(),
+		Publisher: message.Publisher(),
+		Headers:   message.Headers(),
+	}
+}
+
+// A message moved to a dead letter topic after too many deliveries.
+// Headers carry the original topic, subscriber and delivery count
+type DeadLetter struct {
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers"`
 }
 
-// subscribes a user to a topic
+// subscribes a user to a topic. See SubscribeWith
 func (s *Service) Subscribe(topic string, username string) error {
+	return s.SubscribeContext(context.Background(), topic, username)
+}
 
-	returnChannel := make(chan *response)
-	request := &request{
-		topic:           topic,
-		user:            username,
-		responseChannel: returnChannel,
+// as Subscribe, giving up when ctx is done
+func (s *Service) SubscribeContext(ctx context.Context, topic string, username string) error {
+	return s.SubscribeWithContext(ctx, topic, username, SubscribeOptions{})
+}
+
+// subscribes a user to a topic, or updates an existing subscription. The filter of the
+// subscription is replaced by that of the options
+func (s *Service) SubscribeWith(topic string, username string, options SubscribeOptions) error {
+	return s.SubscribeWithContext(context.Background(), topic, username, options)
+}
+
+// as SubscribeWith, giving up when ctx is done
+func (s *Service) SubscribeWithContext(ctx context.Context, topic string, username string, options SubscribeOptions) error {
+
+	if err := validateTopicName(topic); err != nil {
+		return err
 	}
 
-	go func() { s.subscribeChannel <- request }()
-	response := <-returnChannel
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+
+	response := s.do(ctx, &request{
+		operation: subscribeOperation,
+		topic:     topic,
+		user:      username,
+		subscribe: options,
+	})
 
 	return response.err
 }
 
 // deletes a user subscription from a topic
 func (s *Service) UnSubscribe(topic string, username string) error {
+	return s.UnSubscribeContext(context.Background(), topic, username)
+}
 
-	returnChannel := make(chan *response)
+// as UnSubscribe, giving up when ctx is done
+func (s *Service) UnSubscribeContext(ctx context.Context, topic string, username string) error {
 
-	request := &request{
-		topic:           topic,
-		user:            username,
-		responseChannel: returnChannel,
+	response := s.do(ctx, &request{
+		operation: unSubscribeOperation,
+		topic:     topic,
+		user:      username,
+	})
+
+	return response.err
+}
+
+// adds a user to a consumer group of a topic. Each message published to the topic is
+// delivered to one member of the group, which the member reads using the username
+// topic.GroupChannelName(group, username)
+func (s *Service) JoinGroup(topicName string, group string, username string, assignment topic.Assignment) error {
+	return s.JoinGroupContext(context.Background(), topicName, group, username, assignment)
+}
+
+// as JoinGroup, giving up when ctx is done
+func (s *Service) JoinGroupContext(ctx context.Context, topicName string, group string, username string, assignment topic.Assignment) error {
+
+	if err := validateTopicName(topicName); err != nil {
+		return err
 	}
 
-	go func() { s.unSubscribeChannel <- request }()
+	response := s.do(ctx, &request{
+		operation:  joinGroupOperation,
+		topic:      topicName,
+		group:      group,
+		user:       username,
+		assignment: assignment,
+	})
+	return response.err
+}
+
+// removes a user from a consumer group, sharing its messages between the remaining members
+func (s *Service) LeaveGroup(topic string, group string, username string) error {
+	return s.LeaveGroupContext(context.Background(), topic, group, username)
+}
 
-	response := <-returnChannel
+// as LeaveGroup, giving up when ctx is done
+func (s *Service) LeaveGroupContext(ctx context.Context, topic string, group string, username string) error {
 
+	response := s.do(ctx, &request{
+		operation: leaveGroupOperation,
+		topic:     topic,
+		group:     group,
+		user:      username,
+	})
 	return response.err
 }
 
 // allows publication of messages to an existing topic
 func (s *Service) PublishMessage(topic string, message []byte) error {
+	return s.PublishMessageContext(context.Background(), topic, message)
+}
+
+// as PublishMessage, giving up when ctx is done
+func (s *Service) PublishMessageContext(ctx context.Context, topic string, message []byte) error {
 
-	returnChannel := make(chan *response)
-	request := &request{
-		topic:           topic,
-		message:         message,
-		responseChannel: returnChannel,
+	_, err := s.PublishContext(ctx, topic, message, PublishOptions{})
+	return err
+}
+
+// publishes a message with options, returning the id it was given.
+// A message to be delivered in the future is held by the scheduler until then
+func (s *Service) Publish(topic string, message []byte, options PublishOptions) (string, error) {
+	return s.PublishContext(context.Background(), topic, message, options)
+}
+
+// as Publish, giving up when ctx is done
+func (s *Service) PublishContext(ctx context.Context, topic string, message []byte, options PublishOptions) (string, error) {
+
+	if err := validatePublishTopic(topic); err != nil {
+		return "", err
 	}
 
-	go func() { s.publishMessageChannel <- request }()
+	if options.DeliverAt.After(time.Now()) {
 
-	response := <-returnChannel
-	return response.err
+		if !s.enter() {
+			return "", ServiceClosed
+		}
+		defer s.leave()
+
+		scheduled, err := s.scheduler.Schedule(topic, newMessage(message, options), options.DeliverAt)
+
+		if err != nil {
+			return "", err
+		}
+		return scheduled.Id, nil
+	}
+
+	response := s.do(ctx, &request{
+		operation: publishOperation,
+		topic:     topic,
+		message:   message,
+		publish:   options,
+	})
+	return response.messageId, response.err
+}
+
+// lists the messages scheduled for a topic, earliest first.
+// The scheduler is safe for concurrent use so is not serialized with the other requests
+func (s *Service) ListScheduled(topic string) []*ScheduledMessage {
+
+	listed := make([]*ScheduledMessage, 0)
+
+	for _, scheduled := range s.scheduler.List(topic) {
+		listed = append(listed, &ScheduledMessage{
+			Id:        scheduled.Id,
+			Body:      scheduled.Message.String(),
+			DeliverAt: scheduled.DeliverAt,
+			Headers:   scheduled.Message.Headers(),
+		})
+	}
+	return listed
+}
+
+// cancels a scheduled message before it is published
+func (s *Service) CancelScheduled(topic string, id string) error {
+	return translateTopicError(s.scheduler.Cancel(topic, id))
 }
 
 // retrieves messages from an existing topic for a user
 func (s *Service) GetMessage(topic string, username string) ([]byte, error) {
+	return s.GetMessageContext(context.Background(), topic, username)
+}
+
+// as GetMessage, giving up when ctx is done
+func (s *Service) GetMessageContext(ctx context.Context, topic string, username string) ([]byte, error) {
 
-	returnChannel := make(chan *response)
-	request := &request{
-		topic:           topic,
-		user:            username,
-		responseChannel: returnChannel,
+	delivery, err := s.ReceiveContext(ctx, topic, username)
+
+	if err != nil {
+		return nil, err
 	}
+	return delivery.Message, nil
+}
+
+// retrieves the next message from an existing topic for a user along with its metadata
+func (s *Service) Receive(topic string, username string) (*Delivery, error) {
+	return s.ReceiveContext(context.Background(), topic, username)
+}
 
-	go func() { s.getMessageChannel <- request }()
+// as Receive, giving up when ctx is done
+func (s *Service) ReceiveContext(ctx context.Context, topic string, username string) (*Delivery, error) {
 
-	response := <-returnChannel
-	return response.message, response.err
+	response := s.do(ctx, &request{
+		operation: getMessageOperation,
+		topic:     topic,
+		user:      username,
+	})
+	return response.delivery, response.err
 }
 
-func (s *Service) loop() {
+// leases the next message from an existing topic for a user.
+// The message is delivered again if not acknowledged within visibility
+func (s *Service) LeaseMessage(topic string, username string, visibility time.Duration) (*Delivery, error) {
+	return s.LeaseMessageContext(context.Background(), topic, username, visibility)
+}
 
-	for {
-		select {
-		case subscribe := <-s.subscribeChannel:
+// as LeaseMessage, giving up when ctx is done
+func (s *Service) LeaseMessageContext(ctx context.Context, topic string, username string, visibility time.Duration) (*Delivery, error) {
 
-			log.Print("Message recieved on subscribeChannel")
+	response := s.do(ctx, &request{
+		operation:  leaseMessageOperation,
+		topic:      topic,
+		user:       username,
+		visibility: visibility,
+	})
+	return response.delivery, response.err
+}
 
-			topicToSubscribeTo := s.registry.Get(subscribe.topic)
-			topicToSubscribeTo.AddChannel(subscribe.user)
-			subscribe.responseChannel <- &response{err: nil}
+// acknowledges a leased message so it is not delivered again
+func (s *Service) Ack(topic string, username string, receipt string) error {
+	return s.AckContext(context.Background(), topic, username, receipt)
+}
 
-		case unSubscribe := <-s.unSubscribeChannel:
+// as Ack, giving up when ctx is done
+func (s *Service) AckContext(ctx context.Context, topic string, username string, receipt string) error {
 
-			log.Print("Message recieved on unSubscribeChannel")
+	response := s.do(ctx, &request{
+		operation: ackOperation,
+		topic:     topic,
+		user:      username,
+		receipt:   receipt,
+	})
+	return response.err
+}
 
-			exists := s.registry.Contains(unSubscribe.topic)
+// returns a leased message so it is delivered again straight away
+func (s *Service) Nack(topic string, username string, receipt string) error {
+	return s.NackContext(context.Background(), topic, username, receipt)
+}
 
-			if !exists {
-				unSubscribe.responseChannel <- &response{err: UnknownTopic}
-				break
-			}
+// as Nack, giving up when ctx is done
+func (s *Service) NackContext(ctx context.Context, topic string, username string, receipt string) error {
 
-			existingTopic := s.registry.Get(unSubscribe.topic)
-			err := existingTopic.RemoveChannel(unSubscribe.user)
+	response := s.do(ctx, &request{
+		operation: nackOperation,
+		topic:     topic,
+		user:      username,
+		receipt:   receipt,
+	})
+	return response.err
+}
 
-			if err != nil {
-				if err == topic.ChannelNotFoundError {
-					unSubscribe.responseChannel <- &response{err: UnknownUser}
-					break
-				}
+// returns a leased message which was never handed to the user so it is delivered again
+// straight away, without counting as a redelivery
+func (s *Service) Requeue(topic string, username string, receipt string) error {
+	return s.RequeueContext(context.Background(), topic, username, receipt)
+}
 
-				// unexpected error
-				unSubscribe.responseChannel <- &response{err: err}
-				break
-			}
+// as Requeue, giving up when ctx is done
+func (s *Service) RequeueContext(ctx context.Context, topic string, username string, receipt string) error {
 
-			unSubscribe.responseChannel <- &response{err: nil}
+	response := s.do(ctx, &request{
+		operation: requeueOperation,
+		topic:     topic,
+		user:      username,
+		receipt:   receipt,
+	})
+	return response.err
+}
 
-		case getMessage := <-s.getMessageChannel:
+// lists the dead letters of a user's subscription to a topic
+func (s *Service) DeadLetters(topic string, username string) ([]*DeadLetter, error) {
+	return s.DeadLettersContext(context.Background(), topic, username)
+}
 
-			log.Print("Message recieved on getMessageChannel")
+// as DeadLetters, giving up when ctx is done
+func (s *Service) DeadLettersContext(ctx context.Context, topic string, username string) ([]*DeadLetter, error) {
 
-			exists := s.registry.Contains(getMessage.topic)
+	response := s.do(ctx, &request{
+		operation: deadLettersOperation,
+		topic:     topic,
+		user:      username,
+	})
+	return response.deadLetters, response.err
+}
 
-			if !exists {
-				getMessage.responseChannel <- &response{err: UnknownTopic}
-				break
-			}
+// moves the dead letters of a user's subscription back to the subscription,
+// returning how many were moved
+func (s *Service) ReplayDeadLetters(topic string, username string) (int, error) {
+	return s.ReplayDeadLettersContext(context.Background(), topic, username)
+}
 
-			topicToReadFrom := s.registry.Get(getMessage.topic)
-			message, err := topicToReadFrom.GetNextMessage(getMessage.user)
+// as ReplayDeadLetters, giving up when ctx is done
+func (s *Service) ReplayDeadLettersContext(ctx context.Context, topic string, username string) (int, error) {
 
-			if err != nil {
+	response := s.do(ctx, &request{
+		operation: replayOperation,
+		topic:     topic,
+		user:      username,
+	})
+	return response.count, response.err
+}
 
-				if err == topic.ChannelNotFoundError {
-					getMessage.responseChannel <- &response{err: UnknownUser}
-					break
-				}
+// deletes the dead letters of a user's subscription, returning how many were deleted
+func (s *Service) PurgeDeadLetters(topic string, username string) (int, error) {
+	return s.PurgeDeadLettersContext(context.Background(), topic, username)
+}
 
-				if err == topic.NoMessagesAvailable {
-					getMessage.responseChannel <- &response{err: NoMessagesAvailable}
-					break
-				}
+// as PurgeDeadLetters, giving up when ctx is done
+func (s *Service) PurgeDeadLettersContext(ctx context.Context, topic string, username string) (int, error) {
 
-				// unexpected error
-				getMessage.responseChannel <- &response{err: err}
-				break
-			}
+	response := s.do(ctx, &request{
+		operation: purgeOperation,
+		topic:     topic,
+		user:      username,
+	})
+	return response.count, response.err
+}
+
+// publishes messages to a topic in order with nothing else published in between. If a
+// subscriber does not have space for them nothing is published and TopicFull is returned, or
+// PublishTimedOut if it blocks and did not make space for all of them before its timeout.
+// Otherwise the outcome of each message is returned in the same order
+func (s *Service) PublishBatch(topic string, messages []*BatchMessage) ([]*BatchResult, error) {
+	return s.PublishBatchContext(context.Background(), topic, messages)
+}
 
-			getMessage.responseChannel <- &response{err: nil, message: message.Bytes()}
+// as PublishBatch, giving up when ctx is done
+func (s *Service) PublishBatchContext(ctx context.Context, topic string, messages []*BatchMessage) ([]*BatchResult, error) {
+
+	if err := validatePublishTopic(topic); err != nil {
+		return nil, err
+	}
 
-		case publishMessage := <-s.publishMessageChannel:
+	response := s.do(ctx, &request{
+		operation: publishBatchOperation,
+		topic:     topic,
+		batch:     messages,
+	})
+	return response.results, response.err
+}
 
-			log.Print("Message recieved on publishMessageChannel")
+// publishes messages to several topics so every subscriber receives all of those meant for it
+// or none of them, returning their ids in order. Every topic must already exist, otherwise
+// UnknownTopic is returned, and TopicFull is returned if a subscriber does not have space for
+// its messages whatever the overflow policy. Nothing is published if an error is returned.
+// The topics are locked while the messages are pushed so no subscriber receives one of them
+// before all of them are pushed. The transaction is queued with the shard of the first topic so
+// keeps its order with the requests to that topic. A publish to another of its topics, which
+// may belong to another shard, is handled before or after the whole transaction in either order
+func (s *Service) PublishTransaction(messages []*TransactionMessage) ([]string, error) {
+	return s.PublishTransactionContext(context.Background(), messages)
+}
 
-			topicToPostTo := s.registry.Get(publishMessage.topic)
-			topicToPostTo.PublishMessage(topic.NewMessage(publishMessage.message))
+// as PublishTransaction, giving up when ctx is done
+func (s *Service) PublishTransactionContext(ctx context.Context, messages []*TransactionMessage) ([]string, error) {
 
-			publishMessage.responseChannel <- &response{err: nil}
+	if len(messages) == 0 {
+		return []string{}, nil
+	}
 
+	for _, message := range messages {
+		if err := validatePublishTopic(message.Topic); err != nil {
+			return nil, err
 		}
 	}
+
+	response := s.do(ctx, &request{
+		operation:   publishTransactionOperation,
+		topic:       messages[0].Topic,
+		transaction: messages,
+	})
+	return response.messageIds, response.err
+}
+
+// removes and returns up to max of the messages waiting for a user, oldest first.
+// Returns NoMessagesAvailable if none are waiting
+func (s *Service) ReceiveBatch(topic string, username string, max int) ([]*Delivery, error) {
+	return s.ReceiveBatchContext(context.Background(), topic, username, max)
+}
+
+// as ReceiveBatch, giving up when ctx is done
+func (s *Service) ReceiveBatchContext(ctx context.Context, topic string, username string, max int) ([]*Delivery, error) {
+
+	response := s.do(ctx, &request{
+		operation: receiveBatchOperation,
+		topic:     topic,
+		user:      username,
+		limit:     max,
+	})
+	return response.deliveries, response.err
+}
+
+// leases up to max of the messages waiting for a user as LeaseMessage does.
+// Returns NoMessagesAvailable if none are waiting
+func (s *Service) LeaseBatch(topic string, username string, max int, visibility time.Duration) ([]*Delivery, error) {
+	return s.LeaseBatchContext(context.Background(), topic, username, max, visibility)
+}
+
+// as LeaseBatch, giving up when ctx is done
+func (s *Service) LeaseBatchContext(ctx context.Context, topic string, username string, max int, visibility time.Duration) ([]*Delivery, error) {
+
+	response := s.do(ctx, &request{
+		operation:  leaseBatchOperation,
+		topic:      topic,
+		user:       username,
+		limit:      max,
+		visibility: visibility,
+	})
+	return response.deliveries, response.err
+}
+
+// returns the next message for a user without removing it.
+// Returns NoMessagesAvailable if none are waiting
+func (s *Service) Peek(topic string, username string) (*Delivery, error) {
+	return s.PeekContext(context.Background(), topic, username)
+}
+
+// as Peek, giving up when ctx is done
+func (s *Service) PeekContext(ctx context.Context, topic string, username string) (*Delivery, error) {
+
+	deliveries, err := s.BrowseContext(ctx, topic, username, 0, 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(deliveries) == 0 {
+		return nil, NoMessagesAvailable
+	}
+	return deliveries[0], nil
+}
+
+// returns at most limit of the messages waiting for a user, starting offset messages from the
+// next one, without removing them. Leased messages are not included until they are redelivered
+func (s *Service) Browse(topic string, username string, offset int, limit int) ([]*Delivery, error) {
+	return s.BrowseContext(context.Background(), topic, username, offset, limit)
+}
+
+// as Browse, giving up when ctx is done
+func (s *Service) BrowseContext(ctx context.Context, topic string, username string, offset int, limit int) ([]*Delivery, error) {
+
+	response := s.do(ctx, &request{
+		operation: browseOperation,
+		topic:     topic,
+		user:      username,
+		offset:    offset,
+		limit:     limit,
+	})
+	return response.deliveries, response.err
+}
+
+// counts the messages on a topic which expired before a user read them
+func (s *Service) Expired(topic string, username string) (*Expiries, error) {
+	return s.ExpiredContext(context.Background(), topic, username)
+}
+
+// as Expired, giving up when ctx is done
+func (s *Service) ExpiredContext(ctx context.Context, topic string, username string) (*Expiries, error) {
+
+	response := s.do(ctx, &request{
+		operation: expiredOperation,
+		topic:     topic,
+		user:      username,
+	})
+	return response.expiries, response.err
+}
+
+// returns a channel which is closed when a message may have become available for a user.
+// Take it before asking for a message so one arriving in between is not missed
+func (s *Service) Available(topic string, username string) (<-chan struct{}, error) {
+	return s.AvailableContext(context.Background(), topic, username)
+}
+
+// as Available, giving up when ctx is done
+func (s *Service) AvailableContext(ctx context.Context, topic string, username string) (<-chan struct{}, error) {
+
+	response := s.do(ctx, &request{
+		operation: availableOperation,
+		topic:     topic,
+		user:      username,
+	})
+	return response.available, response.err
+}
+
+// The requests waiting in a shard's queue, and those set aside behind a publish waiting for space
+type QueueDepth struct {
+	Shard    int
+	Requests int
+	Waiting  int
+}
+
+// returns what has happened to the messages of every topic, ordered by topic name.
+// Topics are safe for concurrent use so this is not serialized with the other requests
+func (s *Service) TopicStats() []topic.Stats {
+
+	topics := s.registry.Topics()
+	stats := make([]topic.Stats, 0, len(topics))
+
+	for _, existingTopic := range topics {
+		stats = append(stats, existingTopic.Stats())
+	}
+	return stats
+}
+
+// returns how many requests are waiting for each shard
+func (s *Service) QueueDepths() []QueueDepth {
+
+	depths := make([]QueueDepth, 0, len(s.shards))
+
+	for _, sh := range s.shards {
+		depths = append(depths, QueueDepth{Shard: sh.index, Requests: len(sh.requests), Waiting: int(atomic.LoadInt64(&sh.waitingCount))})
+	}
+	return depths
+}
+
+// A topic as described by the admin API
+type TopicInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// subscribers and consumer group members
+	Subscribers int `json:"subscribers"`
+	// messages waiting for every subscriber
+	Backlog int `json:"backlog"`
+	// seconds since the oldest message waiting for any subscriber was published, 0 if none are waiting
+	OldestMessageAge float64 `json:"oldest_message_age"`
+}
+
+// A subscriber to a topic as described by the admin API
+type SubscriberInfo struct {
+	// the username, or topic.GroupChannelName for a consumer group member
+	Name       string    `json:"name"`
+	Group      string    `json:"group,omitempty"`
+	Subscribed time.Time `json:"subscribed"`
+	Backlog    int       `json:"backlog"`
+	// seconds since the oldest message waiting was published, 0 if none are waiting
+	OldestMessageAge float64 `json:"oldest_message_age"`
+}
+
+// returns up to limit topics whose names start with prefix and come after the name after,
+// ordered by name, and whether there are more. Topics are read without waiting for their shards
+func (s *Service) ListTopics(prefix string, after string, limit int) ([]*TopicInfo, bool) {
+
+	topics := s.registry.List(prefix)
+	list := make([]*TopicInfo, 0, limit)
+	now := time.Now()
+
+	for _, existingTopic := range topics {
+
+		if existingTopic.Name() <= after {
+			continue
+		}
+
+		if len(list) == limit {
+			return list, true
+		}
+
+		info, _ := describeTopic(existingTopic, now)
+		list = append(list, info)
+	}
+	return list, false
+}
+
+// describes a topic and its subscribers, ordered by name
+func (s *Service) DescribeTopic(topic string) (*TopicInfo, []*SubscriberInfo, error) {
+	return s.DescribeTopicContext(context.Background(), topic)
+}
+
+// as DescribeTopic, giving up when ctx is done
+func (s *Service) DescribeTopicContext(ctx context.Context, topic string) (*TopicInfo, []*SubscriberInfo, error) {
+
+	response := s.do(ctx, &request{
+		operation: describeOperation,
+		topic:     topic,
+	})
+	return response.topicInfo, response.subscribers, response.err
+}
+
+// deletes a topic along with its subscribers and their messages
+func (s *Service) DeleteTopic(topic string) error {
+	return s.DeleteTopicContext(context.Background(), topic)
+}
+
+// as DeleteTopic, giving up when ctx is done
+func (s *Service) DeleteTopicContext(ctx context.Context, topic string) error {
+
+	response := s.do(ctx, &request{
+		operation: deleteTopicOperation,
+		topic:     topic,
+	})
+	return response.err
+}
+
+func describeTopic(existingTopic *topic.Topic, now time.Time) (*TopicInfo, []*SubscriberInfo) {
+
+	channels := existingTopic.Channels()
+	info := &TopicInfo{Name: existingTopic.Name(), Created: existingTopic.Created(), Subscribers: len(channels)}
+	subscribers := make([]*SubscriberInfo, 0, len(channels))
+
+	for _, channel := range channels {
+
+		subscriber := &SubscriberInfo{
+			Name:       channel.Name,
+			Group:      channel.Group,
+			Subscribed: channel.Subscribed,
+			Backlog:    channel.Backlog,
+		}
+
+		if !channel.Oldest.IsZero() {
+			subscriber.OldestMessageAge = now.Sub(channel.Oldest).Seconds()
+		}
+
+		info.Backlog += subscriber.Backlog
+
+		if subscriber.OldestMessageAge > info.OldestMessageAge {
+			info.OldestMessageAge = subscriber.OldestMessageAge
+		}
+		subscribers = append(subscribers, subscriber)
+	}
+	return info, subscribers
+}
+
+// maps errors from the topic package onto those returned by the Service
+func translateTopicError(err error) error {
+	switch err {
+	case topic.UnknownTopic:
+		return UnknownTopic
+	case topic.ChannelNotFoundError:
+		return UnknownUser
+	case topic.NoMessagesAvailable:
+		return NoMessagesAvailable
+	case topic.UnknownReceipt:
+		return UnknownReceipt
+	case topic.ChannelFull:
+		return TopicFull
+	case topic.PublishTimeout:
+		return PublishTimedOut
+	case topic.UnknownScheduledMessage:
+		return UnknownScheduled
+	case topic.InvalidTopicName:
+		return InvalidTopicName
+	case topic.PublishToWildcard:
+		return WildcardPublish
+	}
+	return err
+}
+
+// the routes of the api which are not those of a topic or a subscriber start with this,
+// so no topic or username can
+const reservedPrefix = "_"
+
+// a topic name is one segment of a URL, so only . separates its levels
+func validateTopicName(topicName string) error {
+
+	if strings.HasPrefix(topicName, reservedPrefix) {
+		return ReservedTopicName
+	}
+
+	if strings.Contains(topicName, "/") {
+		return InvalidTopicName
+	}
+	return translateTopicError(topic.ValidateTopicName(topicName))
+}
+
+func validateUsername(username string) error {
+
+	if strings.HasPrefix(username, reservedPrefix) {
+		return ReservedUsername
+	}
+	return nil
+}
+
+// a message can not be published to a wildcard topic, only to the topics it matches
+func validatePublishTopic(topicName string) error {
+
+	if err := validateTopicName(topicName); err != nil {
+		return err
+	}
+
+	if topic.IsWildcard(topicName) {
+		return WildcardPublish
+	}
+	return nil
+}
+
+func newMessage(content []byte, options PublishOptions) *topic.Message {
+	return topic.NewMessage(content).
+		WithPublisher(options.Publisher).
+		WithHeaders(options.Headers).
+		WithTTL(options.TTL)
+}
+
+// queues a request with the shard owning its topic and waits for the response.
+// Waits for space while the shard's queue is full
+func (s *Service) do(ctx context.Context, request *request) *response {
+
+	if !s.enter() {
+		return &response{err: ServiceClosed}
+	}
+	defer s.leave()
+
+	return send(ctx, request, s.shardFor(request.topic).requests)
+}
+
+// queues a request and waits for the response, giving up with ctx's error if ctx is done
+// first. A request the shard has started handling is waited for so its outcome, such as a
+// message taken from the topic, is not lost
+func send(ctx context.Context, request *request, queue chan<- *request) *response {
+
+	request.context = ctx
+	request.responseChannel = make(chan *response, 1)
+
+	select {
+	case queue <- request:
+	case <-ctx.Done():
+		return &response{err: ctx.Err()}
+	}
+
+	select {
+	case response := <-request.responseChannel:
+		return response
+	case <-ctx.Done():
+		if request.abandon() {
+			return &response{err: ctx.Err()}
+		}
+		return <-request.responseChannel
+	}
+}
+
+const (
+	requestQueued int32 = iota
+	requestHandling
+	requestAbandoned
+)
+
+// marks a request as being handled, returning an error if its caller has given up on it
+func (r *request) claim() error {
+
+	if err := r.context.Err(); err != nil {
+		return err
+	}
+
+	if !atomic.CompareAndSwapInt32(&r.state, requestQueued, requestHandling) {
+		return r.context.Err()
+	}
+	return nil
+}
+
+// marks a request as given up on by its caller, returning false if it is already being handled
+func (r *request) abandon() bool {
+	return atomic.CompareAndSwapInt32(&r.state, requestQueued, requestAbandoned)
+}
+
+// marks a claimed request as queued again, so its caller may give up on it while it waits
+func (r *request) release() {
+	atomic.StoreInt32(&r.state, requestQueued)
+}
+
+// when a publish was first tried, from which it waits for space
+func (r *request) firstTried() time.Time {
+
+	if r.waitingSince.IsZero() {
+		r.waitingSince = time.Now()
+	}
+	return r.waitingSince
+}
+
+func (s *Service) shardFor(topicName string) *shard {
+	return s.shards[shardIndex(topicName, len(s.shards))]
 }
@@ -2,6 +2,9 @@ package app
 
 import (
 	"testing"
+	"time"
+
+	"github.com/mdevilliers/take-home/pkg/topic"
 )
 
 // Path 1
@@ -89,3 +92,55 @@ func TestPath4(t *testing.T) {
 		t.Error("UnSubscribe unsuccessful : ", err.Error())
 	}
 }
+
+// Path5
+// 'topic-one' moves messages to 'topic-one.dlq' after 1 delivery
+// 'user-1' subscribes to 'topic-one'
+// 'message-one' published to 'topic-one'
+// 'user-1' leases and nacks 'message-one'
+// 'message-one' is a dead letter which can be replayed to 'user-1'
+func TestPath5(t *testing.T) {
+
+	registry := topic.NewTopicRegistryWithOptions(nil, func(string) topic.TopicOptions {
+		return topic.TopicOptions{MaxDeliveries: 1}
+	})
+
+	service := NewServiceWithRegistry(registry)
+	service.Subscribe("topic-one", "user-1")
+	service.PublishMessage("topic-one", []byte("message-one"))
+
+	delivery, _ := service.LeaseMessage("topic-one", "user-1", time.Minute)
+	service.Nack("topic-one", "user-1", delivery.Receipt)
+
+	if _, err := service.GetMessage("topic-one", "user-1"); err != NoMessagesAvailable {
+		t.Error("A dead lettered message should not be delivered.")
+	}
+
+	deadLetters, err := service.DeadLetters("topic-one", "user-1")
+
+	if err != nil || len(deadLetters) != 1 || deadLetters[0].Body != "message-one" {
+		t.Fatal("message-one should be a dead letter.")
+	}
+
+	if deadLetters[0].Headers[topic.DeliveryCountHeader] != "1" {
+		t.Error("The dead letter should record its delivery count.")
+	}
+
+	count, err := service.ReplayDeadLetters("topic-one", "user-1")
+
+	if err != nil || count != 1 {
+		t.Error("One dead letter should have been replayed.")
+	}
+
+	message, err := service.GetMessage("topic-one", "user-1")
+
+	if err != nil || string(message) != "message-one" {
+		t.Error("A replayed message should be delivered to user-1.")
+	}
+
+	count, _ = service.PurgeDeadLetters("topic-one", "user-1")
+
+	if count != 0 {
+		t.Error("There should be no dead letters left to purge.")
+	}
+}
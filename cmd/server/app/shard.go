@@ -0,0 +1,581 @@
+package app
+
+import (
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdevilliers/take-home/pkg/topic"
+)
+
+// what a request asks a shard to do
+type operation int
+
+const (
+	subscribeOperation operation = iota
+	unSubscribeOperation
+	joinGroupOperation
+	leaveGroupOperation
+	getMessageOperation
+	leaseMessageOperation
+	ackOperation
+	nackOperation
+	requeueOperation
+	deadLettersOperation
+	replayOperation
+	purgeOperation
+	availableOperation
+	expiredOperation
+	describeOperation
+	deleteTopicOperation
+	browseOperation
+	publishBatchOperation
+	receiveBatchOperation
+	leaseBatchOperation
+	publishTransactionOperation
+	publishOperation
+)
+
+var operationNames = map[operation]string{
+	subscribeOperation:          "subscribe",
+	unSubscribeOperation:        "unsubscribe",
+	joinGroupOperation:          "join group",
+	leaveGroupOperation:         "leave group",
+	getMessageOperation:         "get message",
+	leaseMessageOperation:       "lease message",
+	ackOperation:                "ack",
+	nackOperation:               "nack",
+	requeueOperation:            "requeue",
+	deadLettersOperation:        "dead letters",
+	replayOperation:             "replay",
+	purgeOperation:              "purge",
+	availableOperation:          "available",
+	expiredOperation:            "expired",
+	describeOperation:           "describe",
+	deleteTopicOperation:        "delete topic",
+	browseOperation:             "browse",
+	publishBatchOperation:       "publish batch",
+	receiveBatchOperation:       "receive batch",
+	leaseBatchOperation:         "lease batch",
+	publishTransactionOperation: "publish transaction",
+	publishOperation:            "publish",
+}
+
+func (o operation) String() string {
+	return operationNames[o]
+}
+
+// whether a request only reads, takes or acknowledges messages, so may be handled before
+// the requests for its topic waiting behind a publish. These are how a subscriber makes space
+func (o operation) overtakes() bool {
+
+	switch o {
+	case getMessageOperation, leaseMessageOperation, receiveBatchOperation, leaseBatchOperation,
+		ackOperation, nackOperation, requeueOperation, availableOperation, browseOperation,
+		describeOperation, expiredOperation, deadLettersOperation:
+		return true
+	}
+	return false
+}
+
+// how often publishes waiting for a subscriber to make space are tried again
+var PublishRetryInterval = 10 * time.Millisecond
+
+// A worker owning a partition of the topics. Requests for its topics are handled one at a
+// time in the order they were queued. A publish which must wait for space is set aside with
+// the requests for its topic queued after it, except those which overtake it, until it is
+// published or times out
+type shard struct {
+	registry topic.Registry
+	index    int
+	requests chan *request
+	// the topics the shard owns, handed over by the Service's sweeper to be swept
+	sweeps chan []*topic.Topic
+	// the requests for a topic queued behind a publish waiting for space, oldest first.
+	// only used from the loop
+	waiting map[string][]*request
+	// how many requests are in waiting
+	waitingCount int64
+}
+
+func newShard(registry topic.Registry, index int, options ServiceOptions) *shard {
+	return &shard{
+		registry: registry,
+		index:    index,
+		requests: make(chan *request, options.QueueSize),
+		sweeps:   make(chan []*topic.Topic, 1),
+		waiting:  map[string][]*request{},
+	}
+}
+
+// the shard owning a topic. A dead letter topic belongs to the same shard as its topic
+// so dead letters are moved and replayed by the shard serving the subscriber
+func shardIndex(topicName string, shards int) int {
+
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.TrimSuffix(topicName, topic.DeadLetterSuffix)))
+	return int(hash.Sum32() % uint32(shards))
+}
+
+func (sh *shard) loop() {
+
+	// only set while publishes are waiting
+	var retry <-chan time.Time
+
+	for {
+		if retry == nil && len(sh.waiting) > 0 {
+			retry = time.After(PublishRetryInterval)
+		}
+
+		select {
+		case request, open := <-sh.requests:
+
+			if !open {
+				return
+			}
+
+			log.Print("Request recieved on shard ", sh.index, " : ", request.operation)
+			sh.dispatch(request)
+
+		case <-retry:
+
+			retry = nil
+
+			for topicName := range sh.waiting {
+				sh.resume(topicName)
+			}
+
+		case topics := <-sh.sweeps:
+
+			for _, topicToSweep := range topics {
+				topicToSweep.Sweep()
+				sh.moveDeadLetters(topicToSweep)
+			}
+		}
+	}
+}
+
+// ends the loop once the requests already queued are handled.
+// Only to be called once nothing more will be queued
+func (sh *shard) stop() {
+	close(sh.requests)
+}
+
+// handles a request, unless it must wait behind a publish to its topic which is waiting for space
+func (sh *shard) dispatch(incoming *request) {
+
+	if queued, waiting := sh.waiting[incoming.topic]; waiting && !incoming.operation.overtakes() {
+		sh.waiting[incoming.topic] = append(queued, incoming)
+		atomic.AddInt64(&sh.waitingCount, 1)
+		return
+	}
+
+	if !sh.answer(incoming) {
+		sh.waiting[incoming.topic] = []*request{incoming}
+		atomic.AddInt64(&sh.waitingCount, 1)
+		return
+	}
+
+	// the subscriber may have made space for the publish
+	if incoming.operation.overtakes() {
+		sh.resume(incoming.topic)
+	}
+}
+
+// handles the requests waiting for a topic in order until a publish must wait again
+func (sh *shard) resume(topicName string) {
+
+	queued := sh.waiting[topicName]
+
+	for len(queued) > 0 {
+
+		if !sh.answer(queued[0]) {
+			sh.waiting[topicName] = queued
+			return
+		}
+
+		queued = queued[1:]
+		atomic.AddInt64(&sh.waitingCount, -1)
+	}
+	delete(sh.waiting, topicName)
+}
+
+// handles a request and sends its response, false if it is a publish which must wait for space.
+// The caller may give up on a waiting publish as it is not being handled
+func (sh *shard) answer(request *request) bool {
+
+	if err := request.claim(); err != nil {
+		request.responseChannel <- &response{err: err}
+		return true
+	}
+
+	result := sh.handle(request)
+
+	if result == nil {
+		request.release()
+		return false
+	}
+
+	request.responseChannel <- result
+	return true
+}
+
+// the response to a request, nil if it is a publish which must wait for space
+func (sh *shard) handle(request *request) *response {
+
+	switch request.operation {
+	case publishOperation:
+
+		message := newMessage(request.message, request.publish)
+		published, err := sh.registry.Get(request.topic).TryPublish(message, request.firstTried())
+
+		if err == topic.WouldBlock {
+			return nil
+		}
+
+		result := &response{err: translateTopicError(err)}
+
+		if published != nil {
+			result.messageId = published.Id()
+		}
+		return result
+
+	case publishBatchOperation:
+		return publishBatch(sh.registry.Get(request.topic), request.batch, request.firstTried())
+
+	case publishTransactionOperation:
+		return publishTransaction(sh.registry, request.transaction)
+
+	case subscribeOperation:
+
+		topicToSubscribeTo := sh.registry.Get(request.topic)
+		err := topicToSubscribeTo.AddChannel(request.user)
+
+		if err == nil {
+			err = topicToSubscribeTo.SetFilter(request.user, request.subscribe.Filter)
+		}
+
+		if err == nil && request.subscribe.From != nil {
+			err = topicToSubscribeTo.Seek(request.user, *request.subscribe.From)
+		}
+		return &response{err: err}
+
+	case joinGroupOperation:
+
+		topicToJoin := sh.registry.Get(request.topic)
+		err := topicToJoin.JoinGroup(request.group, request.user, request.assignment)
+		return &response{err: err}
+	}
+
+	// the remaining operations need the topic to exist
+	if !sh.registry.Contains(request.topic) {
+		return &response{err: UnknownTopic}
+	}
+
+	existingTopic := sh.registry.Get(request.topic)
+
+	switch request.operation {
+	case leaveGroupOperation:
+
+		err := existingTopic.LeaveGroup(request.group, request.user)
+		return &response{err: translateTopicError(err)}
+
+	case unSubscribeOperation:
+
+		err := existingTopic.RemoveChannel(request.user)
+		return &response{err: translateTopicError(err)}
+
+	case getMessageOperation:
+
+		delivery, err := receive(existingTopic, request.user)
+		sh.moveDeadLetters(existingTopic)
+
+		return &response{delivery: delivery, err: err}
+
+	case leaseMessageOperation:
+
+		delivery, err := lease(existingTopic, request.user, request.visibility)
+		sh.moveDeadLetters(existingTopic)
+
+		return &response{delivery: delivery, err: err}
+
+	case receiveBatchOperation, leaseBatchOperation:
+
+		deliveries := make([]*Delivery, 0, request.limit)
+		var err error
+
+		for len(deliveries) < request.limit {
+
+			var delivery *Delivery
+
+			if request.operation == leaseBatchOperation {
+				delivery, err = lease(existingTopic, request.user, request.visibility)
+			} else {
+				delivery, err = receive(existingTopic, request.user)
+			}
+
+			if err != nil {
+				break
+			}
+			deliveries = append(deliveries, delivery)
+		}
+
+		sh.moveDeadLetters(existingTopic)
+
+		// the messages already taken are returned rather than lost
+		if len(deliveries) > 0 {
+			return &response{deliveries: deliveries}
+		}
+		return &response{err: err}
+
+	case ackOperation:
+
+		err := existingTopic.Ack(request.user, request.receipt)
+		return &response{err: translateTopicError(err)}
+
+	case nackOperation:
+
+		err := existingTopic.Nack(request.user, request.receipt)
+		sh.moveDeadLetters(existingTopic)
+		return &response{err: translateTopicError(err)}
+
+	case requeueOperation:
+
+		err := existingTopic.Requeue(request.user, request.receipt)
+		return &response{err: translateTopicError(err)}
+
+	case deadLettersOperation:
+
+		messages, err := sh.pendingDeadLetters(request.topic, request.user)
+
+		if err != nil {
+			return &response{err: err}
+		}
+
+		list := make([]*DeadLetter, 0, len(messages))
+
+		for _, message := range messages {
+			list = append(list, &DeadLetter{Body: message.String(), Headers: message.Headers()})
+		}
+		return &response{deadLetters: list}
+
+	case replayOperation:
+
+		count, err := sh.replayDeadLetters(request.topic, request.user)
+		return &response{err: err, count: count}
+
+	case purgeOperation:
+
+		messages, err := sh.pendingDeadLetters(request.topic, request.user)
+
+		if err != nil {
+			return &response{err: err}
+		}
+
+		if len(messages) > 0 {
+			sh.registry.Get(topic.DeadLetterTopicName(request.topic)).RemoveChannel(request.user)
+		}
+		return &response{count: len(messages)}
+
+	case availableOperation:
+
+		if !existingTopic.ChannelExists(request.user) {
+			return &response{err: UnknownUser}
+		}
+		return &response{available: existingTopic.Available()}
+
+	case browseOperation:
+
+		messages, err := existingTopic.Browse(request.user, request.offset, request.limit)
+
+		if err != nil {
+			return &response{err: translateTopicError(err)}
+		}
+
+		deliveries := make([]*Delivery, 0, len(messages))
+
+		for _, message := range messages {
+			deliveries = append(deliveries, newDelivery(message))
+		}
+		return &response{deliveries: deliveries}
+
+	case describeOperation:
+
+		info, subscribers := describeTopic(existingTopic, time.Now())
+		return &response{topicInfo: info, subscribers: subscribers}
+
+	case deleteTopicOperation:
+
+		err := sh.registry.Delete(request.topic)
+		return &response{err: translateTopicError(err)}
+
+	case expiredOperation:
+
+		count, err := existingTopic.ExpiredFor(request.user)
+
+		if err != nil {
+			return &response{err: translateTopicError(err)}
+		}
+		return &response{expiries: &Expiries{Topic: existingTopic.Expired(), Subscriber: count}}
+	}
+
+	log.Print("Unknown operation : ", int(request.operation))
+	return &response{}
+}
+
+// nil if a subscriber must make space for the batch first
+func publishBatch(topicToPostTo *topic.Topic, batch []*BatchMessage, since time.Time) *response {
+
+	messages := make([]*topic.Message, 0, len(batch))
+
+	for _, item := range batch {
+		messages = append(messages, newMessage(item.Message, item.Options))
+	}
+
+	published, errs, err := topicToPostTo.TryPublishBatch(messages, since)
+
+	if err == topic.WouldBlock {
+		return nil
+	}
+
+	if err != nil {
+		return &response{err: translateTopicError(err)}
+	}
+
+	results := make([]*BatchResult, 0, len(published))
+
+	for index, message := range published {
+		results = append(results, &BatchResult{Id: message.Id(), Err: translateTopicError(errs[index])})
+	}
+	return &response{results: results}
+}
+
+func publishTransaction(registry topic.Registry, transaction []*TransactionMessage) *response {
+
+	messages := make([]*topic.TransactionMessage, 0, len(transaction))
+
+	for _, item := range transaction {
+		messages = append(messages, &topic.TransactionMessage{Topic: item.Topic, Message: newMessage(item.Message, item.Options)})
+	}
+
+	published, err := topic.PublishTransaction(registry, messages)
+
+	if err != nil {
+		return &response{err: translateTopicError(err)}
+	}
+
+	ids := make([]string, 0, len(published))
+
+	for _, message := range published {
+		ids = append(ids, message.Id())
+	}
+	return &response{messageIds: ids}
+}
+
+// removes the next message for a user
+func receive(existingTopic *topic.Topic, username string) (*Delivery, error) {
+
+	message, err := existingTopic.GetNextMessage(username)
+
+	if err != nil {
+		return nil, translateTopicError(err)
+	}
+	return newDelivery(message), nil
+}
+
+// leases the next message for a user
+func lease(existingTopic *topic.Topic, username string, visibility time.Duration) (*Delivery, error) {
+
+	leased, err := existingTopic.LeaseNextMessage(username, visibility)
+
+	if err != nil {
+		return nil, translateTopicError(err)
+	}
+
+	delivery := newDelivery(leased.Message)
+	delivery.Receipt = leased.Receipt
+	delivery.Redeliveries = leased.Deliveries - 1
+
+	return delivery, nil
+}
+
+// moves messages which have run out of deliveries into the topic's dead letter topic,
+// queued for the subscriber they failed to be delivered to.
+// only to be called from the loop
+func (sh *shard) moveDeadLetters(from *topic.Topic) {
+
+	for _, deadLetter := range from.TakeDeadLetters() {
+
+		log.Print("Moving dead letter : topic ", deadLetter.Topic, " username ", deadLetter.Subscriber, " deliveries ", deadLetter.Deliveries)
+
+		deadLetterTopic := sh.registry.Get(topic.DeadLetterTopicName(deadLetter.Topic))
+		err := deadLetterTopic.AddChannel(deadLetter.Subscriber)
+
+		if err == nil {
+			err = deadLetterTopic.Deliver(deadLetter.Subscriber, deadLetter.HeaderedMessage())
+		}
+
+		if err != nil {
+			log.Print("Unable to move dead letter : unexpected error : ", err.Error())
+		}
+	}
+}
+
+// the dead letters for a user's subscription. The subscription must exist.
+// only to be called from the loop
+func (sh *shard) pendingDeadLetters(topicName string, username string) ([]*topic.Message, error) {
+
+	if !sh.registry.Contains(topicName) {
+		return nil, UnknownTopic
+	}
+
+	if !sh.registry.Get(topicName).ChannelExists(username) {
+		return nil, UnknownUser
+	}
+
+	deadLetterTopicName := topic.DeadLetterTopicName(topicName)
+
+	if !sh.registry.Contains(deadLetterTopicName) {
+		return []*topic.Message{}, nil
+	}
+
+	messages, err := sh.registry.Get(deadLetterTopicName).Pending(username)
+
+	if err == topic.ChannelNotFoundError {
+		return []*topic.Message{}, nil
+	}
+	return messages, err
+}
+
+// only to be called from the loop
+func (sh *shard) replayDeadLetters(topicName string, username string) (int, error) {
+
+	messages, err := sh.pendingDeadLetters(topicName, username)
+
+	if err != nil || len(messages) == 0 {
+		return 0, err
+	}
+
+	origin := sh.registry.Get(topicName)
+	deadLetterTopic := sh.registry.Get(topic.DeadLetterTopicName(topicName))
+	count := 0
+
+	for {
+		message, err := deadLetterTopic.GetNextMessage(username)
+
+		if err == topic.NoMessagesAvailable {
+			return count, nil
+		}
+
+		if err != nil {
+			return count, err
+		}
+
+		if err := origin.Deliver(username, topic.StripDeadLetterHeaders(message)); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
@@ -0,0 +1,476 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mdevilliers/take-home/pkg/topic"
+)
+
+func TestDeadLetterTopicsBelongToTheShardOfTheirTopic(t *testing.T) {
+
+	for i := 0; i < 100; i++ {
+
+		topicName := fmt.Sprintf("topic-%d", i)
+
+		if shardIndex(topicName, 8) != shardIndex(topic.DeadLetterTopicName(topicName), 8) {
+			t.Error("A dead letter topic should belong to the shard of its topic : ", topicName)
+		}
+	}
+}
+
+func TestEachShardIsHandedTheTopicsItOwnsToSweep(t *testing.T) {
+
+	registry := topic.NewTopicRegistry()
+	options := ServiceOptions{Shards: 4, QueueSize: 1}
+	service := &Service{registry: registry, scheduler: topic.NewScheduler(registry), shards: make([]*shard, options.Shards)}
+
+	for index := range service.shards {
+		service.shards[index] = newShard(registry, index, options)
+	}
+
+	for i := 0; i < 32; i++ {
+		registry.Get(fmt.Sprintf("topic-%d", i))
+	}
+
+	service.sweepShards()
+	service.sweepShards()
+
+	swept := 0
+
+	for _, sh := range service.shards {
+
+		topics := <-sh.sweeps
+		swept += len(topics)
+
+		for _, owned := range topics {
+			if shardIndex(owned.Name(), len(service.shards)) != sh.index {
+				t.Error("A shard should only sweep the topics it owns : ", sh.index, owned.Name())
+			}
+		}
+
+		if len(sh.sweeps) != 0 {
+			t.Error("A shard which has not taken its last sweep should skip the next : ", sh.index)
+		}
+	}
+
+	if swept != 32 {
+		t.Error("Every topic should be swept once : ", swept)
+	}
+}
+
+func TestMessagesToEachTopicKeepTheirOrderAcrossShards(t *testing.T) {
+
+	registry := topic.NewTopicRegistry()
+	service := NewServiceWithOptions(registry, topic.NewScheduler(registry), ServiceOptions{Shards: 4, QueueSize: 1})
+	defer service.Close()
+
+	var publishers sync.WaitGroup
+
+	for i := 0; i < 16; i++ {
+
+		topicName := fmt.Sprintf("topic-%d", i)
+		service.Subscribe(topicName, "user-one")
+
+		publishers.Add(1)
+		go func() {
+			defer publishers.Done()
+
+			for j := 0; j < 20; j++ {
+				service.PublishMessage(topicName, []byte(fmt.Sprintf("message-%d", j)))
+			}
+		}()
+	}
+	publishers.Wait()
+
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 20; j++ {
+
+			message, err := service.GetMessage(fmt.Sprintf("topic-%d", i), "user-one")
+
+			if err != nil || string(message) != fmt.Sprintf("message-%d", j) {
+				t.Fatal("Messages should be received in the order they were published : ", i, j, string(message))
+			}
+		}
+	}
+}
+
+func TestTransactionsAndPublishesToATopicOfAnotherShardDoNotInterleave(t *testing.T) {
+
+	registry := topic.NewTopicRegistry()
+	service := NewServiceWithOptions(registry, topic.NewScheduler(registry), ServiceOptions{Shards: 2})
+	defer service.Close()
+
+	// the transaction is queued with the shard of its first topic, which does not own the other
+	first, other := "topic-0", "topic-1"
+
+	for i := 2; shardIndex(first, 2) == shardIndex(other, 2); i++ {
+		other = fmt.Sprintf("topic-%d", i)
+	}
+
+	service.Subscribe(first, "user-one")
+	service.Subscribe(other, "user-one")
+
+	var publisher sync.WaitGroup
+	publisher.Add(1)
+
+	go func() {
+		defer publisher.Done()
+
+		for i := 0; i < 100; i++ {
+			service.PublishMessage(other, []byte(fmt.Sprintf("publish-%d", i)))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+
+		_, err := service.PublishTransaction([]*TransactionMessage{
+			{Topic: first, Message: []byte("transaction")},
+			{Topic: other, Message: []byte(fmt.Sprintf("transaction-%d-1", i))},
+			{Topic: other, Message: []byte(fmt.Sprintf("transaction-%d-2", i))},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	publisher.Wait()
+
+	published := 0
+
+	for {
+		message, err := service.GetMessage(other, "user-one")
+
+		if err == NoMessagesAvailable {
+			break
+		}
+
+		if strings.HasPrefix(string(message), "publish-") {
+
+			if string(message) != fmt.Sprintf("publish-%d", published) {
+				t.Fatal("Publishes should keep their order : ", string(message))
+			}
+			published++
+			continue
+		}
+
+		next, _ := service.GetMessage(other, "user-one")
+
+		if string(next) != strings.TrimSuffix(string(message), "1")+"2" {
+			t.Fatal("A publish should not be pushed between the messages of a transaction : ", string(message), string(next))
+		}
+	}
+
+	if published != 100 {
+		t.Error("Every publish should be received : ", published)
+	}
+}
+
+func TestABlockedPublishWaitsWhileItsSubscriberMakesSpace(t *testing.T) {
+
+	service := newBlockingService(time.Minute)
+	defer service.Close()
+
+	service.Subscribe("topic-one", "user-one")
+	service.PublishMessage("topic-one", []byte("message-one"))
+
+	published := make(chan error, 1)
+
+	go func() {
+		published <- service.PublishMessage("topic-one", []byte("message-two"))
+	}()
+
+	waitForWaitingRequests(t, service, 1)
+
+	if message, err := service.GetMessage("topic-one", "user-one"); err != nil || string(message) != "message-one" {
+		t.Fatal("A subscriber should receive messages while a publish waits for space : ", err)
+	}
+
+	if err := <-published; err != nil {
+		t.Fatal("A publish should succeed once its subscriber has made space : ", err)
+	}
+
+	if message, err := service.GetMessage("topic-one", "user-one"); err != nil || string(message) != "message-two" {
+		t.Error("The publish which waited should be received : ", err)
+	}
+}
+
+func TestRequestsQueuedBehindABlockedPublishKeepTheirOrder(t *testing.T) {
+
+	service := newBlockingService(time.Minute)
+	defer service.Close()
+
+	service.Subscribe("topic-one", "user-one")
+	service.PublishMessage("topic-one", []byte("message-one"))
+
+	published := make(chan error, 1)
+	subscribed := make(chan error, 1)
+
+	go func() {
+		published <- service.PublishMessage("topic-one", []byte("message-two"))
+	}()
+
+	waitForWaitingRequests(t, service, 1)
+
+	go func() {
+		subscribed <- service.Subscribe("topic-one", "user-two")
+	}()
+
+	waitForWaitingRequests(t, service, 2)
+	service.GetMessage("topic-one", "user-one")
+
+	if err := <-published; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-subscribed; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := service.GetMessage("topic-one", "user-two"); err != NoMessagesAvailable {
+		t.Error("A subscribe queued after a publish should not receive it : ", err)
+	}
+}
+
+func TestABlockedPublishTimesOutOrIsAbandoned(t *testing.T) {
+
+	service := newBlockingService(20 * time.Millisecond)
+	defer service.Close()
+
+	service.Subscribe("topic-one", "user-one")
+	service.PublishMessage("topic-one", []byte("message-one"))
+
+	if err := service.PublishMessage("topic-one", []byte("message-two")); err != PublishTimedOut {
+		t.Error("A publish the subscriber does not make space for in time should return PublishTimedOut : ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := service.PublishContext(ctx, "topic-one", []byte("message-three"), PublishOptions{}); err != context.DeadlineExceeded {
+		t.Error("A publish waiting for space should be given up on when its context is done : ", err)
+	}
+
+	service.GetMessage("topic-one", "user-one")
+	time.Sleep(50 * time.Millisecond)
+
+	if _, err := service.GetMessage("topic-one", "user-one"); err != NoMessagesAvailable {
+		t.Error("A publish given up on should not be published : ", err)
+	}
+
+	if depth := service.QueueDepths()[0]; depth.Waiting != 0 {
+		t.Error("No request should be left waiting : ", depth.Waiting)
+	}
+}
+
+func TestRequestsAreAbandonedWhenTheirContextIsDone(t *testing.T) {
+
+	registry := topic.NewTopicRegistry()
+	service, stalled := newStalledService(registry)
+
+	// the first request is queued and the second waits for space in the queue
+	for i := 0; i < 2; i++ {
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := service.SubscribeContext(ctx, "topic-one", "user-one")
+		cancel()
+
+		if err != context.DeadlineExceeded {
+			t.Error("A request not handled before its deadline should return DeadlineExceeded but returned ", err)
+		}
+	}
+
+	go stalled.loop()
+
+	if err := service.Subscribe("topic-one", "user-two"); err != nil {
+		t.Error("Requests should be handled once the shard is running : ", err)
+	}
+
+	if registry.Get("topic-one").ChannelExists("user-one") {
+		t.Error("An abandoned request should not be handled.")
+	}
+}
+
+func TestClosedServiceLeavesNoGoroutinesRunning(t *testing.T) {
+
+	before := runtime.NumGoroutine()
+
+	registry := topic.NewTopicRegistry()
+	service := NewServiceWithOptions(registry, topic.NewScheduler(registry), ServiceOptions{Shards: 4})
+
+	service.Subscribe("topic-one", "user-one")
+	service.PublishMessage("topic-one", []byte("message-one"))
+	service.Publish("topic-one", []byte("message-two"), PublishOptions{DeliverAt: time.Now().Add(time.Hour)})
+	service.GetMessage("topic-one", "user-one")
+
+	service.Close()
+	service.Close()
+
+	assertNoGoroutinesLeaked(t, before)
+
+	if err := service.Subscribe("topic-one", "user-two"); err != ServiceClosed {
+		t.Error("A closed Service should return ServiceClosed but returned ", err)
+	}
+
+	if _, err := service.Publish("topic-one", []byte("message-three"), PublishOptions{DeliverAt: time.Now().Add(time.Hour)}); err != ServiceClosed {
+		t.Error("A closed Service should not schedule messages : ", err)
+	}
+}
+
+func TestCloseAnswersRequestsAlreadyMade(t *testing.T) {
+
+	registry := topic.NewTopicRegistry()
+	service, stalled := newStalledService(registry)
+
+	subscribed := make(chan error, 1)
+
+	go func() {
+		subscribed <- service.Subscribe("topic-one", "user-one")
+	}()
+
+	for len(stalled.requests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+
+	go func() {
+		service.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close should wait for requests already made to be answered.")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	go stalled.loop()
+	<-closed
+
+	if err := <-subscribed; err != nil {
+		t.Error("A request made before Close should be answered : ", err)
+	}
+}
+
+// waits for the goroutines started since there were before to finish
+func assertNoGoroutinesLeaked(t *testing.T, before int) {
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for runtime.NumGoroutine() > before {
+
+		if time.Now().After(deadline) {
+			t.Error("Goroutines are still running : ", runtime.NumGoroutine()-before)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// a Service with one shard whose subscribers hold one message and block publishes for timeout
+func newBlockingService(timeout time.Duration) *Service {
+
+	options := topic.RingBufferOptions{Capacity: 1, Overflow: topic.BlockWithTimeout, BlockTimeout: timeout}
+	registry := topic.NewTopicRegistryWithChannelFactory(topic.RingBufferChannelFactory(options, nil))
+
+	return NewServiceWithOptions(registry, topic.NewScheduler(registry), ServiceOptions{Shards: 1})
+}
+
+// waits for count requests to be set aside behind a publish waiting for space
+func waitForWaitingRequests(t *testing.T, service *Service, count int) {
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for service.QueueDepths()[0].Waiting < count {
+
+		if time.Now().After(deadline) {
+			t.Fatal("Requests should be waiting behind the publish : ", service.QueueDepths()[0].Waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// a Service with a shard which does not handle requests until its loop is started
+func newStalledService(registry topic.Registry) (*Service, *shard) {
+
+	options := ServiceOptions{Shards: 1, QueueSize: 1}
+	stalled := newShard(registry, 0, options)
+
+	return &Service{registry: registry, scheduler: topic.NewScheduler(registry), shards: []*shard{stalled}, stopSweeping: make(chan struct{})}, stalled
+}
+
+// every topic served by one shard, to compare with them spread over eight
+func BenchmarkPublishAndReceiveOnManyTopicsWithOneShard(b *testing.B) {
+	benchmarkService(b, 1)
+}
+
+func BenchmarkPublishAndReceiveOnManyTopicsWithEightShards(b *testing.B) {
+	benchmarkService(b, 8)
+}
+
+// publishes and receives a message on one of 1000 topics from many goroutines,
+// reporting the median and 99th percentile latency of the pair
+func benchmarkService(b *testing.B, shards int) {
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	registry := topic.NewTopicRegistry()
+	service := NewServiceWithOptions(registry, topic.NewScheduler(registry), ServiceOptions{Shards: shards})
+	defer service.Close()
+
+	topics := make([]string, 1000)
+
+	for i := range topics {
+		topics[i] = fmt.Sprintf("topic-%d", i)
+		service.Subscribe(topics[i], "user-one")
+	}
+
+	var next uint64
+	var lock sync.Mutex
+	latencies := make([]time.Duration, 0, b.N)
+
+	b.SetParallelism(8)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+
+		measured := make([]time.Duration, 0, 1024)
+
+		for pb.Next() {
+
+			topicName := topics[atomic.AddUint64(&next, 1)%uint64(len(topics))]
+			start := time.Now()
+
+			service.PublishMessage(topicName, []byte("message"))
+			service.GetMessage(topicName, "user-one")
+
+			measured = append(measured, time.Since(start))
+		}
+
+		lock.Lock()
+		latencies = append(latencies, measured...)
+		lock.Unlock()
+	})
+
+	b.StopTimer()
+
+	if len(latencies) == 0 {
+		return
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(latencies[len(latencies)/2].Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(latencies[len(latencies)*99/100].Nanoseconds()), "p99-ns")
+}
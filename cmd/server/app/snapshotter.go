@@ -0,0 +1,85 @@
+package app
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mdevilliers/take-home/pkg/topic"
+)
+
+// Snapshotter periodically saves the registry to a file so topics, subscriptions and
+// pending messages can be restored when the server restarts
+type Snapshotter struct {
+	registry topic.Registry
+	path     string
+	interval time.Duration
+	stop     chan struct{}
+	done     sync.WaitGroup
+}
+
+// Returns a Snapshotter saving registry to path every interval
+func NewSnapshotter(registry topic.Registry, path string, interval time.Duration) *Snapshotter {
+	return &Snapshotter{
+		registry: registry,
+		path:     path,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Loads the last snapshot into the registry. A corrupt snapshot is not loaded,
+// it is moved aside to <path>.corrupt and the error is returned for reporting
+func (s *Snapshotter) Restore() error {
+
+	err := topic.LoadSnapshot(s.path, s.registry)
+
+	if err == topic.CorruptSnapshot || err == topic.UnsupportedSnapshotVersion {
+
+		if renameErr := os.Rename(s.path, s.path+".corrupt"); renameErr != nil {
+			log.Print("Snapshotter : unable to move snapshot aside : ", renameErr.Error())
+		}
+	}
+	return err
+}
+
+// Starts saving snapshots in the background
+func (s *Snapshotter) Start() {
+
+	s.done.Add(1)
+	go s.loop()
+}
+
+// Stops the background snapshots and takes a final one
+func (s *Snapshotter) Stop() error {
+
+	close(s.stop)
+	s.done.Wait()
+
+	return s.Save()
+}
+
+// Saves a snapshot now
+func (s *Snapshotter) Save() error {
+	return topic.SaveSnapshot(s.path, s.registry)
+}
+
+func (s *Snapshotter) loop() {
+
+	defer s.done.Done()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.Print("Snapshotter : unable to save snapshot : ", err.Error())
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mdevilliers/take-home/pkg/topic"
+)
+
+func TestSnapshotterRestoresSubscriptionsAfterRestart(t *testing.T) {
+
+	directory, _ := ioutil.TempDir("", "snapshotter")
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "registry.snapshot")
+
+	registry := topic.NewTopicRegistry()
+	snapshotter := NewSnapshotter(registry, path, time.Hour)
+	snapshotter.Start()
+
+	service := NewServiceWithRegistry(registry)
+	service.Subscribe("topic-one", "user-1")
+	service.PublishMessage("topic-one", []byte("message-one"))
+
+	if err := snapshotter.Stop(); err != nil {
+		t.Fatal("Stopping should save a snapshot : ", err.Error())
+	}
+
+	restored := topic.NewTopicRegistry()
+
+	if err := NewSnapshotter(restored, path, time.Hour).Restore(); err != nil {
+		t.Fatal("Restoring should not fail : ", err.Error())
+	}
+
+	message, err := NewServiceWithRegistry(restored).GetMessage("topic-one", "user-1")
+
+	if err != nil || string(message) != "message-one" {
+		t.Error("user-1 should have their pending message after a restart.")
+	}
+}
+
+func TestSnapshotterMovesCorruptSnapshotAside(t *testing.T) {
+
+	directory, _ := ioutil.TempDir("", "snapshotter")
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "registry.snapshot")
+	ioutil.WriteFile(path, []byte("not a snapshot"), 0644)
+
+	err := NewSnapshotter(topic.NewTopicRegistry(), path, time.Hour).Restore()
+
+	if err != topic.CorruptSnapshot {
+		t.Error("A CorruptSnapshot error should have been returned.")
+	}
+
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Error("The corrupt snapshot should have been moved aside.")
+	}
+}
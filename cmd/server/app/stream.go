@@ -0,0 +1,279 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// how often a comment is sent on an idle stream so proxies keep the connection open
+var StreamHeartbeatInterval = 15 * time.Second
+
+// number of recently streamed messages kept per subscription for clients resuming with Last-Event-ID
+const StreamHistorySize = 100
+
+// how long the history of a subscription is kept once no stream is open for it
+var StreamHistoryTTL = 10 * time.Minute
+
+// how long a message being sent over a stream is leased for. Unless it is written before
+// then it is delivered again
+var StreamDeliveryVisibility = 5 * time.Minute
+
+// messages recently sent to a subscriber over a stream
+type streamHistory struct {
+	sync.Mutex
+	// id of the last event sent
+	last   uint64
+	events []streamEvent
+
+	// streams open for the subscription and when the last one finished, guarded by the Api's streamsLock
+	streaming int
+	idleSince time.Time
+}
+
+type streamKey struct {
+	topic    string
+	username string
+}
+
+type streamEvent struct {
+	id      uint64
+	message []byte
+}
+
+// records a message as sent, returning its event id
+func (h *streamHistory) add(message []byte) uint64 {
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.last++
+	h.events = append(h.events, streamEvent{id: h.last, message: message})
+
+	if len(h.events) > StreamHistorySize {
+		h.events = h.events[len(h.events)-StreamHistorySize:]
+	}
+	return h.last
+}
+
+// the events sent after id which are still held
+func (h *streamHistory) since(id uint64) []streamEvent {
+
+	h.Lock()
+	defer h.Unlock()
+
+	events := make([]streamEvent, 0)
+
+	for _, event := range h.events {
+		if event.id > id {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// forgets an event which could not be sent, so it is not sent again when resuming
+func (h *streamHistory) remove(id uint64) {
+
+	h.Lock()
+	defer h.Unlock()
+
+	for index, event := range h.events {
+		if event.id == id {
+			h.events = append(h.events[:index], h.events[index+1:]...)
+			return
+		}
+	}
+}
+
+// history for a subscription, created on first use, held until closeStreamHistory is called.
+// Histories of subscriptions which have not been streamed for StreamHistoryTTL are dropped
+func (api *Api) openStreamHistory(topic string, username string) *streamHistory {
+
+	api.streamsLock.Lock()
+	defer api.streamsLock.Unlock()
+
+	now := time.Now()
+
+	for key, history := range api.streams {
+		if history.streaming == 0 && now.Sub(history.idleSince) > StreamHistoryTTL {
+			delete(api.streams, key)
+		}
+	}
+
+	key := streamKey{topic: topic, username: username}
+	history, exists := api.streams[key]
+
+	if !exists {
+		history = &streamHistory{}
+		api.streams[key] = history
+	}
+
+	history.streaming++
+	return history
+}
+
+func (api *Api) closeStreamHistory(history *streamHistory) {
+
+	api.streamsLock.Lock()
+	defer api.streamsLock.Unlock()
+
+	history.streaming--
+	history.idleSince = time.Now()
+}
+
+// drops the history of a subscription, or of every subscription to the topic if username is empty
+func (api *Api) forgetStreams(topic string, username string) {
+
+	api.streamsLock.Lock()
+	defer api.streamsLock.Unlock()
+
+	for key := range api.streams {
+		if key.topic == topic && (username == "" || key.username == username) {
+			delete(api.streams, key)
+		}
+	}
+}
+
+// GET /<topic>/<username>/stream
+// Streams messages for the subscription as Server-Sent Events until the client disconnects
+// or unsubscribes. Each event carries an id; a client reconnecting with a Last-Event-ID
+// header is first sent the recent events it missed
+func (api *Api) StreamMessages(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	topicFromRequest := c.URLParams["topic"]
+	usernameFromRequest := c.URLParams["username"]
+
+	if isEmptyString(topicFromRequest) || isEmptyString(usernameFromRequest) {
+		w.WriteHeader(500)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		log.Print("StreamMessages : response can not be streamed")
+		w.WriteHeader(500)
+		return
+	}
+
+	log.Println("StreamMessages : topic", topicFromRequest, "username", usernameFromRequest)
+
+	ctx, cancel := api.serviceContext(r)
+	available, err := api.service.AvailableContext(ctx, topicFromRequest, usernameFromRequest)
+	cancel()
+
+	if err != nil {
+		writeNextMessageError(err, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+
+	history := api.openStreamHistory(topicFromRequest, usernameFromRequest)
+	defer api.closeStreamHistory(history)
+
+	if lastEventId, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		for _, event := range history.since(lastEventId) {
+			writeEvent(w, event.id, event.message)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(StreamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		for {
+			delivery, err := api.service.LeaseMessageContext(r.Context(), topicFromRequest, usernameFromRequest, StreamDeliveryVisibility)
+
+			if err == NoMessagesAvailable {
+				break
+			}
+
+			if err != nil {
+				log.Println("StreamMessages : finished topic", topicFromRequest, "username", usernameFromRequest, ":", err.Error())
+				return
+			}
+
+			if !api.streamDelivery(w, flusher, r, history, topicFromRequest, usernameFromRequest, delivery) {
+				log.Println("StreamMessages : client disconnected topic", topicFromRequest, "username", usernameFromRequest)
+				return
+			}
+		}
+
+		select {
+		case <-available:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			log.Println("StreamMessages : client disconnected topic", topicFromRequest, "username", usernameFromRequest)
+			return
+		case <-api.closing:
+			log.Println("StreamMessages : shutting down topic", topicFromRequest, "username", usernameFromRequest)
+			return
+		}
+
+		available, err = api.service.AvailableContext(r.Context(), topicFromRequest, usernameFromRequest)
+
+		if err != nil {
+			log.Println("StreamMessages : finished topic", topicFromRequest, "username", usernameFromRequest, ":", err.Error())
+			return
+		}
+	}
+}
+
+// writes a leased message as an event, acknowledging it once written. A message which
+// could not be written is delivered again. Returns false if the client has gone away
+func (api *Api) streamDelivery(w http.ResponseWriter, flusher http.Flusher, r *http.Request, history *streamHistory, topic string, username string, delivery *Delivery) bool {
+
+	id := history.add(delivery.Message)
+	err := writeEvent(w, id, delivery.Message)
+
+	if err == nil {
+		flusher.Flush()
+		// the request's context is done once the client has gone away
+		err = r.Context().Err()
+	}
+
+	if err != nil {
+		history.remove(id)
+
+		if err := api.service.Requeue(topic, username, delivery.Receipt); err != nil && err != UnknownUser {
+			log.Print("StreamMessages : unable to requeue message : ", err.Error())
+		}
+		return false
+	}
+
+	if err := api.service.Ack(topic, username, delivery.Receipt); err != nil && err != UnknownUser {
+		log.Print("StreamMessages : unable to acknowledge message : ", err.Error())
+	}
+	return true
+}
+
+// writes a message as an event, each line of the message a data field
+func writeEvent(w http.ResponseWriter, id uint64, message []byte) error {
+
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "id: %d\n", id)
+
+	for _, line := range bytes.Split(message, []byte("\n")) {
+		buffer.WriteString("data: ")
+		buffer.Write(line)
+		buffer.WriteString("\n")
+	}
+	buffer.WriteString("\n")
+
+	_, err := w.Write(buffer.Bytes())
+	return err
+}
@@ -0,0 +1,219 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Request: GET /<topic>/<username>/stream
+// Response codes:
+// ● 200: Messages follow as Server-Sent Events.
+// ● 404: The subscription does not exist.
+func TestStreamSendsPublishedMessagesAsEvents(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one"
+	http.Post(url, "text", nil)
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-one")))
+
+	res, err := http.Get(url + "/stream")
+
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatal("Streaming an existing subscription should return 200.")
+	}
+	defer res.Body.Close()
+
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Error("A stream should have a text/event-stream content type.")
+	}
+
+	reader := bufio.NewReader(res.Body)
+	assertEvent(t, reader, "1", "message-one")
+
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("line-one\nline-two")))
+	assertEvent(t, reader, "2", "line-one\nline-two")
+}
+
+func TestStreamResumesFromLastEventId(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one"
+	http.Post(url, "text", nil)
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-one")))
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-two")))
+
+	res, _ := http.Get(url + "/stream")
+	reader := bufio.NewReader(res.Body)
+	assertEvent(t, reader, "1", "message-one")
+	assertEvent(t, reader, "2", "message-two")
+	res.Body.Close()
+
+	request, _ := http.NewRequest("GET", url+"/stream", nil)
+	request.Header.Set("Last-Event-ID", "1")
+
+	res, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	assertEvent(t, bufio.NewReader(res.Body), "2", "message-two")
+}
+
+func TestStreamSendsHeartbeats(t *testing.T) {
+
+	interval := StreamHeartbeatInterval
+	StreamHeartbeatInterval = 10 * time.Millisecond
+	defer func() { StreamHeartbeatInterval = interval }()
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one"
+	http.Post(url, "text", nil)
+
+	res, err := http.Get(url + "/stream")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	line, _ := bufio.NewReader(res.Body).ReadString('\n')
+
+	if line != ": heartbeat\n" {
+		t.Error("An idle stream should send heartbeats but sent ", line)
+	}
+}
+
+func TestStreamForUnknownSubscriptionReturns404(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	res, _ := http.Get(instance.URL + "/topic-one/user-one/stream")
+	_, status := parseResponse(res)
+
+	if status != 404 {
+		t.Error("Streaming an unknown subscription should return 404 but returned ", status)
+	}
+}
+
+func TestStreamHistoriesAreDroppedOnceUnused(t *testing.T) {
+
+	ttl := StreamHistoryTTL
+	StreamHistoryTTL = time.Millisecond
+	defer func() { StreamHistoryTTL = ttl }()
+
+	api := NewApi()
+	instance := httptest.NewServer(routed(api))
+	defer instance.Close()
+
+	url := instance.URL + "/topic-one/user-one"
+	http.Post(url, "text", nil)
+	http.Post(instance.URL+"/topic-one", "text", bytes.NewBuffer([]byte("message-one")))
+
+	res, _ := http.Get(url + "/stream")
+	assertEvent(t, bufio.NewReader(res.Body), "1", "message-one")
+	res.Body.Close()
+
+	req, _ := http.NewRequest("DELETE", url, nil)
+	http.DefaultClient.Do(req)
+
+	if histories := countStreamHistories(api); histories != 0 {
+		t.Error("Unsubscribing should drop the history of the subscription : ", histories)
+	}
+
+	open := api.openStreamHistory("topic-two", "user-one")
+	api.closeStreamHistory(api.openStreamHistory("topic-three", "user-one"))
+	time.Sleep(5 * time.Millisecond)
+	api.closeStreamHistory(api.openStreamHistory("topic-four", "user-one"))
+
+	if histories := countStreamHistories(api); histories != 2 {
+		t.Error("Histories not streamed for StreamHistoryTTL should be dropped : ", histories)
+	}
+	api.closeStreamHistory(open)
+}
+
+func TestMessagesAStreamCouldNotWriteAreDeliveredAgain(t *testing.T) {
+
+	service := NewService()
+	defer service.Close()
+	api := NewApiWithService(service)
+
+	service.Subscribe("topic-one", "user-one")
+	service.PublishMessage("topic-one", []byte("message-one"))
+	service.PublishMessage("topic-one", []byte("message-two"))
+
+	c := web.C{URLParams: map[string]string{"topic": "topic-one", "username": "user-one"}}
+	request := httptest.NewRequest("GET", "/topic-one/user-one/stream", nil)
+	api.StreamMessages(c, brokenStream{httptest.NewRecorder()}, request)
+
+	for _, expected := range []string{"message-one", "message-two"} {
+		if message, err := service.GetMessage("topic-one", "user-one"); err != nil || string(message) != expected {
+			t.Error("A message which could not be streamed should be delivered again : ", string(message), err)
+		}
+	}
+}
+
+// a response which can not be written to, as when the client has gone away
+type brokenStream struct {
+	*httptest.ResponseRecorder
+}
+
+func (b brokenStream) Write(body []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func countStreamHistories(api *Api) int {
+
+	api.streamsLock.Lock()
+	defer api.streamsLock.Unlock()
+
+	return len(api.streams)
+}
+
+func assertEvent(t *testing.T, reader *bufio.Reader, expectedId string, expectedData string) {
+
+	id := ""
+	data := make([]string, 0)
+
+	for {
+		line, err := reader.ReadString('\n')
+
+		if err != nil {
+			t.Fatal("Stream ended before an event was read : ", err.Error())
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+
+		if line == "" {
+			break
+		}
+
+		if strings.HasPrefix(line, "id: ") {
+			id = strings.TrimPrefix(line, "id: ")
+		}
+
+		if strings.HasPrefix(line, "data: ") {
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+
+	if id != expectedId || strings.Join(data, "\n") != expectedData {
+		t.Error("Incorrect event. Expected :", expectedId, expectedData, " Actual :", id, data)
+	}
+}
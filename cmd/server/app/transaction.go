@@ -0,0 +1,138 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+// POST /_transactions[?ttl=<duration>]
+// Publishes messages to several topics so every subscriber receives all of those meant for it
+// or none of them. The body is a JSON array of {"topic": ..., "body": ..., "headers": {...},
+// "publisher": ..., "ttl": ...}, defaulting to the request's X-Msg-<name> headers, publisher and ttl.
+// Returns a JSON array with the id of each message if they were all published. Nothing is
+// published if a message is invalid (400), a topic does not exist (404) or a subscriber does
+// not have space for its messages (507)
+func (api *Api) PublishTransaction(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Print("PublishTransaction : error parsing body : ", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	defaults, err := batchDefaultsOf(r)
+
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	messages, problems, err := parseTransaction(body, defaults)
+
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if len(messages) > MaxBatchSize {
+		w.WriteHeader(413)
+		fmt.Fprintf(w, "a transaction can have at most %d messages", MaxBatchSize)
+		return
+	}
+
+	log.Println("PublishTransaction : messages", len(messages))
+
+	if len(problems) > 0 {
+		writeBatchFailure(w, 400, len(messages), problems)
+		return
+	}
+
+	ctx, cancel := api.serviceContext(r)
+	defer cancel()
+
+	ids, err := api.service.PublishTransactionContext(ctx, messages)
+
+	if err != nil {
+
+		switch err {
+		case UnknownTopic:
+			w.WriteHeader(404)
+			io.WriteString(w, err.Error())
+			return
+		case TopicFull:
+			w.WriteHeader(507)
+			io.WriteString(w, err.Error())
+			return
+		case InvalidTopicName, ReservedTopicName, WildcardPublish:
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if writeUnavailableError(err, w) {
+			return
+		}
+
+		log.Print("PublishTransaction : unexpected error : ", err.Error())
+		w.WriteHeader(500)
+		return
+	}
+
+	outcomes := make([]*batchItemResult, 0, len(ids))
+
+	for _, id := range ids {
+		outcomes = append(outcomes, &batchItemResult{Status: 200, Id: id})
+	}
+	writeJson(w, outcomes)
+}
+
+// reads the messages of a transaction, returning the problem with each invalid one by its
+// index. Returns an error if the body is not a JSON array
+func parseTransaction(body []byte, defaults PublishOptions) ([]*TransactionMessage, map[int]string, error) {
+
+	var items []json.RawMessage
+
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, nil, fmt.Errorf("the body should be a JSON array of messages : %s", err.Error())
+	}
+
+	if len(items) == 0 {
+		return nil, nil, fmt.Errorf("the transaction has no messages")
+	}
+
+	messages := make([]*TransactionMessage, 0, len(items))
+	problems := make(map[int]string)
+
+	for index, item := range items {
+
+		target := struct {
+			Topic string `json:"topic"`
+		}{}
+
+		if err := json.Unmarshal(item, &target); err != nil || isEmptyString(target.Topic) {
+			problems[index] = "a message should be an object with a topic"
+			messages = append(messages, nil)
+			continue
+		}
+
+		message, err := parseBatchItem(item, defaults)
+
+		if err != nil {
+			problems[index] = err.Error()
+			messages = append(messages, nil)
+			continue
+		}
+		messages = append(messages, &TransactionMessage{Topic: target.Topic, Message: message.Message, Options: message.Options})
+	}
+	return messages, problems, nil
+}
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mdevilliers/take-home/pkg/topic"
+)
+
+// Request: POST /_transactions
+// Response codes:
+// ● 200: Every message was published to its topic, their ids are returned in order.
+// ● 400: A message is invalid and nothing was published.
+// ● 404: A topic does not exist and nothing was published.
+func TestTransactionsArePublishedToEveryTopic(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	http.Post(instance.URL+"/orders/user-one", "text", nil)
+	http.Post(instance.URL+"/payments/user-one", "text", nil)
+
+	outcomes, status := postBatch(t, instance.URL+"/_transactions", "application/json", `[{"topic": "orders", "body": "order1"}, {"topic": "payments", "body": "payment1", "headers": {"Kind": "card"}}]`)
+
+	if status != 200 || len(outcomes) != 2 || outcomes[0].Id == "" || outcomes[1].Id == "" {
+		t.Fatal("Publishing a transaction should return 200 with an id for each message but returned ", status, outcomes)
+	}
+
+	_, status = postBatch(t, instance.URL+"/_transactions", "application/json", `[{"topic": "orders", "body": "order2"}, {"topic": "refunds", "body": "refund1"}]`)
+
+	if status != 404 {
+		t.Error("A transaction to a topic which does not exist should return 404 but returned ", status)
+	}
+
+	outcomes, status = postBatch(t, instance.URL+"/_transactions", "application/json", `[{"topic": "orders", "body": "order3"}, "payment2"]`)
+
+	if status != 400 || len(outcomes) != 2 || outcomes[0].Status != StatusNotPublished || outcomes[1].Status != 400 {
+		t.Error("A transaction with an invalid message should return 400 with the problem but returned ", status, outcomes)
+	}
+
+	received := []jsonMessage{}
+	getJson(t, instance.URL+"/orders/user-one/batch", &received)
+
+	if len(received) != 1 || received[0].Body != "order1" {
+		t.Error("Only the published transaction should be received : ", received)
+	}
+
+	received = []jsonMessage{}
+	getJson(t, instance.URL+"/payments/user-one/batch", &received)
+
+	if len(received) != 1 || received[0].Body != "payment1" || received[0].Headers["kind"] != "card" {
+		t.Error("Every topic of the transaction should receive its messages : ", received)
+	}
+
+	http.Post(instance.URL+"/transactions/user-one", "text", nil)
+	http.Post(instance.URL+"/transactions", "text", strings.NewReader("transaction1"))
+
+	res, _ := http.Get(instance.URL + "/transactions/user-one")
+	content, _ := parseResponse(res)
+
+	if content != "transaction1" {
+		t.Error("A topic called transactions should be published to like any other : ", content)
+	}
+}
+
+// Request: POST /_transactions
+// Response codes:
+// ● 507: A subscriber does not have space for its messages and nothing was published.
+func TestTransactionWhichDoesNotFitIsNotPublished(t *testing.T) {
+
+	registry := topic.NewTopicRegistryWithChannelFactory(topic.RingBufferChannelFactory(topic.RingBufferOptions{Capacity: 1, Overflow: topic.RejectPublish}, nil))
+	service := NewServiceWithRegistry(registry)
+	instance := getServerInstanceWithService(service)
+	defer instance.Close()
+
+	service.Subscribe("orders", "user-one")
+	service.Subscribe("payments", "user-one")
+
+	_, status := postBatch(t, instance.URL+"/_transactions", "application/json", `[{"topic": "orders", "body": "order1"}, {"topic": "payments", "body": "payment1"}, {"topic": "payments", "body": "payment2"}]`)
+
+	if status != 507 {
+		t.Error("A transaction which does not fit should return 507 but returned ", status)
+	}
+
+	if _, err := service.GetMessage("orders", "user-one"); err != NoMessagesAvailable {
+		t.Error("No message of a rejected transaction should be published : ", err)
+	}
+}
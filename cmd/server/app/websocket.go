@@ -0,0 +1,572 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mdevilliers/take-home/pkg/topic"
+	"github.com/zenazn/goji/web"
+)
+
+// WebSocket frame protocol
+//
+// Every frame is a JSON object with a type. A client may set id on any frame it sends;
+// the reply to that frame carries the same id.
+//
+// Client to server
+//
+//	{"type": "subscribe", "topic": "t"}                        subscribe the connection's user to t and start receiving its messages
+//	{"type": "subscribe", "topic": "t", "ack": true, "visibility": "30s"}
+//	                                                           lease messages instead, each must be acked or nacked
+//	{"type": "subscribe", "topic": "t", "durable": true}       keep the subscription when the connection closes
+//	{"type": "subscribe", "topic": "t", "filter": "header.region == 'eu'"}
+//	                                                           only receive messages matching the filter
+//	{"type": "unsubscribe", "topic": "t"}                      stop receiving t and unsubscribe
+//	{"type": "publish", "topic": "t", "body": "...", "headers": {"name": "value"}, "ttl": "1m"}
+//	                                                           publish a message to t, headers and ttl are optional
+//	{"type": "ack", "topic": "t", "receipt": "..."}            acknowledge a leased message
+//	{"type": "nack", "topic": "t", "receipt": "..."}           give up a leased message so it is redelivered
+//
+// Server to client
+//
+//	{"type": "ok", "id": "..."}                                the frame with id succeeded
+//	{"type": "error", "id": "...", "error": "..."}             the frame with id failed
+//	{"type": "message", "topic": "t", "body": "...", "published_to": "t", "message_id": "...", "sequence": 1,
+//	 "timestamp": "...", "publisher": "...", "headers": {...}, "receipt": "...", "redeliveries": 1}
+//	                                                           a message, receipt and redeliveries are only set when leased.
+//	                                                           published_to differs from topic for a wildcard subscription
+//
+// Subscriptions made on a connection are unsubscribed when it closes unless they are durable.
+// Messages taken for a connection but not written to it when it closes are delivered again.
+const (
+	subscribeFrame   = "subscribe"
+	unsubscribeFrame = "unsubscribe"
+	publishFrame     = "publish"
+	ackFrame         = "ack"
+	nackFrame        = "nack"
+	okFrame          = "ok"
+	errorFrame       = "error"
+	messageFrame     = "message"
+)
+
+var (
+	// messages sent to a connection but not yet written to it. Once reached
+	// no more are taken from the subscriptions until the client catches up
+	WebSocketOutboundLimit = 64
+	// how often the server pings the client
+	WebSocketPingInterval = 30 * time.Second
+	// how long the server waits for any frame, including a pong, before closing the connection
+	WebSocketReadTimeout = 60 * time.Second
+	// how long a write to the client may take before the connection is closed
+	WebSocketWriteTimeout = 10 * time.Second
+	// how long a message for a subscription without acks is leased while it waits to be
+	// written, after which it is delivered again
+	WebSocketDeliveryVisibility = 5 * time.Minute
+)
+
+// largest frame accepted from a client
+const WebSocketMaxFrameSize = 1 << 20
+
+type frame struct {
+	Type         string `json:"type"`
+	Id           string `json:"id,omitempty"`
+	Topic        string `json:"topic,omitempty"`
+	Body         string `json:"body,omitempty"`
+	Receipt      string `json:"receipt,omitempty"`
+	Redeliveries int    `json:"redeliveries,omitempty"`
+	Ack          bool   `json:"ack,omitempty"`
+	Visibility   string `json:"visibility,omitempty"`
+	Durable      bool   `json:"durable,omitempty"`
+	TTL          string `json:"ttl,omitempty"`
+	Filter       string `json:"filter,omitempty"`
+	Error        string `json:"error,omitempty"`
+
+	PublishedTo string            `json:"published_to,omitempty"`
+	MessageId   string            `json:"message_id,omitempty"`
+	Sequence    uint64            `json:"sequence,omitempty"`
+	Timestamp   string            `json:"timestamp,omitempty"`
+	Publisher   string            `json:"publisher,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+
+	// set on message frames which hold one of the connection's outbound slots
+	slot bool
+	// receipt of the lease the message is held under until it is written, and whether it
+	// is acknowledged once written for a subscription without acks
+	lease   string
+	autoAck bool
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// a WebSocket connection for a user
+type connection struct {
+	service  *Service
+	socket   *websocket.Conn
+	username string
+	context  context.Context
+	cancel   context.CancelFunc
+
+	// frames waiting to be written
+	outbound chan *frame
+	// taken before a message is fetched for the connection and released once it is written
+	slots chan struct{}
+
+	lock          sync.Mutex
+	subscriptions map[string]*socketSubscription
+	pumps         sync.WaitGroup
+	// the write loop, which may be acking or requeueing a frame
+	writer sync.WaitGroup
+}
+
+type socketSubscription struct {
+	cancel     context.CancelFunc
+	durable    bool
+	ack        bool
+	visibility time.Duration
+}
+
+// GET /ws?username=<username>
+// Upgrades to a WebSocket speaking the frame protocol above
+func (api *Api) WebSocket(c web.C, w http.ResponseWriter, r *http.Request) {
+
+	usernameFromRequest := r.URL.Query().Get("username")
+
+	if isEmptyString(usernameFromRequest) {
+		w.WriteHeader(400)
+		return
+	}
+
+	if !api.openSocket() {
+		w.WriteHeader(503)
+		return
+	}
+	defer api.sockets.Done()
+
+	socket, err := upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		// the upgrader has already responded
+		log.Print("WebSocket : unable to upgrade : ", err.Error())
+		return
+	}
+
+	log.Println("WebSocket : connected username", usernameFromRequest)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	conn := &connection{
+		service:       api.service,
+		socket:        socket,
+		username:      usernameFromRequest,
+		context:       ctx,
+		cancel:        cancel,
+		outbound:      make(chan *frame, WebSocketOutboundLimit*2),
+		slots:         make(chan struct{}, WebSocketOutboundLimit),
+		subscriptions: make(map[string]*socketSubscription),
+	}
+
+	conn.writer.Add(1)
+	go conn.write()
+	go conn.closeOnShutdown(api.closing)
+	conn.read()
+	conn.close()
+
+	log.Println("WebSocket : disconnected username", usernameFromRequest)
+}
+
+// registers a WebSocket so Close waits for it, false if the Api is closing
+func (api *Api) openSocket() bool {
+
+	api.closeLock.Lock()
+	defer api.closeLock.Unlock()
+
+	select {
+	case <-api.closing:
+		return false
+	default:
+		api.sockets.Add(1)
+		return true
+	}
+}
+
+// closes the connection when the server shuts down
+func (c *connection) closeOnShutdown(closing <-chan struct{}) {
+
+	select {
+	case <-closing:
+		c.cancel()
+	case <-c.context.Done():
+	}
+}
+
+// reads and handles frames until the client goes away
+func (c *connection) read() {
+
+	c.socket.SetReadLimit(WebSocketMaxFrameSize)
+	c.socket.SetReadDeadline(time.Now().Add(WebSocketReadTimeout))
+	c.socket.SetPongHandler(func(string) error {
+		return c.socket.SetReadDeadline(time.Now().Add(WebSocketReadTimeout))
+	})
+
+	for {
+		request := &frame{}
+
+		if err := c.socket.ReadJSON(request); err != nil {
+
+			if _, ok := err.(*websocket.CloseError); !ok {
+				log.Print("WebSocket : read failed : ", err.Error())
+			}
+			return
+		}
+
+		c.socket.SetReadDeadline(time.Now().Add(WebSocketReadTimeout))
+
+		if err := c.handle(request); err != nil {
+			c.reply(&frame{Type: errorFrame, Id: request.Id, Error: err.Error()})
+		} else {
+			c.reply(&frame{Type: okFrame, Id: request.Id})
+		}
+
+		if c.context.Err() != nil {
+			return
+		}
+	}
+}
+
+func (c *connection) handle(request *frame) error {
+
+	if isEmptyString(request.Topic) {
+		return errMissing("topic")
+	}
+
+	switch request.Type {
+	case subscribeFrame:
+		return c.subscribe(request)
+	case unsubscribeFrame:
+		return c.unsubscribe(request.Topic)
+	case publishFrame:
+		if len(request.Body) == 0 {
+			return errMissing("body")
+		}
+		return c.publish(request)
+	case ackFrame:
+		return c.service.AckContext(c.context, request.Topic, c.username, request.Receipt)
+	case nackFrame:
+		return c.service.NackContext(c.context, request.Topic, c.username, request.Receipt)
+	}
+	return errUnknownFrame(request.Type)
+}
+
+func (c *connection) publish(request *frame) error {
+
+	ttl, err := parseDurationValue("ttl", request.TTL, 0)
+
+	if err != nil {
+		return errInvalid("ttl")
+	}
+
+	_, err = c.service.PublishContext(c.context, request.Topic, []byte(request.Body), PublishOptions{
+		Publisher: c.username,
+		Headers:   request.Headers,
+		TTL:       ttl,
+	})
+	return err
+}
+
+func (c *connection) subscribe(request *frame) error {
+
+	visibility := DefaultVisibilityTimeout
+
+	if request.Visibility != "" {
+
+		parsed, err := time.ParseDuration(request.Visibility)
+
+		if err != nil || parsed <= 0 {
+			return errInvalid("visibility")
+		}
+		visibility = parsed
+	}
+
+	options := SubscribeOptions{}
+
+	if request.Filter != "" {
+
+		filter, err := topic.ParseFilter(request.Filter)
+
+		if err != nil {
+			return err
+		}
+		options.Filter = filter
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, exists := c.subscriptions[request.Topic]; exists {
+		return nil
+	}
+
+	if err := c.service.SubscribeWithContext(c.context, request.Topic, c.username, options); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(c.context)
+
+	subscription := &socketSubscription{
+		cancel:     cancel,
+		durable:    request.Durable,
+		ack:        request.Ack,
+		visibility: visibility,
+	}
+	c.subscriptions[request.Topic] = subscription
+
+	c.pumps.Add(1)
+	go c.pump(ctx, request.Topic, subscription)
+
+	return nil
+}
+
+func (c *connection) unsubscribe(topic string) error {
+
+	c.lock.Lock()
+	subscription, exists := c.subscriptions[topic]
+	delete(c.subscriptions, topic)
+	c.lock.Unlock()
+
+	if exists {
+		subscription.cancel()
+	}
+	return c.service.UnSubscribeContext(c.context, topic, c.username)
+}
+
+// moves messages for a subscription to the outbound queue until the subscription is cancelled.
+// A message is only fetched once an outbound slot is free so a slow reader leaves
+// messages waiting in the topic rather than in memory
+func (c *connection) pump(ctx context.Context, topic string, subscription *socketSubscription) {
+
+	defer c.pumps.Done()
+
+	for {
+		available, err := c.service.AvailableContext(ctx, topic, c.username)
+
+		if err != nil {
+			c.replyUnlessDone(ctx, topic, err)
+			return
+		}
+
+		for {
+			select {
+			case c.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			message, err := c.fetch(ctx, topic, subscription)
+
+			if err != nil {
+				<-c.slots
+
+				if err == NoMessagesAvailable {
+					break
+				}
+
+				c.replyUnlessDone(ctx, topic, err)
+				return
+			}
+
+			message.slot = true
+
+			select {
+			case c.outbound <- message:
+			case <-ctx.Done():
+				c.requeue(message)
+				return
+			}
+		}
+
+		select {
+		case <-available:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reports an error stopping a pump, unless it stopped because the subscription was cancelled
+func (c *connection) replyUnlessDone(ctx context.Context, topic string, err error) {
+
+	if ctx.Err() == nil {
+		c.reply(&frame{Type: errorFrame, Topic: topic, Error: err.Error()})
+	}
+}
+
+// leases the next message for a subscription. Without acks the lease is only held until the
+// message is written, so a message which never reaches the client is delivered again
+func (c *connection) fetch(ctx context.Context, topic string, subscription *socketSubscription) (*frame, error) {
+
+	visibility := subscription.visibility
+
+	if !subscription.ack {
+		visibility = WebSocketDeliveryVisibility
+	}
+
+	delivery, err := c.service.LeaseMessageContext(ctx, topic, c.username, visibility)
+
+	if err != nil {
+		return nil, err
+	}
+
+	message := &frame{
+		Type:        messageFrame,
+		Topic:       topic,
+		Body:        string(delivery.Message),
+		PublishedTo: delivery.Topic,
+		MessageId:   delivery.Id,
+		Sequence:    delivery.Sequence,
+		Publisher:   delivery.Publisher,
+		Headers:     delivery.Headers,
+		lease:       delivery.Receipt,
+		autoAck:     !subscription.ack,
+	}
+
+	if subscription.ack {
+		message.Receipt = delivery.Receipt
+		message.Redeliveries = delivery.Redeliveries
+	}
+
+	if !delivery.Timestamp.IsZero() {
+		message.Timestamp = delivery.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+	return message, nil
+}
+
+// gives back a message taken for the connection which was not written to it
+func (c *connection) requeue(message *frame) {
+
+	if message.lease == "" {
+		return
+	}
+
+	if err := c.service.Requeue(message.Topic, c.username, message.lease); err != nil && err != UnknownUser {
+		log.Print("WebSocket : unable to requeue message : ", err.Error())
+	}
+}
+
+// gives back the messages queued for the connection once nothing more will be written
+func (c *connection) requeueOutbound() {
+
+	for {
+		select {
+		case message := <-c.outbound:
+			c.requeue(message)
+		default:
+			return
+		}
+	}
+}
+
+// queues a frame which does not hold a slot. A client sending frames faster than
+// it reads the replies is disconnected once the outbound queue is full
+func (c *connection) reply(response *frame) {
+
+	select {
+	case c.outbound <- response:
+	default:
+		log.Println("WebSocket : outbound limit reached, closing username", c.username)
+		c.cancel()
+	}
+}
+
+// writes queued frames and pings until the connection is cancelled
+func (c *connection) write() {
+
+	defer c.writer.Done()
+
+	ping := time.NewTicker(WebSocketPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case response := <-c.outbound:
+
+			c.socket.SetWriteDeadline(time.Now().Add(WebSocketWriteTimeout))
+			err := c.socket.WriteJSON(response)
+
+			if response.slot {
+				<-c.slots
+			}
+
+			if err != nil {
+				log.Print("WebSocket : write failed : ", err.Error())
+				c.requeue(response)
+				c.cancel()
+				c.socket.Close()
+				return
+			}
+
+			if response.autoAck {
+				if err := c.service.Ack(response.Topic, c.username, response.lease); err != nil && err != UnknownUser {
+					log.Print("WebSocket : unable to acknowledge message : ", err.Error())
+				}
+			}
+
+		case <-ping.C:
+
+			if err := c.socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(WebSocketWriteTimeout)); err != nil {
+				c.cancel()
+				c.socket.Close()
+				return
+			}
+
+		case <-c.context.Done():
+
+			c.socket.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(WebSocketWriteTimeout))
+			c.socket.Close()
+			return
+		}
+	}
+}
+
+func errMissing(field string) error {
+	return fmt.Errorf("%s is required", field)
+}
+
+func errInvalid(field string) error {
+	return fmt.Errorf("%s is invalid", field)
+}
+
+func errUnknownFrame(frameType string) error {
+	return fmt.Errorf("unknown frame type : %s", frameType)
+}
+
+// stops the pumps and the write loop, gives back the messages not yet written and
+// unsubscribes everything which is not durable
+func (c *connection) close() {
+
+	c.cancel()
+	c.pumps.Wait()
+	c.writer.Wait()
+	c.requeueOutbound()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for topic, subscription := range c.subscriptions {
+		if !subscription.durable {
+			if err := c.service.UnSubscribe(topic, c.username); err != nil {
+				log.Print("WebSocket : unable to unsubscribe : ", err.Error())
+			}
+		}
+	}
+	c.subscriptions = make(map[string]*socketSubscription)
+}
@@ -0,0 +1,212 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Request: GET /ws?username=<username>
+// Frames: subscribe, publish and the messages that follow
+func TestWebSocketDeliversPublishedMessages(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	socket := dialWebSocket(t, instance.URL, "user-one")
+	defer socket.Close()
+
+	socket.WriteJSON(&frame{Type: subscribeFrame, Id: "1", Topic: "topic-one"})
+	assertFrame(t, socket, okFrame, "1", "")
+
+	socket.WriteJSON(&frame{Type: publishFrame, Id: "2", Topic: "topic-one", Body: "message-one"})
+
+	received := map[string]bool{}
+
+	for i := 0; i < 2; i++ {
+		response := readFrame(t, socket)
+		received[response.Type+":"+response.Id+response.Body] = true
+	}
+
+	if !received["ok:2"] || !received["message:message-one"] {
+		t.Error("Publishing should be acknowledged and the message delivered to the subscriber : ", received)
+	}
+}
+
+func TestWebSocketRepliesWithErrorForInvalidFrames(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	socket := dialWebSocket(t, instance.URL, "user-one")
+	defer socket.Close()
+
+	socket.WriteJSON(&frame{Type: ackFrame, Id: "1", Topic: "topic-one", Receipt: "unknown"})
+	assertFrame(t, socket, errorFrame, "1", UnknownTopic.Error())
+
+	socket.WriteJSON(&frame{Type: "unknown", Id: "2", Topic: "topic-one"})
+	assertFrame(t, socket, errorFrame, "2", "unknown frame type : unknown")
+
+	socket.WriteJSON(&frame{Type: subscribeFrame, Id: "3", Topic: "orders/created"})
+	assertFrame(t, socket, errorFrame, "3", InvalidTopicName.Error())
+
+	socket.WriteJSON(&frame{Type: publishFrame, Id: "4", Topic: "orders/created", Body: "message-one"})
+	assertFrame(t, socket, errorFrame, "4", InvalidTopicName.Error())
+}
+
+func TestWebSocketUnsubscribesWhenClosed(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	socket := dialWebSocket(t, instance.URL, "user-one")
+
+	socket.WriteJSON(&frame{Type: subscribeFrame, Id: "1", Topic: "topic-one"})
+	assertFrame(t, socket, okFrame, "1", "")
+	socket.Close()
+
+	// the server notices the close asynchronously
+	deadline := time.Now().Add(2 * time.Second)
+
+	for time.Now().Before(deadline) {
+
+		res, _ := http.Get(instance.URL + "/topic-one/user-one")
+		res.Body.Close()
+
+		if res.StatusCode == 404 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Closing a connection should unsubscribe its subscriptions.")
+}
+
+func TestMessagesNotWrittenToAClosedWebSocketAreDeliveredAgain(t *testing.T) {
+
+	service := NewService()
+	service.Subscribe("topic-one", "user-one")
+
+	for _, body := range []string{"message1", "message2", "message3"} {
+		service.PublishMessage("topic-one", []byte(body))
+	}
+
+	// a connection whose client reads nothing, with space for two messages
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &connection{
+		service:       service,
+		username:      "user-one",
+		context:       ctx,
+		cancel:        cancel,
+		outbound:      make(chan *frame, 4),
+		slots:         make(chan struct{}, 2),
+		subscriptions: map[string]*socketSubscription{"topic-one": {cancel: func() {}, durable: true}},
+	}
+
+	conn.pumps.Add(1)
+	go conn.pump(ctx, "topic-one", conn.subscriptions["topic-one"])
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for len(conn.outbound) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	conn.close()
+
+	for _, expected := range []string{"message1", "message2", "message3"} {
+
+		delivery, err := service.Receive("topic-one", "user-one")
+
+		if err != nil || string(delivery.Message) != expected || delivery.Redeliveries != 0 {
+			t.Fatal("Messages not written should be delivered again in order : ", expected, delivery, err)
+		}
+	}
+}
+
+func TestWebSocketRequiresUsername(t *testing.T) {
+
+	instance := getServerInstance()
+	defer instance.Close()
+
+	res, err := http.Get(instance.URL + "/ws")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 400 {
+		t.Error("Connecting without a username should return 400 : ", res.StatusCode)
+	}
+}
+
+func TestClosingTheApiClosesWebSockets(t *testing.T) {
+
+	service := NewService()
+	api := NewApiWithService(service)
+	instance := httptest.NewServer(routed(api))
+	defer instance.Close()
+
+	socket := dialWebSocket(t, instance.URL, "user-one")
+	defer socket.Close()
+
+	socket.WriteJSON(&frame{Type: subscribeFrame, Id: "1", Topic: "topic-one"})
+	assertFrame(t, socket, okFrame, "1", "")
+
+	api.Close()
+
+	socket.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	if _, _, err := socket.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Error("Closing the Api should close its WebSockets : ", err)
+	}
+
+	if err := service.UnSubscribe("topic-one", "user-one"); err != UnknownUser {
+		t.Error("A closed WebSocket should have been unsubscribed before Close returned : ", err)
+	}
+
+	res, err := http.Get(instance.URL + "/ws?username=user-one")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 503 {
+		t.Error("Connecting once the Api is closed should return 503 : ", res.StatusCode)
+	}
+}
+
+func dialWebSocket(t *testing.T, url string, username string) *websocket.Conn {
+
+	socket, _, err := websocket.DefaultDialer.Dial(strings.Replace(url, "http", "ws", 1)+"/ws?username="+username, nil)
+
+	if err != nil {
+		t.Fatal("Unable to connect : ", err)
+	}
+	return socket
+}
+
+func readFrame(t *testing.T, socket *websocket.Conn) *frame {
+
+	socket.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response := &frame{}
+
+	if err := socket.ReadJSON(response); err != nil {
+		t.Fatal("Unable to read frame : ", err)
+	}
+	return response
+}
+
+func assertFrame(t *testing.T, socket *websocket.Conn, frameType string, id string, error string) {
+
+	response := readFrame(t, socket)
+
+	if response.Type != frameType || response.Id != id || response.Error != error {
+		t.Error("Unexpected frame : ", response)
+	}
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdevilliers/take-home/cmd/server/app"
+	"github.com/mdevilliers/take-home/pkg/topic"
+	"github.com/zenazn/goji/bind"
+)
+
+// environment variables with this prefix set the flag of the same name, so
+// TAKE_HOME_WAL_DIR sets -wal-dir. Per topic flags take comma separated lists
+const environmentPrefix = "TAKE_HOME_"
+
+// how subscribers' messages are stored
+const (
+	// a log shared by the subscribers of a topic, held in memory
+	logStorage = "log"
+	// a list per subscriber held in memory
+	memoryStorage = "memory"
+	// a fixed capacity buffer per subscriber, see capacity and overflow
+	ringBufferStorage = "ring-buffer"
+	// a write-ahead log per subscriber under wal_dir
+	walStorage = "wal"
+)
+
+// replaces the value of fields tagged secret:"true" when the configuration is printed
+const redacted = "[redacted]"
+
+// Configuration of the server. Each setting is taken from the first of
+//
+//	command line flags, environment variables, the -config file, defaults
+//
+// which sets it. The file is JSON using the json names below, with per topic
+// overrides under "topics". -print-config writes the effective configuration
+// in the same format
+type config struct {
+	// where the configuration file is read from, only set by -config or TAKE_HOME_CONFIG
+	File string `json:"-"`
+	// write the effective configuration to stdout and exit
+	Print bool `json:"-"`
+
+	Bind    string `json:"bind"`
+	LogFile string `json:"log_file"`
+
+	Storage         string   `json:"storage"`
+	WALDirectory    string   `json:"wal_dir"`
+	WALSync         string   `json:"wal_sync"`
+	WALSyncInterval duration `json:"wal_sync_interval"`
+
+	SnapshotFile     string   `json:"snapshot_file"`
+	SnapshotInterval duration `json:"snapshot_interval"`
+
+	Capacity      int      `json:"capacity"`
+	Overflow      string   `json:"overflow"`
+	BlockTimeout  duration `json:"block_timeout"`
+	MaxDeliveries int      `json:"max_deliveries"`
+	TTL           duration `json:"ttl"`
+	Retention     duration `json:"retention"`
+
+	Topics map[string]*topicConfig `json:"topics"`
+
+	Shards         int      `json:"shards"`
+	QueueSize      int      `json:"queue_size"`
+	RequestTimeout duration `json:"request_timeout"`
+	GracePeriod    duration `json:"grace_period"`
+
+	MetricsSubscriberLabels int `json:"metrics_subscriber_labels"`
+
+	AdminToken string `json:"admin_token" secret:"true"`
+}
+
+// Settings overriding the defaults for one topic. Unset settings are nil
+type topicConfig struct {
+	Capacity      *int      `json:"capacity,omitempty"`
+	Overflow      string    `json:"overflow,omitempty"`
+	MaxDeliveries *int      `json:"max_deliveries,omitempty"`
+	TTL           *duration `json:"ttl,omitempty"`
+	Retention     *duration `json:"retention,omitempty"`
+}
+
+func defaultConfig() *config {
+
+	listen := bind.Sniff()
+
+	if listen == "" {
+		listen = bind.DefaultBind
+	}
+
+	return &config{
+		Bind:             listen,
+		WALSync:          "always",
+		WALSyncInterval:  duration(topic.DefaultWALOptions.SyncInterval),
+		SnapshotInterval: duration(time.Minute),
+		Overflow:         "drop-oldest",
+		BlockTimeout:     duration(5 * time.Second),
+		Topics:           make(map[string]*topicConfig),
+		Shards:           app.DefaultShards,
+		QueueSize:        app.DefaultQueueSize,
+		RequestTimeout:   duration(app.DefaultRequestTimeout),
+		GracePeriod:      duration(30 * time.Second),
+
+		MetricsSubscriberLabels: app.DefaultSubscriberLabels,
+	}
+}
+
+// Reads the configuration from args, getenv and the file they name, in that order of precedence,
+// and validates it
+func loadConfig(name string, args []string, getenv func(string) string, errorHandling flag.ErrorHandling) (*config, error) {
+
+	// a first pass finds the file, which the environment and flags are then applied over
+	located := defaultConfig()
+	flags := located.flagSet(name, errorHandling)
+
+	if err := applyEnvironment(flags, getenv); err != nil {
+		return nil, err
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+
+	if located.File != "" {
+		if err := c.read(located.File); err != nil {
+			return nil, err
+		}
+	}
+
+	flags = c.flagSet(name, errorHandling)
+
+	if err := applyEnvironment(flags, getenv); err != nil {
+		return nil, err
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// flags setting c
+func (c *config) flagSet(name string, errorHandling flag.ErrorHandling) *flag.FlagSet {
+
+	flags := flag.NewFlagSet(name, errorHandling)
+
+	flags.StringVar(&c.File, "config", c.File, "JSON configuration file. Settings given as flags or environment variables take precedence")
+	flags.BoolVar(&c.Print, "print-config", c.Print, "write the effective configuration as JSON, with secrets redacted, then exit")
+
+	flags.StringVar(&c.Bind, "bind", c.Bind, "address to listen on : host:port, a unix socket path, fd@<n> or einhorn@<n>")
+	flags.StringVar(&c.LogFile, "log-file", c.LogFile, "file the log is appended to. Standard error if empty")
+
+	flags.StringVar(&c.Storage, "storage", c.Storage, "where subscribers' messages are held : log, memory, ring-buffer or wal. Chosen from the other settings if empty")
+	flags.StringVar(&c.WALDirectory, "wal-dir", c.WALDirectory, "directory for subscriber write-ahead logs. Messages are held in memory if empty")
+	flags.StringVar(&c.WALSync, "wal-sync", c.WALSync, "write-ahead log fsync policy : always, interval or never")
+	flags.Var(&c.WALSyncInterval, "wal-sync-interval", "fsync interval when -wal-sync=interval")
+
+	flags.StringVar(&c.SnapshotFile, "snapshot-file", c.SnapshotFile, "file the registry is saved to and restored from at startup. Snapshots are disabled if empty")
+	flags.Var(&c.SnapshotInterval, "snapshot-interval", "how often the registry is saved to -snapshot-file")
+
+	flags.IntVar(&c.Capacity, "capacity", c.Capacity, "maximum pending messages per subscriber. Unbounded if 0")
+	flags.StringVar(&c.Overflow, "overflow", c.Overflow, "what happens when a subscriber is at capacity : drop-oldest, drop-newest, reject or block")
+	flags.Var(&c.BlockTimeout, "block-timeout", "how long a publish waits for space when -overflow=block")
+	flags.IntVar(&c.MaxDeliveries, "max-deliveries", c.MaxDeliveries, "deliveries of a leased message before it is moved to <topic>.dlq. Unlimited if 0")
+	flags.Var(&c.TTL, "ttl", "how long a message published without a ttl lives. Forever if 0")
+	flags.Var(&c.Retention, "retention", "how long a topic keeps messages every subscriber has read, for subscriptions replaying from an earlier position")
+
+	flags.Var(c.topicFlag("capacity[:policy]", setTopicLimit), "topic-limit", "per topic capacity and overflow policy as topic=capacity[:policy]. May be repeated")
+	flags.Var(c.topicFlag("count", setTopicMaxDeliveries), "topic-max-deliveries", "per topic -max-deliveries as topic=count. May be repeated")
+	flags.Var(c.topicFlag("duration", setTopicTTL), "topic-ttl", "per topic -ttl as topic=duration. May be repeated")
+	flags.Var(c.topicFlag("duration", setTopicRetention), "topic-retention", "per topic -retention as topic=duration. May be repeated")
+
+	flags.IntVar(&c.Shards, "shards", c.Shards, "workers topics are partitioned between, each serving its topics' requests in order")
+	flags.IntVar(&c.QueueSize, "queue-size", c.QueueSize, "requests queued for each worker before callers wait")
+	flags.Var(&c.RequestTimeout, "request-timeout", "how long a request waits for a worker before a 503 is returned")
+	flags.Var(&c.GracePeriod, "grace-period", "how long requests being served are given to finish on SIGTERM or SIGINT")
+
+	flags.IntVar(&c.MetricsSubscriberLabels, "metrics-subscriber-labels", c.MetricsSubscriberLabels, "subscribers of each topic with their own backlog series in /metrics, the rest are summed. None if 0")
+	flags.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "bearer token the /_admin routes require. Open to everyone if empty")
+
+	return flags
+}
+
+// sets the flags which have an environment variable, so flags given on the command line replace them
+func applyEnvironment(flags *flag.FlagSet, getenv func(string) string) error {
+
+	var err error
+
+	flags.VisitAll(func(f *flag.Flag) {
+
+		variable := environmentPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value := getenv(variable)
+
+		if value == "" || err != nil {
+			return
+		}
+
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s : %s", value, variable, setErr.Error())
+		}
+	})
+	return err
+}
+
+// reads the settings in a configuration file over c
+func (c *config) read(path string) error {
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return fmt.Errorf("unable to read configuration : %s", err.Error())
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("unable to read configuration %s : %s", path, err.Error())
+	}
+	return nil
+}
+
+// checks every setting, reporting all those which are invalid. An empty storage is
+// replaced by the one the other settings imply
+func (c *config) validate() error {
+
+	problems := make([]string, 0)
+
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if isBlank(c.Bind) {
+		invalid("bind is required")
+	}
+
+	if _, err := topic.ParseSyncPolicy(c.WALSync); err != nil {
+		invalid("wal_sync : %s", err.Error())
+	}
+
+	if c.WALSyncInterval <= 0 {
+		invalid("wal_sync_interval must be positive")
+	}
+
+	if c.SnapshotInterval <= 0 {
+		invalid("snapshot_interval must be positive")
+	}
+
+	if c.Capacity < 0 {
+		invalid("capacity must be zero or a positive number")
+	}
+
+	if _, err := topic.ParseOverflowPolicy(c.Overflow); err != nil {
+		invalid("overflow : %s", err.Error())
+	}
+
+	if c.BlockTimeout <= 0 {
+		invalid("block_timeout must be positive")
+	}
+
+	if c.MaxDeliveries < 0 {
+		invalid("max_deliveries must be zero or a positive number")
+	}
+
+	if c.TTL < 0 || c.Retention < 0 {
+		invalid("ttl and retention must be zero or a positive duration")
+	}
+
+	limited := c.Capacity > 0
+
+	for _, topicName := range c.topicNames() {
+
+		override := c.Topics[topicName]
+
+		if override == nil {
+			invalid("topics : %s has no settings", topicName)
+			continue
+		}
+
+		if override.Capacity != nil {
+
+			limited = true
+
+			if *override.Capacity < 1 {
+				invalid("capacity for %s must be a positive number", topicName)
+			}
+		}
+
+		if override.Overflow != "" {
+
+			if override.Capacity == nil {
+				invalid("overflow for %s needs a capacity", topicName)
+			}
+
+			if _, err := topic.ParseOverflowPolicy(override.Overflow); err != nil {
+				invalid("overflow for %s : %s", topicName, err.Error())
+			}
+		}
+
+		if override.MaxDeliveries != nil && *override.MaxDeliveries < 0 {
+			invalid("count for %s must be zero or a positive number", topicName)
+		}
+
+		if (override.TTL != nil && *override.TTL < 0) || (override.Retention != nil && *override.Retention < 0) {
+			invalid("duration for %s must be zero or a positive duration", topicName)
+		}
+	}
+
+	if c.Storage == "" {
+		switch {
+		case limited:
+			c.Storage = ringBufferStorage
+		case c.WALDirectory != "":
+			c.Storage = walStorage
+		default:
+			c.Storage = logStorage
+		}
+	}
+
+	switch c.Storage {
+	case logStorage, memoryStorage:
+	case ringBufferStorage:
+
+		if c.WALDirectory != "" {
+			invalid("wal_dir can not be combined with capacity or a topic capacity")
+		}
+
+	case walStorage:
+
+		if c.WALDirectory == "" {
+			invalid("wal storage needs wal_dir")
+		}
+
+		if limited {
+			invalid("wal_dir can not be combined with capacity or a topic capacity")
+		}
+
+	default:
+		invalid("storage must be log, memory, ring-buffer or wal but is %s", c.Storage)
+	}
+
+	if limited && c.Storage != ringBufferStorage && c.Storage != walStorage {
+		invalid("capacity needs ring-buffer storage")
+	}
+
+	if c.Shards < 1 {
+		invalid("shards must be a positive number")
+	}
+
+	if c.QueueSize < 1 {
+		invalid("queue_size must be a positive number")
+	}
+
+	if c.RequestTimeout <= 0 {
+		invalid("request_timeout must be positive")
+	}
+
+	if c.GracePeriod < 0 {
+		invalid("grace_period must be zero or a positive duration")
+	}
+
+	if c.MetricsSubscriberLabels < 0 {
+		invalid("metrics_subscriber_labels must be zero or a positive number")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration : %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// writes the configuration as JSON with secrets redacted
+func (c *config) write(w io.Writer) error {
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(redact(c))
+}
+
+// the overrides for a topic, created on first use
+func (c *config) topic(topicName string) *topicConfig {
+
+	if c.Topics == nil {
+		c.Topics = make(map[string]*topicConfig)
+	}
+
+	override, exists := c.Topics[topicName]
+
+	if !exists || override == nil {
+		override = &topicConfig{}
+		c.Topics[topicName] = override
+	}
+	return override
+}
+
+func (c *config) topicNames() []string {
+
+	names := make([]string, 0, len(c.Topics))
+
+	for topicName := range c.Topics {
+		names = append(names, topicName)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// options for a topic, its overrides applied over the defaults
+func (c *config) topicOptions(topicName string) topic.TopicOptions {
+
+	options := topic.TopicOptions{
+		MaxDeliveries: c.MaxDeliveries,
+		DefaultTTL:    time.Duration(c.TTL),
+		Retention:     time.Duration(c.Retention),
+	}
+
+	override, exists := c.Topics[topicName]
+
+	if !exists {
+		return options
+	}
+
+	if override.MaxDeliveries != nil {
+		options.MaxDeliveries = *override.MaxDeliveries
+	}
+
+	if override.TTL != nil {
+		options.DefaultTTL = time.Duration(*override.TTL)
+	}
+
+	if override.Retention != nil {
+		options.Retention = time.Duration(*override.Retention)
+	}
+	return options
+}
+
+// a copy of value with the string fields tagged secret:"true" replaced, recursing into structs
+func redact(value interface{}) interface{} {
+
+	original := reflect.Indirect(reflect.ValueOf(value))
+
+	if original.Kind() != reflect.Struct {
+		return value
+	}
+
+	copied := reflect.New(original.Type()).Elem()
+	copied.Set(original)
+
+	for i := 0; i < copied.NumField(); i++ {
+
+		field := copied.Field(i)
+
+		if !field.CanSet() {
+			continue
+		}
+
+		if copied.Type().Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString(redacted)
+			continue
+		}
+
+		if field.Kind() == reflect.Struct {
+			field.Set(reflect.ValueOf(redact(field.Interface())))
+		}
+	}
+	return copied.Interface()
+}
+
+// time.Duration read from and written as a string such as "1m30s"
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *duration) Set(value string) error {
+
+	parsed, err := time.ParseDuration(value)
+
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(content []byte) error {
+
+	var value string
+
+	if err := json.Unmarshal(content, &value); err != nil {
+		return fmt.Errorf("durations are strings such as \"1m30s\"")
+	}
+	return d.Set(value)
+}
+
+// flag.Value setting a per topic override from topic=value. Several may be
+// given separated by commas
+type topicFlag struct {
+	config   *config
+	expected string
+	set      func(override *topicConfig, value string) error
+}
+
+func (c *config) topicFlag(expected string, set func(*topicConfig, string) error) *topicFlag {
+	return &topicFlag{config: c, expected: expected, set: set}
+}
+
+func (f *topicFlag) String() string {
+	return ""
+}
+
+func (f *topicFlag) Set(value string) error {
+
+	for _, assignment := range strings.Split(value, ",") {
+
+		parts := strings.SplitN(assignment, "=", 2)
+
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("expected topic=%s but got %s", f.expected, assignment)
+		}
+
+		if err := f.set(f.config.topic(parts[0]), parts[1]); err != nil {
+			return fmt.Errorf("%s for %s : %s", f.expected, parts[0], err.Error())
+		}
+	}
+	return nil
+}
+
+// an empty policy falls back to -overflow
+func setTopicLimit(override *topicConfig, value string) error {
+
+	settings := strings.SplitN(value, ":", 2)
+	capacity, err := strconv.Atoi(settings[0])
+
+	if err != nil {
+		return err
+	}
+
+	override.Capacity = &capacity
+	override.Overflow = ""
+
+	if len(settings) == 2 {
+		override.Overflow = settings[1]
+	}
+	return nil
+}
+
+func setTopicMaxDeliveries(override *topicConfig, value string) error {
+
+	count, err := strconv.Atoi(value)
+
+	if err != nil {
+		return err
+	}
+
+	override.MaxDeliveries = &count
+	return nil
+}
+
+func setTopicTTL(override *topicConfig, value string) error {
+
+	parsed := duration(0)
+
+	if err := parsed.Set(value); err != nil {
+		return err
+	}
+
+	override.TTL = &parsed
+	return nil
+}
+
+func setTopicRetention(override *topicConfig, value string) error {
+
+	parsed := duration(0)
+
+	if err := parsed.Set(value); err != nil {
+		return err
+	}
+
+	override.Retention = &parsed
+	return nil
+}
+
+func isBlank(value string) bool {
+	return len(strings.TrimSpace(value)) == 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlagsTakePrecedenceOverTheEnvironmentAndTheFile(t *testing.T) {
+
+	path := writeConfig(t, `{"capacity": 10, "overflow": "reject", "shards": 2, "ttl": "1m", "topics": {"orders": {"capacity": 5, "ttl": "1h"}}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	environment := map[string]string{
+		"TAKE_HOME_CONFIG":    path,
+		"TAKE_HOME_SHARDS":    "3",
+		"TAKE_HOME_CAPACITY":  "20",
+		"TAKE_HOME_TOPIC_TTL": "orders=2h,audit=1s",
+	}
+
+	c, err := loadConfig("server", []string{"-capacity=30", "-topic-limit=audit=50:block"}, lookup(environment), flag.ContinueOnError)
+
+	if err != nil {
+		t.Fatal("The configuration should be valid : ", err)
+	}
+
+	if c.Capacity != 30 || c.Shards != 3 || c.Overflow != "reject" || time.Duration(c.TTL) != time.Minute {
+		t.Error("Flags should override the environment which overrides the file : ", c.Capacity, c.Shards, c.Overflow, c.TTL)
+	}
+
+	if c.Storage != ringBufferStorage {
+		t.Error("A capacity should imply ring-buffer storage but got ", c.Storage)
+	}
+
+	orders := c.topicOptions("orders")
+
+	if *c.Topics["orders"].Capacity != 5 || orders.DefaultTTL != 2*time.Hour {
+		t.Error("Topic overrides from the file and environment should be merged : ", orders)
+	}
+
+	if *c.Topics["audit"].Capacity != 50 || c.Topics["audit"].Overflow != "block" || c.topicOptions("audit").DefaultTTL != time.Second {
+		t.Error("Topic overrides from flags should be kept : ", c.Topics["audit"])
+	}
+
+	if c.topicOptions("other").DefaultTTL != time.Minute {
+		t.Error("Topics without overrides should have the defaults.")
+	}
+}
+
+func TestInvalidSettingsAreAllReported(t *testing.T) {
+
+	_, err := loadConfig("server", []string{"-capacity=-1", "-overflow=sometimes", "-wal-dir=data", "-storage=wal", "-topic-limit=audit=0", "-request-timeout=0s"}, lookup(nil), flag.ContinueOnError)
+
+	if err == nil {
+		t.Fatal("The configuration should be invalid.")
+	}
+
+	for _, problem := range []string{"capacity must be", "overflow :", "capacity for audit", "wal_dir can not be combined", "request_timeout"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Error("The error should report ", problem, " : ", err)
+		}
+	}
+
+	path := writeConfig(t, `{"capacity": 10, "unknown": true}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	if _, err := loadConfig("server", []string{"-config", path}, lookup(nil), flag.ContinueOnError); err == nil {
+		t.Error("A file with an unknown setting should be rejected.")
+	}
+}
+
+func TestPrintedConfigurationCanBeReadBack(t *testing.T) {
+
+	c, err := loadConfig("server", []string{"-wal-dir=data", "-topic-retention=orders=1h"}, lookup(nil), flag.ContinueOnError)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := &bytes.Buffer{}
+
+	if err := c.write(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfig(t, buffer.String())
+	defer os.RemoveAll(filepath.Dir(path))
+
+	read, err := loadConfig("server", []string{"-config", path}, lookup(nil), flag.ContinueOnError)
+
+	if err != nil {
+		t.Fatal("The printed configuration should be readable : ", err)
+	}
+
+	if read.Storage != walStorage || read.WALDirectory != "data" || read.topicOptions("orders").Retention != time.Hour {
+		t.Error("The printed configuration should have the same settings : ", buffer.String())
+	}
+}
+
+func TestSecretsAreRedacted(t *testing.T) {
+
+	type credentials struct {
+		User     string
+		Password string `secret:"true"`
+	}
+
+	type settings struct {
+		Token       string `secret:"true"`
+		Credentials credentials
+	}
+
+	original := &settings{Token: "token", Credentials: credentials{User: "user", Password: "password"}}
+	copied := redact(original).(settings)
+
+	if copied.Token != redacted || copied.Credentials.Password != redacted || copied.Credentials.User != "user" {
+		t.Error("Fields tagged secret should be redacted : ", copied)
+	}
+
+	if original.Token != "token" || original.Credentials.Password != "password" {
+		t.Error("Redacting should not change the original.")
+	}
+}
+
+func lookup(environment map[string]string) func(string) string {
+	return func(name string) string {
+		return environment[name]
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+
+	directory, err := ioutil.TempDir("", "config")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(directory, "server.json")
+
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -1,17 +1,268 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
 	"github.com/mdevilliers/take-home/cmd/server/app"
+	"github.com/mdevilliers/take-home/pkg/topic"
 	"github.com/zenazn/goji"
+	"github.com/zenazn/goji/bind"
+)
+
+// exit statuses
+const (
+	exitOK = 0
+	// the snapshot or write-ahead logs could not be flushed on shutdown so messages may be lost
+	exitFlushFailed = 1
+	// requests were still being served when the grace period ended and were cut off
+	exitGracePeriodExceeded = 2
 )
 
 func main() {
 
+	c, err := loadConfig(os.Args[0], os.Args[1:], os.Getenv, flag.ExitOnError)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if c.Print {
+
+		if err := c.write(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if c.LogFile != "" {
+
+		output, err := os.OpenFile(c.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+		if err != nil {
+			log.Fatal("Unable to open log file : ", err.Error())
+		}
+		log.SetOutput(output)
+	}
+
+	factory, err := channelFactory(c)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	registry := topic.NewTopicRegistryWithOptions(factory, c.topicOptions)
+
+	var snapshotter *app.Snapshotter
+
+	if c.SnapshotFile != "" {
+
+		snapshotter = app.NewSnapshotter(registry, c.SnapshotFile, time.Duration(c.SnapshotInterval))
+
+		err := snapshotter.Restore()
+
+		if err == topic.CorruptSnapshot || err == topic.UnsupportedSnapshotVersion {
+			log.Print("Snapshot ", c.SnapshotFile, " was not restored : ", err.Error())
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		snapshotter.Start()
+	}
+
+	// subscribers the snapshot did not restore, or all of them without one, get their logs back
+	if c.Storage == walStorage {
+
+		restored, err := topic.RestoreWALChannels(registry, c.WALDirectory)
+
+		if err != nil {
+			log.Fatal("Unable to restore write-ahead logs : ", err.Error())
+		}
+		log.Println("Restored", restored, "write-ahead logs from", c.WALDirectory)
+	}
+
+	scheduler, err := newScheduler(c, registry)
+
+	if err != nil {
+		log.Fatal("Unable to restore scheduled messages : ", err.Error())
+	}
+
 	// creates an instance of the api to serve
-	api := app.NewApi()
+	service := app.NewServiceWithOptions(registry, scheduler, app.ServiceOptions{
+		Shards:    c.Shards,
+		QueueSize: c.QueueSize,
+	})
+
+	// the Api takes 0 to mean its default, the configuration to mean no subscriber series
+	subscriberLabels := c.MetricsSubscriberLabels
+
+	if subscriberLabels == 0 {
+		subscriberLabels = -1
+	}
+
+	api := app.NewApiWithOptions(service, app.ApiOptions{
+		RequestTimeout:   time.Duration(c.RequestTimeout),
+		SubscriberLabels: subscriberLabels,
+		AdminToken:       c.AdminToken,
+	})
 
 	// sets up the default routes
 	api.Route(goji.DefaultMux)
+	goji.DefaultMux.Compile()
+	http.Handle("/", goji.DefaultMux)
+
+	listener := bind.Socket(c.Bind)
+	log.Println("Starting on", listener.Addr())
+
+	server := &http.Server{Handler: http.DefaultServeMux}
+	served := make(chan error, 1)
+
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	bind.Ready()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-served:
+		log.Fatal("Unable to serve : ", err.Error())
+	case received := <-signals:
+		log.Print("Received ", received, ", shutting down")
+	}
+
+	os.Exit(shutdown(time.Duration(c.GracePeriod), server, api, service, snapshotter, registry))
+}
+
+// stops accepting connections and gives the requests being served -grace-period to finish,
+// then stops the service and flushes the snapshot and write-ahead logs. Returns the exit status
+func shutdown(gracePeriod time.Duration, server *http.Server, api *app.Api, service *app.Service, snapshotter *app.Snapshotter, registry topic.Registry) int {
+
+	status := exitOK
+
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	// long polls, streams and WebSockets would otherwise hold the server open
+	api.Close()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Print("Requests did not finish within the grace period : ", err.Error())
+		server.Close()
+		status = exitGracePeriodExceeded
+	}
+
+	service.Close()
+
+	if snapshotter != nil {
+		if err := snapshotter.Stop(); err != nil {
+			log.Print("Unable to save snapshot on shutdown : ", err.Error())
+			status = exitFlushFailed
+		}
+	}
+
+	if err := registry.Close(); err != nil {
+		log.Print("Unable to flush write-ahead logs on shutdown : ", err.Error())
+		status = exitFlushFailed
+	}
+
+	log.Print("Stopped")
+	return status
+}
+
+// selects the Channel implementation from the configuration
+func channelFactory(c *config) (topic.ChannelFactory, error) {
+
+	switch c.Storage {
+	case memoryStorage:
+		return topic.InMemoryChannelFactory, nil
+
+	case ringBufferStorage:
+
+		defaults, err := ringBufferOptions(c, c.Capacity, c.Overflow)
+
+		if err != nil {
+			return nil, err
+		}
+
+		topics := make(map[string]topic.RingBufferOptions)
+
+		for topicName, override := range c.Topics {
+
+			if override.Capacity == nil {
+				continue
+			}
+
+			policy := override.Overflow
+
+			if policy == "" {
+				policy = c.Overflow
+			}
+
+			options, err := ringBufferOptions(c, *override.Capacity, policy)
+
+			if err != nil {
+				return nil, err
+			}
+			topics[topicName] = options
+		}
+
+		return topic.RingBufferChannelFactory(defaults, topics), nil
+
+	case walStorage:
+
+		policy, err := topic.ParseSyncPolicy(c.WALSync)
+
+		if err != nil {
+			return nil, err
+		}
+
+		options := topic.DefaultWALOptions
+		options.Sync = policy
+		options.SyncInterval = time.Duration(c.WALSyncInterval)
+
+		log.Println("Using write-ahead log in", c.WALDirectory, "with sync policy", policy)
+
+		return topic.WALChannelFactory(c.WALDirectory, options), nil
+	}
+
+	// a nil factory shares a log between the subscribers of each topic
+	return nil, nil
+}
+
+// a scheduler which saves scheduled messages alongside the write-ahead logs or snapshot, if either is used
+func newScheduler(c *config, registry topic.Registry) (*topic.Scheduler, error) {
+
+	if c.Storage == walStorage {
+		return topic.NewPersistentScheduler(registry, filepath.Join(c.WALDirectory, "scheduled"))
+	}
+
+	if c.SnapshotFile != "" {
+		return topic.NewPersistentScheduler(registry, c.SnapshotFile+".scheduled")
+	}
+
+	return topic.NewScheduler(registry), nil
+}
+
+func ringBufferOptions(c *config, capacity int, overflow string) (topic.RingBufferOptions, error) {
+
+	policy, err := topic.ParseOverflowPolicy(overflow)
+
+	if err != nil {
+		return topic.RingBufferOptions{}, err
+	}
 
-	goji.Serve()
+	return topic.RingBufferOptions{
+		Capacity:     capacity,
+		Overflow:     policy,
+		BlockTimeout: time.Duration(c.BlockTimeout),
+	}, nil
 }
@@ -3,24 +3,73 @@ package topic
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 var (
 	NoMessagesAvailable = errors.New("No messages available in channel")
 )
 
-// A Channel is a store of messages for a user. 
+// A Channel is a store of messages for a user.
 type Channel interface {
-	Push(message *Message)
+	Push(message *Message) error
 	Pop() (*Message, error)
+	// the message Pop would return, without removing it
+	Peek() (*Message, error)
 	Count() int
+	// pending messages, oldest first, without removing them
+	Messages() []*Message
+	// at most limit pending messages starting offset messages from the oldest, without removing them
+	Browse(offset int, limit int) []*Message
+}
+
+// A DisposableChannel holds resources which are released when it is removed from a Topic
+type DisposableChannel interface {
+	Channel
+	Dispose() error
+}
+
+// A ClosableChannel holds resources, such as an open file, which are flushed and released by Close
+type ClosableChannel interface {
+	Channel
+	Close() error
+}
+
+// A BoundedChannel has a fixed capacity and may refuse messages once it is full
+type BoundedChannel interface {
+	Channel
+	// true if the next Push would fail with ChannelFull
+	WouldReject() bool
+	// true if one of the next count Pushes would fail with ChannelFull
+	WouldRejectBatch(count int) bool
+	// true if one of the next count Pushes would wait for space, with how long it would wait
+	WouldBlockBatch(count int) (time.Duration, bool)
+	// true if count more messages do not fit and the overflow policy is to refuse them or
+	// wait for space rather than to drop messages
+	WouldOverflow(count int) bool
+}
+
+// A RetractableChannel can take back the messages most recently pushed to it, so a
+// transaction which fails part way can be rolled back
+type RetractableChannel interface {
+	Channel
+	// removes the last count messages pushed, which must not have been popped
+	Retract(count int) error
+}
+
+// A ChannelFactory creates the Channel for a subscriber to a Topic
+type ChannelFactory func(topicName string, channelName string) (Channel, error)
+
+// ChannelFactory returning an InMemoryChannel
+func InMemoryChannelFactory(topicName string, channelName string) (Channel, error) {
+	return NewChannel(), nil
 }
 
 type Channels []*Channel
 
 // Create a Channel with an InMemory implementation
 // Safe for use via a goroutine
-// WARNING : message store length is unbounded
+// WARNING : message store length is unbounded, see NewRingBufferChannel for a bounded Channel
 func NewChannel() Channel {
 	return &InMemoryChannel{
 		messageStore: make([]*Message, 0),
@@ -30,19 +79,19 @@ func NewChannel() Channel {
 
 type InMemoryChannel struct {
 	sync.RWMutex
-	// REVIEW : look at using a RingBuffer with a fixed length rather than an unbounded array
 	messageStore []*Message
 	messageCount int
 }
 
 // Pushes a message to the store
-func (c *InMemoryChannel) Push(message *Message) {
+func (c *InMemoryChannel) Push(message *Message) error {
 
 	c.Lock()
 	defer c.Unlock()
 
 	c.messageStore = append(c.messageStore, message)
 	c.messageCount++
+	return nil
 }
 
 // Pops a message from the store
@@ -62,6 +111,18 @@ func (c *InMemoryChannel) Pop() (*Message, error) {
 	return nil, NoMessagesAvailable
 }
 
+// Returns the next message without removing it
+func (c *InMemoryChannel) Peek() (*Message, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.messageCount > 0 {
+		return c.messageStore[0], nil
+	}
+	return nil, NoMessagesAvailable
+}
+
 // Current count of messages waiting to be delivered
 func (c *InMemoryChannel) Count() int {
 
@@ -70,3 +131,62 @@ func (c *InMemoryChannel) Count() int {
 
 	return c.messageCount
 }
+
+// Returns a copy of the messages waiting to be delivered
+func (c *InMemoryChannel) Messages() []*Message {
+
+	c.Lock()
+	defer c.Unlock()
+
+	messages := make([]*Message, len(c.messageStore))
+	copy(messages, c.messageStore)
+	return messages
+}
+
+// Returns a copy of a window of the messages waiting to be delivered
+func (c *InMemoryChannel) Browse(offset int, limit int) []*Message {
+
+	c.Lock()
+	defer c.Unlock()
+
+	start, end := window(len(c.messageStore), offset, limit)
+	messages := make([]*Message, end-start)
+	copy(messages, c.messageStore[start:end])
+	return messages
+}
+
+// Removes the last count messages pushed
+func (c *InMemoryChannel) Retract(count int) error {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if count > c.messageCount {
+		count = c.messageCount
+	}
+
+	for i := c.messageCount - count; i < c.messageCount; i++ {
+		c.messageStore[i] = nil
+	}
+
+	c.messageStore = c.messageStore[:c.messageCount-count]
+	c.messageCount -= count
+	return nil
+}
+
+// bounds of the window of at most limit entries from offset within length entries
+func window(length int, offset int, limit int) (int, int) {
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	if offset > length {
+		offset = length
+	}
+
+	if limit < 0 || limit > length-offset {
+		limit = length - offset
+	}
+	return offset, offset + limit
+}
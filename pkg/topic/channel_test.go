@@ -1,6 +1,8 @@
 package topic
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -40,6 +42,77 @@ func TestMessagesAddedCanBeRetrieved(t *testing.T) {
 	assertChannelLength(t, channel, 0)
 }
 
+func TestPeekDoesNotRemoveTheNextMessage(t *testing.T) {
+
+	channels := map[string]Channel{
+		"in memory":   NewChannel(),
+		"ring buffer": NewRingBufferChannel(RingBufferOptions{Capacity: 2}),
+		"log":         NewLog(DefaultSegmentSize).NewChannel(),
+	}
+
+	for name, channel := range channels {
+
+		if _, err := channel.Peek(); err != NoMessagesAvailable {
+			t.Error("Peeking an empty channel should return NoMessagesAvailable : ", name)
+		}
+
+		channel.Push(NewMessage([]byte("message-1")))
+
+		if message, err := channel.Peek(); err != nil || message.String() != "message-1" {
+			t.Error("Peeking should return the next message : ", name)
+		}
+
+		assertChannelLength(t, channel, 1)
+		assertMessageRetreivedWithExpectedContent(t, channel, "message-1")
+	}
+}
+
+func TestBrowseReturnsAWindowOfMessagesWithoutRemovingThem(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	wal, err := NewWALChannel(filepath.Join(directory, "browse.wal"), DefaultWALOptions)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.(ClosableChannel).Close()
+
+	channels := map[string]Channel{
+		"in memory":   NewChannel(),
+		"ring buffer": NewRingBufferChannel(RingBufferOptions{Capacity: 4}),
+		"log":         NewLog(DefaultSegmentSize).NewChannel(),
+		"wal":         wal,
+	}
+
+	for name, channel := range channels {
+
+		for _, body := range []string{"message-0", "message-1", "message-2", "message-3"} {
+			channel.Push(NewMessage([]byte(body)))
+		}
+
+		// the ring buffer wraps around
+		channel.Pop()
+		channel.Push(NewMessage([]byte("message-4")))
+
+		if browsed := channel.Browse(1, 2); len(browsed) != 2 || browsed[0].String() != "message-2" || browsed[1].String() != "message-3" {
+			t.Error("Browsing should return the window of messages : ", name, browsed)
+		}
+
+		if browsed := channel.Browse(3, 5); len(browsed) != 1 || browsed[0].String() != "message-4" {
+			t.Error("Browsing should stop at the last message : ", name, browsed)
+		}
+
+		if browsed := channel.Browse(5, 1); len(browsed) != 0 {
+			t.Error("Browsing beyond the last message should return nothing : ", name, browsed)
+		}
+
+		assertChannelLength(t, channel, 4)
+		assertMessageRetreivedWithExpectedContent(t, channel, "message-1")
+	}
+}
+
 func assertChannelLength(t *testing.T, channel Channel, expectedCount int) {
 
 	actualCount := channel.Count()
@@ -61,3 +134,56 @@ func assertMessageRetreivedWithExpectedContent(t *testing.T, channel Channel, ex
 		t.Error("Incorrect content for message. Expected :", expectedContent, " Actual :", message.String())
 	}
 }
+
+func TestRetractRemovesTheMessagesPushedLast(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "retract.wal")
+	wal, err := NewWALChannel(path, DefaultWALOptions)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channels := map[string]Channel{
+		"in memory":   NewChannel(),
+		"ring buffer": NewRingBufferChannel(RingBufferOptions{Capacity: 3}),
+		"wal":         wal,
+	}
+
+	for name, channel := range channels {
+
+		for _, body := range []string{"message-0", "message-1", "message-2"} {
+			channel.Push(NewMessage([]byte(body)))
+		}
+
+		// the ring buffer wraps around
+		channel.Pop()
+		channel.Push(NewMessage([]byte("message-3")))
+
+		if err := channel.(RetractableChannel).Retract(2); err != nil {
+			t.Error("Retracting should not fail : ", name, err)
+		}
+
+		assertChannelLength(t, channel, 1)
+		channel.Push(NewMessage([]byte("message-4")))
+
+		if messages := channel.Messages(); len(messages) != 2 || messages[0].String() != "message-1" || messages[1].String() != "message-4" {
+			t.Error("Only the messages pushed last should be retracted : ", name, messages)
+		}
+	}
+
+	wal.(ClosableChannel).Close()
+	reopened, err := NewWALChannel(path, DefaultWALOptions)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.(ClosableChannel).Close()
+
+	if messages := reopened.Messages(); len(messages) != 2 || messages[1].String() != "message-4" {
+		t.Error("Retracted messages should not be replayed : ", messages)
+	}
+}
@@ -0,0 +1,53 @@
+package topic
+
+import (
+	"strconv"
+	"strings"
+)
+
+// appended to the name of a topic to give the topic its dead letters are moved to
+const DeadLetterSuffix = ".dlq"
+
+// headers added to a message when it is moved to a dead letter topic
+const (
+	OriginalTopicHeader      = "original-topic"
+	OriginalSubscriberHeader = "original-subscriber"
+	DeliveryCountHeader      = "delivery-count"
+)
+
+// A message which was delivered to a subscriber the maximum number of times without being acknowledged
+type DeadLetter struct {
+	Topic      string
+	Subscriber string
+	Message    *Message
+	Deliveries int
+}
+
+// Name of the topic dead letters from topicName are moved to
+func DeadLetterTopicName(topicName string) string {
+	return topicName + DeadLetterSuffix
+}
+
+// True if topicName holds dead letters. Messages are never dead lettered from such a topic
+func IsDeadLetterTopic(topicName string) bool {
+	return strings.HasSuffix(topicName, DeadLetterSuffix)
+}
+
+// The message to keep in the dead letter topic, carrying where it came from and how often it failed.
+// Dead letters never expire so they stay until they are replayed or purged
+func (d *DeadLetter) HeaderedMessage() *Message {
+	return d.Message.withoutExpiry().WithHeaders(map[string]string{
+		OriginalTopicHeader:      d.Topic,
+		OriginalSubscriberHeader: d.Subscriber,
+		DeliveryCountHeader:      strconv.Itoa(d.Deliveries),
+	})
+}
+
+// Removes the headers added by HeaderedMessage
+func StripDeadLetterHeaders(message *Message) *Message {
+	return message.WithHeaders(map[string]string{
+		OriginalTopicHeader:      "",
+		OriginalSubscriberHeader: "",
+		DeliveryCountHeader:      "",
+	})
+}
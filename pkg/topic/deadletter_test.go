@@ -0,0 +1,77 @@
+package topic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageIsDeadLetteredAfterMaxDeliveries(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+	topic.SetOptions(TopicOptions{MaxDeliveries: 2})
+	topic.AddChannel("subscriber")
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+
+	first, _ := topic.LeaseNextMessage("subscriber", time.Minute)
+	topic.Nack("subscriber", first.Receipt)
+
+	if len(topic.TakeDeadLetters()) != 0 {
+		t.Error("A message should not be dead lettered before its last delivery.")
+	}
+
+	topic.LeaseNextMessage("subscriber", time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	topic.Sweep()
+
+	deadLetters := topic.TakeDeadLetters()
+
+	if len(deadLetters) != 1 {
+		t.Fatal("The message should have been dead lettered after 2 deliveries.")
+	}
+
+	message := deadLetters[0].HeaderedMessage()
+
+	if message.String() != "message-1" ||
+		message.Header(OriginalTopicHeader) != "topic-1" ||
+		message.Header(OriginalSubscriberHeader) != "subscriber" ||
+		message.Header(DeliveryCountHeader) != "2" {
+		t.Error("The dead letter should carry its origin and delivery count : ", message.Headers())
+	}
+
+	if len(StripDeadLetterHeaders(message).Headers()) != 0 {
+		t.Error("Dead letter headers should be removable.")
+	}
+
+	if _, err := topic.GetNextMessage("subscriber"); err != NoMessagesAvailable {
+		t.Error("A dead lettered message should not be delivered again.")
+	}
+}
+
+func TestDeadLetterTopicsNeverDeadLetter(t *testing.T) {
+
+	topic := NewTopic(DeadLetterTopicName("topic-1"))
+	topic.SetOptions(TopicOptions{MaxDeliveries: 1})
+
+	if topic.Options().MaxDeliveries != 0 {
+		t.Error("A dead letter topic should have unlimited deliveries.")
+	}
+}
+
+func TestDeliveredMessageIsOnlySeenByOneChannel(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+	topic.AddChannel("subscriber-1")
+	topic.AddChannel("subscriber-2")
+
+	topic.Deliver("subscriber-1", NewMessage([]byte("message-1")))
+
+	pending, _ := topic.Pending("subscriber-1")
+
+	if len(pending) != 1 || pending[0].String() != "message-1" {
+		t.Error("subscriber-1 should have the delivered message pending.")
+	}
+
+	if _, err := topic.GetNextMessage("subscriber-2"); err != NoMessagesAvailable {
+		t.Error("subscriber-2 should not receive a message delivered to subscriber-1.")
+	}
+}
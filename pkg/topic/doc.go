@@ -4,6 +4,20 @@
 //
 // 	The Channel class holds an ordered list of references to Message objects for a specific listener in a Topic.
 //
+//	The Log class is an append only list of messages shared by the subscribers of a Topic, each reading through it with a LogChannel.
+//
+//	The WALChannel class is a Channel which records every push and pop in a write-ahead log so pending messages survive a restart.
+//
+//	The RingBufferChannel class is a Channel with a fixed capacity and a policy for what happens when it is full.
+//
+//	Consumer groups on a Topic share its messages between their members, each message going to one member of every group.
+//
+//	A Filter chosen by a subscriber limits the messages its Channel receives by their headers and JSON content.
+//
+//	A wildcard Topic, e.g. orders.+.created or orders.#, is forwarded the messages published to the topics in its Registry matching it.
+//
+//	PublishTransaction publishes messages to several Topics of a Registry so every subscriber receives all of them or none.
+//
 //	The Topic class holds the mechanism by which a user is un/subscribed from a topic
 //  and by which a message can be pushed or poped from their Channel
 //
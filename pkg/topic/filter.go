@@ -0,0 +1,589 @@
+package topic
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A subscriber's choice of the messages it receives, matched against the headers of a
+// message and the fields of a JSON body. For example
+//
+//	header.region == 'eu' && (body.order.total >= 100 || !body.order.paid)
+//
+// header.<name> is the header with that name, ignoring case.
+// body.<path> is a field of a JSON object, with array elements selected by index, e.g. body.items.0.sku.
+// A field can be compared with == != < <= > >= to a quoted string, a number, true, false or null,
+// or used on its own to test that it exists and is not false or null. Comparisons combine with && (and), || (or),
+// ! (not) and parentheses.
+// A field which does not exist only equals null. Header values are compared as numbers or booleans
+// when compared with one. Comparing values of different types never matches, although != does
+type Filter struct {
+	expression string
+	root       filterNode
+}
+
+// Limits on a filter expression, so parsing and matching one can not exhaust the stack
+var (
+	MaxFilterLength = 4096
+	// parentheses and nots nested in one another
+	MaxFilterDepth = 64
+)
+
+// Parses a filter expression, returning an error describing where it is invalid
+func ParseFilter(expression string) (*Filter, error) {
+
+	if len(expression) > MaxFilterLength {
+		return nil, fmt.Errorf("filter: longer than %d characters", MaxFilterLength)
+	}
+
+	tokens, err := tokenizeFilter(expression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filterParser{tokens: tokens}
+	root, err := parser.parseOr()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if token := parser.peek(); token.kind != endToken {
+		return nil, fmt.Errorf("filter: unexpected %s at position %d", token, token.position)
+	}
+	return &Filter{expression: expression, root: root}, nil
+}
+
+// The expression the filter was parsed from
+func (f *Filter) String() string {
+	return f.expression
+}
+
+// Whether the message is chosen by the filter. A nil filter matches every message
+func (f *Filter) Match(message *Message) bool {
+
+	if f == nil {
+		return true
+	}
+	return f.root.match(&filterSubject{message: message})
+}
+
+// Replaces the filter of a channel, choosing the messages it receives from those published or
+// read from now on. A nil filter receives every message. If the channel does not exist, or belongs
+// to a consumer group, returns a ChannelNotFoundError
+func (t *Topic) SetFilter(channelName string, filter *Filter) error {
+
+	t.Lock()
+	defer t.Unlock()
+
+	if _, member := t.groupOf[channelName]; member || t.channels[channelName] == nil {
+		return ChannelNotFoundError
+	}
+
+	if filter == nil {
+		delete(t.filters, channelName)
+	} else {
+		t.filters[channelName] = filter
+	}
+	return nil
+}
+
+// the expression of the filter of each channel with one
+func (t *Topic) filterExpressions() map[string]string {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	expressions := make(map[string]string, len(t.filters))
+
+	for channelName, filter := range t.filters {
+		expressions[channelName] = filter.String()
+	}
+	return expressions
+}
+
+// a message being matched, with its body decoded once when a field of it is needed
+type filterSubject struct {
+	message *Message
+	decoded bool
+	body    interface{}
+}
+
+func (s *filterSubject) document() interface{} {
+
+	if !s.decoded {
+		s.decoded = true
+
+		if err := json.Unmarshal(s.message.Bytes(), &s.body); err != nil {
+			s.body = nil
+		}
+	}
+	return s.body
+}
+
+type filterNode interface {
+	match(subject *filterSubject) bool
+}
+
+type orNode struct{ left, right filterNode }
+
+func (n orNode) match(subject *filterSubject) bool {
+	return n.left.match(subject) || n.right.match(subject)
+}
+
+type andNode struct{ left, right filterNode }
+
+func (n andNode) match(subject *filterSubject) bool {
+	return n.left.match(subject) && n.right.match(subject)
+}
+
+type notNode struct{ operand filterNode }
+
+func (n notNode) match(subject *filterSubject) bool {
+	return !n.operand.match(subject)
+}
+
+type presentNode struct{ field filterField }
+
+func (n presentNode) match(subject *filterSubject) bool {
+
+	value, found := n.field.lookup(subject)
+	return found && value != nil && value != false
+}
+
+type compareNode struct {
+	field    filterField
+	operator string
+	// a string, float64, bool or nil for null
+	literal interface{}
+}
+
+func (n compareNode) match(subject *filterSubject) bool {
+
+	value, found := n.field.lookup(subject)
+
+	if n.field.header && found {
+		value = coerceHeader(value.(string), n.literal)
+	}
+
+	switch n.operator {
+	case "==":
+		return filterEqual(value, found, n.literal)
+	case "!=":
+		return !filterEqual(value, found, n.literal)
+	}
+
+	if !found {
+		return false
+	}
+
+	order, comparable := filterOrder(value, n.literal)
+
+	if !comparable {
+		return false
+	}
+
+	switch n.operator {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	}
+	return order >= 0
+}
+
+// a header of a message, or a path into its JSON body
+type filterField struct {
+	header bool
+	path   []string
+}
+
+func (f filterField) lookup(subject *filterSubject) (interface{}, bool) {
+
+	if f.header {
+
+		name := f.path[0]
+
+		if value, found := subject.message.headers[name]; found {
+			return value, true
+		}
+
+		for header, value := range subject.message.headers {
+			if strings.EqualFold(header, name) {
+				return value, true
+			}
+		}
+		return nil, false
+	}
+
+	value := subject.document()
+
+	for _, segment := range f.path {
+
+		switch node := value.(type) {
+		case map[string]interface{}:
+
+			child, found := node[segment]
+
+			if !found {
+				return nil, false
+			}
+			value = child
+
+		case []interface{}:
+
+			index, err := strconv.Atoi(segment)
+
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			value = node[index]
+
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// header values are text, so read them as the type they are compared with
+func coerceHeader(value string, literal interface{}) interface{} {
+
+	switch literal.(type) {
+	case float64:
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			return number
+		}
+	case bool:
+		if boolean, err := strconv.ParseBool(value); err == nil {
+			return boolean
+		}
+	}
+	return value
+}
+
+func filterEqual(value interface{}, found bool, literal interface{}) bool {
+
+	if literal == nil {
+		return !found || value == nil
+	}
+
+	if !found {
+		return false
+	}
+
+	if boolean, ok := literal.(bool); ok {
+		other, ok := value.(bool)
+		return ok && other == boolean
+	}
+
+	order, comparable := filterOrder(value, literal)
+	return comparable && order == 0
+}
+
+// compares two strings or two numbers
+func filterOrder(value interface{}, literal interface{}) (int, bool) {
+
+	switch expected := literal.(type) {
+	case float64:
+
+		number, ok := value.(float64)
+
+		if !ok {
+			return 0, false
+		}
+
+		if number < expected {
+			return -1, true
+		} else if number > expected {
+			return 1, true
+		}
+		return 0, true
+
+	case string:
+
+		text, ok := value.(string)
+
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(text, expected), true
+	}
+	return 0, false
+}
+
+type filterTokenKind int
+
+const (
+	endToken filterTokenKind = iota
+	wordToken
+	stringToken
+	numberToken
+	operatorToken
+)
+
+type filterToken struct {
+	kind     filterTokenKind
+	text     string
+	position int
+}
+
+func (t filterToken) String() string {
+
+	if t.kind == endToken {
+		return "end of filter"
+	}
+	return strconv.Quote(t.text)
+}
+
+func (t filterToken) is(operator string, keyword string) bool {
+	return (t.kind == operatorToken && t.text == operator) || (t.kind == wordToken && t.text == keyword)
+}
+
+// operators, longest first so <= is not read as <
+var filterOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+
+	var tokens []filterToken
+	position := 0
+
+	for position < len(expression) {
+
+		c := expression[position]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			position++
+
+		case c == '\'' || c == '"':
+
+			end := strings.IndexByte(expression[position+1:], c)
+
+			if end < 0 {
+				return nil, fmt.Errorf("filter: unterminated string at position %d", position)
+			}
+			tokens = append(tokens, filterToken{stringToken, expression[position+1 : position+1+end], position})
+			position += end + 2
+
+		case isFilterDigit(c) || (c == '-' && position+1 < len(expression) && isFilterDigit(expression[position+1])):
+
+			end := position + 1
+
+			for end < len(expression) && (isFilterDigit(expression[end]) || expression[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, filterToken{numberToken, expression[position:end], position})
+			position = end
+
+		case isFilterWord(c):
+
+			end := position + 1
+
+			for end < len(expression) && (isFilterWord(expression[end]) || isFilterDigit(expression[end]) || expression[end] == '-' || expression[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, filterToken{wordToken, expression[position:end], position})
+			position = end
+
+		default:
+
+			matched := false
+
+			for _, operator := range filterOperators {
+				if strings.HasPrefix(expression[position:], operator) {
+					tokens = append(tokens, filterToken{operatorToken, operator, position})
+					position += len(operator)
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				return nil, fmt.Errorf("filter: unexpected %q at position %d", c, position)
+			}
+		}
+	}
+	return append(tokens, filterToken{kind: endToken, position: len(expression)}), nil
+}
+
+func isFilterDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isFilterWord(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// recursive descent over
+//
+//	or         : and { (|| | or) and }
+//	and        : unary { (&& | and) unary }
+//	unary      : (! | not) unary | ( or ) | field [ comparison literal ]
+type filterParser struct {
+	tokens []filterToken
+	next   int
+	// parentheses and nots the parser is within
+	depth int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+
+	token := p.tokens[p.next]
+
+	if token.kind != endToken {
+		p.next++
+	}
+	return token
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+
+	left, err := p.parseAnd()
+
+	for err == nil && p.peek().is("||", "or") {
+
+		p.take()
+
+		var right filterNode
+		right, err = p.parseAnd()
+		left = orNode{left, right}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+
+	left, err := p.parseUnary()
+
+	for err == nil && p.peek().is("&&", "and") {
+
+		p.take()
+
+		var right filterNode
+		right, err = p.parseUnary()
+		left = andNode{left, right}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+
+	token := p.take()
+
+	if token.is("!", "not") || token.is("(", "") {
+
+		if p.depth++; p.depth > MaxFilterDepth {
+			return nil, fmt.Errorf("filter: nested more than %d deep at position %d", MaxFilterDepth, token.position)
+		}
+		defer func() { p.depth-- }()
+	}
+
+	if token.is("!", "not") {
+
+		operand, err := p.parseUnary()
+		return notNode{operand}, err
+	}
+
+	if token.is("(", "") {
+
+		inner, err := p.parseOr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if closing := p.take(); !closing.is(")", "") {
+			return nil, fmt.Errorf("filter: expected ) at position %d, found %s", closing.position, closing)
+		}
+		return inner, nil
+	}
+
+	field, err := parseFilterField(token)
+
+	if err != nil {
+		return nil, err
+	}
+
+	operator := p.peek()
+
+	if operator.kind != operatorToken || !isFilterComparison(operator.text) {
+		return presentNode{field}, nil
+	}
+	p.take()
+
+	literal, err := parseFilterLiteral(p.take())
+
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{field: field, operator: operator.text, literal: literal}, nil
+}
+
+func parseFilterField(token filterToken) (filterField, error) {
+
+	if token.kind == wordToken {
+
+		segments := strings.Split(token.text, ".")
+		valid := len(segments) > 1
+
+		for _, segment := range segments {
+			valid = valid && segment != ""
+		}
+
+		switch {
+		case valid && segments[0] == "header" && len(segments) == 2:
+			return filterField{header: true, path: segments[1:]}, nil
+		case valid && segments[0] == "body":
+			return filterField{path: segments[1:]}, nil
+		}
+	}
+	return filterField{}, fmt.Errorf("filter: expected header.<name> or body.<path> at position %d, found %s", token.position, token)
+}
+
+func parseFilterLiteral(token filterToken) (interface{}, error) {
+
+	switch token.kind {
+	case stringToken:
+		return token.text, nil
+
+	case numberToken:
+
+		number, err := strconv.ParseFloat(token.text, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("filter: invalid number %s at position %d", token, token.position)
+		}
+		return number, nil
+
+	case wordToken:
+
+		switch token.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("filter: expected a string, number, true, false or null at position %d, found %s", token.position, token)
+}
+
+func isFilterComparison(operator string) bool {
+
+	switch operator {
+	case "==", "!=", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
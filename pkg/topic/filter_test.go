@@ -0,0 +1,141 @@
+package topic
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFiltersMatchHeadersAndJsonFields(t *testing.T) {
+
+	message := NewMessage([]byte(`{"order": {"total": 150, "paid": false, "items": [{"sku": "a-1"}]}, "note": null}`)).
+		WithHeaders(map[string]string{"region": "eu", "priority": "3"})
+
+	for expression, expected := range map[string]bool{
+		"header.region == 'eu'":                                              true,
+		"header.Region == \"eu\"":                                            true,
+		"header.region != 'eu'":                                              false,
+		"header.priority > 2":                                                true,
+		"header.priority >= 4":                                               false,
+		"header.missing":                                                     false,
+		"header.missing == null":                                             true,
+		"body.order.total >= 100 && !body.order.paid":                        true,
+		"body.order.total < 100 or body.order.paid == true":                  false,
+		"body.order.items.0.sku == 'a-1'":                                    true,
+		"body.order.items.1":                                                 false,
+		"body.note == null && !body.note":                                    true,
+		"body.order.total == '150'":                                          false,
+		"body.order.total != '150'":                                          true,
+		"not (header.region == 'us' || body.order.total < 0)":                true,
+		"header.region == 'us' && body.order.paid || body.order.total > 100": true,
+	} {
+
+		filter, err := ParseFilter(expression)
+
+		if err != nil {
+			t.Error("Unable to parse filter ", expression, " : ", err)
+			continue
+		}
+
+		if filter.Match(message) != expected {
+			t.Error("Filter ", expression, " should match ", expected)
+		}
+	}
+
+	filter, _ := ParseFilter("body.order.total > 1")
+
+	if filter.Match(NewMessage([]byte("not json"))) {
+		t.Error("Body fields of a message which is not JSON should not exist.")
+	}
+}
+
+func TestInvalidFiltersAreRejected(t *testing.T) {
+
+	for _, expression := range []string{
+		"",
+		"region == 'eu'",
+		"header.region ==",
+		"header.region == 'eu",
+		"header.region == eu",
+		"(header.region == 'eu'",
+		"header.region == 'eu' header.priority",
+		"header.a.b",
+		"body.",
+		"header.region ~ 'eu'",
+		strings.Repeat("(", MaxFilterDepth+1) + "header.region" + strings.Repeat(")", MaxFilterDepth+1),
+		strings.Repeat("!", MaxFilterDepth+1) + "header.region",
+		strings.Repeat("header.region || ", MaxFilterLength/16) + "header.region",
+	} {
+		if _, err := ParseFilter(expression); err == nil {
+			t.Error("Filter ", expression, " should not be parsed.")
+		}
+	}
+
+	nested := strings.Repeat("(", MaxFilterDepth) + "header.region" + strings.Repeat(")", MaxFilterDepth)
+
+	if _, err := ParseFilter(nested); err != nil {
+		t.Error("A filter nested as deep as allowed should be parsed : ", err)
+	}
+}
+
+func TestChannelsOnlyReceiveMessagesMatchingTheirFilter(t *testing.T) {
+
+	filter, _ := ParseFilter("header.region == 'eu'")
+
+	for _, topic := range []*Topic{NewTopic("topic-1"), NewTopicWithChannelFactory("topic-1", InMemoryChannelFactory)} {
+
+		topic.AddChannel("subscriber-1")
+		topic.AddChannel("subscriber-2")
+
+		if err := topic.SetFilter("subscriber-1", filter); err != nil {
+			t.Fatal("Setting a filter should not fail : ", err)
+		}
+
+		topic.PublishMessage(NewMessage([]byte("message-1")).WithHeaders(map[string]string{"region": "us"}))
+		topic.PublishMessage(NewMessage([]byte("message-2")).WithHeaders(map[string]string{"region": "eu"}))
+
+		if pending, _ := topic.Pending("subscriber-1"); len(pending) != 1 || pending[0].String() != "message-2" {
+			t.Error("A filtered channel should only hold matching messages : ", len(pending))
+		}
+
+		if message, _ := topic.GetNextMessage("subscriber-1"); message == nil || message.String() != "message-2" {
+			t.Error("A filtered channel should skip messages which do not match.")
+		}
+
+		if pending, _ := topic.Pending("subscriber-2"); len(pending) != 2 {
+			t.Error("A channel without a filter should receive every message : ", len(pending))
+		}
+
+		if err := topic.SetFilter("subscriber-3", filter); err != ChannelNotFoundError {
+			t.Error("Filtering an unknown channel should return ChannelNotFoundError.")
+		}
+	}
+}
+
+func TestFiltersAreRestoredFromASnapshot(t *testing.T) {
+
+	registry := NewTopicRegistryWithChannelFactory(InMemoryChannelFactory)
+	registry.Get("topic-1").AddChannel("subscriber-1")
+
+	filter, _ := ParseFilter("body.total > 10")
+	registry.Get("topic-1").SetFilter("subscriber-1", filter)
+
+	buffer := &bytes.Buffer{}
+	TakeSnapshot(registry).WriteTo(buffer)
+
+	snapshot, err := ReadSnapshot(buffer)
+
+	if err != nil {
+		t.Fatal("Reading a snapshot should not fail : ", err)
+	}
+
+	restored := NewTopicRegistryWithChannelFactory(InMemoryChannelFactory)
+	snapshot.Restore(restored)
+
+	restored.Get("topic-1").PublishMessage(NewMessage([]byte(`{"total": 5}`)))
+	restored.Get("topic-1").PublishMessage(NewMessage([]byte(`{"total": 50}`)))
+
+	if pending, _ := restored.Get("topic-1").Pending("subscriber-1"); len(pending) != 1 {
+		t.Error("The filter of a channel should be restored : ", len(pending))
+	}
+}
@@ -0,0 +1,331 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	UnknownGroup = errors.New("Unknown consumer group")
+)
+
+// How a consumer group chooses the member a message is delivered to
+type Assignment int
+
+const (
+	// members take turns in the order they joined
+	RoundRobin Assignment = iota
+	// the member with the fewest pending and leased messages, the earliest to join on a tie
+	LeastLoaded
+)
+
+func (a Assignment) String() string {
+	switch a {
+	case RoundRobin:
+		return "round-robin"
+	case LeastLoaded:
+		return "least-loaded"
+	}
+	return "unknown"
+}
+
+// Parses round-robin or least-loaded
+func ParseAssignment(value string) (Assignment, error) {
+	switch value {
+	case "round-robin":
+		return RoundRobin, nil
+	case "least-loaded":
+		return LeastLoaded, nil
+	}
+	return RoundRobin, fmt.Errorf("unknown assignment %s, expected round-robin or least-loaded", value)
+}
+
+// Name of the channel holding the messages assigned to a member of a consumer group.
+// Usernames can not contain a / so it does not clash with a subscriber
+func GroupChannelName(groupName string, member string) string {
+	return groupName + "/" + member
+}
+
+// Competing consumers on a topic. Each message published to the topic is delivered to one member
+type consumerGroup struct {
+	name       string
+	assignment Assignment
+	// channel names of the members in the order they joined
+	members []string
+	// member to receive the next message with RoundRobin
+	next int
+}
+
+// the channel name of the member the next message is delivered to.
+// The caller holds the topic lock and serializes calls to choose
+func (g *consumerGroup) choose(t *Topic) string {
+
+	if g.assignment == LeastLoaded {
+
+		chosen, lowest := "", 0
+
+		for _, channelName := range g.members {
+
+			load := t.load(channelName)
+
+			if chosen == "" || load < lowest {
+				chosen, lowest = channelName, load
+			}
+		}
+		return chosen
+	}
+
+	chosen := g.members[g.next%len(g.members)]
+	g.next = (g.next + 1) % len(g.members)
+	return chosen
+}
+
+// how many of the next count messages choose would deliver to each member, without choosing them.
+// The caller holds the topic lock and serializes calls to choose
+func (g *consumerGroup) assign(t *Topic, count int) map[string]int {
+
+	assigned := make(map[string]int)
+
+	if len(g.members) == 0 {
+		return assigned
+	}
+
+	if g.assignment != LeastLoaded {
+
+		for i := 0; i < count; i++ {
+			assigned[g.members[(g.next+i)%len(g.members)]]++
+		}
+		return assigned
+	}
+
+	loads := make(map[string]int)
+
+	for _, channelName := range g.members {
+		loads[channelName] = t.load(channelName)
+	}
+
+	for i := 0; i < count; i++ {
+
+		chosen := ""
+
+		for _, channelName := range g.members {
+			if chosen == "" || loads[channelName] < loads[chosen] {
+				chosen = channelName
+			}
+		}
+
+		assigned[chosen]++
+		loads[chosen]++
+	}
+	return assigned
+}
+
+func (g *consumerGroup) remove(channelName string) {
+
+	for index, member := range g.members {
+		if member == channelName {
+			g.members = append(g.members[:index], g.members[index+1:]...)
+			break
+		}
+	}
+
+	if g.next >= len(g.members) {
+		g.next = 0
+	}
+}
+
+// Adds member to a consumer group of the topic, creating the group if needed. The assignment
+// of an existing group is replaced. Members read through the channel named GroupChannelName
+func (t *Topic) JoinGroup(groupName string, member string, assignment Assignment) error {
+
+	t.Lock()
+	defer t.Unlock()
+
+	return t.joinGroup(groupName, member, assignment)
+}
+
+func (t *Topic) joinGroup(groupName string, member string, assignment Assignment) error {
+
+	group, exists := t.groups[groupName]
+
+	if !exists {
+		group = &consumerGroup{name: groupName}
+		t.groups[groupName] = group
+	}
+	group.assignment = assignment
+
+	channelName := GroupChannelName(groupName, member)
+
+	if _, joined := t.channels[channelName]; joined {
+		return nil
+	}
+
+	var channel Channel = NewChannel()
+
+	// members need a channel of their own rather than a cursor on the shared log
+	if t.factory != nil {
+
+		created, err := t.factory(t.name, channelName)
+
+		if err != nil {
+			if len(group.members) == 0 {
+				delete(t.groups, groupName)
+			}
+			return err
+		}
+		channel = created
+		t.advanceSequence(channel.Messages())
+	}
+
+	t.channels[channelName] = channel
+	t.inflight[channelName] = newInflight()
+	t.subscribed[channelName] = time.Now()
+	t.groupOf[channelName] = groupName
+	group.members = append(group.members, channelName)
+	return nil
+}
+
+// joins a member to a group restored after a restart, keeping the group's assignment if it exists
+func (t *Topic) rejoinGroup(groupName string, member string) error {
+
+	t.Lock()
+	defer t.Unlock()
+
+	assignment := RoundRobin
+
+	if group, exists := t.groups[groupName]; exists {
+		assignment = group.assignment
+	}
+	return t.joinGroup(groupName, member, assignment)
+}
+
+// Removes member from a consumer group. Messages waiting for or leased to the member are
+// shared between those remaining, or dropped if it was the last. If the member does not
+// exist returns a ChannelNotFoundError
+func (t *Topic) LeaveGroup(groupName string, member string) error {
+
+	t.Lock()
+	defer t.Unlock()
+
+	group, exists := t.groups[groupName]
+	channelName := GroupChannelName(groupName, member)
+
+	if !exists || t.groupOf[channelName] != groupName {
+		return ChannelNotFoundError
+	}
+
+	channel := t.channels[channelName]
+	pending := t.inflight[channelName]
+
+	pending.Lock()
+	orphans := append(pending.messages(), channel.Messages()...)
+	pending.Unlock()
+
+	delete(t.channels, channelName)
+	delete(t.inflight, channelName)
+	delete(t.groupOf, channelName)
+	delete(t.subscribed, channelName)
+	group.remove(channelName)
+
+	if len(group.members) == 0 {
+		delete(t.groups, groupName)
+	} else {
+		for _, message := range orphans {
+			heir := t.inflight[group.choose(t)]
+			heir.Lock()
+			heir.redeliver = append(heir.redeliver, &Lease{Message: message})
+			heir.Unlock()
+		}
+		t.notify()
+	}
+
+	if disposable, ok := channel.(DisposableChannel); ok {
+		return disposable.Dispose()
+	}
+	return nil
+}
+
+// Names of the members of a consumer group in the order they joined.
+// If the group does not exist returns UnknownGroup
+func (t *Topic) GroupMembers(groupName string) ([]string, error) {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	group, exists := t.groups[groupName]
+
+	if !exists {
+		return nil, UnknownGroup
+	}
+
+	members := make([]string, 0, len(group.members))
+
+	for _, channelName := range group.members {
+		members = append(members, channelName[len(groupName)+1:])
+	}
+	return members, nil
+}
+
+// delivers message to one member of every group, returning the first error.
+// The caller holds the topic read lock and the publish lock
+func (t *Topic) pushToGroups(message *Message) error {
+
+	var firstErr error
+
+	for _, group := range t.groups {
+		if err := t.push(t.channels[group.choose(t)], message); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// messages waiting for or leased to a channel
+func (t *Topic) load(channelName string) int {
+
+	pending := t.inflight[channelName]
+	pending.Lock()
+	defer pending.Unlock()
+
+	return len(pending.leases) + len(pending.redeliver) + t.channels[channelName].Count()
+}
+
+// the consumer groups of the topic ordered by name
+func (t *Topic) groupSnapshots() []GroupSnapshot {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	groups := make([]GroupSnapshot, 0, len(t.groups))
+
+	for groupName, group := range t.groups {
+
+		snapshot := GroupSnapshot{Name: groupName, Assignment: group.assignment}
+
+		for _, channelName := range group.members {
+			snapshot.Members = append(snapshot.Members, channelName[len(groupName)+1:])
+		}
+		groups = append(groups, snapshot)
+	}
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+// rejoins the members of consumer groups
+func (t *Topic) restoreGroups(groups []GroupSnapshot) error {
+
+	t.Lock()
+	defer t.Unlock()
+
+	for _, group := range groups {
+		for _, member := range group.Members {
+			if err := t.joinGroup(group.Name, member, group.Assignment); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
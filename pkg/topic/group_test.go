@@ -0,0 +1,139 @@
+package topic
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRoundRobinGroupsDeliverEachMessageToOneMember(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+	topic.AddChannel("subscriber-1")
+	topic.JoinGroup("workers", "worker-1", RoundRobin)
+	topic.JoinGroup("workers", "worker-2", RoundRobin)
+
+	for _, content := range []string{"message-1", "message-2", "message-3"} {
+		topic.PublishMessage(NewMessage([]byte(content)))
+	}
+
+	assertGroupMessages(t, topic, "workers", "worker-1", "message-1", "message-3")
+	assertGroupMessages(t, topic, "workers", "worker-2", "message-2")
+
+	if pending, _ := topic.Pending("subscriber-1"); len(pending) != 3 {
+		t.Error("Subscribers outside the group should still receive every message : ", len(pending))
+	}
+}
+
+func TestLeastLoadedGroupsDeliverToTheMemberWithFewestMessages(t *testing.T) {
+
+	topic := NewTopicWithChannelFactory("topic-1", InMemoryChannelFactory)
+	topic.JoinGroup("workers", "worker-1", LeastLoaded)
+	topic.JoinGroup("workers", "worker-2", LeastLoaded)
+
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+	topic.PublishMessage(NewMessage([]byte("message-2")))
+
+	// worker-1 finishes its message so is the least loaded again
+	topic.GetNextMessage(GroupChannelName("workers", "worker-1"))
+	topic.PublishMessage(NewMessage([]byte("message-3")))
+
+	assertGroupMessages(t, topic, "workers", "worker-1", "message-3")
+	assertGroupMessages(t, topic, "workers", "worker-2", "message-2")
+}
+
+func TestPublishIsRejectedWhenTheChosenMemberIsFull(t *testing.T) {
+
+	topic := NewTopicWithChannelFactory("topic-1", RingBufferChannelFactory(RingBufferOptions{Capacity: 1, Overflow: RejectPublish}, nil))
+	topic.AddChannel("subscriber-1")
+	topic.JoinGroup("workers", "worker-1", RoundRobin)
+	topic.JoinGroup("workers", "worker-2", RoundRobin)
+
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+	topic.GetNextMessage("subscriber-1")
+
+	// worker-2 has space but the batch would give worker-1 a second message
+	if _, _, err := topic.PublishBatch([]*Message{NewMessage([]byte("message-2")), NewMessage([]byte("message-3"))}); err != ChannelFull {
+		t.Error("A batch the chosen member has no space for should return ChannelFull : ", err)
+	}
+
+	if pending, _ := topic.Pending("subscriber-1"); len(pending) != 0 {
+		t.Error("Nothing should be pushed when a member would reject a message : ", len(pending))
+	}
+
+	if err := topic.PublishMessage(NewMessage([]byte("message-2"))); err != nil {
+		t.Error("A message for the member with space should be published : ", err)
+	}
+	assertGroupMessages(t, topic, "workers", "worker-2", "message-2")
+}
+
+func TestMessagesOfAMemberLeavingAreSharedWithTheRest(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+	topic.JoinGroup("workers", "worker-1", RoundRobin)
+	topic.JoinGroup("workers", "worker-2", RoundRobin)
+
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+	topic.PublishMessage(NewMessage([]byte("message-2")))
+
+	if err := topic.LeaveGroup("workers", "worker-1"); err != nil {
+		t.Fatal("Leaving a group should not fail : ", err)
+	}
+
+	assertGroupMessages(t, topic, "workers", "worker-2", "message-1", "message-2")
+
+	if err := topic.LeaveGroup("workers", "worker-1"); err != ChannelNotFoundError {
+		t.Error("Leaving twice should return ChannelNotFoundError.")
+	}
+
+	topic.LeaveGroup("workers", "worker-2")
+
+	if _, err := topic.GroupMembers("workers"); err != UnknownGroup {
+		t.Error("A group should be removed when its last member leaves.")
+	}
+}
+
+func TestGroupsAreRestoredFromASnapshot(t *testing.T) {
+
+	registry := NewTopicRegistry()
+	registry.Get("topic-1").JoinGroup("workers", "worker-1", LeastLoaded)
+	registry.Get("topic-1").PublishMessage(NewMessage([]byte("message-1")))
+
+	buffer := &bytes.Buffer{}
+	TakeSnapshot(registry).WriteTo(buffer)
+
+	snapshot, err := ReadSnapshot(buffer)
+
+	if err != nil {
+		t.Fatal("Reading a snapshot should not fail : ", err)
+	}
+
+	restored := NewTopicRegistry()
+	snapshot.Restore(restored)
+
+	if members, _ := restored.Get("topic-1").GroupMembers("workers"); len(members) != 1 || members[0] != "worker-1" {
+		t.Fatal("Group members should be restored : ", members)
+	}
+
+	if restored.Get("topic-1").groups["workers"].assignment != LeastLoaded {
+		t.Error("The assignment of a group should be restored.")
+	}
+
+	assertGroupMessages(t, restored.Get("topic-1"), "workers", "worker-1", "message-1")
+}
+
+func assertGroupMessages(t *testing.T, topic *Topic, groupName string, member string, expected ...string) {
+
+	for _, content := range expected {
+
+		message, err := topic.GetNextMessage(GroupChannelName(groupName, member))
+
+		if err != nil || message.String() != content {
+			t.Error("Expected ", member, " to receive ", content)
+			return
+		}
+	}
+
+	if _, err := topic.GetNextMessage(GroupChannelName(groupName, member)); err != NoMessagesAvailable {
+		t.Error("Expected no more messages for ", member)
+	}
+}
@@ -0,0 +1,99 @@
+package topic
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	UnknownReceipt = errors.New("Unknown or expired receipt")
+)
+
+// A Lease is a message delivered to a subscriber which will be delivered again
+// unless it is acknowledged before it expires
+type Lease struct {
+	Receipt string
+	Message *Message
+	// number of times the message has been delivered to this subscriber, including this one
+	Deliveries int
+	Expires    time.Time
+}
+
+// messages delivered to a subscriber which have not been acknowledged
+type inflight struct {
+	sync.Mutex
+	// oldest first
+	leases []*Lease
+	// expired or nacked leases waiting to be delivered again, oldest first
+	redeliver []*Lease
+	// leases which have used up their deliveries waiting to be moved to the dead letter topic
+	dead []*Lease
+	// messages which expired before being read
+	expired uint64
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		leases:    make([]*Lease, 0),
+		redeliver: make([]*Lease, 0),
+		dead:      make([]*Lease, 0),
+	}
+}
+
+// moves leases which have expired into the redelivery queue, or the dead letters
+// once they have been delivered maxDeliveries times. Unlimited if maxDeliveries is 0
+func (i *inflight) expire(now time.Time, maxDeliveries int) {
+
+	active := i.leases[:0]
+
+	for _, lease := range i.leases {
+		if now.Before(lease.Expires) {
+			active = append(active, lease)
+		} else {
+			i.release(lease, maxDeliveries)
+		}
+	}
+
+	for j := len(active); j < len(i.leases); j++ {
+		i.leases[j] = nil
+	}
+	i.leases = active
+}
+
+// queues a lease which was not acknowledged for redelivery or as a dead letter
+func (i *inflight) release(lease *Lease, maxDeliveries int) {
+
+	if maxDeliveries > 0 && lease.Deliveries >= maxDeliveries {
+		i.dead = append(i.dead, lease)
+		return
+	}
+	i.redeliver = append(i.redeliver, lease)
+}
+
+// removes the active lease with receipt
+func (i *inflight) remove(receipt string) (*Lease, bool) {
+
+	for index, lease := range i.leases {
+		if lease.Receipt == receipt {
+			i.leases = append(i.leases[:index], i.leases[index+1:]...)
+			return lease, true
+		}
+	}
+	return nil, false
+}
+
+// leased and waiting messages, oldest first
+func (i *inflight) messages() []*Message {
+
+	messages := make([]*Message, 0, len(i.redeliver)+len(i.leases))
+
+	for _, lease := range i.redeliver {
+		messages = append(messages, lease.Message)
+	}
+
+	for _, lease := range i.leases {
+		messages = append(messages, lease.Message)
+	}
+	return messages
+}
@@ -0,0 +1,109 @@
+package topic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcknowledgedLeaseIsNotRedelivered(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+	topic.AddChannel("subscriber")
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+
+	lease, err := topic.LeaseNextMessage("subscriber", time.Millisecond)
+
+	if err != nil || lease.Message.String() != "message-1" || lease.Deliveries != 1 {
+		t.Fatal("The first lease should deliver message-1.")
+	}
+
+	if err := topic.Ack("subscriber", lease.Receipt); err != nil {
+		t.Error("Acknowledging an active lease should not fail.")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+
+	if _, err := topic.LeaseNextMessage("subscriber", time.Minute); err != NoMessagesAvailable {
+		t.Error("An acknowledged message should not be delivered again.")
+	}
+}
+
+func TestExpiredLeaseIsRedelivered(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+	topic.AddChannel("subscriber")
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+	topic.PublishMessage(NewMessage([]byte("message-2")))
+
+	first, _ := topic.LeaseNextMessage("subscriber", time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+
+	if err := topic.Ack("subscriber", first.Receipt); err != UnknownReceipt {
+		t.Error("Acknowledging an expired lease should return UnknownReceipt.")
+	}
+
+	again, _ := topic.LeaseNextMessage("subscriber", time.Minute)
+
+	if again.Message.String() != "message-1" || again.Deliveries != 2 {
+		t.Error("An expired lease should be delivered again before newer messages.")
+	}
+
+	if again.Receipt == first.Receipt {
+		t.Error("A redelivered message should have a new receipt.")
+	}
+}
+
+func TestNackedLeaseIsRedeliveredImmediately(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+	topic.AddChannel("subscriber")
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+
+	lease, _ := topic.LeaseNextMessage("subscriber", time.Minute)
+
+	if err := topic.Nack("subscriber", lease.Receipt); err != nil {
+		t.Error("Nacking an active lease should not fail.")
+	}
+
+	message, err := topic.GetNextMessage("subscriber")
+
+	if err != nil || message.String() != "message-1" {
+		t.Error("A nacked message should be delivered again.")
+	}
+}
+
+func TestRequeuedLeaseIsRedeliveredWithoutCountingTheDelivery(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+	topic.AddChannel("subscriber")
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+
+	lease, _ := topic.LeaseNextMessage("subscriber", time.Minute)
+
+	if err := topic.Requeue("subscriber", lease.Receipt); err != nil {
+		t.Error("Requeueing an active lease should not fail.")
+	}
+
+	lease, err := topic.LeaseNextMessage("subscriber", time.Minute)
+
+	if err != nil || lease.Message.String() != "message-1" || lease.Deliveries != 1 {
+		t.Error("A requeued message should be delivered again as if for the first time : ", lease, err)
+	}
+
+	if topic.Stats().Delivered != 1 {
+		t.Error("A requeued delivery should not be counted : ", topic.Stats().Delivered)
+	}
+}
+
+func TestLeasingFromUnknownChannelErrors(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+
+	if _, err := topic.LeaseNextMessage("unknown", time.Minute); err != ChannelNotFoundError {
+		t.Error("A ChannelNotFoundError should have been returned.")
+	}
+
+	if err := topic.Ack("unknown", "receipt"); err != ChannelNotFoundError {
+		t.Error("A ChannelNotFoundError should have been returned.")
+	}
+}
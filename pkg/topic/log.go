@@ -0,0 +1,374 @@
+package topic
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// number of messages held by each segment of a Log
+const DefaultSegmentSize = 1024
+
+// A Log is an append only sequence of messages shared by every subscriber of a Topic.
+// Each subscriber reads through the log with a LogChannel holding only its offset.
+// Segments are released once every LogChannel has moved past them and, with a retention
+// period, every message in them is older than it.
+// Safe for use via goroutines
+type Log struct {
+	sync.RWMutex
+	segmentSize int
+	segments    []*segment
+	// offset the next appended message will be given
+	next    uint64
+	cursors map[*LogChannel]struct{}
+	// how long messages are kept after every cursor has passed them
+	retention time.Duration
+}
+
+type segment struct {
+	base     uint64
+	messages []*Message
+}
+
+// Creates an empty Log
+func NewLog(segmentSize int) *Log {
+
+	if segmentSize < 1 {
+		segmentSize = DefaultSegmentSize
+	}
+
+	return &Log{
+		segmentSize: segmentSize,
+		segments:    make([]*segment, 0),
+		cursors:     make(map[*LogChannel]struct{}),
+	}
+}
+
+// Appends a message to the log, returning its offset
+func (l *Log) Append(message *Message) uint64 {
+
+	l.Lock()
+	defer l.Unlock()
+
+	return l.append(message)
+}
+
+// Offset the next appended message will be given
+func (l *Log) End() uint64 {
+
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.next
+}
+
+// Offset of the oldest message still held
+func (l *Log) Start() uint64 {
+
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.start()
+}
+
+// Keeps messages for at least retention after they are published, even once every
+// LogChannel has read them, so new readers can start from them
+func (l *Log) SetRetention(retention time.Duration) {
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.retention = retention
+	l.collect()
+}
+
+// Releases the segments which are no longer needed
+func (l *Log) Trim() {
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.collect()
+}
+
+// Offset of the first held message which satisfies found, or End if none does.
+// found must be false for a prefix of the log and true for the rest
+func (l *Log) Search(found func(message *Message) bool) uint64 {
+
+	l.RLock()
+	defer l.RUnlock()
+
+	start := l.start()
+	count := int(l.next - start)
+
+	return start + uint64(sort.Search(count, func(i int) bool {
+		return found(l.read(start + uint64(i)))
+	}))
+}
+
+// Returns the held messages from offset onwards, oldest first
+func (l *Log) From(offset uint64) []*Message {
+
+	l.RLock()
+	defer l.RUnlock()
+
+	if start := l.start(); offset < start {
+		offset = start
+	}
+
+	messages := make([]*Message, 0)
+
+	for ; offset < l.next; offset++ {
+		messages = append(messages, l.read(offset))
+	}
+	return messages
+}
+
+// Creates a LogChannel reading from the end of the log
+func (l *Log) NewChannel() *LogChannel {
+
+	l.Lock()
+	defer l.Unlock()
+
+	channel := &LogChannel{
+		log:    l,
+		offset: l.next,
+	}
+	l.cursors[channel] = struct{}{}
+	return channel
+}
+
+// only to be called when locked
+func (l *Log) start() uint64 {
+
+	if len(l.segments) == 0 {
+		return l.next
+	}
+	return l.segments[0].base
+}
+
+// only to be called when locked
+func (l *Log) append(message *Message) uint64 {
+
+	last := len(l.segments) - 1
+
+	if last < 0 || len(l.segments[last].messages) == l.segmentSize {
+		l.segments = append(l.segments, &segment{
+			base:     l.next,
+			messages: make([]*Message, 0, l.segmentSize),
+		})
+		last++
+	}
+
+	l.segments[last].messages = append(l.segments[last].messages, message)
+	offset := l.next
+	l.next++
+	return offset
+}
+
+// removes the messages from offset end onwards, none of which a cursor may have read past
+func (l *Log) truncate(end uint64) {
+
+	l.Lock()
+	defer l.Unlock()
+
+	for len(l.segments) > 0 {
+
+		last := l.segments[len(l.segments)-1]
+
+		if end >= last.base+uint64(len(last.messages)) {
+			break
+		}
+
+		if end <= last.base {
+			l.segments = l.segments[:len(l.segments)-1]
+			continue
+		}
+
+		for i := int(end - last.base); i < len(last.messages); i++ {
+			last.messages[i] = nil
+		}
+		last.messages = last.messages[:end-last.base]
+		break
+	}
+
+	if end < l.next {
+		l.next = end
+	}
+}
+
+// only to be called when locked
+func (l *Log) read(offset uint64) *Message {
+
+	if len(l.segments) == 0 || offset < l.segments[0].base || offset >= l.next {
+		return nil
+	}
+
+	index := int(offset-l.segments[0].base) / l.segmentSize
+	segment := l.segments[index]
+	return segment.messages[offset-segment.base]
+}
+
+// releases the segments every cursor has read past whose messages are older than the retention period.
+// only to be called when locked
+func (l *Log) collect() {
+
+	low := l.next
+
+	for cursor := range l.cursors {
+		if cursor.offset < low {
+			low = cursor.offset
+		}
+	}
+
+	cutoff := time.Now().Add(-l.retention)
+	released := 0
+
+	for _, segment := range l.segments {
+
+		if segment.base+uint64(l.segmentSize) > low {
+			break
+		}
+
+		// the newest message in a full segment is its last
+		if l.retention > 0 && segment.messages[len(segment.messages)-1].Timestamp().After(cutoff) {
+			break
+		}
+		released++
+	}
+
+	if released > 0 {
+		l.segments = l.segments[released:]
+	}
+}
+
+// LogChannel is a subscriber's position in a Log.
+// Pushing to a LogChannel appends to the shared Log so the message is visible
+// to every subscriber reading from it
+type LogChannel struct {
+	log    *Log
+	offset uint64
+	closed bool
+}
+
+// Appends a message to the shared log
+func (c *LogChannel) Push(message *Message) error {
+
+	c.log.Append(message)
+	return nil
+}
+
+// Returns the message at the cursor and moves past it
+func (c *LogChannel) Pop() (*Message, error) {
+
+	c.log.Lock()
+	defer c.log.Unlock()
+
+	message := c.log.read(c.offset)
+
+	if message == nil {
+		return nil, NoMessagesAvailable
+	}
+
+	c.offset++
+
+	// only the first segment can be released so only check on leaving one
+	if (c.offset-c.log.segments[0].base)%uint64(c.log.segmentSize) == 0 {
+		c.log.collect()
+	}
+
+	return message, nil
+}
+
+// Returns the message at the cursor without moving it
+func (c *LogChannel) Peek() (*Message, error) {
+
+	c.log.RLock()
+	defer c.log.RUnlock()
+
+	message := c.log.read(c.offset)
+
+	if message == nil {
+		return nil, NoMessagesAvailable
+	}
+	return message, nil
+}
+
+// Number of messages between the cursor and the end of the log
+func (c *LogChannel) Count() int {
+
+	c.log.RLock()
+	defer c.log.RUnlock()
+
+	return int(c.log.next - c.offset)
+}
+
+// Returns the messages between the cursor and the end of the log
+func (c *LogChannel) Messages() []*Message {
+
+	c.log.RLock()
+	defer c.log.RUnlock()
+
+	messages := make([]*Message, 0, c.log.next-c.offset)
+
+	for offset := c.offset; offset < c.log.next; offset++ {
+		messages = append(messages, c.log.read(offset))
+	}
+	return messages
+}
+
+// Returns a window of the messages between the cursor and the end of the log
+func (c *LogChannel) Browse(offset int, limit int) []*Message {
+
+	c.log.RLock()
+	defer c.log.RUnlock()
+
+	start, end := window(int(c.log.next-c.offset), offset, limit)
+	messages := make([]*Message, 0, end-start)
+
+	for index := start; index < end; index++ {
+		messages = append(messages, c.log.read(c.offset+uint64(index)))
+	}
+	return messages
+}
+
+// Offset of the next message the channel will return
+func (c *LogChannel) Offset() uint64 {
+
+	c.log.RLock()
+	defer c.log.RUnlock()
+
+	return c.offset
+}
+
+// Moves the cursor to offset, or the oldest message held if that has been released
+func (c *LogChannel) Seek(offset uint64) {
+
+	c.log.Lock()
+	defer c.log.Unlock()
+
+	if start := c.log.start(); offset < start {
+		offset = start
+	}
+
+	if offset > c.log.next {
+		offset = c.log.next
+	}
+
+	c.offset = offset
+	c.log.collect()
+}
+
+// Stops the channel holding segments of the log
+func (c *LogChannel) Dispose() error {
+
+	c.log.Lock()
+	defer c.log.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		delete(c.log.cursors, c)
+		c.log.collect()
+	}
+	return nil
+}
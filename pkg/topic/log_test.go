@@ -0,0 +1,88 @@
+package topic
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLogChannelsReadIndependently(t *testing.T) {
+
+	log := NewLog(2)
+
+	channel1 := log.NewChannel()
+	log.Append(NewMessage([]byte("message-1")))
+
+	channel2 := log.NewChannel()
+	log.Append(NewMessage([]byte("message-2")))
+
+	assertChannelLength(t, channel1, 2)
+	assertChannelLength(t, channel2, 1)
+
+	assertMessageRetreivedWithExpectedContent(t, channel1, "message-1")
+	assertMessageRetreivedWithExpectedContent(t, channel1, "message-2")
+	assertMessageRetreivedWithExpectedContent(t, channel2, "message-2")
+
+	if _, err := channel1.Pop(); err != NoMessagesAvailable {
+		t.Error("A NoMessagesAvailable error should have been returned.")
+	}
+}
+
+func TestLogReleasesSegmentsOnceEveryChannelHasPassed(t *testing.T) {
+
+	log := NewLog(2)
+
+	channel1 := log.NewChannel()
+	channel2 := log.NewChannel()
+
+	for i := 0; i < 5; i++ {
+		log.Append(NewMessage([]byte(fmt.Sprintf("message-%d", i))))
+	}
+
+	assertSegmentCount(t, log, 3)
+
+	channel1.Pop()
+	channel1.Pop()
+	channel1.Pop()
+
+	// channel2 still needs the first segment
+	assertSegmentCount(t, log, 3)
+
+	channel2.Pop()
+	channel2.Pop()
+
+	assertSegmentCount(t, log, 2)
+
+	channel2.Dispose()
+	channel1.Pop()
+
+	// the last segment is still being written to
+	assertSegmentCount(t, log, 1)
+	assertMessageRetreivedWithExpectedContent(t, channel1, "message-4")
+}
+
+func TestLogChannelMessagesAreNotConsumed(t *testing.T) {
+
+	log := NewLog(DefaultSegmentSize)
+	channel := log.NewChannel()
+
+	log.Append(NewMessage([]byte("message-1")))
+	log.Append(NewMessage([]byte("message-2")))
+
+	messages := channel.Messages()
+
+	if len(messages) != 2 || messages[0].String() != "message-1" || messages[1].String() != "message-2" {
+		t.Error("Messages should return every pending message in order.")
+	}
+
+	assertChannelLength(t, channel, 2)
+}
+
+func assertSegmentCount(t *testing.T, log *Log, expected int) {
+
+	log.RLock()
+	defer log.RUnlock()
+
+	if len(log.segments) != expected {
+		t.Error("Incorrect segment count. Expected : ", expected, "Actual : ", len(log.segments))
+	}
+}
@@ -1,8 +1,51 @@
 package topic
 
-// wrapper for content to be kept in a channel
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	UnknownMessageEncoding = errors.New("Unknown message encoding")
+)
+
+// versions prefixed to encoded messages so the format can evolve
+const (
+	// content only
+	messageEncodingVersion1 byte = 1
+	// header count uint32 | (key, value)... | content, keys and values prefixed with their length as a uint32
+	messageEncodingVersion2 byte = 2
+	// id | sequence uint64 | timestamp int64 | publisher | header count uint32 | (key, value)... | content,
+	// strings prefixed with their length as a uint32 and the timestamp in nanoseconds since the epoch
+	messageEncodingVersion3 byte = 3
+	// as version 3 with the expiry as an int64 in nanoseconds since the epoch following the timestamp, 0 if it never expires
+	messageEncodingVersion4 byte = 4
+	// as version 4 with the name of the topic following the publisher
+	messageEncodingVersion5 byte = 5
+)
+
+// wrapper for content to be kept in a channel.
+// A message is shared between channels so must not be modified once published
 type Message struct {
 	content []byte
+	headers map[string]string
+
+	// set by the topic when the message is published
+	topic     string
+	id        string
+	sequence  uint64
+	timestamp time.Time
+	publisher string
+
+	// how long the message lives once published, the topic default if 0
+	ttl time.Duration
+	// when the message expires, the zero time if it never does
+	expires time.Time
 }
 
 func NewMessage(content []byte) *Message {
@@ -18,3 +61,298 @@ func (m *Message) String() string {
 func (m *Message) Bytes() []byte {
 	return m.content
 }
+
+// Unique id assigned when the message was published, empty until then
+func (m *Message) Id() string {
+	return m.id
+}
+
+// Position of the message in the order it was published to its topic, starting at 1.
+// Zero until the message is published
+func (m *Message) Sequence() uint64 {
+	return m.sequence
+}
+
+// When the message was published, the zero time until then
+func (m *Message) Timestamp() time.Time {
+	return m.timestamp
+}
+
+// Name of the topic the message was published to, empty until it is published
+func (m *Message) Topic() string {
+	return m.topic
+}
+
+// Who published the message, empty if not known
+func (m *Message) Publisher() string {
+	return m.publisher
+}
+
+// Returns a copy of the message published by publisher
+func (m *Message) WithPublisher(publisher string) *Message {
+
+	copied := *m
+	copied.publisher = publisher
+	return &copied
+}
+
+// Returns a copy of the message which expires ttl after it is published
+func (m *Message) WithTTL(ttl time.Duration) *Message {
+
+	copied := *m
+	copied.ttl = ttl
+	return &copied
+}
+
+// When the message expires, the zero time if it never does
+func (m *Message) Expires() time.Time {
+	return m.expires
+}
+
+// True if the message has expired by now
+func (m *Message) Expired(now time.Time) bool {
+	return !m.expires.IsZero() && !now.Before(m.expires)
+}
+
+// Returns a copy of the message which never expires
+func (m *Message) withoutExpiry() *Message {
+
+	copied := *m
+	copied.ttl = 0
+	copied.expires = time.Time{}
+	return &copied
+}
+
+// Value of a header or an empty string if it is not set
+func (m *Message) Header(name string) string {
+	return m.headers[name]
+}
+
+// Returns a copy of the message headers
+func (m *Message) Headers() map[string]string {
+
+	headers := make(map[string]string, len(m.headers))
+
+	for name, value := range m.headers {
+		headers[name] = value
+	}
+	return headers
+}
+
+// Returns a copy of the message with headers added to its own.
+// An empty value removes a header
+func (m *Message) WithHeaders(headers map[string]string) *Message {
+
+	merged := m.Headers()
+
+	for name, value := range headers {
+		if value == "" {
+			delete(merged, name)
+		} else {
+			merged[name] = value
+		}
+	}
+
+	copied := *m
+	copied.headers = merged
+	return &copied
+}
+
+// Returns a copy of the message as published to a topic, keeping the id it was given
+// when scheduled. Unless the message has its own ttl it expires defaultTTL after
+// timestamp, never if that is 0
+func (m *Message) published(topicName string, sequence uint64, timestamp time.Time, defaultTTL time.Duration) *Message {
+
+	copied := *m
+	copied.topic = topicName
+	copied.sequence = sequence
+	copied.timestamp = timestamp
+
+	if copied.id == "" {
+		copied.id = newId()
+	}
+
+	ttl := m.ttl
+
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+
+	if ttl > 0 {
+		copied.expires = timestamp.Add(ttl)
+	}
+	return &copied
+}
+
+// Encodes the message for storage
+func (m *Message) MarshalBinary() ([]byte, error) {
+
+	buffer := &bytes.Buffer{}
+	buffer.WriteByte(messageEncodingVersion5)
+
+	writeMessageString(buffer, m.id)
+	binary.Write(buffer, binary.BigEndian, m.sequence)
+	binary.Write(buffer, binary.BigEndian, encodeMessageTime(m.timestamp))
+	binary.Write(buffer, binary.BigEndian, encodeMessageTime(m.expires))
+	writeMessageString(buffer, m.publisher)
+	writeMessageString(buffer, m.topic)
+
+	binary.Write(buffer, binary.BigEndian, uint32(len(m.headers)))
+
+	names := make([]string, 0, len(m.headers))
+	for name := range m.headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		writeMessageString(buffer, name)
+		writeMessageString(buffer, m.headers[name])
+	}
+
+	buffer.Write(m.content)
+	return buffer.Bytes(), nil
+}
+
+// Decodes a message previously encoded with MarshalBinary
+func (m *Message) UnmarshalBinary(data []byte) error {
+
+	if len(data) == 0 {
+		return UnknownMessageEncoding
+	}
+
+	decoded := Message{}
+	var content []byte
+
+	switch data[0] {
+	case messageEncodingVersion1:
+		content = data[1:]
+
+	case messageEncodingVersion2, messageEncodingVersion3, messageEncodingVersion4, messageEncodingVersion5:
+		reader := bytes.NewReader(data[1:])
+
+		if data[0] >= messageEncodingVersion3 {
+			if err := decoded.readMetadata(reader, data[0]); err != nil {
+				return err
+			}
+		}
+
+		var count uint32
+		if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+			return UnknownMessageEncoding
+		}
+
+		decoded.headers = make(map[string]string)
+
+		for i := uint32(0); i < count; i++ {
+
+			name, err := readMessageString(reader)
+
+			if err != nil {
+				return err
+			}
+
+			value, err := readMessageString(reader)
+
+			if err != nil {
+				return err
+			}
+			decoded.headers[name] = value
+		}
+
+		content = data[len(data)-reader.Len():]
+
+	default:
+		return UnknownMessageEncoding
+	}
+
+	decoded.content = make([]byte, len(content))
+	copy(decoded.content, content)
+
+	*m = decoded
+	return nil
+}
+
+// reads the fields set when the message was published
+func (m *Message) readMetadata(reader *bytes.Reader, version byte) error {
+
+	id, err := readMessageString(reader)
+
+	if err != nil {
+		return err
+	}
+
+	var timestamp, expires int64
+
+	if binary.Read(reader, binary.BigEndian, &m.sequence) != nil || binary.Read(reader, binary.BigEndian, &timestamp) != nil {
+		return UnknownMessageEncoding
+	}
+
+	if version >= messageEncodingVersion4 && binary.Read(reader, binary.BigEndian, &expires) != nil {
+		return UnknownMessageEncoding
+	}
+
+	publisher, err := readMessageString(reader)
+
+	if err != nil {
+		return err
+	}
+
+	if version >= messageEncodingVersion5 {
+		if m.topic, err = readMessageString(reader); err != nil {
+			return err
+		}
+	}
+
+	m.id = id
+	m.publisher = publisher
+	m.timestamp = decodeMessageTime(timestamp)
+	m.expires = decodeMessageTime(expires)
+	return nil
+}
+
+// nanoseconds since the epoch, 0 for the zero time
+func encodeMessageTime(value time.Time) int64 {
+
+	if value.IsZero() {
+		return 0
+	}
+	return value.UnixNano()
+}
+
+func decodeMessageTime(value int64) time.Time {
+
+	if value == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, value)
+}
+
+func writeMessageString(buffer *bytes.Buffer, value string) {
+	binary.Write(buffer, binary.BigEndian, uint32(len(value)))
+	buffer.WriteString(value)
+}
+
+func readMessageString(reader *bytes.Reader) (string, error) {
+
+	var length uint32
+
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil || int64(length) > int64(reader.Len()) {
+		return "", UnknownMessageEncoding
+	}
+
+	value := make([]byte, length)
+	reader.Read(value)
+	return string(value), nil
+}
+
+// random hex string, unique for all practical purposes
+func newId() string {
+
+	id := make([]byte, 16)
+
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
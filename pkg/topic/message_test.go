@@ -3,6 +3,7 @@ package topic
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMessagesAreRoundTrippedCorrectly(t *testing.T) {
@@ -20,3 +21,78 @@ func TestMessagesAreRoundTrippedCorrectly(t *testing.T) {
 	}
 
 }
+
+func TestMessagesAreEncodedAndDecodedCorrectly(t *testing.T) {
+
+	data, err := NewMessage([]byte("hello")).MarshalBinary()
+
+	if err != nil {
+		t.Error("Encoding a message should not fail.")
+	}
+
+	message := &Message{}
+
+	if err := message.UnmarshalBinary(data); err != nil {
+		t.Error("Decoding a message should not fail.")
+	}
+
+	if message.String() != "hello" {
+		t.Error("Messages aren't being encoded correctly.")
+	}
+
+	if err := message.UnmarshalBinary([]byte{}); err != UnknownMessageEncoding {
+		t.Error("An UnknownMessageEncoding error should have been returned.")
+	}
+}
+
+func TestMessageHeadersAreEncodedAndDecodedCorrectly(t *testing.T) {
+
+	original := NewMessage([]byte("hello")).WithHeaders(map[string]string{"name": "value", "empty": ""})
+	data, _ := original.MarshalBinary()
+
+	message := &Message{}
+
+	if err := message.UnmarshalBinary(data); err != nil {
+		t.Fatal("Decoding a message should not fail.")
+	}
+
+	if message.String() != "hello" || message.Header("name") != "value" || len(message.Headers()) != 1 {
+		t.Error("Message headers aren't being encoded correctly : ", message.Headers())
+	}
+
+	legacy := &Message{}
+
+	if err := legacy.UnmarshalBinary(append([]byte{1}, "hello"...)); err != nil || legacy.String() != "hello" {
+		t.Error("Messages encoded without headers should still be decoded.")
+	}
+}
+
+func TestPublishedMessageMetadataIsEncodedAndDecodedCorrectly(t *testing.T) {
+
+	original := NewMessage([]byte("hello")).WithPublisher("publisher-one").WithTTL(time.Minute).published("topic-1", 42, time.Unix(1000, 5), 0)
+	data, _ := original.MarshalBinary()
+
+	message := &Message{}
+
+	if err := message.UnmarshalBinary(data); err != nil {
+		t.Fatal("Decoding a message should not fail.")
+	}
+
+	if message.Id() != original.Id() || message.Sequence() != 42 || !message.Timestamp().Equal(original.Timestamp()) || message.Publisher() != "publisher-one" || message.Topic() != "topic-1" || !message.Expires().Equal(time.Unix(1060, 5)) {
+		t.Error("Message metadata isn't being encoded correctly : ", message)
+	}
+
+	unpublished := &Message{}
+	data, _ = NewMessage([]byte("hello")).MarshalBinary()
+	unpublished.UnmarshalBinary(data)
+
+	if unpublished.Id() != "" || !unpublished.Timestamp().IsZero() {
+		t.Error("An unpublished message should have no metadata after decoding.")
+	}
+
+	legacy := &Message{}
+
+	if err := legacy.UnmarshalBinary(append([]byte{2, 0, 0, 0, 0}, "hello"...)); err != nil || legacy.String() != "hello" {
+		t.Error("Messages encoded without metadata should still be decoded.")
+	}
+}
@@ -2,6 +2,8 @@ package topic
 
 import (
 	"errors"
+	"sort"
+	"strings"
 	"sync"
 )
 
@@ -13,22 +15,49 @@ type Registry interface {
 	Delete(topicName string) error
 	Contains(topicName string) bool
 	Get(topicName string) *Topic
+	Topics() []*Topic
+	// topics whose names start with prefix
+	List(prefix string) []*Topic
+	// flushes and releases the resources held by the topics' channels
+	Close() error
 }
 
 // Registry implementatoin which maintains an in memory index
 type InMemoryRegistry struct {
 	sync.RWMutex
-	topics map[string]*Topic
+	topics  map[string]*Topic
+	factory ChannelFactory
+	options TopicOptionsProvider
+	// wildcard topics, forwarded the messages published to the topics they match
+	wildcards *wildcardIndex
 }
 
-// Returns an instance of the InMemoryRegistry
+// Returns the options a topic is created with
+type TopicOptionsProvider func(topicName string) TopicOptions
+
+// Returns an instance of the InMemoryRegistry whose topics each share a Log between their subscribers
 func NewTopicRegistry() Registry {
+	return NewTopicRegistryWithChannelFactory(nil)
+}
+
+// Returns an instance of the InMemoryRegistry whose topics create Channels with the factory.
+// See NewTopicWithChannelFactory for a nil factory
+func NewTopicRegistryWithChannelFactory(factory ChannelFactory) Registry {
+	return NewTopicRegistryWithOptions(factory, nil)
+}
+
+// Returns an instance of the InMemoryRegistry whose topics create Channels with the factory
+// and are configured by options. Topics have default options if options is nil
+func NewTopicRegistryWithOptions(factory ChannelFactory, options TopicOptionsProvider) Registry {
 	return &InMemoryRegistry{
-		topics: make(map[string]*Topic),
+		topics:    make(map[string]*Topic),
+		factory:   factory,
+		options:   options,
+		wildcards: newWildcardIndex(),
 	}
 }
 
-// removes an existing topic
+// removes an existing topic, disposing of its channels and their messages
 func (r *InMemoryRegistry) Delete(topicName string) error {
 	r.Lock()
 	defer r.Unlock()
@@ -37,35 +66,106 @@ func (r *InMemoryRegistry) Delete(topicName string) error {
 		return UnknownTopic
 	}
 
+	if r.topics[topicName].wildcard {
+		r.wildcards.remove(topicName)
+	}
+
+	deleted := r.topics[topicName]
 	delete(r.topics, topicName)
 
-	return nil
+	return deleted.dispose()
 
 }
 
 // Return true if a topic exists in the registry
 func (r *InMemoryRegistry) Contains(topicName string) bool {
 
-	r.Lock()
-	defer r.Unlock()
+	r.RLock()
+	defer r.RUnlock()
 
 	return r.exists(topicName)
 }
 
 // Finds a Topic of a given name. If the topic does not exists it create it.
+// Messages published to a topic are forwarded to the wildcard topics matching it
 func (r *InMemoryRegistry) Get(topicName string) *Topic {
+
+	r.RLock()
+	existing, exists := r.topics[topicName]
+	r.RUnlock()
+
+	if exists {
+		return existing
+	}
+
 	r.Lock()
 	defer r.Unlock()
 
 	if !r.exists(topicName) {
-		r.topics[topicName] = NewTopic(topicName)
+		topic := NewTopicWithChannelFactory(topicName, r.factory)
+
+		if r.options != nil {
+			topic.SetOptions(r.options(topicName))
+		}
+
+		if !IsDeadLetterTopic(topicName) {
+			if !topic.wildcard {
+				topic.wildcards = r.wildcards
+			} else if ValidateTopicName(topicName) == nil {
+				r.wildcards.add(topic)
+			}
+		}
+		r.topics[topicName] = topic
 	}
 	return r.topics[topicName]
 
 }
 
+// Returns every topic in the registry ordered by name
+func (r *InMemoryRegistry) Topics() []*Topic {
+	return r.List("")
+}
+
+// Returns the topics whose names start with prefix ordered by name
+func (r *InMemoryRegistry) List(prefix string) []*Topic {
+
+	r.RLock()
+	defer r.RUnlock()
+
+	topics := make([]*Topic, 0, len(r.topics))
+
+	for name, topic := range r.topics {
+		if strings.HasPrefix(name, prefix) {
+			topics = append(topics, topic)
+		}
+	}
+
+	sort.Sort(byName(topics))
+	return topics
+}
+
+// Closes the channels of every topic, returning the first error. The registry should
+// not be used once closed
+func (r *InMemoryRegistry) Close() error {
+
+	var first error
+
+	for _, topic := range r.Topics() {
+		if err := topic.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
 // only to be called when locked
 func (r *InMemoryRegistry) exists(topicName string) bool {
 	_, exists := r.topics[topicName]
 	return exists
 }
+
+type byName []*Topic
+
+func (t byName) Len() int           { return len(t) }
+func (t byName) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byName) Less(i, j int) bool { return t[i].name < t[j].name }
@@ -1,6 +1,7 @@
 package topic
 
 import (
+	"os"
 	"testing"
 )
 
@@ -63,3 +64,80 @@ func TestAnAddedTopicExistsInTheRegistry(t *testing.T) {
 		t.Error("Registry should not contain the topic called 'exists'")
 	}
 }
+
+func TestTopicsAreListedByName(t *testing.T) {
+	registry := NewTopicRegistry()
+
+	registry.Get("topic-b")
+	registry.Get("topic-a")
+
+	topics := registry.Topics()
+
+	if len(topics) != 2 || topics[0].Name() != "topic-a" || topics[1].Name() != "topic-b" {
+		t.Error("Registry should list every topic ordered by name.")
+	}
+}
+
+func TestTopicsCanBeListedByPrefix(t *testing.T) {
+	registry := NewTopicRegistry()
+
+	registry.Get("orders.eu")
+	registry.Get("audit")
+	registry.Get("orders.us")
+
+	topics := registry.List("orders.")
+
+	if len(topics) != 2 || topics[0].Name() != "orders.eu" || topics[1].Name() != "orders.us" {
+		t.Error("Registry should list the topics starting with the prefix ordered by name.")
+	}
+}
+
+func TestDeletingATopicDisposesOfItsChannels(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	registry := NewTopicRegistryWithChannelFactory(WALChannelFactory(directory, DefaultWALOptions))
+	defer registry.Close()
+
+	registry.Get("topic-a").AddChannel("subscriber-1")
+	registry.Get("topic-a").PublishMessage(NewMessage([]byte("message-1")))
+
+	if err := registry.Delete("topic-a"); err != nil {
+		t.Error("Deleting a topic should not error : ", err)
+	}
+
+	registry.Get("topic-a").AddChannel("subscriber-1")
+
+	if _, err := registry.Get("topic-a").GetNextMessage("subscriber-1"); err != NoMessagesAvailable {
+		t.Error("A deleted topic should not keep its messages but returned ", err)
+	}
+}
+
+func TestClosingTheRegistryClosesTheChannelsOfItsTopics(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	registry := NewTopicRegistryWithChannelFactory(WALChannelFactory(directory, DefaultWALOptions))
+	registry.Get("topic-a").AddChannel("subscriber-1")
+	registry.Get("topic-a").PublishMessage(NewMessage([]byte("message-1")))
+
+	if err := registry.Close(); err != nil {
+		t.Error("Closing the registry should not error : ", err)
+	}
+
+	if err := registry.Get("topic-a").PublishMessage(NewMessage([]byte("message-2"))); err != ChannelClosed {
+		t.Error("Publishing to a closed channel should return ChannelClosed but returned ", err)
+	}
+
+	reopened := NewTopicRegistryWithChannelFactory(WALChannelFactory(directory, DefaultWALOptions))
+	reopened.Get("topic-a").AddChannel("subscriber-1")
+	defer reopened.Close()
+
+	message, err := reopened.Get("topic-a").GetNextMessage("subscriber-1")
+
+	if err != nil || message.String() != "message-1" {
+		t.Error("Messages should be kept once the registry is closed : ", err)
+	}
+}
@@ -0,0 +1,135 @@
+package topic
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Where a subscription starts reading a topic's retained messages
+type Position struct {
+	Kind PositionKind
+	// first sequence number to read with AtSequence
+	Sequence uint64
+	// read messages published from then with AtTime
+	Time time.Time
+}
+
+type PositionKind int
+
+const (
+	// the oldest message the topic retains
+	Earliest PositionKind = iota
+	// only messages published from now on
+	Latest
+	// the message with a sequence number, or the next one after it
+	AtSequence
+	// the first message published at or after a time
+	AtTime
+)
+
+func (p Position) String() string {
+	switch p.Kind {
+	case Earliest:
+		return "earliest"
+	case Latest:
+		return "latest"
+	case AtSequence:
+		return strconv.FormatUint(p.Sequence, 10)
+	}
+	return p.Time.Format(time.RFC3339)
+}
+
+// Parses earliest, latest, a sequence number, an RFC3339 time, or a duration
+// meaning that long ago, e.g. 2h
+func ParsePosition(value string) (Position, error) {
+
+	switch value {
+	case "earliest":
+		return Position{Kind: Earliest}, nil
+	case "latest":
+		return Position{Kind: Latest}, nil
+	}
+
+	if sequence, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return Position{Kind: AtSequence, Sequence: sequence}, nil
+	}
+
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return Position{Kind: AtTime, Time: at}, nil
+	}
+
+	if ago, err := time.ParseDuration(value); err == nil && ago >= 0 {
+		return Position{Kind: AtTime, Time: time.Now().Add(-ago)}, nil
+	}
+
+	return Position{}, fmt.Errorf("unknown position %s, expected earliest, latest, a sequence number, an RFC3339 time or a duration", value)
+}
+
+// Resets a subscription to read the topic's retained messages from position. Messages waiting
+// for or leased to the channel are discarded. A position older than the oldest retained
+// message starts from that message. Topics retain messages until every subscriber has read
+// them, and for TopicOptions.Retention after that.
+// If the channel does not exist, or belongs to a consumer group, returns a ChannelNotFoundError
+func (t *Topic) Seek(channelName string, position Position) error {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	channel, exists := t.channels[channelName]
+
+	if _, member := t.groupOf[channelName]; !exists || member {
+		return ChannelNotFoundError
+	}
+
+	// stop publishes so nothing is pushed between finding the offset and moving to it
+	t.publishLock.Lock()
+	defer t.publishLock.Unlock()
+
+	pending := t.inflight[channelName]
+	pending.Lock()
+	defer pending.Unlock()
+
+	pending.leases = pending.leases[:0]
+	pending.redeliver = pending.redeliver[:0]
+
+	defer t.notify()
+
+	if cursor, ok := channel.(*LogChannel); ok {
+		cursor.Seek(offsetOf(t.log, position))
+		return nil
+	}
+
+	for {
+		if _, err := channel.Pop(); err == NoMessagesAvailable {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if t.retained == nil {
+		return nil
+	}
+
+	for _, message := range t.matching(channelName, t.retained.From(offsetOf(t.retained, position))) {
+		if err := t.push(channel, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// offset in a log of the first message at position
+func offsetOf(log *Log, position Position) uint64 {
+
+	switch position.Kind {
+	case Earliest:
+		return log.Start()
+	case AtSequence:
+		return log.Search(func(message *Message) bool { return message.Sequence() >= position.Sequence })
+	case AtTime:
+		return log.Search(func(message *Message) bool { return !message.Timestamp().Before(position.Time) })
+	}
+	return log.End()
+}
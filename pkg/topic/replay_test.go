@@ -0,0 +1,94 @@
+package topic
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionsCanBeMovedToRetainedMessages(t *testing.T) {
+
+	for _, topic := range []*Topic{NewTopic("topic-1"), NewTopicWithChannelFactory("topic-1", InMemoryChannelFactory)} {
+
+		topic.SetOptions(TopicOptions{Retention: time.Hour})
+		topic.AddChannel("subscriber-1")
+
+		for i := 1; i <= 3; i++ {
+			topic.PublishMessage(NewMessage([]byte(fmt.Sprintf("message-%d", i))))
+		}
+
+		topic.GetNextMessage("subscriber-1")
+		topic.AddChannel("subscriber-2")
+
+		assertSeek(t, topic, "subscriber-2", Position{Kind: Earliest}, "message-1", "message-2", "message-3")
+		assertSeek(t, topic, "subscriber-1", Position{Kind: AtSequence, Sequence: 2}, "message-2", "message-3")
+		assertSeek(t, topic, "subscriber-1", Position{Kind: Latest})
+		assertSeek(t, topic, "subscriber-1", Position{Kind: AtTime, Time: time.Now().Add(-time.Minute)}, "message-1", "message-2", "message-3")
+
+		if err := topic.Seek("subscriber-3", Position{Kind: Earliest}); err != ChannelNotFoundError {
+			t.Error("Seeking an unknown channel should return ChannelNotFoundError.")
+		}
+	}
+}
+
+func TestLogReleasesMessagesOnlyAfterTheRetentionPeriod(t *testing.T) {
+
+	log := NewLog(1)
+	log.SetRetention(time.Hour)
+
+	cursor := log.NewChannel()
+	log.Append(NewMessage([]byte("message-1")).published("topic-1", 1, time.Now().Add(-30*time.Minute), 0))
+	log.Append(NewMessage([]byte("message-2")).published("topic-1", 2, time.Now(), 0))
+	cursor.Pop()
+	cursor.Pop()
+
+	if log.Start() != 0 {
+		t.Error("Messages within the retention period should be kept : ", log.Start())
+	}
+
+	log.SetRetention(time.Minute)
+
+	if log.Start() != 1 {
+		t.Error("Messages older than the retention period should be released : ", log.Start())
+	}
+}
+
+func TestPositionsAreParsed(t *testing.T) {
+
+	for value, kind := range map[string]PositionKind{
+		"earliest":             Earliest,
+		"latest":               Latest,
+		"42":                   AtSequence,
+		"2030-01-01T00:00:00Z": AtTime,
+		"2h":                   AtTime,
+	} {
+		if position, err := ParsePosition(value); err != nil || position.Kind != kind {
+			t.Error("Unable to parse position ", value)
+		}
+	}
+
+	if _, err := ParsePosition("yesterday"); err == nil {
+		t.Error("An unknown position should not be parsed.")
+	}
+}
+
+func assertSeek(t *testing.T, topic *Topic, channelName string, position Position, expected ...string) {
+
+	if err := topic.Seek(channelName, position); err != nil {
+		t.Fatal("Seeking should not fail : ", err)
+	}
+
+	for _, content := range expected {
+
+		message, err := topic.GetNextMessage(channelName)
+
+		if err != nil || message.String() != content {
+			t.Error("Expected ", content, " after seeking to ", position)
+			return
+		}
+	}
+
+	if _, err := topic.GetNextMessage(channelName); err != NoMessagesAvailable {
+		t.Error("Expected no more messages after seeking to ", position)
+	}
+}
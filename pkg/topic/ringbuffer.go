@@ -0,0 +1,293 @@
+package topic
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ChannelFull    = errors.New("Channel is full")
+	PublishTimeout = errors.New("Timed out waiting for space in channel")
+	WouldBlock     = errors.New("Channel is full and publishes wait for space")
+)
+
+// OverflowPolicy decides what a RingBufferChannel does with a Push when it is full
+type OverflowPolicy int
+
+const (
+	// overwrite the oldest pending message
+	DropOldest OverflowPolicy = iota
+	// discard the message being pushed
+	DropNewest
+	// refuse the message with a ChannelFull error
+	RejectPublish
+	// wait up to BlockTimeout for a Pop to make space, then fail with PublishTimeout
+	BlockWithTimeout
+)
+
+// Parses "drop-oldest", "drop-newest", "reject" or "block" into an OverflowPolicy
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch policy {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "drop-newest":
+		return DropNewest, nil
+	case "reject":
+		return RejectPublish, nil
+	case "block":
+		return BlockWithTimeout, nil
+	}
+	return DropOldest, fmt.Errorf("Unknown overflow policy : %s", policy)
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case RejectPublish:
+		return "reject"
+	case BlockWithTimeout:
+		return "block"
+	}
+	return "unknown"
+}
+
+// RingBufferOptions configures a RingBufferChannel
+type RingBufferOptions struct {
+	Capacity     int
+	Overflow     OverflowPolicy
+	BlockTimeout time.Duration
+}
+
+// Create a Channel holding at most options.Capacity messages
+// Safe for use via goroutines
+func NewRingBufferChannel(options RingBufferOptions) Channel {
+
+	if options.Capacity < 1 {
+		options.Capacity = 1
+	}
+
+	c := &RingBufferChannel{
+		options:      options,
+		messageStore: make([]*Message, options.Capacity),
+	}
+	c.space = sync.NewCond(&c.Mutex)
+	return c
+}
+
+// Returns a ChannelFactory creating a RingBufferChannel per subscriber.
+// Topics found in topics use their own options, every other topic uses defaults
+func RingBufferChannelFactory(defaults RingBufferOptions, topics map[string]RingBufferOptions) ChannelFactory {
+	return func(topicName string, channelName string) (Channel, error) {
+
+		options, exists := topics[topicName]
+
+		if !exists {
+			options = defaults
+		}
+		return NewRingBufferChannel(options), nil
+	}
+}
+
+// A fixed capacity Channel
+type RingBufferChannel struct {
+	sync.Mutex
+	options      RingBufferOptions
+	messageStore []*Message
+	head         int
+	messageCount int
+	dropped      int
+	space        *sync.Cond
+}
+
+// Pushes a message to the store, applying the overflow policy if it is full
+func (c *RingBufferChannel) Push(message *Message) error {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.messageCount == c.options.Capacity {
+
+		switch c.options.Overflow {
+		case DropOldest:
+			c.messageStore[c.head] = nil
+			c.head = (c.head + 1) % c.options.Capacity
+			c.messageCount--
+			c.dropped++
+		case DropNewest:
+			c.dropped++
+			return nil
+		case RejectPublish:
+			return ChannelFull
+		case BlockWithTimeout:
+			if err := c.waitForSpace(); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.messageStore[(c.head+c.messageCount)%c.options.Capacity] = message
+	c.messageCount++
+	return nil
+}
+
+// Pops a message from the store
+func (c *RingBufferChannel) Pop() (*Message, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.messageCount == 0 {
+		return nil, NoMessagesAvailable
+	}
+
+	message := c.messageStore[c.head]
+	c.messageStore[c.head] = nil
+	c.head = (c.head + 1) % c.options.Capacity
+	c.messageCount--
+
+	c.space.Signal()
+	return message, nil
+}
+
+// Returns the next message without removing it
+func (c *RingBufferChannel) Peek() (*Message, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.messageCount == 0 {
+		return nil, NoMessagesAvailable
+	}
+	return c.messageStore[c.head], nil
+}
+
+// Current count of messages waiting to be delivered
+func (c *RingBufferChannel) Count() int {
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.messageCount
+}
+
+// Returns a copy of the messages waiting to be delivered
+func (c *RingBufferChannel) Messages() []*Message {
+
+	c.Lock()
+	defer c.Unlock()
+
+	messages := make([]*Message, c.messageCount)
+
+	for i := range messages {
+		messages[i] = c.messageStore[(c.head+i)%c.options.Capacity]
+	}
+	return messages
+}
+
+// Returns a copy of a window of the messages waiting to be delivered
+func (c *RingBufferChannel) Browse(offset int, limit int) []*Message {
+
+	c.Lock()
+	defer c.Unlock()
+
+	start, end := window(c.messageCount, offset, limit)
+	messages := make([]*Message, 0, end-start)
+
+	for i := start; i < end; i++ {
+		messages = append(messages, c.messageStore[(c.head+i)%c.options.Capacity])
+	}
+	return messages
+}
+
+// True if the channel is full and its policy is to reject further messages
+func (c *RingBufferChannel) WouldReject() bool {
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.options.Overflow == RejectPublish && c.messageCount == c.options.Capacity
+}
+
+// True if the channel does not have space for count messages and its policy is to reject further messages
+func (c *RingBufferChannel) WouldRejectBatch(count int) bool {
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.options.Overflow == RejectPublish && c.messageCount+count > c.options.Capacity
+}
+
+// True if the channel does not have space for count messages and its policy is to wait for
+// space, with how long a publish waits
+func (c *RingBufferChannel) WouldBlockBatch(count int) (time.Duration, bool) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.options.BlockTimeout, c.options.Overflow == BlockWithTimeout && c.messageCount+count > c.options.Capacity
+}
+
+// True if the channel does not have space for count messages and its policy is to reject them
+// or wait for space
+func (c *RingBufferChannel) WouldOverflow(count int) bool {
+
+	c.Lock()
+	defer c.Unlock()
+
+	dropping := c.options.Overflow == DropOldest || c.options.Overflow == DropNewest
+	return !dropping && c.messageCount+count > c.options.Capacity
+}
+
+// Removes the last count messages pushed
+func (c *RingBufferChannel) Retract(count int) error {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if count > c.messageCount {
+		count = c.messageCount
+	}
+
+	for ; count > 0; count-- {
+		c.messageCount--
+		c.messageStore[(c.head+c.messageCount)%c.options.Capacity] = nil
+	}
+
+	c.space.Broadcast()
+	return nil
+}
+
+// Number of messages discarded by the DropOldest or DropNewest policies
+func (c *RingBufferChannel) Dropped() int {
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.dropped
+}
+
+// only to be called when locked
+func (c *RingBufferChannel) waitForSpace() error {
+
+	deadline := time.Now().Add(c.options.BlockTimeout)
+	timer := time.AfterFunc(c.options.BlockTimeout, func() {
+		c.Lock()
+		defer c.Unlock()
+		c.space.Broadcast()
+	})
+	defer timer.Stop()
+
+	for c.messageCount == c.options.Capacity {
+
+		if !time.Now().Before(deadline) {
+			return PublishTimeout
+		}
+		c.space.Wait()
+	}
+	return nil
+}
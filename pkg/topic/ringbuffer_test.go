@@ -0,0 +1,111 @@
+package topic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRingBufferDropsOldestMessage(t *testing.T) {
+
+	channel := NewRingBufferChannel(RingBufferOptions{Capacity: 2, Overflow: DropOldest})
+
+	channel.Push(NewMessage([]byte("message-1")))
+	channel.Push(NewMessage([]byte("message-2")))
+	channel.Push(NewMessage([]byte("message-3")))
+
+	assertChannelLength(t, channel, 2)
+	assertMessageRetreivedWithExpectedContent(t, channel, "message-2")
+	assertMessageRetreivedWithExpectedContent(t, channel, "message-3")
+
+	if channel.(*RingBufferChannel).Dropped() != 1 {
+		t.Error("One message should have been dropped.")
+	}
+}
+
+func TestRingBufferDropsNewestMessage(t *testing.T) {
+
+	channel := NewRingBufferChannel(RingBufferOptions{Capacity: 2, Overflow: DropNewest})
+
+	channel.Push(NewMessage([]byte("message-1")))
+	channel.Push(NewMessage([]byte("message-2")))
+
+	if err := channel.Push(NewMessage([]byte("message-3"))); err != nil {
+		t.Error("Dropping the newest message should not error.")
+	}
+
+	assertChannelLength(t, channel, 2)
+	assertMessageRetreivedWithExpectedContent(t, channel, "message-1")
+	assertMessageRetreivedWithExpectedContent(t, channel, "message-2")
+}
+
+func TestRingBufferRejectsMessageWhenFull(t *testing.T) {
+
+	channel := NewRingBufferChannel(RingBufferOptions{Capacity: 1, Overflow: RejectPublish})
+
+	channel.Push(NewMessage([]byte("message-1")))
+
+	if !channel.(BoundedChannel).WouldReject() {
+		t.Error("A full channel should report it would reject.")
+	}
+
+	if err := channel.Push(NewMessage([]byte("message-2"))); err != ChannelFull {
+		t.Error("A ChannelFull error should have been returned.")
+	}
+
+	assertMessageRetreivedWithExpectedContent(t, channel, "message-1")
+}
+
+func TestRingBufferBlocksUntilSpaceIsAvailable(t *testing.T) {
+
+	channel := NewRingBufferChannel(RingBufferOptions{Capacity: 1, Overflow: BlockWithTimeout, BlockTimeout: time.Second})
+
+	channel.Push(NewMessage([]byte("message-1")))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		channel.Pop()
+	}()
+
+	if err := channel.Push(NewMessage([]byte("message-2"))); err != nil {
+		t.Error("Push should succeed once space is available : ", err.Error())
+	}
+
+	assertMessageRetreivedWithExpectedContent(t, channel, "message-2")
+}
+
+func TestRingBufferTimesOutWhenBlocked(t *testing.T) {
+
+	channel := NewRingBufferChannel(RingBufferOptions{Capacity: 1, Overflow: BlockWithTimeout, BlockTimeout: 10 * time.Millisecond})
+
+	channel.Push(NewMessage([]byte("message-1")))
+
+	if err := channel.Push(NewMessage([]byte("message-2"))); err != PublishTimeout {
+		t.Error("A PublishTimeout error should have been returned.")
+	}
+}
+
+func TestRingBufferFactoryUsesPerTopicOptions(t *testing.T) {
+
+	factory := RingBufferChannelFactory(RingBufferOptions{Capacity: 1}, map[string]RingBufferOptions{
+		"topic-big": {Capacity: 10},
+	})
+
+	small, _ := factory("topic-small", "subscriber")
+	big, _ := factory("topic-big", "subscriber")
+
+	if small.(*RingBufferChannel).options.Capacity != 1 || big.(*RingBufferChannel).options.Capacity != 10 {
+		t.Error("Factory should apply per topic options.")
+	}
+}
+
+func TestOverflowPoliciesAreParsed(t *testing.T) {
+
+	for _, policy := range []OverflowPolicy{DropOldest, DropNewest, RejectPublish, BlockWithTimeout} {
+
+		parsed, err := ParseOverflowPolicy(policy.String())
+
+		if err != nil || parsed != policy {
+			t.Error("Overflow policy did not round trip : ", policy)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package topic
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	UnknownScheduledMessage = errors.New("Unknown or already delivered scheduled message")
+)
+
+// Schedule file layout
+//
+//	magic "TOPD" | version uint16 | message count uint32 | messages... | crc32 of everything before it
+//
+//	message : id | topic | deliver at int64 | ttl int64 | Message.MarshalBinary
+//
+// strings and messages are prefixed with their length as a uint32, times are in
+// nanoseconds since the epoch and the ttl in nanoseconds
+const (
+	scheduleMagic   = "TOPD"
+	scheduleVersion = uint16(1)
+)
+
+// how long a due message waits to be published again when a subscriber of its topic has no
+// space for it, doubling with each attempt up to ScheduleMaxRetryDelay
+var (
+	ScheduleRetryDelay    = time.Second
+	ScheduleMaxRetryDelay = time.Minute
+)
+
+// A message waiting to be published to a topic
+type ScheduledMessage struct {
+	// the id the message is published with
+	Id        string
+	Topic     string
+	Message   *Message
+	DeliverAt time.Time
+
+	// position in the scheduler's heap
+	index int
+	// times publishing the message found its topic full
+	attempts int
+}
+
+// Holds messages until they are due then publishes them to their topic.
+// If the scheduler has a path every change is saved to it so scheduled messages survive a restart.
+// Safe for use via goroutines
+type Scheduler struct {
+	sync.Mutex
+	registry Registry
+	path     string
+	pending  scheduledHeap
+	byId     map[string]*ScheduledMessage
+
+	// signalled when a message is scheduled which may be due before the current earliest
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Returns a Scheduler publishing to topics in the registry, keeping scheduled messages in memory
+func NewScheduler(registry Registry) *Scheduler {
+
+	scheduler := newScheduler(registry, "")
+	go scheduler.loop()
+	return scheduler
+}
+
+// Returns a Scheduler publishing to topics in the registry which saves scheduled messages to path,
+// restoring any previously saved there. A missing file is not an error
+func NewPersistentScheduler(registry Registry, path string) (*Scheduler, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	scheduler := newScheduler(registry, path)
+
+	if err := scheduler.load(); err != nil {
+		return nil, err
+	}
+
+	go scheduler.loop()
+	return scheduler, nil
+}
+
+func newScheduler(registry Registry, path string) *Scheduler {
+	return &Scheduler{
+		registry: registry,
+		path:     path,
+		pending:  make(scheduledHeap, 0),
+		byId:     make(map[string]*ScheduledMessage),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Holds message until deliverAt then publishes it to the topic, returning it as scheduled.
+// A time in the past publishes it straight away
+func (s *Scheduler) Schedule(topicName string, message *Message, deliverAt time.Time) (*ScheduledMessage, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	copied := *message
+	copied.id = newId()
+	message = &copied
+
+	scheduled := &ScheduledMessage{
+		Id:        message.id,
+		Topic:     topicName,
+		Message:   message,
+		DeliverAt: deliverAt,
+	}
+
+	heap.Push(&s.pending, scheduled)
+	s.byId[scheduled.Id] = scheduled
+
+	if err := s.save(); err != nil {
+		heap.Remove(&s.pending, scheduled.index)
+		delete(s.byId, scheduled.Id)
+		return nil, err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	listed := *scheduled
+	return &listed, nil
+}
+
+// Removes a scheduled message before it is published.
+// Returns UnknownScheduledMessage if it is not waiting for the topic
+func (s *Scheduler) Cancel(topicName string, id string) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	scheduled, exists := s.byId[id]
+
+	if !exists || scheduled.Topic != topicName {
+		return UnknownScheduledMessage
+	}
+
+	heap.Remove(&s.pending, scheduled.index)
+	delete(s.byId, id)
+
+	if err := s.save(); err != nil {
+		heap.Push(&s.pending, scheduled)
+		s.byId[id] = scheduled
+		return err
+	}
+	return nil
+}
+
+// The messages waiting for a topic, earliest first
+func (s *Scheduler) List(topicName string) []*ScheduledMessage {
+
+	s.Lock()
+	defer s.Unlock()
+
+	listed := make([]*ScheduledMessage, 0)
+
+	for _, scheduled := range s.pending.sorted() {
+		if scheduled.Topic == topicName {
+			copied := *scheduled
+			listed = append(listed, &copied)
+		}
+	}
+	return listed
+}
+
+// Stops publishing. Messages which have not been published are left in the file
+func (s *Scheduler) Stop() {
+
+	close(s.stop)
+	<-s.done
+}
+
+// publishes messages as they fall due until stopped
+func (s *Scheduler) loop() {
+
+	defer close(s.done)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		due, next := s.takeDue(time.Now())
+
+		for _, scheduled := range due {
+
+			err := s.registry.Get(scheduled.Topic).PublishMessage(scheduled.Message)
+
+			if err == ChannelFull || err == PublishTimeout {
+				next = s.retry(scheduled, time.Now())
+				log.Print("Scheduler : ", scheduled.Topic, " is full, publishing ", scheduled.Id, " again at ", scheduled.DeliverAt)
+			} else if err != nil {
+				log.Print("Scheduler : unable to publish ", scheduled.Id, " to ", scheduled.Topic, " : ", err.Error())
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// removes the messages due by now, returning them with when the next one is due.
+// next is the zero time if nothing is waiting
+func (s *Scheduler) takeDue(now time.Time) ([]*ScheduledMessage, time.Time) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	due := make([]*ScheduledMessage, 0)
+
+	for len(s.pending) > 0 && !s.pending[0].DeliverAt.After(now) {
+		scheduled := heap.Pop(&s.pending).(*ScheduledMessage)
+		delete(s.byId, scheduled.Id)
+		due = append(due, scheduled)
+	}
+
+	if len(due) > 0 {
+		// a message is published again after a restart if this fails, which at-least-once delivery allows
+		if err := s.save(); err != nil {
+			log.Print("Scheduler : unable to save ", s.path, " : ", err.Error())
+		}
+	}
+
+	if len(s.pending) == 0 {
+		return due, time.Time{}
+	}
+	return due, s.pending[0].DeliverAt
+}
+
+// schedules a message whose topic was full again after a backoff, returning when the next
+// message is due
+func (s *Scheduler) retry(scheduled *ScheduledMessage, now time.Time) time.Time {
+
+	s.Lock()
+	defer s.Unlock()
+
+	delay := ScheduleRetryDelay
+
+	for i := 0; i < scheduled.attempts && delay < ScheduleMaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > ScheduleMaxRetryDelay {
+		delay = ScheduleMaxRetryDelay
+	}
+
+	scheduled.attempts++
+	scheduled.DeliverAt = now.Add(delay)
+
+	heap.Push(&s.pending, scheduled)
+	s.byId[scheduled.Id] = scheduled
+
+	if err := s.save(); err != nil {
+		log.Print("Scheduler : unable to save ", s.path, " : ", err.Error())
+	}
+	return s.pending[0].DeliverAt
+}
+
+// writes the scheduled messages to the file, if there is one. The caller holds the lock
+func (s *Scheduler) save() error {
+
+	if s.path == "" {
+		return nil
+	}
+
+	return writeFileAtomically(s.path, func(w io.Writer) error {
+
+		buffer := &bytes.Buffer{}
+		buffer.WriteString(scheduleMagic)
+		binary.Write(buffer, binary.BigEndian, scheduleVersion)
+		binary.Write(buffer, binary.BigEndian, uint32(len(s.pending)))
+
+		for _, scheduled := range s.pending.sorted() {
+
+			data, err := scheduled.Message.MarshalBinary()
+
+			if err != nil {
+				return err
+			}
+
+			writeSnapshotBytes(buffer, []byte(scheduled.Id))
+			writeSnapshotBytes(buffer, []byte(scheduled.Topic))
+			binary.Write(buffer, binary.BigEndian, scheduled.DeliverAt.UnixNano())
+			binary.Write(buffer, binary.BigEndian, int64(scheduled.Message.ttl))
+			writeSnapshotBytes(buffer, data)
+		}
+
+		binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(buffer.Bytes()))
+
+		_, err := buffer.WriteTo(w)
+		return err
+	})
+}
+
+// reads the scheduled messages saved to the file
+func (s *Scheduler) load() error {
+
+	data, err := ioutil.ReadFile(s.path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(data) < len(scheduleMagic)+2+4 || string(data[:len(scheduleMagic)]) != scheduleMagic {
+		return CorruptSnapshot
+	}
+
+	body := data[:len(data)-4]
+
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return CorruptSnapshot
+	}
+
+	reader := bytes.NewReader(body[len(scheduleMagic):])
+
+	var version uint16
+	binary.Read(reader, binary.BigEndian, &version)
+
+	if version != scheduleVersion {
+		return UnsupportedSnapshotVersion
+	}
+
+	count, err := readSnapshotCount(reader)
+
+	if err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+
+		id, err := readSnapshotBytes(reader)
+
+		if err != nil {
+			return err
+		}
+
+		topicName, err := readSnapshotBytes(reader)
+
+		if err != nil {
+			return err
+		}
+
+		var deliverAt, ttl int64
+
+		if binary.Read(reader, binary.BigEndian, &deliverAt) != nil || binary.Read(reader, binary.BigEndian, &ttl) != nil {
+			return CorruptSnapshot
+		}
+
+		data, err := readSnapshotBytes(reader)
+
+		if err != nil {
+			return err
+		}
+
+		message := &Message{}
+
+		if err := message.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		message.ttl = time.Duration(ttl)
+
+		scheduled := &ScheduledMessage{
+			Id:        string(id),
+			Topic:     string(topicName),
+			Message:   message,
+			DeliverAt: time.Unix(0, deliverAt),
+		}
+
+		heap.Push(&s.pending, scheduled)
+		s.byId[scheduled.Id] = scheduled
+	}
+
+	if reader.Len() != 0 {
+		return CorruptSnapshot
+	}
+	return nil
+}
+
+// min-heap of scheduled messages ordered by when they are due
+type scheduledHeap []*ScheduledMessage
+
+func (h scheduledHeap) Len() int { return len(h) }
+
+func (h scheduledHeap) Less(i, j int) bool { return h[i].DeliverAt.Before(h[j].DeliverAt) }
+
+func (h scheduledHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduledHeap) Push(x interface{}) {
+
+	scheduled := x.(*ScheduledMessage)
+	scheduled.index = len(*h)
+	*h = append(*h, scheduled)
+}
+
+func (h *scheduledHeap) Pop() interface{} {
+
+	old := *h
+	last := len(old) - 1
+	scheduled := old[last]
+	old[last] = nil
+	*h = old[:last]
+	return scheduled
+}
+
+// the messages in the order they are due, without changing the heap
+func (h scheduledHeap) sorted() []*ScheduledMessage {
+
+	sorted := make([]*ScheduledMessage, len(h))
+	copy(sorted, h)
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].DeliverAt.Before(sorted[j].DeliverAt) })
+	return sorted
+}
@@ -0,0 +1,149 @@
+package topic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduledMessagesArePublishedWhenDue(t *testing.T) {
+
+	registry := NewTopicRegistry()
+	registry.Get("topic-1").AddChannel("subscriber-1")
+
+	scheduler := NewScheduler(registry)
+	defer scheduler.Stop()
+
+	later, _ := scheduler.Schedule("topic-1", NewMessage([]byte("message-2")), time.Now().Add(time.Hour))
+	scheduled, _ := scheduler.Schedule("topic-1", NewMessage([]byte("message-1")), time.Now().Add(10*time.Millisecond))
+
+	if _, err := registry.Get("topic-1").GetNextMessage("subscriber-1"); err != NoMessagesAvailable {
+		t.Error("A scheduled message should not be published before it is due.")
+	}
+
+	message := waitForMessage(t, registry.Get("topic-1"), "subscriber-1")
+
+	if message.String() != "message-1" || message.Id() != scheduled.Id {
+		t.Error("A scheduled message should be published with its id when due : ", message.String())
+	}
+
+	listed := scheduler.List("topic-1")
+
+	if len(listed) != 1 || listed[0].Id != later.Id {
+		t.Error("Only messages which are not yet due should be listed : ", len(listed))
+	}
+}
+
+func TestCancelledMessagesAreNotPublished(t *testing.T) {
+
+	registry := NewTopicRegistry()
+	registry.Get("topic-1").AddChannel("subscriber-1")
+
+	scheduler := NewScheduler(registry)
+	defer scheduler.Stop()
+
+	scheduled, _ := scheduler.Schedule("topic-1", NewMessage([]byte("message-1")), time.Now().Add(10*time.Millisecond))
+
+	if err := scheduler.Cancel("topic-2", scheduled.Id); err != UnknownScheduledMessage {
+		t.Error("A message can only be cancelled for its own topic.")
+	}
+
+	if err := scheduler.Cancel("topic-1", scheduled.Id); err != nil {
+		t.Fatal("Cancelling a scheduled message should not fail : ", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := registry.Get("topic-1").GetNextMessage("subscriber-1"); err != NoMessagesAvailable {
+		t.Error("A cancelled message should not be published.")
+	}
+
+	if err := scheduler.Cancel("topic-1", scheduled.Id); err != UnknownScheduledMessage {
+		t.Error("Cancelling twice should return UnknownScheduledMessage.")
+	}
+}
+
+func TestDueMessagesForAFullTopicArePublishedOnceThereIsSpace(t *testing.T) {
+
+	delay := ScheduleRetryDelay
+	ScheduleRetryDelay = 5 * time.Millisecond
+	defer func() { ScheduleRetryDelay = delay }()
+
+	registry := NewTopicRegistryWithChannelFactory(RingBufferChannelFactory(RingBufferOptions{Capacity: 1, Overflow: RejectPublish}, nil))
+	registry.Get("topic-1").AddChannel("subscriber-1")
+	registry.Get("topic-1").PublishMessage(NewMessage([]byte("message-1")))
+
+	scheduler := NewScheduler(registry)
+	defer scheduler.Stop()
+
+	scheduled, _ := scheduler.Schedule("topic-1", NewMessage([]byte("message-2")), time.Now())
+
+	time.Sleep(20 * time.Millisecond)
+
+	if listed := scheduler.List("topic-1"); len(listed) != 1 || listed[0].Id != scheduled.Id || !listed[0].DeliverAt.After(scheduled.DeliverAt) {
+		t.Fatal("A message whose topic is full should be scheduled again : ", listed)
+	}
+
+	registry.Get("topic-1").GetNextMessage("subscriber-1")
+	message := waitForMessage(t, registry.Get("topic-1"), "subscriber-1")
+
+	if message.String() != "message-2" || message.Id() != scheduled.Id {
+		t.Error("The message should be published once there is space : ", message.String())
+	}
+}
+
+func TestScheduledMessagesSurviveARestart(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+	path := filepath.Join(directory, "scheduled")
+
+	registry := NewTopicRegistry()
+	scheduler, err := NewPersistentScheduler(registry, path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, _ := scheduler.Schedule("topic-1", NewMessage([]byte("message-1")).WithTTL(time.Minute), time.Now().Add(50*time.Millisecond))
+	scheduler.Stop()
+
+	restarted := NewTopicRegistry()
+	restarted.Get("topic-1").AddChannel("subscriber-1")
+
+	scheduler, err = NewPersistentScheduler(restarted, path)
+
+	if err != nil {
+		t.Fatal("Restoring scheduled messages should not fail : ", err)
+	}
+	defer scheduler.Stop()
+
+	if listed := scheduler.List("topic-1"); len(listed) != 1 || listed[0].Id != scheduled.Id {
+		t.Fatal("Scheduled messages should be restored.")
+	}
+
+	message := waitForMessage(t, restarted.Get("topic-1"), "subscriber-1")
+
+	if message.String() != "message-1" || message.Id() != scheduled.Id || message.Expires().IsZero() {
+		t.Error("A restored message should be published with its id and ttl.")
+	}
+}
+
+func waitForMessage(t *testing.T, topic *Topic, channelName string) *Message {
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for time.Now().Before(deadline) {
+
+		message, err := topic.GetNextMessage(channelName)
+
+		if err == nil {
+			return message
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("No message was published.")
+	return nil
+}
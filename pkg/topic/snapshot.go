@@ -0,0 +1,468 @@
+package topic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	CorruptSnapshot            = errors.New("Snapshot is corrupt")
+	UnsupportedSnapshotVersion = errors.New("Snapshot version is not supported")
+)
+
+// Snapshot layout
+//
+//	magic "TOPS" | version uint16 | topic count uint32 | topics... | crc32 of everything before it
+//
+//	topic   : name | created int64 | channel count uint32 | channels... | group count uint32 | groups...
+//	channel : name | filter | subscribed int64 | message count uint32 | messages...
+//	message : Message.MarshalBinary
+//	group   : name | assignment uint8 | member count uint32 | member names...
+//
+// strings and messages are prefixed with their length as a uint32, a channel without a filter
+// has an empty one. Times are in nanoseconds since the Unix epoch. Version 1 snapshots have
+// no groups, versions 1 and 2 no filters and versions 1 to 3 no creation times
+const (
+	snapshotMagic   = "TOPS"
+	snapshotVersion = uint16(4)
+)
+
+// A point in time copy of the topics, subscribers and pending messages in a Registry
+type Snapshot struct {
+	Topics []TopicSnapshot
+}
+
+type TopicSnapshot struct {
+	Name string
+	// the zero time if the snapshot did not record it
+	Created  time.Time
+	Channels []ChannelSnapshot
+	Groups   []GroupSnapshot
+}
+
+type ChannelSnapshot struct {
+	Name string
+	// expression of the channel's Filter, empty if it has none
+	Filter string
+	// the zero time if the snapshot did not record it
+	Subscribed time.Time
+	Messages   []*Message
+}
+
+type GroupSnapshot struct {
+	Name       string
+	Assignment Assignment
+	Members    []string
+}
+
+// Copies the state of every topic in the registry
+func TakeSnapshot(registry Registry) *Snapshot {
+
+	snapshot := &Snapshot{}
+
+	for _, topic := range registry.Topics() {
+
+		pending := topic.pendingMessages()
+		filters := topic.filterExpressions()
+		subscribed := topic.subscribedTimes()
+		topicSnapshot := TopicSnapshot{Name: topic.Name(), Created: topic.Created(), Groups: topic.groupSnapshots()}
+
+		channelNames := make([]string, 0, len(pending))
+		for channelName := range pending {
+			channelNames = append(channelNames, channelName)
+		}
+		sort.Strings(channelNames)
+
+		for _, channelName := range channelNames {
+			topicSnapshot.Channels = append(topicSnapshot.Channels, ChannelSnapshot{
+				Name:       channelName,
+				Filter:     filters[channelName],
+				Subscribed: subscribed[channelName],
+				Messages:   pending[channelName],
+			})
+		}
+
+		snapshot.Topics = append(snapshot.Topics, topicSnapshot)
+	}
+	return snapshot
+}
+
+// Recreates the topics and subscribers of the snapshot in the registry.
+// Pending messages are only restored into channels which are empty once created
+// so channels that persist their own messages, e.g. a WALChannel, are not duplicated
+func (s *Snapshot) Restore(registry Registry) error {
+
+	for _, topicSnapshot := range s.Topics {
+
+		topic := registry.Get(topicSnapshot.Name)
+		topic.restoreCreated(topicSnapshot.Created)
+
+		// members first so their channels are not restored as subscribers
+		if err := topic.restoreGroups(topicSnapshot.Groups); err != nil {
+			return err
+		}
+
+		if err := topic.restoreChannels(topicSnapshot.Channels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encodes the snapshot
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(snapshotMagic)
+	binary.Write(buffer, binary.BigEndian, snapshotVersion)
+	binary.Write(buffer, binary.BigEndian, uint32(len(s.Topics)))
+
+	for _, topic := range s.Topics {
+
+		writeSnapshotBytes(buffer, []byte(topic.Name))
+		writeSnapshotTime(buffer, topic.Created)
+		binary.Write(buffer, binary.BigEndian, uint32(len(topic.Channels)))
+
+		for _, channel := range topic.Channels {
+
+			writeSnapshotBytes(buffer, []byte(channel.Name))
+			writeSnapshotBytes(buffer, []byte(channel.Filter))
+			writeSnapshotTime(buffer, channel.Subscribed)
+			binary.Write(buffer, binary.BigEndian, uint32(len(channel.Messages)))
+
+			for _, message := range channel.Messages {
+
+				data, err := message.MarshalBinary()
+
+				if err != nil {
+					return 0, err
+				}
+				writeSnapshotBytes(buffer, data)
+			}
+		}
+
+		binary.Write(buffer, binary.BigEndian, uint32(len(topic.Groups)))
+
+		for _, group := range topic.Groups {
+
+			writeSnapshotBytes(buffer, []byte(group.Name))
+			buffer.WriteByte(byte(group.Assignment))
+			binary.Write(buffer, binary.BigEndian, uint32(len(group.Members)))
+
+			for _, member := range group.Members {
+				writeSnapshotBytes(buffer, []byte(member))
+			}
+		}
+	}
+
+	binary.Write(buffer, binary.BigEndian, crc32.ChecksumIEEE(buffer.Bytes()))
+
+	return buffer.WriteTo(w)
+}
+
+// Decodes a snapshot, verifying its checksum before anything is read from it
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+
+	data, err := ioutil.ReadAll(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(snapshotMagic)+2+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, CorruptSnapshot
+	}
+
+	body := data[:len(data)-4]
+	checksum := binary.BigEndian.Uint32(data[len(data)-4:])
+
+	if crc32.ChecksumIEEE(body) != checksum {
+		return nil, CorruptSnapshot
+	}
+
+	reader := bytes.NewReader(body[len(snapshotMagic):])
+
+	var version uint16
+	binary.Read(reader, binary.BigEndian, &version)
+
+	if version < 1 || version > snapshotVersion {
+		return nil, UnsupportedSnapshotVersion
+	}
+
+	snapshot := &Snapshot{}
+	topicCount, err := readSnapshotCount(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := uint32(0); i < topicCount; i++ {
+
+		topicName, err := readSnapshotBytes(reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		topic := TopicSnapshot{Name: string(topicName)}
+
+		if version >= 4 {
+			if topic.Created, err = readSnapshotTime(reader); err != nil {
+				return nil, err
+			}
+		}
+
+		channelCount, err := readSnapshotCount(reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for j := uint32(0); j < channelCount; j++ {
+
+			channelName, err := readSnapshotBytes(reader)
+
+			if err != nil {
+				return nil, err
+			}
+
+			channel := ChannelSnapshot{Name: string(channelName)}
+
+			if version >= 3 {
+
+				filter, err := readSnapshotBytes(reader)
+
+				if err != nil {
+					return nil, err
+				}
+				channel.Filter = string(filter)
+			}
+
+			if version >= 4 {
+				if channel.Subscribed, err = readSnapshotTime(reader); err != nil {
+					return nil, err
+				}
+			}
+
+			messageCount, err := readSnapshotCount(reader)
+
+			if err != nil {
+				return nil, err
+			}
+
+			for k := uint32(0); k < messageCount; k++ {
+
+				data, err := readSnapshotBytes(reader)
+
+				if err != nil {
+					return nil, err
+				}
+
+				message := &Message{}
+
+				if err := message.UnmarshalBinary(data); err != nil {
+					return nil, err
+				}
+				channel.Messages = append(channel.Messages, message)
+			}
+
+			topic.Channels = append(topic.Channels, channel)
+		}
+
+		if version >= 2 {
+
+			groups, err := readSnapshotGroups(reader)
+
+			if err != nil {
+				return nil, err
+			}
+			topic.Groups = groups
+		}
+
+		snapshot.Topics = append(snapshot.Topics, topic)
+	}
+
+	if reader.Len() != 0 {
+		return nil, CorruptSnapshot
+	}
+
+	return snapshot, nil
+}
+
+// Writes a snapshot of the registry to path. The file is replaced atomically
+func SaveSnapshot(path string, registry Registry) error {
+
+	return writeFileAtomically(path, func(w io.Writer) error {
+		_, err := TakeSnapshot(registry).WriteTo(w)
+		return err
+	})
+}
+
+// replaces the file at path with what write writes, leaving it untouched if anything fails
+func writeFileAtomically(path string, write func(w io.Writer) error) error {
+
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	if err := write(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// Restores the snapshot at path into the registry. A missing file is not an error
+func LoadSnapshot(path string, registry Registry) error {
+
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	snapshot, err := ReadSnapshot(file)
+
+	if err != nil {
+		return err
+	}
+
+	return snapshot.Restore(registry)
+}
+
+func readSnapshotGroups(reader *bytes.Reader) ([]GroupSnapshot, error) {
+
+	groupCount, err := readSnapshotCount(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]GroupSnapshot, 0, groupCount)
+
+	for i := uint32(0); i < groupCount; i++ {
+
+		name, err := readSnapshotBytes(reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		assignment, err := reader.ReadByte()
+
+		if err != nil {
+			return nil, CorruptSnapshot
+		}
+
+		group := GroupSnapshot{Name: string(name), Assignment: Assignment(assignment)}
+		memberCount, err := readSnapshotCount(reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for j := uint32(0); j < memberCount; j++ {
+
+			member, err := readSnapshotBytes(reader)
+
+			if err != nil {
+				return nil, err
+			}
+			group.Members = append(group.Members, string(member))
+		}
+
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func writeSnapshotBytes(buffer *bytes.Buffer, data []byte) {
+	binary.Write(buffer, binary.BigEndian, uint32(len(data)))
+	buffer.Write(data)
+}
+
+// the zero time is written as 0
+func writeSnapshotTime(buffer *bytes.Buffer, value time.Time) {
+
+	var nanoseconds int64
+
+	if !value.IsZero() {
+		nanoseconds = value.UnixNano()
+	}
+	binary.Write(buffer, binary.BigEndian, nanoseconds)
+}
+
+func readSnapshotTime(reader *bytes.Reader) (time.Time, error) {
+
+	var nanoseconds int64
+
+	if err := binary.Read(reader, binary.BigEndian, &nanoseconds); err != nil {
+		return time.Time{}, CorruptSnapshot
+	}
+
+	if nanoseconds == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, nanoseconds), nil
+}
+
+func readSnapshotCount(reader *bytes.Reader) (uint32, error) {
+
+	var count uint32
+
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return 0, CorruptSnapshot
+	}
+
+	// each entry needs at least its length prefix
+	if int64(count)*4 > int64(reader.Len()) {
+		return 0, CorruptSnapshot
+	}
+	return count, nil
+}
+
+func readSnapshotBytes(reader *bytes.Reader) ([]byte, error) {
+
+	var length uint32
+
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, CorruptSnapshot
+	}
+
+	if int64(length) > int64(reader.Len()) {
+		return nil, CorruptSnapshot
+	}
+
+	data := make([]byte, length)
+	reader.Read(data)
+	return data, nil
+}
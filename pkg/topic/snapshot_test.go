@@ -0,0 +1,107 @@
+package topic
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTripsRegistry(t *testing.T) {
+
+	registry := NewTopicRegistry()
+
+	topic := registry.Get("topic-1")
+	topic.AddChannel("subscriber-1")
+	topic.AddChannel("subscriber-2")
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+	topic.GetNextMessage("subscriber-2")
+	registry.Get("topic-2")
+
+	buffer := &bytes.Buffer{}
+
+	if _, err := TakeSnapshot(registry).WriteTo(buffer); err != nil {
+		t.Fatal("Writing a snapshot should not fail : ", err.Error())
+	}
+
+	snapshot, err := ReadSnapshot(buffer)
+
+	if err != nil {
+		t.Fatal("Reading a snapshot should not fail : ", err.Error())
+	}
+
+	restored := NewTopicRegistry()
+	snapshot.Restore(restored)
+
+	if !restored.Contains("topic-1") || !restored.Contains("topic-2") {
+		t.Error("Restored registry should contain every topic.")
+	}
+
+	restoredTopic := restored.Get("topic-1")
+
+	if !restoredTopic.ChannelExists("subscriber-1") || !restoredTopic.ChannelExists("subscriber-2") {
+		t.Error("Restored topic should contain every subscriber.")
+	}
+
+	message, err := restoredTopic.GetNextMessage("subscriber-1")
+
+	if err != nil || message.String() != "message-1" {
+		t.Error("subscriber-1 should have their pending message restored.")
+	}
+
+	if _, err := restoredTopic.GetNextMessage("subscriber-2"); err != NoMessagesAvailable {
+		t.Error("subscriber-2 should have no pending messages.")
+	}
+	if !restoredTopic.Created().Equal(topic.Created()) || !restoredTopic.Channels()[0].Subscribed.Equal(topic.Channels()[0].Subscribed) {
+		t.Error("Restored topic should keep when it and its subscribers were created.")
+	}
+}
+
+func TestCorruptSnapshotIsDetected(t *testing.T) {
+
+	registry := NewTopicRegistry()
+	registry.Get("topic-1").AddChannel("subscriber-1")
+
+	buffer := &bytes.Buffer{}
+	TakeSnapshot(registry).WriteTo(buffer)
+
+	data := buffer.Bytes()
+	data[len(data)/2] ^= 0xff
+
+	if _, err := ReadSnapshot(bytes.NewReader(data)); err != CorruptSnapshot {
+		t.Error("A CorruptSnapshot error should have been returned.")
+	}
+
+	if _, err := ReadSnapshot(bytes.NewReader(data[:3])); err != CorruptSnapshot {
+		t.Error("A CorruptSnapshot error should have been returned for a truncated snapshot.")
+	}
+}
+
+func TestSnapshotIsSavedAndLoaded(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "registry.snapshot")
+
+	if err := LoadSnapshot(path, NewTopicRegistry()); err != nil {
+		t.Error("Loading a missing snapshot should not fail.")
+	}
+
+	registry := NewTopicRegistry()
+	registry.Get("topic-1").AddChannel("subscriber-1")
+
+	if err := SaveSnapshot(path, registry); err != nil {
+		t.Fatal("Saving a snapshot should not fail : ", err.Error())
+	}
+
+	restored := NewTopicRegistry()
+
+	if err := LoadSnapshot(path, restored); err != nil {
+		t.Fatal("Loading a snapshot should not fail : ", err.Error())
+	}
+
+	if !restored.Get("topic-1").ChannelExists("subscriber-1") {
+		t.Error("Restored topic should contain its subscriber.")
+	}
+}
@@ -0,0 +1,99 @@
+package topic
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// What has happened to a topic's messages, for monitoring
+type Stats struct {
+	Topic string
+	// messages published to the topic. Messages forwarded to a wildcard topic are not counted
+	Published uint64
+	// messages handed to subscribers, counting each redelivery
+	Delivered uint64
+	// messages discarded by the overflow policy of the subscribers, including those since removed
+	Dropped uint64
+	// see Expired
+	Expired uint64
+	// messages waiting for each subscriber, including consumer group members
+	Backlog map[string]int
+}
+
+// A Channel which discards messages when full, such as a RingBufferChannel
+type DroppingChannel interface {
+	Channel
+	// number of messages discarded
+	Dropped() int
+}
+
+// Returns what has happened to the topic's messages
+func (t *Topic) Stats() Stats {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	stats := Stats{
+		Topic:     t.name,
+		Published: atomic.LoadUint64(&t.published),
+		Delivered: atomic.LoadUint64(&t.delivered),
+		Dropped:   atomic.LoadUint64(&t.dropped),
+		Expired:   atomic.LoadUint64(&t.expired),
+		Backlog:   make(map[string]int, len(t.channels)),
+	}
+
+	for channelName, channel := range t.channels {
+		stats.Backlog[channelName] = channel.Count()
+	}
+	return stats
+}
+
+// What a channel of a topic holds, for monitoring
+type ChannelInfo struct {
+	Name string
+	// the consumer group of a member's channel, empty for a subscriber
+	Group string
+	// messages waiting to be delivered
+	Backlog int
+	// when the oldest message waiting was published, the zero time if none are waiting
+	Oldest time.Time
+	// when the channel was created
+	Subscribed time.Time
+}
+
+// When the topic was created
+func (t *Topic) Created() time.Time {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.created
+}
+
+// Describes every channel of the topic ordered by name, including consumer group members
+func (t *Topic) Channels() []ChannelInfo {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	channels := make([]ChannelInfo, 0, len(t.channels))
+
+	for channelName, channel := range t.channels {
+
+		info := ChannelInfo{
+			Name:       channelName,
+			Group:      t.groupOf[channelName],
+			Backlog:    channel.Count(),
+			Subscribed: t.subscribed[channelName],
+		}
+
+		if oldest, err := channel.Peek(); err == nil {
+			info.Oldest = oldest.Timestamp()
+		}
+		channels = append(channels, info)
+	}
+
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels
+}
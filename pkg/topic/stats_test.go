@@ -0,0 +1,65 @@
+package topic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsCountWhatHappenedToMessages(t *testing.T) {
+
+	factory := RingBufferChannelFactory(RingBufferOptions{Capacity: 2, Overflow: DropOldest}, nil)
+	topic := NewTopicWithChannelFactory("topic-a", factory)
+	topic.AddChannel("subscriber-1")
+	topic.AddChannel("subscriber-2")
+
+	for _, body := range []string{"message-1", "message-2", "message-3"} {
+		topic.PublishMessage(NewMessage([]byte(body)))
+	}
+
+	topic.GetNextMessage("subscriber-1")
+	topic.LeaseNextMessage("subscriber-1", time.Minute)
+
+	stats := topic.Stats()
+
+	if stats.Topic != "topic-a" || stats.Published != 3 || stats.Delivered != 2 || stats.Dropped != 2 {
+		t.Error("Unexpected counts : ", stats)
+	}
+
+	if stats.Backlog["subscriber-1"] != 0 || stats.Backlog["subscriber-2"] != 2 {
+		t.Error("Unexpected backlog : ", stats.Backlog)
+	}
+
+	topic.RemoveChannel("subscriber-2")
+
+	if dropped := topic.Stats().Dropped; dropped != 2 {
+		t.Error("Messages dropped by a removed subscriber should still be counted : ", dropped)
+	}
+}
+
+func TestChannelsDescribeTheSubscribersOfATopic(t *testing.T) {
+
+	topic := NewTopic("topic-a")
+	topic.AddChannel("subscriber-2")
+	topic.JoinGroup("workers", "worker-1", RoundRobin)
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+	topic.AddChannel("subscriber-1")
+
+	channels := topic.Channels()
+	member := GroupChannelName("workers", "worker-1")
+
+	if len(channels) != 3 || channels[0].Name != "subscriber-1" || channels[1].Name != "subscriber-2" {
+		t.Fatal("Every channel should be described ordered by name : ", channels)
+	}
+
+	if channels[0].Backlog != 0 || !channels[0].Oldest.IsZero() || channels[1].Backlog != 1 || channels[1].Oldest.IsZero() {
+		t.Error("Channels should have their backlog and oldest message : ", channels)
+	}
+
+	if channels[2].Name != member || channels[2].Group != "workers" || channels[2].Subscribed.IsZero() {
+		t.Error("Group members should be described with their group : ", channels[2])
+	}
+
+	if topic.Created().After(channels[0].Subscribed) {
+		t.Error("A topic should be created before its subscribers.")
+	}
+}
@@ -2,38 +2,176 @@ package topic
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	ChannelNotFoundError = errors.New("Channel not found")
 )
 
+// Settings which can differ between topics
+type TopicOptions struct {
+	// a leased message delivered this many times without being acknowledged
+	// is moved to the dead letter topic. Unlimited if 0
+	MaxDeliveries int
+	// how long a message published without its own ttl lives. Forever if 0
+	DefaultTTL time.Duration
+	// how long published messages are kept after every subscriber has read them
+	// so a subscription can be moved back to them with Seek
+	Retention time.Duration
+}
+
 // A Topic is the 'broker' type object distrubuting messages to connected Channels
 // Safe for use via goroutines
 type Topic struct {
 	sync.RWMutex
 	channels map[string]Channel
+	inflight map[string]*inflight
 	name     string
+	factory  ChannelFactory
+	created  time.Time
+	log      *Log
+	options  TopicOptions
+	// published messages kept for Seek when subscribers do not share a log
+	retained *Log
+
+	// whether the name has a wildcard level, so the topic only receives messages forwarded to it
+	wildcard bool
+	// the wildcard topics of the registry, forwarded the messages published to the topic
+	wildcards *wildcardIndex
+
+	groups map[string]*consumerGroup
+	// group of each channel belonging to a group member
+	groupOf map[string]string
+	// messages each channel with a filter receives
+	filters map[string]*Filter
+	// when each channel was created
+	subscribed map[string]time.Time
+
+	// held while a message is stamped and pushed so sequence numbers follow the publish order
+	publishLock sync.Mutex
+	// sequence number of the last message published
+	sequence uint64
+
+	// messages which expired before being read, counted once for each channel which missed them.
+	// Accessed atomically
+	expired uint64
+	// messages published to the topic and messages handed to its channels. Accessed atomically
+	published uint64
+	delivered uint64
+	// messages the overflow policy of a channel discarded, including channels since removed.
+	// Accessed atomically
+	dropped uint64
+
+	notifyLock sync.Mutex
+	// closed and replaced whenever a message becomes available
+	available chan struct{}
 }
 
+// Creates a Topic whose subscribers read from a Log shared by the topic
 func NewTopic(name string) *Topic {
-	return &Topic{
-		name:     name,
-		channels: make(map[string]Channel),
+	return NewTopicWithChannelFactory(name, nil)
+}
+
+// Creates a Topic whose subscribers use Channels made by the factory.
+// If factory is nil a published message is appended once to a Log shared by the
+// topic and each subscriber is a LogChannel reading from it
+func NewTopicWithChannelFactory(name string, factory ChannelFactory) *Topic {
+	topic := &Topic{
+		name:       name,
+		channels:   make(map[string]Channel),
+		inflight:   make(map[string]*inflight),
+		factory:    factory,
+		created:    time.Now(),
+		wildcard:   IsWildcard(name),
+		groups:     make(map[string]*consumerGroup),
+		groupOf:    make(map[string]string),
+		filters:    make(map[string]*Filter),
+		subscribed: make(map[string]time.Time),
+		available:  make(chan struct{}),
+	}
+
+	if factory == nil {
+		topic.log = NewLog(DefaultSegmentSize)
+	}
+	return topic
+}
+
+// Name of the topic
+func (t *Topic) Name() string {
+	return t.name
+}
+
+// Current options of the topic
+func (t *Topic) Options() TopicOptions {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.options
+}
+
+// Replaces the options of the topic.
+// Dead letter topics never move messages on so MaxDeliveries is ignored for them.
+// Messages already published are only retained if the topic was retaining them before
+func (t *Topic) SetOptions(options TopicOptions) {
+
+	t.Lock()
+	defer t.Unlock()
+
+	if IsDeadLetterTopic(t.name) {
+		options.MaxDeliveries = 0
+	}
+	t.options = options
+
+	if t.log != nil {
+		t.log.SetRetention(options.Retention)
+		return
+	}
+
+	if options.Retention > 0 {
+
+		if t.retained == nil {
+			t.retained = NewLog(DefaultSegmentSize)
+		}
+		t.retained.SetRetention(options.Retention)
+	} else {
+		t.retained = nil
 	}
 }
 
 // Adds a channel to a topic. If it doesn't exist a channel is created for the topic
-func (t *Topic) AddChannel(channelName string) {
+func (t *Topic) AddChannel(channelName string) error {
 	t.Lock()
 	defer t.Unlock()
 
 	_, exists := t.channels[channelName]
 
 	if !exists {
-		t.channels[channelName] = NewChannel()
+
+		if t.log != nil {
+			t.channels[channelName] = t.log.NewChannel()
+			t.inflight[channelName] = newInflight()
+			t.subscribed[channelName] = time.Now()
+			return nil
+		}
+
+		channel, err := t.factory(t.name, channelName)
+
+		if err != nil {
+			return err
+		}
+
+		// a persistent channel may already hold messages from before a restart
+		t.advanceSequence(channel.Messages())
+		t.channels[channelName] = channel
+		t.inflight[channelName] = newInflight()
+		t.subscribed[channelName] = time.Now()
 	}
+	return nil
 }
 
 // Test for whether a specific channel exists
@@ -52,33 +190,434 @@ func (t *Topic) RemoveChannel(channelName string) error {
 	t.Lock()
 	defer t.Unlock()
 
-	_, exists := t.channels[channelName]
+	channel, exists := t.channels[channelName]
 
-	if !exists {
+	// members leave their group with LeaveGroup
+	if _, member := t.groupOf[channelName]; !exists || member {
 		return ChannelNotFoundError
 	}
 
 	delete(t.channels, channelName)
+	delete(t.inflight, channelName)
+	delete(t.filters, channelName)
+	delete(t.subscribed, channelName)
+
+	if disposable, ok := channel.(DisposableChannel); ok {
+		return disposable.Dispose()
+	}
 
 	return nil
 }
 
-// Appends message to all known channels
-func (t *Topic) PublishMessage(message *Message) {
+// Closes the channels which hold resources such as an open file, returning the first error.
+// Their messages are kept for when they are reopened
+func (t *Topic) Close() error {
 
 	t.Lock()
 	defer t.Unlock()
 
+	var first error
+
 	for _, channel := range t.channels {
-		channel.Push(message)
+		if closable, ok := channel.(ClosableChannel); ok {
+			if err := closable.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
 	}
+	return first
 }
 
-// Returns the next message for the channel. If the channel does not exist returns a ChannelNotFoundError
-func (t *Topic) GetNextMessage(channelName string) (*Message, error) {
+// Removes every channel, disposing of those holding resources, and wakes those waiting for
+// a message so they find the topic gone. Returns the first error
+func (t *Topic) dispose() error {
 
 	t.Lock()
-	defer t.Unlock()
+
+	var first error
+
+	for channelName, channel := range t.channels {
+
+		delete(t.channels, channelName)
+		delete(t.inflight, channelName)
+
+		if disposable, ok := channel.(DisposableChannel); ok {
+			if err := disposable.Dispose(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+
+	t.groups = make(map[string]*consumerGroup)
+	t.groupOf = make(map[string]string)
+	t.filters = make(map[string]*Filter)
+	t.subscribed = make(map[string]time.Time)
+	t.Unlock()
+
+	t.notify()
+	return first
+}
+
+// Appends message to all known channels. See Publish
+func (t *Topic) PublishMessage(message *Message) error {
+
+	_, err := t.Publish(message)
+	return err
+}
+
+// Assigns the message an id, the next sequence number of the topic and a timestamp,
+// then appends it to all known channels whose filter matches it and one member of each
+// consumer group, returning the message as published. The message is forwarded to the
+// wildcard topics in the same registry whose name matches.
+// If any channel, including those of the wildcard topics, would reject the message nothing
+// is pushed and ChannelFull is returned.
+// Otherwise a failure to push to one channel does not stop delivery to the others;
+// the first error is returned. A wildcard topic returns PublishToWildcard.
+// Channels which block while full only hold a read lock on the topic, so subscribers
+// can still make space while a publish waits
+func (t *Topic) Publish(message *Message) (*Message, error) {
+
+	if t.wildcard {
+		return nil, PublishToWildcard
+	}
+
+	wildcards := t.lockPublish()
+	defer t.unlockPublish(wildcards)
+
+	if t.wouldRejectWithWildcards([]*Message{message}, wildcards) {
+		return nil, ChannelFull
+	}
+	return t.publish(message, wildcards)
+}
+
+// Publishes the message as Publish does without waiting for space. If a channel which waits
+// while full, including those of the wildcard topics, does not have space nothing is pushed
+// and WouldBlock is returned, or PublishTimeout once the channel's timeout has passed since
+// the publish began waiting at since
+func (t *Topic) TryPublish(message *Message, since time.Time) (*Message, error) {
+
+	if t.wildcard {
+		return nil, PublishToWildcard
+	}
+
+	wildcards := t.lockPublish()
+	defer t.unlockPublish(wildcards)
+
+	if err := t.mustWait([]*Message{message}, wildcards, since); err != nil {
+		return nil, err
+	}
+	return t.publish(message, wildcards)
+}
+
+// Publishes the messages in order as PublishBatch does without waiting for space, as TryPublish.
+// Every channel which waits while full must have space for all the messages it would receive
+func (t *Topic) TryPublishBatch(messages []*Message, since time.Time) ([]*Message, []error, error) {
+
+	if t.wildcard {
+		return nil, nil, PublishToWildcard
+	}
+
+	wildcards := t.lockPublish()
+	defer t.unlockPublish(wildcards)
+
+	if err := t.mustWait(messages, wildcards, since); err != nil {
+		return nil, nil, err
+	}
+
+	published := make([]*Message, len(messages))
+	errs := make([]error, len(messages))
+
+	for index, message := range messages {
+		published[index], errs[index] = t.publish(message, wildcards)
+	}
+	return published, errs, nil
+}
+
+// ChannelFull if a channel of the topic or the wildcard topics would reject the messages.
+// Otherwise if one would wait for space, WouldBlock or PublishTimeout once its timeout has
+// passed since since. The caller holds the locks taken by lockPublish
+func (t *Topic) mustWait(messages []*Message, wildcards []*Topic, since time.Time) error {
+
+	if t.wouldRejectWithWildcards(messages, wildcards) {
+		return ChannelFull
+	}
+
+	timeout, blocks := t.wouldBlock(messages)
+
+	for _, wildcard := range wildcards {
+
+		wildcardTimeout, wildcardBlocks := wildcard.wouldBlock(messages)
+
+		if wildcardBlocks {
+			blocks = true
+
+			if wildcardTimeout > timeout {
+				timeout = wildcardTimeout
+			}
+		}
+	}
+
+	if !blocks {
+		return nil
+	}
+
+	if time.Since(since) >= timeout {
+		return PublishTimeout
+	}
+	return WouldBlock
+}
+
+// Publishes the messages in order as Publish does, with no other message published in between.
+// If any channel would reject one of them nothing is pushed and ChannelFull is returned,
+// otherwise the messages as published are returned with the error, if any, of each
+func (t *Topic) PublishBatch(messages []*Message) ([]*Message, []error, error) {
+
+	if t.wildcard {
+		return nil, nil, PublishToWildcard
+	}
+
+	wildcards := t.lockPublish()
+	defer t.unlockPublish(wildcards)
+
+	if t.wouldRejectWithWildcards(messages, wildcards) {
+		return nil, nil, ChannelFull
+	}
+
+	published := make([]*Message, len(messages))
+	errs := make([]error, len(messages))
+
+	for index, message := range messages {
+		published[index], errs[index] = t.publish(message, wildcards)
+	}
+	return published, errs, nil
+}
+
+// stamps the message and pushes it to the channels and wildcard topics, returning the first
+// error. The caller holds the locks taken by lockPublish
+func (t *Topic) publish(message *Message, wildcards []*Topic) (*Message, error) {
+
+	t.sequence++
+	message = message.published(t.name, t.sequence, time.Now(), t.options.DefaultTTL)
+	atomic.AddUint64(&t.published, 1)
+
+	firstErr := t.append(message)
+
+	for _, wildcard := range wildcards {
+		if err := wildcard.append(message); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return message, firstErr
+}
+
+// read locks the topic and takes its publish lock, then does the same for the wildcard
+// topics matching it in name order, as a transaction does, so they can be checked for space
+// and pushed to without another publish in between. Returns the wildcard topics
+func (t *Topic) lockPublish() []*Topic {
+
+	t.RLock()
+	t.publishLock.Lock()
+
+	if t.wildcards == nil {
+		return nil
+	}
+
+	wildcards := t.wildcards.match(t.name)
+	sort.Slice(wildcards, func(i, j int) bool { return wildcards[i].name < wildcards[j].name })
+
+	for _, wildcard := range wildcards {
+		wildcard.RLock()
+		wildcard.publishLock.Lock()
+	}
+	return wildcards
+}
+
+func (t *Topic) unlockPublish(wildcards []*Topic) {
+
+	for _, wildcard := range wildcards {
+		wildcard.publishLock.Unlock()
+		wildcard.RUnlock()
+	}
+
+	t.publishLock.Unlock()
+	t.RUnlock()
+}
+
+// whether the topic or one of the wildcard topics would reject the messages.
+// The caller holds the locks taken by lockPublish
+func (t *Topic) wouldRejectWithWildcards(messages []*Message, wildcards []*Topic) bool {
+
+	if t.wouldReject(messages) {
+		return true
+	}
+
+	for _, wildcard := range wildcards {
+		if wildcard.wouldReject(messages) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether a channel the messages would be pushed to, including the group members they would
+// be shared between, does not have space for those it matches and rejects publishes.
+// The caller holds the topic read lock and the publish lock
+func (t *Topic) wouldReject(messages []*Message) bool {
+
+	return t.anyBounded(messages, func(bounded BoundedChannel, count int) bool {
+		return bounded.WouldRejectBatch(count)
+	})
+}
+
+// whether a channel the messages would be pushed to does not have space for those it matches
+// and waits for space, with the longest such a channel waits.
+// The caller holds the topic read lock and the publish lock
+func (t *Topic) wouldBlock(messages []*Message) (time.Duration, bool) {
+
+	var longest time.Duration
+	blocks := false
+
+	t.anyBounded(messages, func(bounded BoundedChannel, count int) bool {
+
+		if timeout, full := bounded.WouldBlockBatch(count); full {
+
+			blocks = true
+
+			if timeout > longest {
+				longest = timeout
+			}
+		}
+		return false
+	})
+	return longest, blocks
+}
+
+// calls check with each bounded channel the messages would be pushed to and how many of them
+// it would receive, until check returns true. Each group is sent every message, shared between
+// the members choose would pick. The caller holds the topic read lock and the publish lock
+func (t *Topic) anyBounded(messages []*Message, check func(BoundedChannel, int) bool) bool {
+
+	if t.log != nil {
+		return false
+	}
+
+	for channelName, channel := range t.channels {
+
+		bounded, ok := channel.(BoundedChannel)
+
+		if _, member := t.groupOf[channelName]; member || !ok {
+			continue
+		}
+
+		matched := 0
+
+		for _, message := range messages {
+			if t.filters[channelName].Match(message) {
+				matched++
+			}
+		}
+
+		if matched > 0 && check(bounded, matched) {
+			return true
+		}
+	}
+
+	for _, group := range t.groups {
+		for channelName, assigned := range group.assign(t, len(messages)) {
+			if bounded, ok := t.channels[channelName].(BoundedChannel); ok && assigned > 0 && check(bounded, assigned) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pushes a published message to the channels of the topic, returning the first error.
+// The caller holds the topic read lock and the publish lock
+func (t *Topic) append(message *Message) error {
+
+	defer t.notify()
+
+	if t.log != nil {
+		t.log.Append(message)
+		return t.pushToGroups(message)
+	}
+
+	firstErr := t.pushToGroups(message)
+
+	if t.retained != nil {
+		t.retained.Append(message)
+	}
+
+	for channelName, channel := range t.channels {
+
+		if _, member := t.groupOf[channelName]; member || !t.filters[channelName].Match(message) {
+			continue
+		}
+
+		if err := t.push(channel, message); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// pushes the message to the channel, counting what its overflow policy discarded.
+// The caller holds the topic lock, or the read lock and the publish lock
+func (t *Topic) push(channel Channel, message *Message) error {
+
+	dropping, ok := channel.(DroppingChannel)
+
+	if !ok {
+		return channel.Push(message)
+	}
+
+	before := dropping.Dropped()
+	err := channel.Push(message)
+
+	if dropped := dropping.Dropped() - before; dropped > 0 {
+		atomic.AddUint64(&t.dropped, uint64(dropped))
+	}
+	return err
+}
+
+// Returns the next message for the channel. If the channel does not exist returns a ChannelNotFoundError.
+// Messages waiting to be redelivered after a lease expired are returned first
+func (t *Topic) GetNextMessage(channelName string) (*Message, error) {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	channel, exists := t.channels[channelName]
+
+	if !exists {
+		return nil, ChannelNotFoundError
+	}
+
+	pending := t.inflight[channelName]
+	pending.Lock()
+	defer pending.Unlock()
+
+	now := time.Now()
+	pending.expire(now, t.options.MaxDeliveries)
+
+	lease, err := t.next(channel, pending, t.filters[channelName], now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddUint64(&t.delivered, 1)
+	return lease.Message, nil
+}
+
+// Leases the next message for the channel. Unless the lease is acknowledged with Ack
+// within visibility the message is delivered again. If the channel does not exist
+// returns a ChannelNotFoundError
+func (t *Topic) LeaseNextMessage(channelName string, visibility time.Duration) (*Lease, error) {
+
+	t.RLock()
+	defer t.RUnlock()
 
 	channel, exists := t.channels[channelName]
 
@@ -86,5 +625,495 @@ func (t *Topic) GetNextMessage(channelName string) (*Message, error) {
 		return nil, ChannelNotFoundError
 	}
 
-	return channel.Pop()
+	pending := t.inflight[channelName]
+	pending.Lock()
+	defer pending.Unlock()
+
+	now := time.Now()
+	pending.expire(now, t.options.MaxDeliveries)
+
+	lease, err := t.next(channel, pending, t.filters[channelName], now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lease.Receipt = newId()
+	lease.Deliveries++
+	lease.Expires = now.Add(visibility)
+	pending.leases = append(pending.leases, lease)
+	atomic.AddUint64(&t.delivered, 1)
+
+	delivered := *lease
+	return &delivered, nil
+}
+
+// Acknowledges a leased message so it is not delivered again.
+// Returns UnknownReceipt if the lease does not exist or has expired
+func (t *Topic) Ack(channelName string, receipt string) error {
+
+	pending, err := t.lockInflight(channelName)
+
+	if err != nil {
+		return err
+	}
+
+	defer t.RUnlock()
+	defer pending.Unlock()
+
+	if _, exists := pending.remove(receipt); !exists {
+		return UnknownReceipt
+	}
+	return nil
+}
+
+// Gives up a leased message so it is delivered again straight away.
+// Returns UnknownReceipt if the lease does not exist or has expired
+func (t *Topic) Nack(channelName string, receipt string) error {
+
+	pending, err := t.lockInflight(channelName)
+
+	if err != nil {
+		return err
+	}
+
+	defer t.RUnlock()
+	defer pending.Unlock()
+
+	lease, exists := pending.remove(receipt)
+
+	if !exists {
+		return UnknownReceipt
+	}
+
+	pending.release(lease, t.options.MaxDeliveries)
+	t.notify()
+	return nil
+}
+
+// Gives back a leased message which never reached the subscriber so it is delivered again
+// straight away, without counting the delivery towards its redeliveries.
+// Returns UnknownReceipt if the lease does not exist or has expired
+func (t *Topic) Requeue(channelName string, receipt string) error {
+
+	pending, err := t.lockInflight(channelName)
+
+	if err != nil {
+		return err
+	}
+
+	defer t.RUnlock()
+	defer pending.Unlock()
+
+	lease, exists := pending.remove(receipt)
+
+	if !exists {
+		return UnknownReceipt
+	}
+
+	lease.Deliveries--
+	pending.redeliver = append(pending.redeliver, lease)
+	atomic.AddUint64(&t.delivered, ^uint64(0))
+	t.notify()
+	return nil
+}
+
+// Queues a message for a single channel, ahead of anything published to the topic.
+// If the channel does not exist returns a ChannelNotFoundError
+func (t *Topic) Deliver(channelName string, message *Message) error {
+
+	pending, err := t.lockInflight(channelName)
+
+	if err != nil {
+		return err
+	}
+
+	defer t.RUnlock()
+	defer pending.Unlock()
+
+	pending.redeliver = append(pending.redeliver, &Lease{Message: message})
+	t.notify()
+	return nil
+}
+
+// Returns a channel which is closed the next time a message is published to the topic
+// or delivered to one of its channels. Take the channel before checking for messages so
+// one arriving in between is not missed
+func (t *Topic) Available() <-chan struct{} {
+
+	t.notifyLock.Lock()
+	defer t.notifyLock.Unlock()
+
+	return t.available
+}
+
+// wakes everything waiting on Available
+func (t *Topic) notify() {
+
+	t.notifyLock.Lock()
+	defer t.notifyLock.Unlock()
+
+	close(t.available)
+	t.available = make(chan struct{})
+}
+
+// Returns the messages waiting for a channel without removing them.
+// If the channel does not exist returns a ChannelNotFoundError
+func (t *Topic) Pending(channelName string) ([]*Message, error) {
+
+	pending, err := t.lockInflight(channelName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer t.RUnlock()
+	defer pending.Unlock()
+
+	return append(pending.messages(), t.matching(channelName, t.channels[channelName].Messages())...), nil
+}
+
+// Returns at most limit of the messages waiting for a channel, starting offset messages from the
+// next one it would receive, without removing them. Leased messages are not included while
+// their lease lasts, messages which expired but have not been swept yet are.
+// If the channel does not exist returns a ChannelNotFoundError
+func (t *Topic) Browse(channelName string, offset int, limit int) ([]*Message, error) {
+
+	pending, err := t.lockInflight(channelName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer t.RUnlock()
+	defer pending.Unlock()
+
+	messages := make([]*Message, 0, len(pending.redeliver))
+
+	for _, lease := range pending.redeliver {
+		messages = append(messages, lease.Message)
+	}
+
+	channel := t.channels[channelName]
+
+	// a filter has to see every message to know which are in the window
+	if _, filtered := t.filters[channelName]; filtered {
+		messages = append(messages, t.matching(channelName, channel.Messages())...)
+		start, end := window(len(messages), offset, limit)
+		return messages[start:end], nil
+	}
+
+	start, end := window(len(messages), offset, limit)
+	browsed := messages[start:end]
+
+	if limit >= 0 && len(browsed) == limit {
+		return browsed, nil
+	}
+
+	remaining := -1
+
+	if limit >= 0 {
+		remaining = limit - len(browsed)
+	}
+	return append(browsed, channel.Browse(offset-start, remaining)...), nil
+}
+
+// Expires the leases of every channel, removes messages which have expired while
+// waiting and releases retained messages older than the retention period. Expired
+// messages behind one which has not are left until they reach the front of their channel
+func (t *Topic) Sweep() {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	now := time.Now()
+
+	for channelName, pending := range t.inflight {
+
+		pending.Lock()
+		pending.expire(now, t.options.MaxDeliveries)
+		t.removeExpired(t.channels[channelName], pending, now)
+		pending.Unlock()
+	}
+
+	if t.log != nil {
+		t.log.Trim()
+	}
+
+	if t.retained != nil {
+		t.retained.Trim()
+	}
+}
+
+// Messages which expired before being read, counted once for every channel which missed them
+// including those since removed
+func (t *Topic) Expired() uint64 {
+	return atomic.LoadUint64(&t.expired)
+}
+
+// Messages which expired before the channel read them.
+// If the channel does not exist returns a ChannelNotFoundError
+func (t *Topic) ExpiredFor(channelName string) (uint64, error) {
+
+	pending, err := t.lockInflight(channelName)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer t.RUnlock()
+	defer pending.Unlock()
+
+	return pending.expired, nil
+}
+
+// Removes and returns the messages which have been delivered MaxDeliveries times without
+// being acknowledged, ready to be moved to the dead letter topic
+func (t *Topic) TakeDeadLetters() []*DeadLetter {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	deadLetters := make([]*DeadLetter, 0)
+
+	for channelName, pending := range t.inflight {
+
+		pending.Lock()
+
+		for _, lease := range pending.dead {
+			deadLetters = append(deadLetters, &DeadLetter{
+				Topic:      t.name,
+				Subscriber: channelName,
+				Message:    lease.Message,
+				Deliveries: lease.Deliveries,
+			})
+		}
+		pending.dead = pending.dead[:0]
+
+		pending.Unlock()
+	}
+	return deadLetters
+}
+
+// removes the next message for a channel which has not expired, messages waiting to be
+// redelivered first. Expired messages passed over are counted. Messages the filter does not
+// match are passed over too, as channels reading a shared Log are given every message.
+// The caller holds the inflight lock of the channel
+func (t *Topic) next(channel Channel, pending *inflight, filter *Filter, now time.Time) (*Lease, error) {
+
+	for len(pending.redeliver) > 0 {
+
+		lease := pending.redeliver[0]
+		pending.redeliver = pending.redeliver[1:]
+
+		if !lease.Message.Expired(now) {
+			return lease, nil
+		}
+		t.countExpired(pending)
+	}
+
+	for {
+		message, err := channel.Pop()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if message.Expired(now) {
+			t.countExpired(pending)
+		} else if filter.Match(message) {
+			return &Lease{Message: message}, nil
+		}
+	}
+}
+
+// removes the expired messages waiting to be redelivered and those at the front of the channel.
+// The caller holds the inflight lock of the channel
+func (t *Topic) removeExpired(channel Channel, pending *inflight, now time.Time) {
+
+	waiting := pending.redeliver[:0]
+
+	for _, lease := range pending.redeliver {
+		if lease.Message.Expired(now) {
+			t.countExpired(pending)
+		} else {
+			waiting = append(waiting, lease)
+		}
+	}
+
+	for j := len(waiting); j < len(pending.redeliver); j++ {
+		pending.redeliver[j] = nil
+	}
+	pending.redeliver = waiting
+
+	for {
+		message, err := channel.Peek()
+
+		if err != nil || !message.Expired(now) {
+			return
+		}
+
+		if _, err := channel.Pop(); err != nil {
+			return
+		}
+		t.countExpired(pending)
+	}
+}
+
+func (t *Topic) countExpired(pending *inflight) {
+	pending.expired++
+	atomic.AddUint64(&t.expired, 1)
+}
+
+// read locks the topic and locks the inflight messages of the channel with expired leases
+// moved to redelivery. Both locks are held on success
+func (t *Topic) lockInflight(channelName string) (*inflight, error) {
+
+	t.RLock()
+
+	pending, exists := t.inflight[channelName]
+
+	if !exists {
+		t.RUnlock()
+		return nil, ChannelNotFoundError
+	}
+
+	pending.Lock()
+	pending.expire(time.Now(), t.options.MaxDeliveries)
+	return pending, nil
+}
+
+// Returns the pending messages of every channel keyed by channel name
+func (t *Topic) pendingMessages() map[string][]*Message {
+
+	t.Lock()
+	defer t.Unlock()
+
+	pending := make(map[string][]*Message, len(t.channels))
+
+	for channelName, channel := range t.channels {
+
+		leased := t.inflight[channelName]
+		leased.Lock()
+		pending[channelName] = append(leased.messages(), t.matching(channelName, channel.Messages())...)
+		leased.Unlock()
+	}
+	return pending
+}
+
+// Sets when the topic was created to when a snapshot says it was, unless the snapshot
+// did not record it
+func (t *Topic) restoreCreated(created time.Time) {
+
+	t.Lock()
+	defer t.Unlock()
+
+	if !created.IsZero() {
+		t.created = created
+	}
+}
+
+// Returns when each channel was created keyed by channel name
+func (t *Topic) subscribedTimes() map[string]time.Time {
+
+	t.RLock()
+	defer t.RUnlock()
+
+	subscribed := make(map[string]time.Time, len(t.subscribed))
+
+	for channelName, created := range t.subscribed {
+		subscribed[channelName] = created
+	}
+	return subscribed
+}
+
+// Recreates channels with their filters and pending messages.
+// Channels reading from a shared Log have their messages queued just for them,
+// other channels have their messages pushed to them if they are empty
+func (t *Topic) restoreChannels(channels []ChannelSnapshot) error {
+
+	for _, channel := range channels {
+		if err := t.AddChannel(channel.Name); err != nil {
+			return err
+		}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	for _, channelSnapshot := range channels {
+
+		t.advanceSequence(channelSnapshot.Messages)
+
+		if !channelSnapshot.Subscribed.IsZero() {
+			t.subscribed[channelSnapshot.Name] = channelSnapshot.Subscribed
+		}
+
+		if channelSnapshot.Filter == "" {
+			continue
+		}
+
+		filter, err := ParseFilter(channelSnapshot.Filter)
+
+		if err != nil {
+			return err
+		}
+		t.filters[channelSnapshot.Name] = filter
+	}
+
+	for _, channelSnapshot := range channels {
+
+		if t.log != nil {
+
+			pending := t.inflight[channelSnapshot.Name]
+
+			for _, message := range channelSnapshot.Messages {
+				pending.redeliver = append(pending.redeliver, &Lease{Message: message})
+			}
+			continue
+		}
+
+		channel := t.channels[channelSnapshot.Name]
+
+		if channel.Count() > 0 {
+			continue
+		}
+
+		for _, message := range channelSnapshot.Messages {
+			if err := channel.Push(message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// the messages the filter of a channel matches. The caller holds the topic lock
+func (t *Topic) matching(channelName string, messages []*Message) []*Message {
+
+	filter, exists := t.filters[channelName]
+
+	if !exists {
+		return messages
+	}
+
+	matched := messages[:0]
+
+	for _, message := range messages {
+		if filter.Match(message) {
+			matched = append(matched, message)
+		}
+	}
+	return matched
+}
+
+// moves the sequence on past that of any of the messages so numbers are not reused
+// after a restart. The caller holds the write lock
+func (t *Topic) advanceSequence(messages []*Message) {
+
+	for _, message := range messages {
+		if message.sequence > t.sequence {
+			t.sequence = message.sequence
+		}
+	}
 }
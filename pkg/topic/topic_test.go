@@ -1,7 +1,9 @@
 package topic
 
 import (
+	"fmt"
 	"testing"
+	"time"
 )
 
 func TestUnkownChannelShouldErrorWhenRemoved(t *testing.T) {
@@ -86,3 +88,216 @@ func TestMessagesSentToTopicAreAddedToEachSubscribedChannel(t *testing.T) {
 		t.Error("Subscriber2 should have had an error as they are not subscribed.", m.String())
 	}
 }
+
+func TestPublishIsRejectedWhenAnyChannelIsFull(t *testing.T) {
+
+	topic := NewTopicWithChannelFactory("topic-1", RingBufferChannelFactory(RingBufferOptions{Capacity: 1, Overflow: RejectPublish}, nil))
+
+	topic.AddChannel("subscriber-1")
+	topic.AddChannel("subscriber-2")
+
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+	topic.GetNextMessage("subscriber-2")
+
+	if err := topic.PublishMessage(NewMessage([]byte("message-2"))); err != ChannelFull {
+		t.Error("A ChannelFull error should have been returned.")
+	}
+
+	if _, err := topic.GetNextMessage("subscriber-2"); err != NoMessagesAvailable {
+		t.Error("A rejected message should not be delivered to any subscriber.")
+	}
+}
+
+func TestBatchIsRejectedWhenAChannelHasNoSpaceForIt(t *testing.T) {
+
+	topic := NewTopicWithChannelFactory("topic-1", RingBufferChannelFactory(RingBufferOptions{Capacity: 3, Overflow: RejectPublish}, nil))
+	topic.AddChannel("subscriber-1")
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+
+	batch := func(bodies ...string) []*Message {
+		messages := []*Message{}
+		for _, body := range bodies {
+			messages = append(messages, NewMessage([]byte(body)))
+		}
+		return messages
+	}
+
+	if _, _, err := topic.PublishBatch(batch("message-2", "message-3", "message-4")); err != ChannelFull {
+		t.Error("A batch which does not fit should return ChannelFull but returned ", err)
+	}
+
+	if count, _ := topic.Pending("subscriber-1"); len(count) != 1 {
+		t.Error("No message of a rejected batch should be pushed : ", len(count))
+	}
+
+	published, errs, err := topic.PublishBatch(batch("message-2", "message-3"))
+
+	if err != nil || len(published) != 2 || errs[0] != nil || errs[1] != nil {
+		t.Fatal("A batch which fits should be published : ", err, errs)
+	}
+
+	if published[0].Sequence() != 2 || published[1].Sequence() != 3 || published[1].String() != "message-3" {
+		t.Error("A batch should be published in order : ", published[0].Sequence(), published[1].Sequence())
+	}
+}
+
+func TestPublishingAppendsOnceToTheSharedLog(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+
+	topic.AddChannel("subscriber-1")
+	topic.AddChannel("subscriber-2")
+
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+
+	if topic.log.End() != 1 {
+		t.Error("A published message should be appended to the log once.")
+	}
+}
+
+func TestPublishedMessagesAreNumberedInOrder(t *testing.T) {
+
+	topic := NewTopicWithChannelFactory("topic-1", InMemoryChannelFactory)
+	topic.AddChannel("subscriber-1")
+
+	first, _ := topic.Publish(NewMessage([]byte("message-1")))
+	second, _ := topic.Publish(NewMessage([]byte("message-2")))
+
+	if first.Sequence() != 1 || second.Sequence() != 2 {
+		t.Error("Messages should be numbered in the order they are published : ", first.Sequence(), second.Sequence())
+	}
+
+	if first.Id() == "" || first.Id() == second.Id() || first.Timestamp().IsZero() {
+		t.Error("Published messages should be given a unique id and a timestamp.")
+	}
+
+	received, _ := topic.GetNextMessage("subscriber-1")
+
+	if received.Id() != first.Id() {
+		t.Error("Subscribers should receive the message as published.")
+	}
+
+	restored := NewTopic("topic-1")
+	restored.restoreChannels([]ChannelSnapshot{{Name: "subscriber-1", Messages: []*Message{second}}})
+
+	if next, _ := restored.Publish(NewMessage([]byte("message-3"))); next.Sequence() != 3 {
+		t.Error("Sequence numbers should carry on from restored messages : ", next.Sequence())
+	}
+}
+
+func TestExpiredMessagesAreSkippedAndCounted(t *testing.T) {
+
+	for _, topic := range []*Topic{NewTopic("topic-1"), NewTopicWithChannelFactory("topic-1", InMemoryChannelFactory)} {
+
+		topic.SetOptions(TopicOptions{DefaultTTL: time.Millisecond})
+		topic.AddChannel("subscriber-1")
+		topic.AddChannel("subscriber-2")
+
+		topic.PublishMessage(NewMessage([]byte("message-1")))
+		topic.PublishMessage(NewMessage([]byte("message-2")).WithTTL(time.Hour))
+		time.Sleep(2 * time.Millisecond)
+
+		message, err := topic.GetNextMessage("subscriber-1")
+
+		if err != nil || message.String() != "message-2" {
+			t.Fatal("An expired message should be skipped.")
+		}
+
+		if expired, _ := topic.ExpiredFor("subscriber-1"); expired != 1 {
+			t.Error("Skipped messages should be counted against the subscriber : ", expired)
+		}
+
+		topic.Sweep()
+
+		if count, _ := topic.Pending("subscriber-2"); len(count) != 1 {
+			t.Error("The sweeper should remove expired messages : ", len(count))
+		}
+
+		if topic.Expired() != 2 {
+			t.Error("Expired messages should be counted for the topic : ", topic.Expired())
+		}
+	}
+}
+
+func BenchmarkPublishToSharedLog(b *testing.B) {
+	benchmarkPublish(b, NewTopic("topic-1"))
+}
+
+func BenchmarkPublishToInMemoryChannels(b *testing.B) {
+	benchmarkPublish(b, NewTopicWithChannelFactory("topic-1", InMemoryChannelFactory))
+}
+
+func benchmarkPublish(b *testing.B, topic *Topic) {
+
+	for i := 0; i < 1000; i++ {
+		topic.AddChannel(fmt.Sprintf("subscriber-%d", i))
+	}
+
+	message := NewMessage([]byte("message"))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		topic.PublishMessage(message)
+	}
+}
+
+func TestAvailableIsClosedWhenAMessageIsPublished(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+	topic.AddChannel("subscriber-1")
+
+	available := topic.Available()
+
+	select {
+	case <-available:
+		t.Fatal("Nothing has been published yet.")
+	default:
+	}
+
+	topic.PublishMessage(NewMessage([]byte("message-1")))
+
+	select {
+	case <-available:
+	default:
+		t.Error("Publishing should close the available channel.")
+	}
+}
+
+func TestBrowseShowsMessagesInTheOrderTheyWillBeDelivered(t *testing.T) {
+
+	topic := NewTopic("topic-1")
+	topic.AddChannel("subscriber-1")
+	topic.AddChannel("subscriber-2")
+
+	filter, _ := ParseFilter("header.kind == 'b'")
+	topic.SetFilter("subscriber-2", filter)
+
+	for index, kind := range []string{"a", "b", "a", "b"} {
+		topic.PublishMessage(NewMessage([]byte(fmt.Sprintf("message-%d", index+1))).WithHeaders(map[string]string{"kind": kind}))
+	}
+
+	lease, _ := topic.LeaseNextMessage("subscriber-1", time.Minute)
+	topic.LeaseNextMessage("subscriber-1", time.Minute)
+	topic.Nack("subscriber-1", lease.Receipt)
+
+	// message-2 is leased and message-1 is waiting to be redelivered
+	if browsed, _ := topic.Browse("subscriber-1", 0, 2); len(browsed) != 2 || browsed[0].String() != "message-1" || browsed[1].String() != "message-3" {
+		t.Error("Redelivered messages should be browsed first : ", browsed)
+	}
+
+	if browsed, _ := topic.Browse("subscriber-1", 1, 5); len(browsed) != 2 || browsed[0].String() != "message-3" || browsed[1].String() != "message-4" {
+		t.Error("Browsing from an offset should skip that many messages : ", browsed)
+	}
+
+	if browsed, _ := topic.Browse("subscriber-2", 1, 5); len(browsed) != 1 || browsed[0].String() != "message-4" {
+		t.Error("Only the messages matching a filter should be browsed : ", browsed)
+	}
+
+	if _, err := topic.Browse("subscriber-3", 0, 1); err != ChannelNotFoundError {
+		t.Error("Browsing an unknown channel should return ChannelNotFoundError but returned ", err)
+	}
+
+	if message, _ := topic.GetNextMessage("subscriber-1"); message.String() != "message-1" {
+		t.Error("Browsing should not remove messages.")
+	}
+}
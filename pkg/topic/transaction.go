@@ -0,0 +1,304 @@
+package topic
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ChannelNotRetractable = errors.New("Channel can not retract messages")
+)
+
+// A message to publish to a topic of a Registry as part of a transaction
+type TransactionMessage struct {
+	Topic   string
+	Message *Message
+}
+
+// A topic locked by a transaction with what it held beforehand, so it can be rolled back
+type transactionTopic struct {
+	topic *Topic
+	// messages of the transaction the topic receives, including those forwarded to a wildcard topic
+	messages []*Message
+	sequence uint64
+	logEnd   uint64
+	retained uint64
+	counts   map[string]int
+	dropped  map[string]int
+	// round robin position of each consumer group
+	next map[string]int
+	// the topic's published and dropped counters
+	published    uint64
+	totalDropped uint64
+}
+
+// Publishes messages to topics of the registry so that every subscriber receives all of
+// those meant for it or none of them. Every topic must already exist, otherwise UnknownTopic is
+// returned, and a wildcard topic returns PublishToWildcard.
+// The topics and the wildcard topics matching them are locked while the messages are pushed,
+// so nothing can be read from them between the first push and the last. If a channel which
+// rejects or waits when full does not have space for the messages it would receive, nothing is
+// pushed and ChannelFull is returned. A member of a consumer group must have space for all those
+// its group would receive. A channel which drops messages when full takes them as a publish
+// would. If a push fails the messages already pushed are retracted, though not those dropped to
+// make space for them, the topics' published and dropped counts are restored and the error is
+// returned. Otherwise the messages as published are
+// returned in order
+func PublishTransaction(registry Registry, messages []*TransactionMessage) ([]*Message, error) {
+
+	targets := make(map[string]*transactionTopic)
+
+	for _, message := range messages {
+
+		if IsWildcard(message.Topic) {
+			return nil, PublishToWildcard
+		}
+
+		if _, found := targets[message.Topic]; !found {
+
+			if !registry.Contains(message.Topic) {
+				return nil, UnknownTopic
+			}
+			targets[message.Topic] = &transactionTopic{topic: registry.Get(message.Topic)}
+		}
+		targets[message.Topic].messages = append(targets[message.Topic].messages, message.Message)
+	}
+
+	locked := lockTransaction(targets)
+	defer unlockTransaction(locked)
+
+	for _, target := range locked {
+		if target.topic.wouldOverflow(target.messages) {
+			return nil, ChannelFull
+		}
+	}
+
+	for _, target := range locked {
+		target.mark()
+	}
+
+	published := make([]*Message, 0, len(messages))
+
+	for _, message := range messages {
+
+		target := targets[message.Topic]
+		stamped, err := target.topic.commit(message.Message, locked)
+
+		if err != nil {
+			rollbackTransaction(locked)
+			return nil, err
+		}
+		published = append(published, stamped)
+	}
+	return published, nil
+}
+
+// locks the targets for writing ordered by name, then the wildcard topics matching them, in
+// the order a publish takes them, so transactions and publishes sharing topics can not deadlock.
+// A publish to one of the topics is wholly before or after the transaction.
+// Returns the locked topics by name with the messages forwarded to each wildcard topic
+func lockTransaction(targets map[string]*transactionTopic) map[string]*transactionTopic {
+
+	locked := make(map[string]*transactionTopic)
+	wildcards := make(map[string]*transactionTopic)
+	names := make([]string, 0, len(targets))
+
+	for name, target := range targets {
+
+		names = append(names, name)
+		locked[name] = target
+
+		if target.topic.wildcards == nil {
+			continue
+		}
+
+		for _, wildcard := range target.topic.wildcards.match(name) {
+
+			if _, found := wildcards[wildcard.name]; !found {
+				wildcards[wildcard.name] = &transactionTopic{topic: wildcard}
+			}
+			wildcards[wildcard.name].messages = append(wildcards[wildcard.name].messages, target.messages...)
+		}
+	}
+
+	wildcardNames := make([]string, 0, len(wildcards))
+
+	for name, wildcard := range wildcards {
+		wildcardNames = append(wildcardNames, name)
+		locked[name] = wildcard
+	}
+
+	sort.Strings(names)
+	sort.Strings(wildcardNames)
+
+	for _, name := range append(names, wildcardNames...) {
+		locked[name].topic.Lock()
+	}
+	return locked
+}
+
+func unlockTransaction(locked map[string]*transactionTopic) {
+
+	for _, target := range locked {
+		target.topic.Unlock()
+	}
+}
+
+// takes back the messages pushed to every locked topic, logging those which can not be
+func rollbackTransaction(locked map[string]*transactionTopic) {
+
+	for _, target := range locked {
+		if err := target.rollback(); err != nil {
+			log.Print("PublishTransaction : rolling back ", target.topic.name, " failed : ", err.Error())
+		}
+	}
+}
+
+// records what the topic holds before any message is pushed. The caller holds the topic lock
+func (target *transactionTopic) mark() {
+
+	t := target.topic
+	target.sequence = t.sequence
+	target.published = atomic.LoadUint64(&t.published)
+	target.totalDropped = atomic.LoadUint64(&t.dropped)
+	target.counts = make(map[string]int)
+	target.dropped = make(map[string]int)
+	target.next = make(map[string]int)
+
+	if t.log != nil {
+		target.logEnd = t.log.End()
+	}
+
+	if t.retained != nil {
+		target.retained = t.retained.End()
+	}
+
+	for channelName, channel := range t.channels {
+
+		if _, shared := channel.(*LogChannel); shared {
+			continue
+		}
+		target.counts[channelName] = channel.Count()
+
+		if dropping, ok := channel.(DroppingChannel); ok {
+			target.dropped[channelName] = dropping.Dropped()
+		}
+	}
+
+	for name, group := range t.groups {
+		target.next[name] = group.next
+	}
+}
+
+// returns the topic to what it held when marked, returning the first error.
+// The caller holds the topic lock
+func (target *transactionTopic) rollback() error {
+
+	t := target.topic
+	var first error
+
+	t.sequence = target.sequence
+	atomic.StoreUint64(&t.published, target.published)
+	atomic.StoreUint64(&t.dropped, target.totalDropped)
+
+	if t.log != nil {
+		t.log.truncate(target.logEnd)
+	}
+
+	if t.retained != nil {
+		t.retained.truncate(target.retained)
+	}
+
+	for name, next := range target.next {
+		t.groups[name].next = next
+	}
+
+	for channelName, count := range target.counts {
+
+		channel := t.channels[channelName]
+		pushed := channel.Count() - count
+
+		// each message dropped to make space for one of the transaction left the count as it was
+		if ring, ok := channel.(*RingBufferChannel); ok && ring.options.Overflow == DropOldest {
+			pushed += ring.Dropped() - target.dropped[channelName]
+		}
+
+		if pushed <= 0 {
+			continue
+		}
+
+		retractable, ok := channel.(RetractableChannel)
+
+		if !ok {
+			if first == nil {
+				first = ChannelNotRetractable
+			}
+			continue
+		}
+
+		if err := retractable.Retract(pushed); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// whether a channel the messages would be pushed to does not have space for those it
+// matches and would reject them or wait. The caller holds the topic lock
+func (t *Topic) wouldOverflow(messages []*Message) bool {
+
+	for channelName, channel := range t.channels {
+
+		bounded, ok := channel.(BoundedChannel)
+
+		if !ok {
+			continue
+		}
+
+		matched := 0
+
+		for _, message := range messages {
+			if t.filters[channelName].Match(message) {
+				matched++
+			}
+		}
+
+		if matched > 0 && bounded.WouldOverflow(matched) {
+			return true
+		}
+	}
+	return false
+}
+
+// stamps the message and pushes it to the channels of the topic and the wildcard topics
+// matching it, stopping at the first error. The caller holds the lock of the topic and of
+// the wildcard topics, which are among those locked
+func (t *Topic) commit(message *Message, locked map[string]*transactionTopic) (*Message, error) {
+
+	t.sequence++
+	message = message.published(t.name, t.sequence, time.Now(), t.options.DefaultTTL)
+	atomic.AddUint64(&t.published, 1)
+
+	if err := t.append(message); err != nil {
+		return nil, err
+	}
+
+	if t.wildcards == nil {
+		return message, nil
+	}
+
+	for _, wildcard := range t.wildcards.match(t.name) {
+
+		if _, held := locked[wildcard.name]; !held {
+			continue
+		}
+
+		if err := wildcard.append(message); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
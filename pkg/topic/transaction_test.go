@@ -0,0 +1,180 @@
+package topic
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTransactionsPublishToEveryTopic(t *testing.T) {
+
+	registry := NewTopicRegistry()
+	registry.Get("orders.#").AddChannel("subscriber-1")
+	registry.Get("orders.created").AddChannel("subscriber-1")
+	registry.Get("payments.taken").AddChannel("subscriber-1")
+
+	published, err := PublishTransaction(registry, []*TransactionMessage{
+		{Topic: "orders.created", Message: NewMessage([]byte("orders.created"))},
+		{Topic: "payments.taken", Message: NewMessage([]byte("payments.taken"))},
+		{Topic: "orders.created", Message: NewMessage([]byte("orders.created"))},
+	})
+
+	if err != nil || len(published) != 3 || published[2].Sequence() != 2 || published[1].Sequence() != 1 {
+		t.Fatal("Every message should be published in order : ", err, published)
+	}
+
+	assertWildcardMessages(t, registry.Get("orders.created"), "subscriber-1", "orders.created", "orders.created")
+	assertWildcardMessages(t, registry.Get("payments.taken"), "subscriber-1", "payments.taken")
+	assertWildcardMessages(t, registry.Get("orders.#"), "subscriber-1", "orders.created", "orders.created")
+}
+
+func TestTransactionsWhichCanNotBeDeliveredPublishNothing(t *testing.T) {
+
+	registry := NewTopicRegistryWithChannelFactory(RingBufferChannelFactory(RingBufferOptions{Capacity: 1, Overflow: RejectPublish}, nil))
+	registry.Get("orders").AddChannel("subscriber-1")
+	registry.Get("payments").AddChannel("subscriber-1")
+
+	_, err := PublishTransaction(registry, []*TransactionMessage{
+		{Topic: "orders", Message: NewMessage([]byte("orders"))},
+		{Topic: "refunds", Message: NewMessage([]byte("refunds"))},
+	})
+
+	if err != UnknownTopic || registry.Contains("refunds") {
+		t.Error("A transaction to a topic which does not exist should return UnknownTopic : ", err)
+	}
+
+	_, err = PublishTransaction(registry, []*TransactionMessage{
+		{Topic: "orders", Message: NewMessage([]byte("orders"))},
+		{Topic: "payments", Message: NewMessage([]byte("payments"))},
+		{Topic: "payments", Message: NewMessage([]byte("payments"))},
+	})
+
+	if err != ChannelFull {
+		t.Error("A transaction a channel does not have space for should return ChannelFull : ", err)
+	}
+
+	assertWildcardMessages(t, registry.Get("orders"), "subscriber-1")
+	assertWildcardMessages(t, registry.Get("payments"), "subscriber-1")
+
+	if _, err := PublishTransaction(registry, []*TransactionMessage{{Topic: "orders.#", Message: NewMessage([]byte("orders"))}}); err != PublishToWildcard {
+		t.Error("A transaction to a wildcard topic should return PublishToWildcard : ", err)
+	}
+}
+
+func TestTransactionsDropMessagesAsPublishesDo(t *testing.T) {
+
+	registry := NewTopicRegistryWithChannelFactory(RingBufferChannelFactory(RingBufferOptions{Capacity: 1, Overflow: DropOldest}, nil))
+	registry.Get("orders").AddChannel("subscriber-1")
+	registry.Get("payments").AddChannel("subscriber-1")
+
+	_, err := PublishTransaction(registry, []*TransactionMessage{
+		{Topic: "orders", Message: NewMessage([]byte("orders"))},
+		{Topic: "payments", Message: NewMessage([]byte("payments"))},
+		{Topic: "payments", Message: NewMessage([]byte("payments"))},
+	})
+
+	if err != nil {
+		t.Error("A channel which drops messages when full should not refuse a transaction : ", err)
+	}
+
+	assertWildcardMessages(t, registry.Get("orders"), "subscriber-1", "orders")
+	assertWildcardMessages(t, registry.Get("payments"), "subscriber-1", "payments")
+
+	if dropped := registry.Get("payments").Stats().Dropped; dropped != 1 {
+		t.Error("The message which did not fit should be dropped : ", dropped)
+	}
+}
+
+func TestFailedTransactionsRestoreTheCountersOfEveryTopic(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	wal := WALChannelFactory(directory, DefaultWALOptions)
+	registry := NewTopicRegistryWithChannelFactory(func(topicName string, channelName string) (Channel, error) {
+
+		if topicName == "payments" {
+			return wal(topicName, channelName)
+		}
+		return NewRingBufferChannel(RingBufferOptions{Capacity: 1, Overflow: DropOldest}), nil
+	})
+	defer registry.Close()
+
+	registry.Get("orders.#").AddChannel("subscriber-1")
+	registry.Get("orders.eu").AddChannel("subscriber-1")
+	registry.Get("orders.eu").Publish(NewMessage([]byte("orders.eu")))
+	registry.Get("payments").AddChannel("subscriber-1")
+
+	// pushing to a closed channel fails
+	registry.Get("payments").Close()
+
+	_, err := PublishTransaction(registry, []*TransactionMessage{
+		{Topic: "orders.eu", Message: NewMessage([]byte("orders.eu"))},
+		{Topic: "payments", Message: NewMessage([]byte("payments"))},
+	})
+
+	if err != ChannelClosed {
+		t.Fatal("A transaction which fails to push should return the error : ", err)
+	}
+
+	for _, topicName := range []string{"orders.eu", "orders.#", "payments"} {
+
+		stats := registry.Get(topicName).Stats()
+		expected := uint64(0)
+
+		if topicName == "orders.eu" {
+			expected = 1
+		}
+
+		if stats.Published != expected || stats.Dropped != 0 {
+			t.Error("A rolled back transaction should not be counted : ", topicName, stats.Published, stats.Dropped)
+		}
+	}
+}
+
+func TestFailedTransactionsAreRolledBack(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	registry := NewTopicRegistryWithChannelFactory(WALChannelFactory(directory, DefaultWALOptions))
+	defer registry.Close()
+
+	registry.Get("orders").AddChannel("subscriber-1")
+	registry.Get("orders").JoinGroup("workers", "worker-1", RoundRobin)
+	registry.Get("orders").JoinGroup("workers", "worker-2", RoundRobin)
+	registry.Get("payments").AddChannel("subscriber-1")
+
+	// pushing to a closed channel fails
+	registry.Get("payments").Close()
+
+	_, err := PublishTransaction(registry, []*TransactionMessage{
+		{Topic: "orders", Message: NewMessage([]byte("orders"))},
+		{Topic: "payments", Message: NewMessage([]byte("payments"))},
+	})
+
+	if err != ChannelClosed {
+		t.Error("A transaction which fails to push should return the error : ", err)
+	}
+
+	assertWildcardMessages(t, registry.Get("orders"), "subscriber-1")
+
+	published, _ := registry.Get("orders").Publish(NewMessage([]byte("orders")))
+
+	if published.Sequence() != 1 || registry.Get("orders").Stats().Published != 1 {
+		t.Error("The sequence number of a rolled back message should be reused : ", published.Sequence())
+	}
+
+	assertWildcardMessages(t, registry.Get("orders"), GroupChannelName("workers", "worker-1"), "orders")
+	assertWildcardMessages(t, registry.Get("orders"), GroupChannelName("workers", "worker-2"))
+
+	reopened, err := NewWALChannel(WALPath(directory, "orders", "subscriber-1"), DefaultWALOptions)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.(ClosableChannel).Close()
+
+	if messages := reopened.Messages(); len(messages) != 1 || messages[0].Sequence() != 1 {
+		t.Error("A rolled back message should not be replayed : ", messages)
+	}
+}
@@ -0,0 +1,540 @@
+package topic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ChannelClosed = errors.New("Channel has been closed")
+)
+
+// SyncPolicy controls how often a WALChannel flushes its log to stable storage
+type SyncPolicy int
+
+const (
+	// fsync after every write
+	SyncAlways SyncPolicy = iota
+	// fsync on a fixed interval if anything has been written
+	SyncInterval
+	// leave flushing to the operating system
+	SyncNever
+)
+
+// Parses "always", "interval" or "never" into a SyncPolicy
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch policy {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return SyncAlways, fmt.Errorf("Unknown sync policy : %s", policy)
+}
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	}
+	return "unknown"
+}
+
+// WALOptions configures a WALChannel
+type WALOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	// number of popped entries tolerated in the log before it is rewritten
+	CompactThreshold int
+}
+
+// DefaultWALOptions fsyncs every write and compacts after 1024 pops
+var DefaultWALOptions = WALOptions{
+	Sync:             SyncAlways,
+	SyncInterval:     time.Second,
+	CompactThreshold: 1024,
+}
+
+const (
+	recordPush    byte = 1
+	recordPop     byte = 2
+	recordRetract byte = 3
+
+	// length + checksum
+	recordHeaderSize = 8
+)
+
+// WALChannel is a Channel backed by an append only log on disk.
+// Every Push and Pop is recorded so the pending messages can be replayed
+// when the channel is reopened. Popped entries are removed from the log
+// once the channel is empty or CompactThreshold pops have accumulated.
+// Safe for use via goroutines
+type WALChannel struct {
+	sync.RWMutex
+	path         string
+	options      WALOptions
+	file         *os.File
+	messageStore []*Message
+	messageCount int
+	popped       int
+	dirty        bool
+	closed       bool
+	stop         chan struct{}
+}
+
+// Opens or creates a WALChannel at path, replaying any existing entries
+func NewWALChannel(path string, options WALOptions) (Channel, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &WALChannel{
+		path:         path,
+		options:      options,
+		file:         file,
+		messageStore: make([]*Message, 0),
+		stop:         make(chan struct{}),
+	}
+
+	if err := c.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if options.Sync == SyncInterval && options.SyncInterval > 0 {
+		go c.syncLoop()
+	}
+
+	return c, nil
+}
+
+// Returns a ChannelFactory creating a WALChannel per subscriber under directory
+func WALChannelFactory(directory string, options WALOptions) ChannelFactory {
+	return func(topicName string, channelName string) (Channel, error) {
+		return NewWALChannel(WALPath(directory, topicName, channelName), options)
+	}
+}
+
+// Location of the log for a subscriber. Names are escaped so they are always a single path element
+func WALPath(directory string, topicName string, channelName string) string {
+	return filepath.Join(directory, url.PathEscape(topicName)+".topic", url.PathEscape(channelName)+".wal")
+}
+
+// Reopens the logs found under directory, laid out as WALPath places them, adding each to its
+// topic in the registry so the messages pending when the server stopped are delivered. The
+// registry must create its channels with a WALChannelFactory for directory. A log belonging to a
+// consumer group member rejoins the group, with RoundRobin unless the group already exists.
+// Returns the number of logs reopened
+func RestoreWALChannels(registry Registry, directory string) (int, error) {
+
+	paths, err := filepath.Glob(filepath.Join(directory, "*.topic", "*.wal"))
+
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+
+	for _, path := range paths {
+
+		topicName, topicErr := url.PathUnescape(strings.TrimSuffix(filepath.Base(filepath.Dir(path)), ".topic"))
+		channelName, channelErr := url.PathUnescape(strings.TrimSuffix(filepath.Base(path), ".wal"))
+
+		if topicErr != nil || channelErr != nil {
+			log.Print("WALChannel : skipping log with an unexpected name : ", path)
+			continue
+		}
+
+		restoredTopic := registry.Get(topicName)
+
+		if separator := strings.Index(channelName, "/"); separator >= 0 {
+			err = restoredTopic.rejoinGroup(channelName[:separator], channelName[separator+1:])
+		} else {
+			err = restoredTopic.AddChannel(channelName)
+		}
+
+		if err != nil {
+			return restored, err
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// Appends a message to the log and the in memory store
+func (c *WALChannel) Push(message *Message) error {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return ChannelClosed
+	}
+
+	payload, err := message.MarshalBinary()
+
+	if err != nil {
+		return err
+	}
+
+	if err := c.write(recordPush, payload); err != nil {
+		return err
+	}
+
+	c.messageStore = append(c.messageStore, message)
+	c.messageCount++
+	return nil
+}
+
+// Pops a message from the store, recording the removal in the log
+func (c *WALChannel) Pop() (*Message, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return nil, ChannelClosed
+	}
+
+	if c.messageCount == 0 {
+		return nil, NoMessagesAvailable
+	}
+
+	if err := c.write(recordPop, nil); err != nil {
+		return nil, err
+	}
+
+	message := c.messageStore[0]
+	c.messageStore = c.messageStore[1:]
+	c.messageCount--
+	c.popped++
+
+	if err := c.compact(); err != nil {
+		log.Print("WALChannel : compaction failed : ", c.path, " : ", err.Error())
+	}
+
+	return message, nil
+}
+
+// Returns the next message without removing it
+func (c *WALChannel) Peek() (*Message, error) {
+
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.closed {
+		return nil, ChannelClosed
+	}
+
+	if c.messageCount == 0 {
+		return nil, NoMessagesAvailable
+	}
+	return c.messageStore[0], nil
+}
+
+// Current count of messages waiting to be delivered
+func (c *WALChannel) Count() int {
+
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.messageCount
+}
+
+// Returns a copy of the messages waiting to be delivered
+func (c *WALChannel) Messages() []*Message {
+
+	c.RLock()
+	defer c.RUnlock()
+
+	messages := make([]*Message, len(c.messageStore))
+	copy(messages, c.messageStore)
+	return messages
+}
+
+// Returns a copy of a window of the messages waiting to be delivered
+func (c *WALChannel) Browse(offset int, limit int) []*Message {
+
+	c.RLock()
+	defer c.RUnlock()
+
+	start, end := window(len(c.messageStore), offset, limit)
+	messages := make([]*Message, end-start)
+	copy(messages, c.messageStore[start:end])
+	return messages
+}
+
+// Removes the last count messages pushed, recording the removal in the log.
+// They are removed from the store even if the record can not be written, in which case
+// they are replayed when the channel is reopened
+func (c *WALChannel) Retract(count int) error {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return ChannelClosed
+	}
+
+	if count > c.messageCount {
+		count = c.messageCount
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(count))
+	err := c.write(recordRetract, payload)
+
+	c.messageStore = c.messageStore[:c.messageCount-count]
+	c.messageCount -= count
+
+	if err != nil {
+		return err
+	}
+	return c.compact()
+}
+
+// Flushes and closes the log. The channel can be reopened with NewWALChannel
+func (c *WALChannel) Close() error {
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	close(c.stop)
+
+	if err := c.file.Sync(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
+
+// Closes the channel and removes its log
+func (c *WALChannel) Dispose() error {
+
+	if err := c.Close(); err != nil {
+		return err
+	}
+	return os.Remove(c.path)
+}
+
+// only to be called when locked
+func (c *WALChannel) write(recordType byte, payload []byte) error {
+
+	record := make([]byte, recordHeaderSize+1+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(1+len(payload)))
+	record[recordHeaderSize] = recordType
+	copy(record[recordHeaderSize+1:], payload)
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[recordHeaderSize:]))
+
+	if _, err := c.file.Write(record); err != nil {
+		return err
+	}
+
+	if c.options.Sync == SyncAlways {
+		return c.file.Sync()
+	}
+
+	c.dirty = true
+	return nil
+}
+
+// only to be called when locked
+func (c *WALChannel) compact() error {
+
+	if c.messageCount == 0 {
+		if err := c.file.Truncate(0); err != nil {
+			return err
+		}
+		_, err := c.file.Seek(0, io.SeekStart)
+		c.popped = 0
+		return err
+	}
+
+	if c.options.CompactThreshold <= 0 || c.popped < c.options.CompactThreshold {
+		return nil
+	}
+
+	return c.rewrite()
+}
+
+// writes the pending messages to a new log and swaps it in place of the current one.
+// only to be called when locked
+func (c *WALChannel) rewrite() error {
+
+	temporaryPath := c.path + ".tmp"
+	file, err := os.OpenFile(temporaryPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	previous := c.file
+	c.file = file
+
+	for _, message := range c.messageStore {
+
+		payload, err := message.MarshalBinary()
+
+		if err == nil {
+			err = c.write(recordPush, payload)
+		}
+
+		if err != nil {
+			c.file = previous
+			file.Close()
+			os.Remove(temporaryPath)
+			return err
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		c.file = previous
+		file.Close()
+		os.Remove(temporaryPath)
+		return err
+	}
+
+	if err := os.Rename(temporaryPath, c.path); err != nil {
+		c.file = previous
+		file.Close()
+		return err
+	}
+
+	previous.Close()
+	c.popped = 0
+	return nil
+}
+
+// rebuilds the in memory store from the log. A torn or corrupt tail,
+// e.g. from a crash mid write, is truncated away.
+func (c *WALChannel) replay() error {
+
+	info, err := c.file.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(c.file)
+	header := make([]byte, recordHeaderSize)
+	var offset int64
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF {
+				log.Print("WALChannel : truncating torn record : ", c.path, " at ", offset)
+			}
+			break
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+
+		// a corrupt length could be far larger than what is left of the file
+		if int64(length) > info.Size()-offset-int64(recordHeaderSize) {
+			log.Print("WALChannel : truncating corrupt record : ", c.path, " at ", offset)
+			break
+		}
+		body := make([]byte, length)
+
+		if _, err := io.ReadFull(reader, body); err != nil || length == 0 || crc32.ChecksumIEEE(body) != checksum {
+			log.Print("WALChannel : truncating corrupt record : ", c.path, " at ", offset)
+			break
+		}
+
+		switch body[0] {
+		case recordPush:
+			message := &Message{}
+			if err := message.UnmarshalBinary(body[1:]); err != nil {
+				return err
+			}
+			c.messageStore = append(c.messageStore, message)
+			c.messageCount++
+		case recordPop:
+			if c.messageCount > 0 {
+				c.messageStore = c.messageStore[1:]
+				c.messageCount--
+				c.popped++
+			}
+		case recordRetract:
+			if len(body) != 5 {
+				return fmt.Errorf("Invalid retract record in %s", c.path)
+			}
+			count := int(binary.BigEndian.Uint32(body[1:]))
+			if count > c.messageCount {
+				count = c.messageCount
+			}
+			c.messageStore = c.messageStore[:c.messageCount-count]
+			c.messageCount -= count
+		default:
+			return fmt.Errorf("Unknown record type %d in %s", body[0], c.path)
+		}
+
+		offset += int64(recordHeaderSize) + int64(length)
+	}
+
+	if err := c.file.Truncate(offset); err != nil {
+		return err
+	}
+
+	if _, err := c.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	return c.compact()
+}
+
+func (c *WALChannel) syncLoop() {
+
+	ticker := time.NewTicker(c.options.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Lock()
+			if c.dirty && !c.closed {
+				if err := c.file.Sync(); err != nil {
+					log.Print("WALChannel : sync failed : ", c.path, " : ", err.Error())
+				}
+				c.dirty = false
+			}
+			c.Unlock()
+		case <-c.stop:
+			return
+		}
+	}
+}
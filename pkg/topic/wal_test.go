@@ -0,0 +1,240 @@
+package topic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWALChannelReplaysPendingMessages(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "channel.wal")
+	channel := openWALChannel(t, path, DefaultWALOptions)
+
+	channel.Push(NewMessage([]byte("message-1")))
+	channel.Push(NewMessage([]byte("message-2")))
+	channel.Push(NewMessage([]byte("message-3")))
+	assertMessageRetreivedWithExpectedContent(t, channel, "message-1")
+
+	channel.(*WALChannel).Close()
+
+	reopened := openWALChannel(t, path, DefaultWALOptions)
+	defer reopened.(*WALChannel).Close()
+
+	assertChannelLength(t, reopened, 2)
+	assertMessageRetreivedWithExpectedContent(t, reopened, "message-2")
+	assertMessageRetreivedWithExpectedContent(t, reopened, "message-3")
+	assertChannelLength(t, reopened, 0)
+}
+
+func TestWALChannelIsTruncatedOnceEmpty(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "channel.wal")
+	channel := openWALChannel(t, path, WALOptions{Sync: SyncNever})
+	defer channel.(*WALChannel).Close()
+
+	channel.Push(NewMessage([]byte("message-1")))
+	channel.Pop()
+
+	assertFileSize(t, path, 0)
+}
+
+func TestWALChannelCompactsPoppedEntries(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "channel.wal")
+	channel := openWALChannel(t, path, WALOptions{Sync: SyncNever, CompactThreshold: 2})
+
+	channel.Push(NewMessage([]byte("message-1")))
+	channel.Push(NewMessage([]byte("message-2")))
+	channel.Push(NewMessage([]byte("message-3")))
+
+	channel.Pop()
+	channel.Pop()
+	channel.(*WALChannel).Close()
+
+	// a single push record for message-3
+	expected, _ := NewMessage([]byte("message-3")).MarshalBinary()
+	assertFileSize(t, path, int64(recordHeaderSize+1+len(expected)))
+
+	reopened := openWALChannel(t, path, DefaultWALOptions)
+	defer reopened.(*WALChannel).Close()
+
+	assertChannelLength(t, reopened, 1)
+	assertMessageRetreivedWithExpectedContent(t, reopened, "message-3")
+}
+
+func TestWALChannelDiscardsTornRecord(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "channel.wal")
+	channel := openWALChannel(t, path, DefaultWALOptions)
+
+	channel.Push(NewMessage([]byte("message-1")))
+	channel.Push(NewMessage([]byte("message-2")))
+	channel.(*WALChannel).Close()
+
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-3)
+
+	reopened := openWALChannel(t, path, DefaultWALOptions)
+	defer reopened.(*WALChannel).Close()
+
+	assertChannelLength(t, reopened, 1)
+	assertMessageRetreivedWithExpectedContent(t, reopened, "message-1")
+}
+
+func TestWALChannelDiscardsRecordLongerThanTheFile(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	path := filepath.Join(directory, "channel.wal")
+	channel := openWALChannel(t, path, DefaultWALOptions)
+
+	channel.Push(NewMessage([]byte("message-1")))
+	channel.(*WALChannel).Close()
+
+	// a header claiming a body of almost 4 GiB
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write([]byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, recordPush})
+	file.Close()
+
+	reopened := openWALChannel(t, path, DefaultWALOptions)
+	defer reopened.(*WALChannel).Close()
+
+	assertChannelLength(t, reopened, 1)
+	assertMessageRetreivedWithExpectedContent(t, reopened, "message-1")
+}
+
+func TestWALChannelFactoryEscapesNames(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	topic := NewTopicWithChannelFactory("..", WALChannelFactory(directory, DefaultWALOptions))
+
+	if err := topic.AddChannel("../user"); err != nil {
+		t.Fatal("Adding a WAL backed channel should not fail : ", err.Error())
+	}
+
+	path := WALPath(directory, "..", "../user")
+
+	if filepath.Dir(filepath.Dir(path)) != directory {
+		t.Error("WAL should be created inside the directory but was created at ", path)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Error("WAL should exist at ", path)
+	}
+
+	topic.RemoveChannel("../user")
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("WAL should be removed when the channel is removed.")
+	}
+}
+
+func TestWALChannelsAreRestoredWithoutASnapshot(t *testing.T) {
+
+	directory := tempDirectory(t)
+	defer os.RemoveAll(directory)
+
+	registry := NewTopicRegistryWithChannelFactory(WALChannelFactory(directory, DefaultWALOptions))
+	registry.Get("orders.eu").AddChannel("subscriber-1")
+	registry.Get("orders.eu").JoinGroup("workers", "worker-1", RoundRobin)
+
+	for _, body := range []string{"message-1", "message-2"} {
+		registry.Get("orders.eu").PublishMessage(NewMessage([]byte(body)))
+	}
+	registry.Get("orders.eu").GetNextMessage("subscriber-1")
+	registry.Close()
+
+	// a restart with nothing but the logs
+	reopened := NewTopicRegistryWithChannelFactory(WALChannelFactory(directory, DefaultWALOptions))
+	defer reopened.Close()
+
+	restored, err := RestoreWALChannels(reopened, directory)
+
+	if err != nil || restored != 2 {
+		t.Fatal("Every log should be restored : ", restored, err)
+	}
+
+	if pending, _ := reopened.Get("orders.eu").Pending("subscriber-1"); len(pending) != 1 || pending[0].String() != "message-2" {
+		t.Error("A subscriber should be restored with its pending messages : ", pending)
+	}
+
+	member := GroupChannelName("workers", "worker-1")
+
+	if pending, _ := reopened.Get("orders.eu").Pending(member); len(pending) != 2 {
+		t.Error("A group member should be restored with its pending messages : ", pending)
+	}
+
+	if groups := reopened.Get("orders.eu").groupSnapshots(); len(groups) != 1 || groups[0].Name != "workers" {
+		t.Error("A group member should rejoin its group : ", groups)
+	}
+
+	if published, _ := reopened.Get("orders.eu").Publish(NewMessage([]byte("message-3"))); published.Sequence() != 3 {
+		t.Error("Sequence numbers should carry on from the restored messages : ", published.Sequence())
+	}
+}
+
+func TestSyncPoliciesAreParsed(t *testing.T) {
+
+	for _, policy := range []SyncPolicy{SyncAlways, SyncInterval, SyncNever} {
+
+		parsed, err := ParseSyncPolicy(policy.String())
+
+		if err != nil || parsed != policy {
+			t.Error("Sync policy did not round trip : ", policy)
+		}
+	}
+
+	if _, err := ParseSyncPolicy("sometimes"); err == nil {
+		t.Error("An unknown sync policy should error.")
+	}
+}
+
+func openWALChannel(t *testing.T, path string, options WALOptions) Channel {
+
+	channel, err := NewWALChannel(path, options)
+
+	if err != nil {
+		t.Fatal("Opening a WAL channel should not fail : ", err.Error())
+	}
+	return channel
+}
+
+func tempDirectory(t *testing.T) string {
+
+	directory, err := ioutil.TempDir("", "topic")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	return directory
+}
+
+func assertFileSize(t *testing.T, path string, expected int64) {
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != expected {
+		t.Error("Incorrect file size. Expected : ", expected, "Actual : ", info.Size())
+	}
+}
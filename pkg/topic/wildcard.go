@@ -0,0 +1,166 @@
+package topic
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	InvalidTopicName  = errors.New("Invalid topic name, + and # must be a whole level and # the last")
+	PublishToWildcard = errors.New("Messages can not be published to a wildcard topic")
+)
+
+// Levels of a topic name are separated by either of
+const topicLevelSeparators = "./"
+
+const (
+	// matches any one level of a topic name
+	SingleLevelWildcard = "+"
+	// matches any number of levels, including none, at the end of a topic name
+	MultiLevelWildcard = "#"
+)
+
+// Whether a topic name has a wildcard level. Subscribers to a wildcard topic, e.g. orders.+.created
+// or orders/#, receive the messages published to every topic matching it, including those
+// created after them. Dead letter topics are never matched
+func IsWildcard(topicName string) bool {
+
+	for _, level := range topicLevels(topicName) {
+		if level == SingleLevelWildcard || level == MultiLevelWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns InvalidTopicName if a wildcard is part of a level or # is not the last level
+func ValidateTopicName(topicName string) error {
+
+	levels := topicLevels(topicName)
+
+	for index, level := range levels {
+
+		if level == MultiLevelWildcard && index != len(levels)-1 {
+			return InvalidTopicName
+		}
+
+		if level != SingleLevelWildcard && level != MultiLevelWildcard && strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard) {
+			return InvalidTopicName
+		}
+	}
+	return nil
+}
+
+func topicLevels(topicName string) []string {
+
+	levels := make([]string, 0, strings.Count(topicName, ".")+strings.Count(topicName, "/")+1)
+	start := 0
+
+	for index := 0; index < len(topicName); index++ {
+		if strings.IndexByte(topicLevelSeparators, topicName[index]) >= 0 {
+			levels = append(levels, topicName[start:index])
+			start = index + 1
+		}
+	}
+	return append(levels, topicName[start:])
+}
+
+// Wildcard topics held in a trie by level so those matching a topic name are found by
+// walking its levels rather than comparing every pattern.
+// Safe for use via goroutines
+type wildcardIndex struct {
+	sync.RWMutex
+	root *wildcardNode
+}
+
+type wildcardNode struct {
+	children map[string]*wildcardNode
+	// wildcard topics whose last level is this node, keyed by name as . and / are interchangeable
+	topics map[string]*Topic
+}
+
+func newWildcardIndex() *wildcardIndex {
+	return &wildcardIndex{root: newWildcardNode()}
+}
+
+func newWildcardNode() *wildcardNode {
+	return &wildcardNode{
+		children: make(map[string]*wildcardNode),
+		topics:   make(map[string]*Topic),
+	}
+}
+
+func (i *wildcardIndex) add(topic *Topic) {
+
+	i.Lock()
+	defer i.Unlock()
+
+	node := i.root
+
+	for _, level := range topicLevels(topic.name) {
+
+		child, exists := node.children[level]
+
+		if !exists {
+			child = newWildcardNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.topics[topic.name] = topic
+}
+
+func (i *wildcardIndex) remove(topicName string) {
+
+	i.Lock()
+	defer i.Unlock()
+
+	i.root.remove(topicName, topicLevels(topicName))
+}
+
+// removes the topic below the node, returning whether the node is left empty
+func (n *wildcardNode) remove(topicName string, levels []string) bool {
+
+	if len(levels) == 0 {
+		delete(n.topics, topicName)
+	} else if child, exists := n.children[levels[0]]; exists && child.remove(topicName, levels[1:]) {
+		delete(n.children, levels[0])
+	}
+	return len(n.children) == 0 && len(n.topics) == 0
+}
+
+// the wildcard topics matching a topic name
+func (i *wildcardIndex) match(topicName string) []*Topic {
+
+	i.RLock()
+	defer i.RUnlock()
+
+	var matched []*Topic
+	i.root.match(topicLevels(topicName), &matched)
+	return matched
+}
+
+func (n *wildcardNode) match(levels []string, matched *[]*Topic) {
+
+	if rest, exists := n.children[MultiLevelWildcard]; exists {
+		for _, topic := range rest.topics {
+			*matched = append(*matched, topic)
+		}
+	}
+
+	if len(levels) == 0 {
+		for _, topic := range n.topics {
+			*matched = append(*matched, topic)
+		}
+		return
+	}
+
+	if child, exists := n.children[levels[0]]; exists {
+		child.match(levels[1:], matched)
+	}
+
+	if any, exists := n.children[SingleLevelWildcard]; exists {
+		any.match(levels[1:], matched)
+	}
+}
@@ -0,0 +1,148 @@
+package topic
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWildcardTopicsReceiveMessagesPublishedToMatchingTopics(t *testing.T) {
+
+	registry := NewTopicRegistry()
+	registry.Get("orders.+.created").AddChannel("subscriber-1")
+	registry.Get("orders/#").AddChannel("subscriber-2")
+
+	// topics created after the wildcard subscriptions
+	for _, topicName := range []string{"orders.eu.created", "orders/us/created", "orders.eu.cancelled", "orders", "payments.eu.created"} {
+		registry.Get(topicName).PublishMessage(NewMessage([]byte(topicName)))
+	}
+
+	assertWildcardMessages(t, registry.Get("orders.+.created"), "subscriber-1", "orders.eu.created", "orders/us/created")
+	assertWildcardMessages(t, registry.Get("orders/#"), "subscriber-2", "orders.eu.created", "orders/us/created", "orders.eu.cancelled", "orders")
+
+	if _, err := registry.Get("orders.+.created").Publish(NewMessage([]byte("message-1"))); err != PublishToWildcard {
+		t.Error("Publishing to a wildcard topic should return PublishToWildcard.")
+	}
+}
+
+func TestPublishIsRejectedWhenAWildcardSubscriberIsFull(t *testing.T) {
+
+	registry := NewTopicRegistryWithChannelFactory(RingBufferChannelFactory(RingBufferOptions{Capacity: 1, Overflow: RejectPublish}, nil))
+	registry.Get("orders.#").AddChannel("subscriber-1")
+	registry.Get("orders.created").AddChannel("subscriber-2")
+
+	if _, err := registry.Get("orders.eu").Publish(NewMessage([]byte("orders.eu"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := registry.Get("orders.created").Publish(NewMessage([]byte("orders.created"))); err != ChannelFull {
+		t.Error("A publish a wildcard subscriber does not have space for should return ChannelFull : ", err)
+	}
+
+	if _, _, err := registry.Get("orders.created").PublishBatch([]*Message{NewMessage([]byte("orders.created"))}); err != ChannelFull {
+		t.Error("A batch a wildcard subscriber does not have space for should return ChannelFull : ", err)
+	}
+
+	assertWildcardMessages(t, registry.Get("orders.created"), "subscriber-2")
+	assertWildcardMessages(t, registry.Get("orders.#"), "subscriber-1", "orders.eu")
+}
+
+func TestTryPublishWaitsForABlockingWildcardSubscriber(t *testing.T) {
+
+	registry := NewTopicRegistryWithChannelFactory(RingBufferChannelFactory(RingBufferOptions{Capacity: 1, Overflow: BlockWithTimeout, BlockTimeout: time.Minute}, nil))
+	registry.Get("orders.#").AddChannel("subscriber-1")
+	registry.Get("orders.created").AddChannel("subscriber-2")
+
+	since := time.Now()
+
+	if _, err := registry.Get("orders.created").TryPublish(NewMessage([]byte("orders.created")), since); err != nil {
+		t.Fatal(err)
+	}
+
+	registry.Get("orders.created").GetNextMessage("subscriber-2")
+
+	if _, err := registry.Get("orders.created").TryPublish(NewMessage([]byte("orders.created")), since); err != WouldBlock {
+		t.Error("A publish a blocking wildcard subscriber does not have space for should return WouldBlock : ", err)
+	}
+
+	if _, _, err := registry.Get("orders.created").TryPublishBatch([]*Message{NewMessage([]byte("orders.created"))}, since.Add(-time.Minute)); err != PublishTimeout {
+		t.Error("A batch which has waited longer than the block timeout should return PublishTimeout : ", err)
+	}
+
+	assertWildcardMessages(t, registry.Get("orders.created"), "subscriber-2")
+	assertWildcardMessages(t, registry.Get("orders.#"), "subscriber-1", "orders.created")
+
+	registry.Get("orders.#").GetNextMessage("subscriber-1")
+
+	if _, err := registry.Get("orders.created").TryPublish(NewMessage([]byte("orders.created")), since); err != nil {
+		t.Error("A publish should succeed once the wildcard subscriber has made space : ", err)
+	}
+
+	assertWildcardMessages(t, registry.Get("orders.created"), "subscriber-2", "orders.created")
+	assertWildcardMessages(t, registry.Get("orders.#"), "subscriber-1", "orders.created")
+}
+
+func TestDeletedAndDeadLetterTopicsAreNotMatched(t *testing.T) {
+
+	registry := NewTopicRegistryWithChannelFactory(InMemoryChannelFactory)
+	registry.Get("#").AddChannel("subscriber-1")
+	deleted := registry.Get("orders.+")
+	deleted.AddChannel("subscriber-1")
+
+	registry.Get(DeadLetterTopicName("orders")).PublishMessage(NewMessage([]byte("orders.dlq")))
+	registry.Delete("orders.+")
+	registry.Get("orders.eu").PublishMessage(NewMessage([]byte("orders.eu")))
+
+	assertWildcardMessages(t, registry.Get("#"), "subscriber-1", "orders.eu")
+	assertWildcardMessages(t, deleted, "subscriber-1")
+}
+
+func TestTopicNamesAreValidated(t *testing.T) {
+
+	for topicName, valid := range map[string]bool{
+		"orders.eu.created": true,
+		"orders/+/created":  true,
+		"orders.#":          true,
+		"#":                 true,
+		"orders.#.created":  false,
+		"orders.eu+":        false,
+		"orders.#eu":        false,
+	} {
+		if err := ValidateTopicName(topicName); (err == nil) != valid {
+			t.Error("Topic name ", topicName, " should be valid ", valid)
+		}
+	}
+}
+
+func BenchmarkPublishWithThousandsOfWildcardTopics(b *testing.B) {
+
+	registry := NewTopicRegistry()
+
+	for i := 0; i < 5000; i++ {
+		registry.Get(fmt.Sprintf("orders.region-%d.+", i)).AddChannel("subscriber-1")
+	}
+
+	topic := registry.Get("orders.region-1.created")
+	message := NewMessage([]byte("message"))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		topic.PublishMessage(message)
+	}
+}
+
+func assertWildcardMessages(t *testing.T, topic *Topic, channelName string, expected ...string) {
+
+	pending, _ := topic.Pending(channelName)
+
+	if len(pending) != len(expected) {
+		t.Error("Expected ", len(expected), " messages for ", topic.Name(), " but got ", len(pending))
+		return
+	}
+
+	for index, message := range pending {
+		if message.Topic() != expected[index] || message.String() != expected[index] {
+			t.Error("Expected the message published to ", expected[index], " but got ", message.Topic())
+		}
+	}
+}